@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// With -access-log, every request is also written to a file, one line each
+// in Apache's log formats, for tools that read web server logs. Unlike the
+// structured log it is never sampled. SIGHUP reopens the file, so it can be
+// rotated by renaming it away, as logrotate does.
+
+// Named -access-log-format values, as Apache defines them
+var accessLogFormats = map[string]string{
+	"common":   `%h %l %u %t "%r" %>s %b`,
+	"combined": `%h %l %u %t "%r" %>s %b "%{Referer}i" "%{User-Agent}i"`,
+}
+
+// accessLog is the open access log; nil when none is written.
+var accessLog *accessLogFile
+
+type accessLogFile struct {
+	path   string
+	fields []accessLogField
+
+	mu sync.Mutex
+	f  *os.File
+}
+
+// accessLogEntry is what is known about a request once it has been served.
+type accessLogEntry struct {
+	r       *http.Request
+	header  http.Header // of the response
+	status  int
+	bytes   int64
+	start   time.Time
+	elapsed time.Duration
+}
+
+// An accessLogField appends one part of a line.
+type accessLogField func(b []byte, e *accessLogEntry) []byte
+
+// openAccessLog opens path for appending lines in format, a name from
+// accessLogFormats or an Apache LogFormat string.
+func openAccessLog(path, format string) (*accessLogFile, error) {
+	if named, ok := accessLogFormats[format]; ok {
+		format = named
+	}
+	fields, err := parseAccessLogFormat(format)
+	if err != nil {
+		return nil, err
+	}
+	a := &accessLogFile{path: path, fields: fields}
+	if err := a.reopen(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// reopen opens the log's path afresh and switches to it.
+func (a *accessLogFile) reopen() error {
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	old := a.f
+	a.f = f
+	a.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// reopenOnSIGHUP reopens the log whenever the process gets SIGHUP. It
+// never returns.
+func (a *accessLogFile) reopenOnSIGHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := a.reopen(); err != nil {
+			slog.Error("Reopening access log failed", "path", a.path, "err", err)
+			continue
+		}
+		slog.Info("Reopened access log", "path", a.path)
+	}
+}
+
+func (a *accessLogFile) write(e *accessLogEntry) {
+	line := make([]byte, 0, 256)
+	for _, field := range a.fields {
+		line = field(line, e)
+	}
+	line = append(line, '\n')
+	a.mu.Lock()
+	_, err := a.f.Write(line)
+	a.mu.Unlock()
+	if err != nil {
+		slog.Error("Writing access log failed", "err", err)
+	}
+}
+
+// parseAccessLogFormat compiles an Apache LogFormat string. The supported
+// directives are %h, %l, %u, %t, %r, %m, %U, %q, %H, %s (or %>s), %b, %B,
+// %D, %T, %{Header}i, %{Header}o and %%.
+func parseAccessLogFormat(format string) ([]accessLogField, error) {
+	var fields []accessLogField
+	literal := func(s string) {
+		if s != "" {
+			fields = append(fields, func(b []byte, _ *accessLogEntry) []byte { return append(b, s...) })
+		}
+	}
+	for {
+		i := strings.IndexByte(format, '%')
+		if i < 0 {
+			literal(format)
+			return fields, nil
+		}
+		literal(format[:i])
+		format = format[i+1:]
+
+		var arg string
+		if strings.HasPrefix(format, "{") {
+			end := strings.IndexByte(format, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("invalid access log format: unterminated %%{")
+			}
+			arg, format = format[1:end], format[end+1:]
+		}
+		// Apache's "final status" modifier; there is only one status here
+		format = strings.TrimPrefix(format, ">")
+		if format == "" {
+			return nil, fmt.Errorf("invalid access log format: trailing %%")
+		}
+		directive := format[0]
+		format = format[1:]
+		field, err := accessLogDirective(directive, arg)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+}
+
+func accessLogDirective(directive byte, arg string) (accessLogField, error) {
+	if arg != "" && directive != 'i' && directive != 'o' {
+		return nil, fmt.Errorf("invalid access log format: %%{%s}%c takes no argument", arg, directive)
+	}
+	switch directive {
+	case '%':
+		return func(b []byte, _ *accessLogEntry) []byte { return append(b, '%') }, nil
+	case 'h':
+		return func(b []byte, e *accessLogEntry) []byte {
+			host, _, err := net.SplitHostPort(e.r.RemoteAddr)
+			if err != nil {
+				host = e.r.RemoteAddr
+			}
+			return appendLogValue(b, host)
+		}, nil
+	case 'l', 'u':
+		return func(b []byte, _ *accessLogEntry) []byte { return append(b, '-') }, nil
+	case 't':
+		return func(b []byte, e *accessLogEntry) []byte {
+			return e.start.AppendFormat(append(b, '['), "02/Jan/2006:15:04:05 -0700]")
+		}, nil
+	case 'r':
+		return func(b []byte, e *accessLogEntry) []byte {
+			return appendLogValue(b, e.r.Method+" "+e.r.RequestURI+" "+e.r.Proto)
+		}, nil
+	case 'm':
+		return func(b []byte, e *accessLogEntry) []byte { return appendLogValue(b, e.r.Method) }, nil
+	case 'U':
+		return func(b []byte, e *accessLogEntry) []byte {
+			path, _, _ := strings.Cut(e.r.RequestURI, "?")
+			return appendLogValue(b, path)
+		}, nil
+	case 'q':
+		return func(b []byte, e *accessLogEntry) []byte {
+			if _, query, ok := strings.Cut(e.r.RequestURI, "?"); ok {
+				return appendLogValue(append(b, '?'), query)
+			}
+			return b
+		}, nil
+	case 'H':
+		return func(b []byte, e *accessLogEntry) []byte { return appendLogValue(b, e.r.Proto) }, nil
+	case 's':
+		return func(b []byte, e *accessLogEntry) []byte { return strconv.AppendInt(b, int64(e.status), 10) }, nil
+	case 'b':
+		return func(b []byte, e *accessLogEntry) []byte {
+			if e.bytes == 0 {
+				return append(b, '-')
+			}
+			return strconv.AppendInt(b, e.bytes, 10)
+		}, nil
+	case 'B':
+		return func(b []byte, e *accessLogEntry) []byte { return strconv.AppendInt(b, e.bytes, 10) }, nil
+	case 'D':
+		return func(b []byte, e *accessLogEntry) []byte { return strconv.AppendInt(b, e.elapsed.Microseconds(), 10) }, nil
+	case 'T':
+		return func(b []byte, e *accessLogEntry) []byte {
+			return strconv.AppendInt(b, int64(e.elapsed/time.Second), 10)
+		}, nil
+	case 'i', 'o':
+		if arg == "" {
+			return nil, fmt.Errorf("invalid access log format: %%%c needs a header name, as in %%{User-Agent}%c", directive, directive)
+		}
+		return func(b []byte, e *accessLogEntry) []byte {
+			h := e.r.Header
+			if directive == 'o' {
+				h = e.header
+			}
+			v := h.Get(arg)
+			if v == "" {
+				return append(b, '-')
+			}
+			return appendLogValue(b, v)
+		}, nil
+	}
+	return nil, fmt.Errorf("invalid access log format: unsupported directive %%%c", directive)
+}
+
+// appendLogValue appends s as Apache does, escaping quotes, backslashes and
+// non-printable bytes so a client can't forge lines or break quoted fields.
+func appendLogValue(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c >= 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return b
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// newAdminMux serves the endpoints meant for operators and orchestrators
+// rather than S3 clients: metrics and the liveness and readiness probes.
+// None of them require authentication, unless -admin-token is set for the
+// -admin-addr listener.
+func newAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", healthzHandler)
+	mux.HandleFunc("/readyz", readyzHandler)
+	return mux
+}
+
+// healthzHandler is the liveness probe: answering at all means the process
+// is up.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, "ok")
+}
+
+// readyzHandler is the readiness probe: 200 while a file can be created in
+// the storage root, 503 otherwise (e.g. a missing or read-only volume, or
+// one with fewer than -min-free-inodes inodes left).
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if outOfInodes() {
+		slog.Warn("Readiness check failed: storage root is out of inodes", "root", storageRootDir, "min_free_inodes", minFreeInodes)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "storage root is out of inodes")
+		return
+	}
+	f, err := createTempFile(storageRootDir)
+	if err == nil {
+		f.Close()
+		err = os.Remove(f.Name())
+	}
+	if err != nil {
+		slog.Warn("Readiness check failed: storage root is not writable", "root", storageRootDir, "err", err)
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, "storage root is not writable")
+		return
+	}
+	fmt.Fprint(w, "ok")
+}
+
+// plainGetOr serves a plain GET (no query string) with h, and hands
+// everything else to api. On the main listener this keeps the admin paths
+// from shadowing buckets of the same name, whose operations carry a
+// method or query.
+func plainGetOr(h, api http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.URL.RawQuery == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,19 @@
+//go:build linux || openbsd
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+const atimeSupported = true
+
+// accessTime returns the file's last access time.
+func accessTime(fi os.FileInfo) time.Time {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return time.Unix(st.Atim.Unix())
+	}
+	return fi.ModTime()
+}
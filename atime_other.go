@@ -0,0 +1,15 @@
+//go:build !(linux || openbsd || darwin || freebsd || netbsd)
+
+package main
+
+import (
+	"os"
+	"time"
+)
+
+const atimeSupported = false
+
+// accessTime falls back to the modification time where atime isn't exposed.
+func accessTime(fi os.FileInfo) time.Time {
+	return fi.ModTime()
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /<bucket>/<key>?attributes (GetObjectAttributes) describes an object
+// without sending it: the attributes named in x-amz-object-attributes out
+// of ETag, Checksum, ObjectParts, StorageClass and ObjectSize. SDKs use it
+// to verify uploads. Values come from the object's metadata, as HEAD's do.
+
+// Attributes GetObjectAttributes may ask for
+var objectAttributeNames = []string{"ETag", "Checksum", "ObjectParts", "StorageClass", "ObjectSize"}
+
+type objectAttributesResult struct {
+	XMLName      xml.Name            `xml:"http://s3.amazonaws.com/doc/2006-03-01/ GetObjectAttributesResponse"`
+	ETag         string              `xml:"ETag,omitempty"`
+	Checksum     *objectChecksum     `xml:"Checksum,omitempty"`
+	ObjectParts  *objectPartsSummary `xml:"ObjectParts,omitempty"`
+	StorageClass string              `xml:"StorageClass,omitempty"`
+	ObjectSize   *int64              `xml:"ObjectSize,omitempty"`
+}
+
+type objectChecksum struct {
+	ChecksumCRC32     string `xml:"ChecksumCRC32,omitempty"`
+	ChecksumCRC32C    string `xml:"ChecksumCRC32C,omitempty"`
+	ChecksumCRC64NVME string `xml:"ChecksumCRC64NVME,omitempty"`
+	ChecksumSHA1      string `xml:"ChecksumSHA1,omitempty"`
+	ChecksumSHA256    string `xml:"ChecksumSHA256,omitempty"`
+	ChecksumType      string `xml:"ChecksumType"`
+}
+
+// objectPartsSummary reports how many parts a multipart upload assembled
+// the object from. The parts themselves aren't kept.
+type objectPartsSummary struct {
+	TotalPartsCount int `xml:"PartsCount"`
+}
+
+// objectAttributesHandler handles GET /<bucket>/<key>?attributes, optionally
+// for a ?versionId.
+func objectAttributesHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	attrs, apiErr := requestObjectAttributes(r.Header)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	if !refererAllowed(bucket, r) {
+		slog.Info("Blocked hotlinked request", "method", r.Method, "bucket", bucket, "key", key, "referer", r.Referer())
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "Hotlinking is not allowed for this bucket", r.URL.Path)
+		return
+	}
+
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	ref, apiErr := readVersion(bucket, targetPath, r.URL.Query().Get("versionId"))
+	setVersionHeaders(w, ref.versionID, ref.deleteMarker)
+	setReadVersionAllow(w, apiErr)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	// A transaction commit in progress is seen entirely or not at all
+	txnPublishLock.RLock()
+	fi, exists, err := statObject(ref.path)
+	txnPublishLock.RUnlock()
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Stating file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+	if !exists {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", r.URL.Path)
+		return
+	}
+	meta, err := loadMeta(ref.path, fi)
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Computing ETag failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+	if r.URL.Query().Get("versionId") == "" && isExpired(meta, time.Now()) {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", r.URL.Path)
+		return
+	}
+
+	// Unlike the ETag header, the element is not quoted
+	etag := strings.Trim(meta.ETag, `"`)
+	var result objectAttributesResult
+	if attrs["ETag"] {
+		result.ETag = etag
+	}
+	if attrs["Checksum"] {
+		result.Checksum = storedChecksum(meta)
+	}
+	if attrs["ObjectParts"] {
+		if _, parts, ok := strings.Cut(etag, "-"); ok {
+			if n, err := strconv.Atoi(parts); err == nil {
+				result.ObjectParts = &objectPartsSummary{TotalPartsCount: n}
+			}
+		}
+	}
+	if attrs["StorageClass"] {
+		result.StorageClass = storageClass(meta)
+	}
+	if attrs["ObjectSize"] {
+		size := contentSize(fi, meta)
+		result.ObjectSize = &size
+	}
+
+	setLastModified(w, fi.ModTime())
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Writing object attributes failed", "err", err)
+	}
+	debugLog(r, "Read object attributes", "attributes", r.Header.Values("x-amz-object-attributes"))
+}
+
+// requestObjectAttributes returns the set of attributes the request's
+// x-amz-object-attributes header asks for: a comma-separated list, which
+// the SDKs may also send as repeated headers. At least one is required.
+func requestObjectAttributes(h http.Header) (map[string]bool, *apiError) {
+	attrs := map[string]bool{}
+	for _, v := range h.Values("x-amz-object-attributes") {
+		for _, name := range strings.Split(v, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if !isObjectAttributeName(name) {
+				return nil, &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid attribute name specified: " + name}
+			}
+			attrs[name] = true
+		}
+	}
+	if len(attrs) == 0 {
+		return nil, &apiError{http.StatusBadRequest, "InvalidArgument", "The x-amz-object-attributes header specifying the attributes to be retrieved is either missing or empty"}
+	}
+	return attrs, nil
+}
+
+func isObjectAttributeName(name string) bool {
+	for _, n := range objectAttributeNames {
+		if name == n {
+			return true
+		}
+	}
+	return false
+}
+
+// storedChecksum returns the additional checksum recorded for the object
+// described by m, or nil if it was stored without one.
+func storedChecksum(m *objectMeta) *objectChecksum {
+	alg := checksumAlgorithmNamed(m.ChecksumAlgorithm)
+	if alg == nil || m.Checksum == "" {
+		return nil
+	}
+	c := &objectChecksum{ChecksumType: "FULL_OBJECT"}
+	switch alg.name {
+	case "CRC32":
+		c.ChecksumCRC32 = m.Checksum
+	case "CRC32C":
+		c.ChecksumCRC32C = m.Checksum
+	case "CRC64NVME":
+		c.ChecksumCRC64NVME = m.Checksum
+	case "SHA1":
+		c.ChecksumSHA1 = m.Checksum
+	case "SHA256":
+		c.ChecksumSHA256 = m.Checksum
+	}
+	return c
+}
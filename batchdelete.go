@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Most keys a single DeleteObjects request may name, as in S3
+const maxDeleteKeys = 1000
+
+// Upper bound on the size of a DeleteObjects request document
+const maxDeleteBodyBytes = 4 << 20
+
+type deleteRequest struct {
+	XMLName xml.Name `xml:"Delete"`
+	Quiet   bool     `xml:"Quiet"`
+	Objects []struct {
+		Key       string `xml:"Key"`
+		VersionId string `xml:"VersionId"`
+	} `xml:"Object"`
+}
+
+type deletedObject struct {
+	Key                   string `xml:"Key"`
+	VersionId             string `xml:"VersionId,omitempty"`
+	DeleteMarker          bool   `xml:"DeleteMarker,omitempty"`
+	DeleteMarkerVersionId string `xml:"DeleteMarkerVersionId,omitempty"`
+}
+
+type deleteError struct {
+	Key     string `xml:"Key"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+type deleteResult struct {
+	XMLName xml.Name        `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []deletedObject `xml:"Deleted"`
+	Errors  []deleteError   `xml:"Error"`
+}
+
+// deleteObjectsHandler handles POST /<bucket>?delete (DeleteObjects)
+func deleteObjectsHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := splitRequestPath(r)[0]
+	if bucket == "" {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "Missing bucket name", r.URL.Path)
+		return
+	}
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	var req deleteRequest
+	body, err := spoolBody(http.MaxBytesReader(w, r.Body, maxDeleteBodyBytes))
+	if respondIfSpoolFailed(w, r, err) {
+		return
+	}
+	if err == nil {
+		err = xml.NewDecoder(body).Decode(&req)
+		body.Close()
+	}
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", "The Delete document is not well-formed", r.URL.Path)
+		return
+	}
+	if len(req.Objects) == 0 || len(req.Objects) > maxDeleteKeys {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", fmt.Sprintf("The Delete document must list between 1 and %d objects", maxDeleteKeys), r.URL.Path)
+		return
+	}
+
+	debugLog(r, "Batch delete request", "keys", len(req.Objects))
+
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", r.URL.Path)
+		} else {
+			slog.Error("Stating bucket failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+
+	versioned := bucketVersioning(bucket) != ""
+	result := deleteResult{}
+	for _, obj := range req.Objects {
+		if obj.Key == "" {
+			result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: "InvalidArgument", Message: "Missing object key"})
+			continue
+		}
+		key, apiErr := validateKey(obj.Key)
+		if apiErr != nil {
+			result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: apiErr.code, Message: apiErr.message})
+			continue
+		}
+		targetPath, err := sanitizePath(bucket, key)
+		if errors.Is(err, errSymlinkEscape) {
+			result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: "AccessDenied", Message: "Access Denied"})
+			continue
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: "InvalidArgument", Message: err.Error()})
+			continue
+		}
+		deleted := deletedObject{Key: obj.Key}
+		switch {
+		case versioned:
+			res, err := deleteVersioned(bucket, key, targetPath, obj.VersionId)
+			if err != nil {
+				slog.Error("Deleting version failed", "err", err)
+				result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: "InternalError", Message: "We encountered an internal error. Please try again."})
+				continue
+			}
+			deleted.DeleteMarker = res.deleteMarker
+			if obj.VersionId != "" {
+				deleted.VersionId = res.versionID
+			} else {
+				deleted.DeleteMarkerVersionId = res.versionID
+			}
+		case obj.VersionId != "" && obj.VersionId != nullVersionID:
+			result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: "NoSuchVersion", Message: "The specified version does not exist."})
+			continue
+		default:
+			// Under the object's lock, as a single DELETE, so a
+			// conditional write can't slip in between
+			err := func() error {
+				defer lockObject(targetPath)()
+				return backend.Delete(bucket, key)
+			}()
+			if err != nil {
+				slog.Error("Deleting file failed", "err", err)
+				result.Errors = append(result.Errors, deleteError{Key: obj.Key, Code: "InternalError", Message: "We encountered an internal error. Please try again."})
+				continue
+			}
+		}
+		if !req.Quiet {
+			result.Deleted = append(result.Deleted, deleted)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Writing delete result failed", "err", err)
+	}
+	debugLog(r, "Batch delete done", "errors", len(result.Errors))
+}
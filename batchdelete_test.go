@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDeleteObjectsTakesObjectLock(t *testing.T) {
+	root := useTempRoot(t)
+	for _, key := range []string{"locked", "free"} {
+		writeTestFile(t, filepath.Join(root, "b", key), "data")
+	}
+
+	// A write holding the lock of one key holds up its deletion, and so
+	// the rest of the batch, until it is done
+	unlock := lockObject(filepath.Join(root, "b", "locked"))
+	done := make(chan *http.Response, 1)
+	go func() {
+		body := `<Delete><Object><Key>locked</Key></Object><Object><Key>free</Key></Object></Delete>`
+		done <- serve(t, http.MethodPost, "/b?delete", strings.NewReader(body), nil).Result()
+	}()
+	select {
+	case <-done:
+		t.Fatal("DeleteObjects finished while a key's lock was held")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if _, err := os.Stat(filepath.Join(root, "b", "locked")); err != nil {
+		t.Errorf("locked object deleted under the lock: %v", err)
+	}
+	unlock()
+
+	resp := <-done
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("DeleteObjects: %d", resp.StatusCode)
+	}
+	for _, key := range []string{"locked", "free"} {
+		if _, err := os.Stat(filepath.Join(root, "b", key)); !os.IsNotExist(err) {
+			t.Errorf("%s not deleted: %v", key, err)
+		}
+	}
+	// The lock was released again
+	lockObject(filepath.Join(root, "b", "locked"))()
+}
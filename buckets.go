@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+type bucketEntry struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type listAllMyBucketsResult struct {
+	XMLName xml.Name      `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListAllMyBucketsResult"`
+	Owner   struct{}      `xml:"Owner"`
+	Buckets []bucketEntry `xml:"Buckets>Bucket"`
+}
+
+// Whether objects may only be stored in buckets created beforehand with
+// PUT /<bucket>, rather than creating their bucket on first write
+var requireBucket bool
+
+// checkBucketExists returns the error to refuse an object request with when
+// -require-bucket is set and bucket has not been created.
+func checkBucketExists(bucket string) *apiError {
+	if !requireBucket {
+		return nil
+	}
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		return nil // reported by the caller's own sanitizePath
+	}
+	if fi, err := os.Stat(bucketPath); (err == nil && !fi.IsDir()) || os.IsNotExist(err) {
+		return &apiError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+	}
+	return nil
+}
+
+// isBucketRequest reports whether a request addresses the service (/) or a
+// bucket (/<bucket> or /<bucket>/) rather than an object.
+func isBucketRequest(r *http.Request) bool {
+	parts := splitRequestPath(r)
+	return len(parts) < 2 || parts[1] == ""
+}
+
+// bucketHandler handles GET / (ListBuckets) and PUT, GET, HEAD and DELETE
+// of /<bucket>
+func bucketHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := splitRequestPath(r)[0]
+	if bucket == "" {
+		if r.Method != http.MethodGet {
+			writeMethodNotAllowed(w, r, plusDAVMethods(http.MethodGet)...)
+			return
+		}
+		listBucketsHandler(w, r)
+		return
+	}
+
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	q := r.URL.Query()
+	if _, ok := q["versioning"]; ok {
+		versioningHandler(w, r, bucket, bucketPath)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, ok := q["versions"]; ok {
+			listVersionsHandler(w, r, bucket, bucketPath)
+			return
+		}
+		listObjectsHandler(w, r, bucket)
+	case http.MethodHead:
+		// HEAD responses carry no body, so errors are reported by status alone
+		if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPut:
+		createBucketHandler(w, r, bucket, bucketPath)
+	case http.MethodDelete:
+		deleteBucketHandler(w, r, bucket, bucketPath)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)
+	}
+}
+
+// listBucketsHandler handles GET / (ListBuckets)
+func listBucketsHandler(w http.ResponseWriter, r *http.Request) {
+	entries, err := os.ReadDir(storageRootDir)
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Listing buckets failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+
+	result := listAllMyBucketsResult{Buckets: []bucketEntry{}}
+	for _, e := range entries {
+		// Dot-directories hold server state (.txn, .meta, ...), not buckets
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		// The filesystem keeps no portable creation time; use the directory's mtime
+		result.Buckets = append(result.Buckets, bucketEntry{
+			Name:         e.Name(),
+			CreationDate: info.ModTime().UTC().Format(s3TimeFormat),
+		})
+	}
+	sort.Slice(result.Buckets, func(i, j int) bool { return result.Buckets[i].Name < result.Buckets[j].Name })
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Writing bucket list failed", "err", err)
+	}
+	debugLog(r, "Listed buckets", "buckets", len(result.Buckets))
+}
+
+// createBucketHandler handles PUT /<bucket>. Creating an existing bucket
+// succeeds, as in S3's us-east-1.
+func createBucketHandler(w http.ResponseWriter, r *http.Request, bucket, bucketPath string) {
+	if err := makeDirs(bucketPath); err != nil {
+		if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EEXIST) {
+			writeS3Error(w, http.StatusConflict, "BucketAlreadyExists", "A file named "+bucket+" is in the way of the bucket directory", r.URL.Path)
+			return
+		}
+		slog.Error("Creating bucket failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	w.Header().Set("Location", "/"+bucket)
+	w.WriteHeader(http.StatusOK)
+}
+
+// deleteBucketHandler handles DELETE /<bucket>, which only succeeds for a
+// bucket without objects. Empty folder directories left behind by deleted
+// objects don't count.
+func deleteBucketHandler(w http.ResponseWriter, r *http.Request, bucket, bucketPath string) {
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", r.URL.Path)
+		} else {
+			slog.Error("Stating bucket failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+
+	// Old versions and delete markers count as objects, as in S3
+	hasVersions, err := bucketHasVersions(bucket)
+	if err != nil {
+		slog.Error("Checking bucket versions failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	if hasVersions {
+		writeS3Error(w, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty", r.URL.Path)
+		return
+	}
+
+	if err := removeEmptyTree(bucketPath); err != nil {
+		if errors.Is(err, syscall.ENOTEMPTY) || errors.Is(err, syscall.EEXIST) {
+			writeS3Error(w, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty", r.URL.Path)
+			return
+		}
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Deleting bucket failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+
+	// Whatever metadata remains belongs to objects that no longer exist
+	if p, err := metaPath(bucketPath); err == nil {
+		if err := os.RemoveAll(p); err != nil {
+			slog.Error("Deleting bucket metadata failed", "bucket", bucket, "err", err)
+		}
+	}
+	// A bucket created later under the same name starts unversioned
+	if err := removeBucketVersions(bucket); err != nil {
+		slog.Error("Deleting bucket versioning state failed", "bucket", bucket, "err", err)
+	}
+	forgetUsage(bucket)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeEmptyTree removes dir and the directories below it, failing with
+// ENOTEMPTY if it contains anything else. Directories are removed deepest
+// first with os.Remove, so an object written concurrently makes it fail
+// rather than be deleted.
+func removeEmptyTree(dir string) error {
+	var dirs []string
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return syscall.ENOTEMPTY
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err := os.Remove(dirs[i]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"net/http"
+	"strings"
+)
+
+// Newer AWS SDKs protect uploads with an additional checksum, sent either
+// as an x-amz-checksum-<algorithm> header or, with aws-chunked bodies, as
+// a trailer named in x-amz-trailer. The checksum is verified as the body
+// streams in and stored with the object, and GET and HEAD return it when
+// asked to with x-amz-checksum-mode: ENABLED.
+
+type checksumAlgorithm struct {
+	name   string // as in x-amz-checksum-algorithm, e.g. "CRC32"
+	header string // carrying the value, e.g. "x-amz-checksum-crc32"
+	new    func() hash.Hash
+}
+
+// Reflected form of the CRC-64/NVME polynomial, 0xad93d23594c93659
+var crc64NVMETable = crc64.MakeTable(0x9a6c9329ac4bc9b5)
+
+var checksumAlgorithms = []checksumAlgorithm{
+	{"CRC32", "x-amz-checksum-crc32", func() hash.Hash { return crc32.NewIEEE() }},
+	{"CRC32C", "x-amz-checksum-crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	{"CRC64NVME", "x-amz-checksum-crc64nvme", func() hash.Hash { return crc64.New(crc64NVMETable) }},
+	{"SHA1", "x-amz-checksum-sha1", sha1.New},
+	{"SHA256", "x-amz-checksum-sha256", sha256.New},
+}
+
+// checksumAlgorithmNamed returns the algorithm called name, ignoring case,
+// or nil if there is none.
+func checksumAlgorithmNamed(name string) *checksumAlgorithm {
+	for i := range checksumAlgorithms {
+		if strings.EqualFold(checksumAlgorithms[i].name, name) {
+			return &checksumAlgorithms[i]
+		}
+	}
+	return nil
+}
+
+// uploadChecksum computes the checksum an upload asked for and checks it
+// against the value the client sent.
+type uploadChecksum struct {
+	alg  *checksumAlgorithm
+	hash hash.Hash
+	want string // base64 value sent as a header; empty if none
+	// Whether the value follows the body as a trailer instead
+	trailer bool
+}
+
+// requestChecksum returns the checksum an upload's headers ask for, or nil
+// if they ask for none. A request may name one algorithm, with its value
+// in a header, announced in x-amz-trailer, or neither (x-amz-checksum-
+// algorithm alone), in which case the checksum is only computed and stored.
+func requestChecksum(r *http.Request) (*uploadChecksum, *apiError) {
+	var c *uploadChecksum
+	for i := range checksumAlgorithms {
+		alg := &checksumAlgorithms[i]
+		value := r.Header.Get(alg.header)
+		if value == "" {
+			continue
+		}
+		if c != nil {
+			return nil, &apiError{http.StatusBadRequest, "InvalidRequest", "Expecting a single x-amz-checksum- header. Multiple checksum Types are not allowed."}
+		}
+		if sum, err := base64.StdEncoding.DecodeString(value); err != nil || len(sum) != alg.new().Size() {
+			return nil, &apiError{http.StatusBadRequest, "InvalidRequest", "Value for " + alg.header + " header is invalid."}
+		}
+		c = &uploadChecksum{alg: alg, want: value}
+	}
+	if c == nil {
+		for _, name := range strings.Split(r.Header.Get("x-amz-trailer"), ",") {
+			name = strings.TrimSpace(name)
+			for i := range checksumAlgorithms {
+				if strings.EqualFold(name, checksumAlgorithms[i].header) {
+					c = &uploadChecksum{alg: &checksumAlgorithms[i], trailer: true}
+				}
+			}
+		}
+	}
+	for _, header := range []string{"x-amz-sdk-checksum-algorithm", "x-amz-checksum-algorithm"} {
+		name := r.Header.Get(header)
+		if name == "" {
+			continue
+		}
+		alg := checksumAlgorithmNamed(name)
+		if alg == nil || (c != nil && c.alg != alg) {
+			return nil, &apiError{http.StatusBadRequest, "InvalidRequest", "Value for " + header + " header is invalid."}
+		}
+		if c == nil {
+			c = &uploadChecksum{alg: alg}
+		}
+	}
+	if c != nil {
+		c.hash = c.alg.new()
+	}
+	return c, nil
+}
+
+// verify returns the base64 checksum of the body, which must have been
+// read to the end, or the error to refuse the upload with if it doesn't
+// match the value sent with it.
+func (c *uploadChecksum) verify(r *http.Request) (string, *apiError) {
+	got := base64.StdEncoding.EncodeToString(c.hash.Sum(nil))
+	want := c.want
+	if c.trailer {
+		// Filled in by net/http, or by awsChunkedReader for aws-chunked
+		// bodies, once the body has been read
+		if want = r.Trailer.Get(c.alg.header); want == "" {
+			return "", &apiError{http.StatusBadRequest, "MalformedTrailerError", "The request contained trailing data that was not well-formed or did not conform to our published schema."}
+		}
+	}
+	if want != "" && want != got {
+		return "", &apiError{http.StatusBadRequest, "BadDigest", "The " + c.alg.name + " you specified did not match the calculated checksum."}
+	}
+	return got, nil
+}
+
+// setChecksumHeader sends an object's stored checksum on a GET or HEAD
+// that asks for it with x-amz-checksum-mode: ENABLED. It is only sent for
+// the whole object, since it can't be checked against part of it.
+func setChecksumHeader(w http.ResponseWriter, r *http.Request, m *objectMeta, partial bool) {
+	if partial || m.Checksum == "" || !strings.EqualFold(r.Header.Get("x-amz-checksum-mode"), "ENABLED") {
+		return
+	}
+	if alg := checksumAlgorithmNamed(m.ChecksumAlgorithm); alg != nil {
+		w.Header().Set(alg.header, m.Checksum)
+		w.Header().Set("x-amz-checksum-type", "FULL_OBJECT")
+	}
+}
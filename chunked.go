@@ -0,0 +1,310 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// AWS SDKs may upload with "Content-Encoding: aws-chunked", framing the body
+// as a series of chunks:
+//
+//	<size-hex>[;chunk-signature=<sig>]\r\n<data>\r\n ... 0[;chunk-signature=<sig>]\r\n<trailers>\r\n
+//
+// x-amz-content-sha256 says whether each chunk is signed and whether
+// trailing headers (usually a checksum) follow the last one, and
+// x-amz-decoded-content-length gives the size of the payload itself.
+
+// x-amz-content-sha256 values of the aws-chunked variants we decode
+const (
+	streamingSignedPayload          = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingSignedPayloadTrailer   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsignedPayloadTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// Longest chunk header or trailer line accepted
+const maxChunkLineBytes = 4 << 10
+
+var (
+	// errChunkSignatureMismatch is returned from an aws-chunked body with a
+	// chunk or trailer whose signature is wrong.
+	errChunkSignatureMismatch = errors.New("aws-chunked chunk signature does not match")
+	// errMalformedChunk is returned from an aws-chunked body whose framing is
+	// broken, or whose payload is longer than x-amz-decoded-content-length.
+	errMalformedChunk = errors.New("malformed aws-chunked body")
+)
+
+// isAWSChunked reports whether r's body is framed with aws-chunked.
+func isAWSChunked(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("x-amz-content-sha256"), streamingPayload) {
+		return true
+	}
+	for _, enc := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+		if strings.EqualFold(strings.TrimSpace(enc), "aws-chunked") {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeAWSChunked replaces r's aws-chunked body with one yielding the
+// payload, checking each chunk against signer unless it is nil. The request
+// is left looking like a plain upload of x-amz-decoded-content-length bytes,
+// with the trailing headers in r.Trailer once the body has been read, as
+// net/http does for HTTP trailers. It does nothing if the body is already
+// being decoded.
+func decodeAWSChunked(r *http.Request, signer *chunkSigner) *apiError {
+	if _, ok := r.Body.(*awsChunkedReader); ok {
+		return nil
+	}
+	size, err := strconv.ParseInt(r.Header.Get("x-amz-decoded-content-length"), 10, 64)
+	if err != nil || size < 0 {
+		return &apiError{http.StatusLengthRequired, "MissingContentLength", "You must provide the x-amz-decoded-content-length HTTP header with an aws-chunked body."}
+	}
+	r.Trailer = http.Header{}
+	r.Body = &awsChunkedReader{
+		r:       bufio.NewReaderSize(r.Body, 64<<10),
+		body:    r.Body,
+		signer:  signer,
+		trailer: r.Trailer,
+		hash:    sha256.New(),
+		want:    size,
+	}
+	r.ContentLength = size
+
+	var encodings []string
+	for _, enc := range strings.Split(r.Header.Get("Content-Encoding"), ",") {
+		if enc = strings.TrimSpace(enc); enc != "" && !strings.EqualFold(enc, "aws-chunked") {
+			encodings = append(encodings, enc)
+		}
+	}
+	if len(encodings) > 0 {
+		r.Header.Set("Content-Encoding", strings.Join(encodings, ","))
+	} else {
+		r.Header.Del("Content-Encoding")
+	}
+	return nil
+}
+
+// respondIfChunkError answers a request whose aws-chunked body failed to
+// decode. It reports whether it handled err.
+func respondIfChunkError(w http.ResponseWriter, r *http.Request, err error) bool {
+	switch {
+	case errors.Is(err, errChunkSignatureMismatch):
+		writeS3Error(w, http.StatusForbidden, "SignatureDoesNotMatch", "The chunk signature does not match the signature computed with the configured secret key", r.URL.Path)
+	case errors.Is(err, errMalformedChunk):
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "The aws-chunked body is malformed or longer than x-amz-decoded-content-length", r.URL.Path)
+	default:
+		return false
+	}
+	return true
+}
+
+// chunkSigner computes the signatures of successive chunks, each chained to
+// the one before, starting from the request's own signature.
+type chunkSigner struct {
+	key     []byte
+	amzDate string
+	scope   string
+	prev    string
+	// Whether the last chunk is followed by signed trailing headers
+	trailer bool
+}
+
+// Hex SHA-256 of no data
+var emptySHA256 = hex.EncodeToString(sha256.New().Sum(nil))
+
+// verify checks the signature of the chunk whose SHA-256 is dataHash.
+func (s *chunkSigner) verify(signature string, dataHash []byte) bool {
+	stringToSign := "AWS4-HMAC-SHA256-PAYLOAD\n" + s.amzDate + "\n" + s.scope + "\n" + s.prev + "\n" + emptySHA256 + "\n" + hex.EncodeToString(dataHash)
+	return s.check(signature, stringToSign)
+}
+
+// verifyTrailer checks the signature of the trailing headers, given as
+// "name:value\n" lines.
+func (s *chunkSigner) verifyTrailer(signature, trailers string) bool {
+	hashed := sha256.Sum256([]byte(trailers))
+	stringToSign := "AWS4-HMAC-SHA256-TRAILER\n" + s.amzDate + "\n" + s.scope + "\n" + s.prev + "\n" + hex.EncodeToString(hashed[:])
+	return s.check(signature, stringToSign)
+}
+
+func (s *chunkSigner) check(signature, stringToSign string) bool {
+	want := hex.EncodeToString(hmacSHA256(s.key, stringToSign))
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return false
+	}
+	s.prev = want
+	return true
+}
+
+// awsChunkedReader yields the payload of an aws-chunked body. A chunk's
+// data is passed on as it arrives; a bad signature fails the read that
+// completes the chunk.
+type awsChunkedReader struct {
+	r       *bufio.Reader
+	body    io.Closer
+	signer  *chunkSigner
+	trailer http.Header // filled in from the trailing headers
+
+	remaining int64     // bytes left in the current chunk
+	signature string    // of the current chunk
+	hash      hash.Hash // of the current chunk's data
+	decoded   int64     // payload bytes read so far
+	want      int64     // x-amz-decoded-content-length
+	done      bool      // the final chunk has been read
+	err       error
+}
+
+func (c *awsChunkedReader) Read(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	for c.remaining == 0 {
+		if c.done {
+			return 0, io.EOF
+		}
+		if c.err = c.nextChunk(); c.err != nil {
+			return 0, c.err
+		}
+	}
+	if int64(len(p)) > c.remaining {
+		p = p[:c.remaining]
+	}
+	n, err := c.r.Read(p)
+	c.hash.Write(p[:n])
+	c.remaining -= int64(n)
+	c.decoded += int64(n)
+	switch {
+	case c.decoded > c.want:
+		c.err = errMalformedChunk
+	case c.remaining == 0:
+		c.err = c.endChunk()
+	case err == io.EOF:
+		c.err = io.ErrUnexpectedEOF
+	default:
+		c.err = err
+	}
+	return n, c.err
+}
+
+func (c *awsChunkedReader) Close() error {
+	return c.body.Close()
+}
+
+// nextChunk reads a chunk header, and after the final chunk the trailing
+// headers.
+func (c *awsChunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeHex, ext, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(sizeHex, 16, 64)
+	if err != nil || size < 0 {
+		return errMalformedChunk
+	}
+	c.signature = ""
+	if c.signer != nil {
+		var ok bool
+		if c.signature, ok = strings.CutPrefix(ext, "chunk-signature="); !ok {
+			return errChunkSignatureMismatch
+		}
+	}
+	c.hash.Reset()
+	if size > 0 {
+		c.remaining = size
+		return nil
+	}
+
+	// The final, empty chunk
+	if c.signer != nil && !c.signer.verify(c.signature, c.hash.Sum(nil)) {
+		return errChunkSignatureMismatch
+	}
+	if err := c.readTrailers(); err != nil {
+		return err
+	}
+	if c.decoded != c.want {
+		return errMalformedChunk
+	}
+	c.done = true
+	return nil
+}
+
+// endChunk reads the CRLF closing a chunk's data and checks its signature.
+func (c *awsChunkedReader) endChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	if line != "" {
+		return errMalformedChunk
+	}
+	if c.signer != nil && !c.signer.verify(c.signature, c.hash.Sum(nil)) {
+		return errChunkSignatureMismatch
+	}
+	return nil
+}
+
+// readTrailers reads the header lines after the final chunk up to the
+// closing empty line into c.trailer.
+func (c *awsChunkedReader) readTrailers() error {
+	var trailers strings.Builder
+	var signature string
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return err
+		}
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return errMalformedChunk
+		}
+		if strings.EqualFold(name, "x-amz-trailer-signature") {
+			signature = strings.TrimSpace(value)
+			continue
+		}
+		trailers.WriteString(line + "\n")
+		c.trailer.Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+	if c.signer != nil && c.signer.trailer && !c.signer.verifyTrailer(signature, trailers.String()) {
+		return errChunkSignatureMismatch
+	}
+	return nil
+}
+
+// readLine reads a CRLF-terminated line, without the CRLF.
+func (c *awsChunkedReader) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := c.r.ReadSlice('\n')
+		line = append(line, b...)
+		if len(line) > maxChunkLineBytes {
+			return "", errMalformedChunk
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	s, ok := strings.CutSuffix(string(line), "\r\n")
+	if !ok {
+		return "", errMalformedChunk
+	}
+	return s, nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// With -compress, object content is gzip-compressed as it is written and
+// decompressed as it is read, so clients get back the bytes they stored,
+// with ETags and sizes of those. The gzip stream follows a marker, so that
+// a compressed object is recognized even if its metadata is lost:
+//
+//	S3FSGZ01 <gzip stream>
+//
+// With -encryption-key as well, this is what gets encrypted. A GET that
+// accepts gzip is sent the stream as it is, with Content-Encoding: gzip.
+
+// Prefix identifying compressed object content
+const gzipMagic = "S3FSGZ01"
+
+// Whether new objects are stored compressed
+var compressObjects bool
+
+// newCompressingWriter writes the marker of compressed content to w and
+// returns the writer to write the content to. Closing it does not close w.
+func newCompressingWriter(w io.Writer) (*gzip.Writer, error) {
+	if _, err := io.WriteString(w, gzipMagic); err != nil {
+		return nil, err
+	}
+	return gzip.NewWriter(w), nil
+}
+
+// decompressingReader reads compressed content. Seeking backwards starts
+// over from the beginning, and any seek is paid for by decompressing up to
+// the new position.
+type decompressingReader struct {
+	src  io.ReadSeeker
+	zr   *gzip.Reader
+	size int64
+	pos  int64
+}
+
+// newDecompressingReader returns a reader of the content compressed in src,
+// which is size bytes long uncompressed.
+func newDecompressingReader(src io.ReadSeeker, size int64) (*decompressingReader, error) {
+	var magic [len(gzipMagic)]byte
+	if _, err := io.ReadFull(src, magic[:]); err != nil || string(magic[:]) != gzipMagic {
+		return nil, errObjectCorrupt
+	}
+	zr, err := gzip.NewReader(src)
+	if err != nil {
+		return nil, errObjectCorrupt
+	}
+	return &decompressingReader{src: src, zr: zr, size: size}, nil
+}
+
+func (d *decompressingReader) Read(p []byte) (int, error) {
+	n, err := d.zr.Read(p)
+	d.pos += int64(n)
+	if err != nil && err != io.EOF {
+		return n, errObjectCorrupt
+	}
+	return n, err
+}
+
+func (d *decompressingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	if offset < d.pos {
+		if _, err := d.src.Seek(int64(len(gzipMagic)), io.SeekStart); err != nil {
+			return 0, err
+		}
+		if err := d.zr.Reset(d.src); err != nil {
+			return 0, errObjectCorrupt
+		}
+		d.pos = 0
+	}
+	if _, err := io.CopyN(io.Discard, d, offset-d.pos); err != nil && err != io.EOF {
+		return 0, err
+	}
+	return d.pos, nil
+}
+
+// objectContent returns a reader of the content of the object open as f
+// and its size, decrypting and decompressing it as m records it was stored.
+func objectContent(f ObjectReader, fi os.FileInfo, m *objectMeta) (io.ReadSeeker, int64, error) {
+	content, size, err := storedContent(f, fi, m)
+	if err != nil || !m.Compressed {
+		return content, size, err
+	}
+	d, err := newDecompressingReader(content, m.ContentSize)
+	if err != nil {
+		return nil, 0, err
+	}
+	return d, m.ContentSize, nil
+}
+
+// compressedContent returns a reader of the gzip stream holding the content
+// of the object open as f, which m records was stored compressed, and its
+// size.
+func compressedContent(f ObjectReader, fi os.FileInfo, m *objectMeta) (io.Reader, int64, error) {
+	content, _, err := storedContent(f, fi, m)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := content.Seek(int64(len(gzipMagic)), io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	return content, compressedSize(fi, m), nil
+}
+
+// compressedSize returns the size of the gzip stream compressedContent reads.
+func compressedSize(fi os.FileInfo, m *objectMeta) int64 {
+	return max(storedSize(fi, m)-int64(len(gzipMagic)), 0)
+}
+
+// sendCompressed reports whether a GET or HEAD of an object described by m
+// is answered with the stored gzip stream as is: when it is compressed, the
+// whole object is asked for, and the client accepts gzip without asking for
+// another Content-Encoding.
+func sendCompressed(r *http.Request, m *objectMeta, partial bool) bool {
+	return m.Compressed && !partial && acceptsGzip(r) && r.URL.Query().Get("response-content-encoding") == ""
+}
+
+// acceptsGzip reports whether the client accepts a gzip Content-Encoding.
+func acceptsGzip(r *http.Request) bool {
+	for _, v := range r.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(coding), ";")
+			if !strings.EqualFold(strings.TrimSpace(name), "gzip") {
+				continue
+			}
+			// "gzip;q=0" refuses it
+			q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+			return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+		}
+	}
+	return false
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Response header with the modification time of an object at the full
+// precision of the filesystem, as RFC 3339; Last-Modified only has whole
+// seconds. The conditional headers accept it in place of an HTTP date.
+const preciseModTimeHeader = "x-last-modified"
+
+// setLastModified sets the Last-Modified and x-last-modified headers of an
+// object modified at modTime.
+func setLastModified(w http.ResponseWriter, modTime time.Time) {
+	w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set(preciseModTimeHeader, modTime.UTC().Format(time.RFC3339Nano))
+}
+
+// parseConditionTime parses the date of a conditional header: an HTTP
+// date, which stands for the start of its second, or a timestamp as sent
+// in x-last-modified.
+func parseConditionTime(v string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, strings.TrimSpace(v)); err == nil {
+		return t, nil
+	}
+	return http.ParseTime(v)
+}
+
+// etagListMatches reports whether an If-Match/If-None-Match value ("*" or a
+// comma-separated list of entity tags) matches etag. Weak tags (W/"...")
+// compare by their opaque part.
+func etagListMatches(list, etag string) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkReadPreconditions evaluates the conditional headers of a GET or HEAD
+// against the object's current ETag and modification time, in the order
+// RFC 9110 prescribes. When the request should not be served normally it
+// writes the response (412 Precondition Failed or 304 Not Modified) and
+// returns false. The caller must already have set ETag and Last-Modified.
+// Dates are compared with the full modification time, so an object written
+// again within the second of an HTTP date counts as modified since.
+func checkReadPreconditions(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	if im := r.Header.Get("If-Match"); im != "" {
+		if !etagListMatches(im, etag) {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold", r.URL.Path)
+			return false
+		}
+	} else if ius := r.Header.Get("If-Unmodified-Since"); ius != "" {
+		if t, err := parseConditionTime(ius); err == nil && modTime.After(t) {
+			writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "At least one of the pre-conditions you specified did not hold", r.URL.Path)
+			return false
+		}
+	}
+
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etagListMatches(inm, etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return false
+		}
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := parseConditionTime(ims); err == nil && !modTime.After(t) {
+			w.WriteHeader(http.StatusNotModified)
+			return false
+		}
+	}
+	return true
+}
+
+// ifRangeMatches reports whether the Range of a GET may be served given its
+// If-Range header: always without one, and otherwise only if the object
+// is still the one the client has part of. An entity tag must be the
+// current ETag, compared strongly; a date must be exactly the object's
+// modification time (RFC 9110 section 13.1.5), which an HTTP date is only
+// if it has no fraction of a second. Otherwise the whole object is
+// sent, so a resuming download starts over instead of mixing versions.
+func ifRangeMatches(r *http.Request, etag string, modTime time.Time) bool {
+	ir := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		return ir == etag
+	}
+	t, err := parseConditionTime(ir)
+	return err == nil && t.Equal(modTime)
+}
+
+// PUTs of the same object are serialized on one of these (picked by path)
+// so a precondition can't be invalidated between its check and the write
+var objectLocks [64]sync.Mutex
+
+// lockObject locks the object stored at path against concurrent writes and
+// returns the function that unlocks it.
+func lockObject(path string) func() {
+	l := &objectLocks[objectLockIndex(path)]
+	l.Lock()
+	return l.Unlock
+}
+
+// lockObjects is lockObject for several objects at once. The locks are
+// taken in a fixed order, and paths sharing one are locked once, so two
+// callers can't deadlock each other.
+func lockObjects(paths []string) func() {
+	seen := map[int]bool{}
+	var indexes []int
+	for _, p := range paths {
+		if i := objectLockIndex(p); !seen[i] {
+			seen[i] = true
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+	for _, i := range indexes {
+		objectLocks[i].Lock()
+	}
+	return func() {
+		for j := len(indexes) - 1; j >= 0; j-- {
+			objectLocks[indexes[j]].Unlock()
+		}
+	}
+}
+
+func objectLockIndex(path string) int {
+	h := fnv.New32a()
+	h.Write([]byte(path))
+	return int(h.Sum32() % uint32(len(objectLocks)))
+}
+
+// checkWritePreconditions evaluates If-None-Match: * (create only) and
+// If-Match (replace only the given version) on a PUT of key in bucket.
+// When a condition fails it writes the error response and returns false.
+// The object must be locked with lockObject.
+func checkWritePreconditions(w http.ResponseWriter, r *http.Request, bucket, key string) bool {
+	inm := r.Header.Get("If-None-Match")
+	im := r.Header.Get("If-Match")
+	if inm == "" && im == "" {
+		return true
+	}
+	if inm != "" && strings.TrimSpace(inm) != "*" {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "If-None-Match on a write only supports *", r.URL.Path)
+		return false
+	}
+
+	meta, ok := currentMeta(w, r, bucket, key)
+	if !ok {
+		return false
+	}
+	if inm != "" && meta != nil {
+		writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "The object already exists and If-None-Match: * was given", r.URL.Path)
+		return false
+	}
+	if im != "" {
+		return checkIfMatch(w, r, meta, im)
+	}
+	return true
+}
+
+// checkDeletePreconditions evaluates If-Match (delete only the given
+// version) on a DELETE of key in bucket, for compare-and-delete between
+// writers. When it fails it writes the error response and returns false.
+// The object must be locked with lockObject.
+func checkDeletePreconditions(w http.ResponseWriter, r *http.Request, bucket, key string) bool {
+	im := r.Header.Get("If-Match")
+	if im == "" {
+		return true
+	}
+	// The condition is on the current object, not on a version by ID
+	if r.URL.Query().Get("versionId") != "" {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "If-Match is not supported when deleting a specific version", r.URL.Path)
+		return false
+	}
+	meta, ok := currentMeta(w, r, bucket, key)
+	if !ok {
+		return false
+	}
+	return checkIfMatch(w, r, meta, im)
+}
+
+// currentMeta returns the metadata of key in bucket, or nil if there is no
+// such object. When it can't tell, it writes the error response and
+// returns false.
+func currentMeta(w http.ResponseWriter, r *http.Request, bucket, key string) (*objectMeta, bool) {
+	_, meta, err := backend.Stat(bucket, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, true
+	}
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Stating file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return nil, false
+	}
+	return meta, true
+}
+
+// checkIfMatch evaluates the If-Match value im against the object meta
+// describes, nil if there is none.
+func checkIfMatch(w http.ResponseWriter, r *http.Request, meta *objectMeta, im string) bool {
+	// As in S3, conditioning on the version of a missing object is a 404
+	if meta == nil {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", r.URL.Path)
+		return false
+	}
+	if !etagListMatches(im, meta.ETag) {
+		writeS3Error(w, http.StatusPreconditionFailed, "PreconditionFailed", "The object's ETag does not match If-Match", r.URL.Path)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A client deletes the version it read; if the object changed since, the
+// delete must be refused and the new content kept.
+func TestConditionalDeleteAfterModification(t *testing.T) {
+	useTempRoot(t)
+	if w := serve(t, "PUT", "/b/k", strings.NewReader("first"), nil); w.Code != 204 {
+		t.Fatalf("PUT: %d", w.Code)
+	}
+	read := serve(t, "GET", "/b/k", nil, nil).Header().Get("ETag")
+	if w := serve(t, "PUT", "/b/k", strings.NewReader("second"), nil); w.Code != 204 {
+		t.Fatalf("PUT: %d", w.Code)
+	}
+
+	if w := serve(t, "DELETE", "/b/k", nil, http.Header{"If-Match": {read}}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE of a modified object: %d, want 412", w.Code)
+	}
+	w := serve(t, "GET", "/b/k", nil, nil)
+	if w.Code != 200 || w.Body.String() != "second" {
+		t.Fatalf("after the refused DELETE: %d %q", w.Code, w.Body)
+	}
+
+	current := w.Header().Get("ETag")
+	if w := serve(t, "DELETE", "/b/k", nil, http.Header{"If-Match": {current}}); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE of the current ETag: %d, want 204", w.Code)
+	}
+	if w := serve(t, "DELETE", "/b/k", nil, http.Header{"If-Match": {current}}); w.Code != http.StatusNotFound {
+		t.Errorf("DELETE of a missing object: %d, want 404", w.Code)
+	}
+}
+
+// A conditional delete racing a write either lands before it or is
+// refused: it never deletes the new content.
+func TestConditionalDeleteRacingWrite(t *testing.T) {
+	useTempRoot(t)
+	for i := 0; i < 20; i++ {
+		if w := serve(t, "PUT", "/b/k", strings.NewReader("old"), nil); w.Code != 204 {
+			t.Fatalf("PUT: %d", w.Code)
+		}
+		etag := serve(t, "HEAD", "/b/k", nil, nil).Header().Get("ETag")
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			if w := serve(t, "PUT", "/b/k", strings.NewReader("new"), nil); w.Code != 204 {
+				t.Errorf("PUT: %d", w.Code)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			w := serve(t, "DELETE", "/b/k", nil, http.Header{"If-Match": {etag}})
+			if w.Code != http.StatusNoContent && w.Code != http.StatusPreconditionFailed {
+				t.Errorf("DELETE: %d", w.Code)
+			}
+		}()
+		wg.Wait()
+
+		// Whichever came first, the write is what remains
+		if w := serve(t, "GET", "/b/k", nil, nil); w.Code != 200 || w.Body.String() != "new" {
+			t.Fatalf("GET after the race: %d %q", w.Code, w.Body)
+		}
+	}
+}
+
+// Conditional reads compare the full modification time: an object written
+// again within the second of its Last-Modified counts as modified, and the
+// precise time in x-last-modified can be sent back instead.
+func TestSubSecondModTime(t *testing.T) {
+	root := useTempRoot(t)
+	if w := serve(t, "PUT", "/b/k", strings.NewReader("content"), nil); w.Code != 204 {
+		t.Fatalf("PUT: %d", w.Code)
+	}
+	modTime := time.Date(2026, 1, 2, 3, 4, 5, 500_000_000, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "b", "k"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(t, "HEAD", "/b/k", nil, nil)
+	lastModified, precise := w.Header().Get("Last-Modified"), w.Header().Get(preciseModTimeHeader)
+	if lastModified != "Fri, 02 Jan 2026 03:04:05 GMT" || precise != "2026-01-02T03:04:05.5Z" {
+		t.Fatalf("Last-Modified %q, x-last-modified %q", lastModified, precise)
+	}
+
+	for _, tc := range []struct {
+		header, value string
+		status        int
+	}{
+		{"If-Modified-Since", lastModified, 200},
+		{"If-Modified-Since", precise, 304},
+		{"If-Modified-Since", "Fri, 02 Jan 2026 03:04:06 GMT", 304},
+		{"If-Unmodified-Since", lastModified, 412},
+		{"If-Unmodified-Since", precise, 200},
+		{"If-Unmodified-Since", "2026-01-02T03:04:05.499999999Z", 412},
+	} {
+		if w := serve(t, "GET", "/b/k", nil, http.Header{tc.header: {tc.value}}); w.Code != tc.status {
+			t.Errorf("%s: %s: %d, want %d", tc.header, tc.value, w.Code, tc.status)
+		}
+	}
+	for value, status := range map[string]int{lastModified: 200, precise: 206} {
+		header := http.Header{"Range": {"bytes=0-2"}, "If-Range": {value}}
+		if w := serve(t, "GET", "/b/k", nil, header); w.Code != status {
+			t.Errorf("If-Range: %s: %d, want %d", value, w.Code, status)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	statsHandler(w, httptest.NewRequest("GET", "/admin/stats?bucket=b&key=k", nil))
+	if !strings.Contains(w.Body.String(), `"last_modified": "2026-01-02T03:04:05.5Z"`) {
+		t.Errorf("object stats: %s", w.Body)
+	}
+
+	// With whole seconds, as on filesystems with coarse timestamps, HTTP
+	// dates work as they always have
+	modTime = modTime.Truncate(time.Second)
+	if err := os.Chtimes(filepath.Join(root, "b", "k"), modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(t, "GET", "/b/k", nil, http.Header{"If-Modified-Since": {lastModified}}); w.Code != 304 {
+		t.Errorf("If-Modified-Since of a whole second: %d, want 304", w.Code)
+	}
+	if w := serve(t, "GET", "/b/k", nil, http.Header{"If-Unmodified-Since": {lastModified}}); w.Code != 200 {
+		t.Errorf("If-Unmodified-Since of a whole second: %d, want 200", w.Code)
+	}
+	header := http.Header{"Range": {"bytes=0-2"}, "If-Range": {lastModified}}
+	if w := serve(t, "GET", "/b/k", nil, header); w.Code != 206 {
+		t.Errorf("If-Range of a whole second: %d, want 206", w.Code)
+	}
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// bucketConfig holds per-bucket settings loaded from the -bucket-config file.
+type bucketConfig struct {
+	// Content-Type served when nothing more specific is known about an object
+	DefaultContentType string `json:"defaultContentType,omitempty"`
+
+	// Hosts allowed in the Referer of GET requests ("example.com" or
+	// "*.example.com"); empty disables hotlink protection
+	AllowedReferers []string `json:"allowedReferers,omitempty"`
+	// With AllowedReferers set, also refuse GETs that carry no Referer at all
+	BlockEmptyReferer bool `json:"blockEmptyReferer,omitempty"`
+
+	// In a versioned bucket, noncurrent versions (and delete markers) of
+	// each key to keep; older ones are deleted after every write. 0 keeps
+	// them all.
+	KeepVersions int `json:"keepVersions,omitempty"`
+}
+
+// Per-bucket settings keyed by bucket name; buckets without an entry use the global behavior
+var bucketConfigs map[string]bucketConfig
+
+// loadBucketConfig reads a JSON object mapping bucket names to bucketConfig.
+func loadBucketConfig(path string) (map[string]bucketConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]bucketConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	for bucket, cfg := range configs {
+		if cfg.DefaultContentType != "" {
+			if _, _, err := mime.ParseMediaType(cfg.DefaultContentType); err != nil {
+				return nil, fmt.Errorf("bucket %q: invalid defaultContentType %q: %w", bucket, cfg.DefaultContentType, err)
+			}
+		}
+		if cfg.KeepVersions < 0 {
+			return nil, fmt.Errorf("bucket %q: invalid keepVersions %d: must not be negative", bucket, cfg.KeepVersions)
+		}
+		for _, pattern := range cfg.AllowedReferers {
+			if host := strings.TrimPrefix(pattern, "*."); host == "" || strings.ContainsAny(host, "*/:") {
+				return nil, fmt.Errorf("bucket %q: invalid allowedReferers entry %q: want a host name or *.domain", bucket, pattern)
+			}
+		}
+	}
+	return configs, nil
+}
+
+// refererAllowed applies the bucket's hotlink protection to a read request.
+// Referer is trivially spoofed by non-browser clients, so this only stops
+// other sites from embedding objects; it is not access control.
+func refererAllowed(bucket string, r *http.Request) bool {
+	cfg := bucketConfigs[bucket]
+	if len(cfg.AllowedReferers) == 0 {
+		return true
+	}
+	referer := r.Header.Get("Referer")
+	if referer == "" {
+		// Cross-origin fetches may send only Origin
+		referer = r.Header.Get("Origin")
+	}
+	if referer == "" {
+		return !cfg.BlockEmptyReferer
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Hostname() == "" {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, pattern := range cfg.AllowedReferers {
+		pattern = strings.ToLower(pattern)
+		if domain := strings.TrimPrefix(pattern, "*."); domain != pattern {
+			if strings.HasSuffix(host, "."+domain) {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
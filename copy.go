@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// copySource is the object named by an x-amz-copy-source header, opened
+// for reading.
+type copySource struct {
+	file      *os.File
+	content   io.Reader // of the file as served, or the x-amz-copy-source-range of it
+	path      string
+	versionID string     // "" unless the source bucket is versioned
+	meta      objectMeta // with ContentType set to the type the source is served with
+	size      int64
+}
+
+// openCopySource opens the object named by the request's x-amz-copy-source
+// header ("/<bucket>/<key>" or "<bucket>/<key>", URL-encoded, optionally
+// followed by "?versionId=<id>"), limited to the bytes named by any
+// x-amz-copy-source-range header. When it can't, it writes the error
+// response and returns nil.
+func openCopySource(w http.ResponseWriter, r *http.Request) *copySource {
+	header := r.Header.Get("x-amz-copy-source")
+	var versionID string
+	if i := strings.IndexByte(header, '?'); i >= 0 {
+		q, err := url.ParseQuery(header[i+1:])
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "x-amz-copy-source is not properly URL-encoded", r.URL.Path)
+			return nil
+		}
+		versionID = q.Get("versionId")
+		header = header[:i]
+	}
+	source, err := url.PathUnescape(header)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "x-amz-copy-source is not properly URL-encoded", r.URL.Path)
+		return nil
+	}
+	parts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "x-amz-copy-source must be of the form /<bucket>/<key>", r.URL.Path)
+		return nil
+	}
+	srcBucket := parts[0]
+	srcKey, apiErr := validateKey(parts[1])
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, "x-amz-copy-source: "+apiErr.message, r.URL.Path)
+		return nil
+	}
+
+	srcPath, err := sanitizePath(srcBucket, srcKey)
+	if errors.Is(err, errSymlinkEscape) {
+		writePathError(w, r, err)
+		return nil
+	}
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "x-amz-copy-source: "+err.Error(), r.URL.Path)
+		return nil
+	}
+
+	ref, apiErr := readVersion(srcBucket, srcPath, versionID)
+	if apiErr != nil {
+		if ref.deleteMarker {
+			writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "The source of a copy request may not specifically refer to a delete marker by version id.", r.URL.Path)
+		} else {
+			writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		}
+		return nil
+	}
+
+	txnPublishLock.RLock()
+	f, err := os.Open(ref.path)
+	txnPublishLock.RUnlock()
+	if err != nil {
+		if respondIfOutOfFDs(w, r, err) {
+			return nil
+		}
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The copy source "+source+" does not exist.", r.URL.Path)
+		} else {
+			slog.Error("Opening copy source failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return nil
+	}
+
+	fi, err := f.Stat()
+	if err == nil && fi.IsDir() {
+		f.Close()
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The copy source "+source+" does not exist.", r.URL.Path)
+		return nil
+	}
+	var meta *objectMeta
+	if err == nil {
+		meta, err = loadMeta(ref.path, fi)
+	}
+	var content io.ReadSeeker
+	var size int64
+	if err == nil {
+		content, size, err = objectContent(f, fi, meta)
+	}
+	if err != nil {
+		f.Close()
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Reading copy source failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return nil
+	}
+	if versionID == "" && isExpired(meta, time.Now()) {
+		f.Close()
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The copy source "+source+" does not exist.", r.URL.Path)
+		return nil
+	}
+
+	debugLog(r, "Copying object", "source_bucket", srcBucket, "source_key", srcKey)
+	src := &copySource{file: f, content: content, path: ref.path, versionID: ref.versionID, size: size, meta: *meta}
+	src.meta.ContentType = contentTypeFor(srcBucket, srcKey, meta)
+
+	if header := r.Header.Get("x-amz-copy-source-range"); header != "" {
+		start, length, apiErr := parseCopySourceRange(header, size)
+		if apiErr != nil {
+			f.Close()
+			writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+			return nil
+		}
+		if _, err := content.Seek(start, io.SeekStart); err != nil {
+			f.Close()
+			slog.Error("Seeking file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return nil
+		}
+		src.content, src.size = io.LimitReader(content, length), length
+		// The source's checksum covers all of it
+		src.meta.ChecksumAlgorithm, src.meta.Checksum = "", ""
+	}
+	return src
+}
+
+// writeCopyResult answers a successful copy with a document named result:
+// CopyObjectResult, or CopyPartResult for a part.
+func writeCopyResult(w http.ResponseWriter, result, etag string, modTime time.Time) {
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(struct {
+		XMLName      xml.Name
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+	}{XMLName: xml.Name{Space: s3Namespace, Local: result}, LastModified: modTime.UTC().Format(s3TimeFormat), ETag: etag}); err != nil {
+		slog.Error("Writing copy result failed", "err", err)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Origins allowed to make cross-origin requests, from -cors-origin; empty
+// disables CORS, and "*" allows any origin
+var corsOrigins []string
+
+// Methods and response headers browsers are told about
+const (
+	corsAllowMethods  = "GET, HEAD, PUT, POST, DELETE"
+	corsExposeHeaders = "ETag, Content-Length, Content-Range, Last-Modified, x-amz-version-id, x-amz-delete-marker, x-amz-request-id, x-last-modified"
+)
+
+// How long browsers may cache a preflight result, in seconds
+const corsMaxAge = "3000"
+
+// parseCORSOrigins parses the -cors-origin value: "*" or a comma-separated
+// list of origins such as "https://app.example.com".
+func parseCORSOrigins(value string) ([]string, error) {
+	var origins []string
+	for _, o := range strings.Split(value, ",") {
+		o = strings.TrimSuffix(strings.TrimSpace(o), "/")
+		if o == "" {
+			continue
+		}
+		if o != "*" {
+			u, err := url.Parse(o)
+			if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+				return nil, fmt.Errorf("invalid -cors-origin entry %q: want * or an origin like https://example.com", o)
+			}
+		}
+		origins = append(origins, strings.ToLower(o))
+	}
+	return origins, nil
+}
+
+// corsAllowOrigin returns the Access-Control-Allow-Origin value for a
+// request's Origin, or "" if the origin is not allowed.
+func corsAllowOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, o := range corsOrigins {
+		if o == "*" {
+			return "*"
+		}
+		if o == strings.ToLower(origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// withCORS answers preflight OPTIONS requests and adds CORS headers to
+// responses for allowed origins. It runs ahead of authentication, since
+// browsers send preflights without credentials.
+func withCORS(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		allowed := corsAllowOrigin(origin)
+		if origin != "" {
+			w.Header().Add("Vary", "Origin")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			if allowed == "" {
+				writeS3Error(w, http.StatusForbidden, "AccessForbidden", "CORSResponse: This CORS request is not allowed.", r.URL.Path)
+				return
+			}
+			h := w.Header()
+			h.Set("Access-Control-Allow-Origin", allowed)
+			h.Set("Access-Control-Allow-Methods", corsAllowMethods)
+			// Any request header may be sent; it is still subject to signing
+			if reqHeaders := r.Header.Get("Access-Control-Request-Headers"); reqHeaders != "" {
+				h.Set("Access-Control-Allow-Headers", reqHeaders)
+			}
+			h.Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		if allowed != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowed)
+			w.Header().Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+func fileDevice(fi os.FileInfo) (uint64, bool) {
+	return 0, false
+}
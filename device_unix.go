@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileDevice returns the device of the filesystem fi lives on.
+func fileDevice(fi os.FileInfo) (uint64, bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Dev), true // Dev is int32 on some BSDs
+	}
+	return 0, false
+}
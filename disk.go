@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"syscall"
+)
+
+// Fewest free inodes the filesystem holding the storage root must have
+// left for writes to be accepted (-min-free-inodes; 0 = no check)
+var minFreeInodes uint64
+
+// respondIfOutOfInodes refuses a write with 507 InsufficientStorage, as an
+// out-of-space error would be answered, while the filesystem holding the
+// storage root has fewer than minFreeInodes inodes left. Many small objects
+// can use up the inodes long before the bytes, and a write then fails
+// with ENOSPC however much space df reports. Filesystems that don't count
+// inodes are never refused. It reports whether it handled the request.
+func respondIfOutOfInodes(w http.ResponseWriter, r *http.Request) bool {
+	if !outOfInodes() {
+		return false
+	}
+	slog.Warn("Storage is out of inodes; free some up under the storage root", "root", storageRootDir, "min_free_inodes", minFreeInodes)
+	writeS3Error(w, http.StatusInsufficientStorage, "InsufficientStorage", "There are not enough free inodes on the server to store the object.", r.URL.Path)
+	return true
+}
+
+// outOfInodes reports whether the filesystem holding the storage root has
+// fewer than minFreeInodes free inodes.
+func outOfInodes() bool {
+	if minFreeInodes == 0 {
+		return false
+	}
+	d := diskSpace(storageRootDir)
+	return d != nil && d.Inodes != nil && d.Inodes.Free < minFreeInodes
+}
+
+// isCreatingRequest reports whether the request is a write that may take
+// up inodes: anything but a read or delete.
+func isCreatingRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodPut, methodMkcol:
+		return true
+	case http.MethodPost:
+		return !hasQuery("delete")(r)
+	}
+	return false
+}
+
+// respondIfDiskFull turns an out-of-space error (ENOSPC) into a 507
+// InsufficientStorage, so clients learn why their write failed. It reports
+// whether it handled err; the caller is still responsible for removing what
+// it partly wrote.
+func respondIfDiskFull(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, syscall.ENOSPC) {
+		return false
+	}
+	slog.Warn("Storage is full; free up space under the storage root", "root", storageRootDir, "err", err)
+	writeS3Error(w, http.StatusInsufficientStorage, "InsufficientStorage", "There is not enough free space on the server to store the object.", r.URL.Path)
+	return true
+}
@@ -0,0 +1,7 @@
+//go:build !(linux || darwin || freebsd)
+
+package main
+
+func diskSpace(path string) *diskStats {
+	return nil
+}
@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import "syscall"
+
+// Reads the filesystem statistics; replaced in tests
+var statfs = syscall.Statfs
+
+// diskSpace reports the size of the filesystem holding path and the space
+// left on it, or nil if that can't be told. Inodes are left out if the
+// filesystem doesn't count them, as some network and FUSE filesystems don't.
+func diskSpace(path string) *diskStats {
+	var st syscall.Statfs_t
+	if err := statfs(path, &st); err != nil {
+		return nil
+	}
+	bsize := uint64(st.Bsize)
+	d := &diskStats{
+		TotalBytes:     uint64(st.Blocks) * bsize,
+		FreeBytes:      uint64(st.Bfree) * bsize,
+		AvailableBytes: uint64(st.Bavail) * bsize,
+	}
+	if st.Files > 0 {
+		d.Inodes = &inodeStats{Total: uint64(st.Files), Free: uint64(st.Ffree)}
+	}
+	return d
+}
@@ -0,0 +1,100 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// useStatfs makes the filesystem of the storage root report files inodes,
+// free of them, for the duration of the test.
+func useStatfs(t *testing.T, files, free uint64) {
+	t.Helper()
+	old := statfs
+	statfs = func(path string, st *syscall.Statfs_t) error {
+		*st = syscall.Statfs_t{Bsize: 4096, Blocks: 1000, Bfree: 500, Bavail: 400, Files: files}
+		setCount(&st.Ffree, free)
+		return nil
+	}
+	t.Cleanup(func() { statfs = old })
+}
+
+// setCount sets a Statfs_t count, signed on some platforms.
+func setCount[T int64 | uint64](p *T, n uint64) {
+	*p = T(n)
+}
+
+func useMinFreeInodes(t *testing.T, n uint64) {
+	t.Helper()
+	old := minFreeInodes
+	minFreeInodes = n
+	t.Cleanup(func() { minFreeInodes = old })
+}
+
+func TestMinFreeInodes(t *testing.T) {
+	useTempRoot(t)
+	useMinFreeInodes(t, 100)
+	if w := serve(t, http.MethodPut, "/b/existing", strings.NewReader("data"), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT: %d %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		name        string
+		files, free uint64
+		status      int
+	}{
+		{"enough inodes", 1000, 100, http.StatusNoContent},
+		{"too few inodes", 1000, 99, http.StatusInsufficientStorage},
+		// Filesystems that don't count inodes report none at all
+		{"no inode counts", 0, 0, http.StatusNoContent},
+	} {
+		useStatfs(t, tc.files, tc.free)
+		w := serve(t, http.MethodPut, "/b/new", strings.NewReader("data"), nil)
+		if w.Code != tc.status {
+			t.Errorf("%s: PUT %d, want %d", tc.name, w.Code, tc.status)
+		}
+		if tc.status == http.StatusInsufficientStorage && !strings.Contains(w.Body.String(), "<Code>InsufficientStorage</Code>") {
+			t.Errorf("%s: body %s", tc.name, w.Body)
+		}
+	}
+
+	// Out of inodes, reads and deletes are still served, and the volume isn't ready
+	useStatfs(t, 1000, 10)
+	if w := serve(t, http.MethodGet, "/b/existing", nil, nil); w.Code != http.StatusOK {
+		t.Errorf("GET: %d, want 200", w.Code)
+	}
+	body := `<Delete><Object><Key>new</Key></Object></Delete>`
+	if w := serve(t, http.MethodPost, "/b?delete", strings.NewReader(body), nil); w.Code != http.StatusOK {
+		t.Errorf("DeleteObjects: %d, want 200", w.Code)
+	}
+	if w := serve(t, http.MethodDelete, "/b/existing", nil, nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: %d, want 204", w.Code)
+	}
+	w := httptest.NewRecorder()
+	readyzHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz: %d, want 503", w.Code)
+	}
+
+	useMinFreeInodes(t, 0)
+	if w := serve(t, http.MethodPut, "/b/new", strings.NewReader("data"), nil); w.Code != http.StatusNoContent {
+		t.Errorf("PUT without -min-free-inodes: %d, want 204", w.Code)
+	}
+}
+
+func TestDiskSpaceInodes(t *testing.T) {
+	useTempRoot(t)
+	useStatfs(t, 1000, 250)
+	d := diskSpace(storageRootDir)
+	if d == nil || d.TotalBytes != 4096*1000 || d.Inodes == nil || *d.Inodes != (inodeStats{Total: 1000, Free: 250}) {
+		t.Errorf("disk stats %+v", d)
+	}
+	useStatfs(t, 0, 0)
+	if d := diskSpace(storageRootDir); d == nil || d.Inodes != nil {
+		t.Errorf("inodes reported for a filesystem without counts: %+v", d)
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"strings"
+)
+
+// With -encryption-key, object content is encrypted with AES-256-GCM as it
+// is written and decrypted as it is read. A stored object is a header, the
+// magic string and a random base nonce, followed by the content sealed in
+// segments of encSegmentSize bytes, each with its own tag:
+//
+//	S3FSENC1 <nonce:12> <segment 0 + tag> <segment 1 + tag> ... <final segment + tag>
+//
+// Segment i is sealed with the base nonce XORed with i, so a range can be
+// served by decrypting only the segments it covers. Every segment but the
+// final one is full, and the final one (empty if the content ends on a
+// segment boundary) is sealed as such, so a truncated file fails to
+// decrypt rather than passing for a shorter object.
+
+// Prefix identifying an encrypted object file
+const encMagic = "S3FSENC1"
+
+// Plaintext bytes per sealed segment
+const encSegmentSize = 64 << 10
+
+const (
+	encNonceSize  = 12
+	encTagSize    = 16
+	encHeaderSize = len(encMagic) + encNonceSize
+)
+
+// objectCipher seals object content; nil while encryption is disabled.
+var objectCipher cipher.AEAD
+
+var (
+	// errNoEncryptionKey is returned when reading an object stored
+	// encrypted while the server runs without a key.
+	errNoEncryptionKey = errors.New("object is encrypted but no -encryption-key is configured")
+	// errObjectCorrupt is returned when an encrypted object fails to
+	// decrypt: it was damaged, truncated, or written with another key.
+	errObjectCorrupt = errors.New("encrypted object failed authentication")
+)
+
+// loadEncryptionKey enables encryption with a 256-bit key given as 64 hex
+// digits, or read from keyFile as either those digits or 32 raw bytes.
+func loadEncryptionKey(hexKey, keyFile string) error {
+	var key []byte
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return err
+		}
+		if len(data) == 32 {
+			key = data
+		} else {
+			hexKey = strings.TrimSpace(string(data))
+		}
+	}
+	if key == nil {
+		var err error
+		if key, err = hex.DecodeString(hexKey); err != nil || len(key) != 32 {
+			return errors.New("the key must be 32 bytes, written as 64 hex digits")
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	objectCipher, err = cipher.NewGCM(block)
+	return err
+}
+
+// segmentNonce returns the nonce segment i is sealed with.
+func segmentNonce(base [encNonceSize]byte, i int64) []byte {
+	nonce := base
+	ctr := binary.BigEndian.Uint64(nonce[4:]) ^ uint64(i)
+	binary.BigEndian.PutUint64(nonce[4:], ctr)
+	return nonce[:]
+}
+
+// Additional data marking whether a segment is the final one
+var (
+	encInnerSegment = []byte{0}
+	encFinalSegment = []byte{1}
+)
+
+// encryptingWriter seals what is written to it into w. Close must be called
+// to seal the final segment; it does not close w.
+type encryptingWriter struct {
+	w     io.Writer
+	nonce [encNonceSize]byte
+	seg   int64
+	buf   []byte
+	out   []byte
+}
+
+// newEncryptingWriter writes the header of an encrypted object to w and
+// returns the writer to write its content to.
+func newEncryptingWriter(w io.Writer) (*encryptingWriter, error) {
+	e := &encryptingWriter{w: w, buf: make([]byte, 0, encSegmentSize)}
+	if _, err := rand.Read(e.nonce[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, encMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(e.nonce[:]); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (e *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more content follows, since
+		// until then it may turn out to be the final one
+		if len(e.buf) == encSegmentSize {
+			if err := e.seal(encInnerSegment); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encSegmentSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptingWriter) Close() error {
+	return e.seal(encFinalSegment)
+}
+
+func (e *encryptingWriter) seal(ad []byte) error {
+	e.out = objectCipher.Seal(e.out[:0], segmentNonce(e.nonce, e.seg), e.buf, ad)
+	e.seg++
+	e.buf = e.buf[:0]
+	_, err := e.w.Write(e.out)
+	return err
+}
+
+// decryptingReader reads the content of an encrypted object, decrypting a
+// segment at a time.
+type decryptingReader struct {
+	f        io.ReaderAt
+	nonce    [encNonceSize]byte
+	stored   int64 // size of the file
+	size     int64 // of the content
+	segments int64
+	pos      int64
+	seg      int64 // segment held in buf, or -1
+	buf      []byte
+	in       []byte
+	verified bool // the final segment has been authenticated
+}
+
+// newDecryptingReader reads the header of the encrypted object f, whose file
+// is stored bytes long, and returns a reader of its content.
+func newDecryptingReader(f io.ReaderAt, stored int64) (*decryptingReader, error) {
+	if objectCipher == nil {
+		return nil, errNoEncryptionKey
+	}
+	var header [encHeaderSize]byte
+	if _, err := f.ReadAt(header[:], 0); err != nil {
+		if err == io.EOF {
+			return nil, errObjectCorrupt
+		}
+		return nil, err
+	}
+	if string(header[:len(encMagic)]) != encMagic {
+		return nil, errObjectCorrupt
+	}
+	d := &decryptingReader{f: f, stored: stored, seg: -1}
+	copy(d.nonce[:], header[len(encMagic):])
+
+	body := stored - int64(encHeaderSize)
+	sealed := int64(encSegmentSize + encTagSize)
+	d.segments = (body + sealed - 1) / sealed
+	final := body - (d.segments-1)*sealed - encTagSize
+	if body < encTagSize || final < 0 {
+		return nil, errObjectCorrupt
+	}
+	d.size = (d.segments-1)*encSegmentSize + final
+	return d, nil
+}
+
+// Size returns the size of the content.
+func (d *decryptingReader) Size() int64 {
+	return d.size
+}
+
+func (d *decryptingReader) Read(p []byte) (int, error) {
+	if d.pos >= d.size {
+		// The final segment is authenticated even if none of it is read,
+		// as for an empty object or after seeking to the end
+		if !d.verified {
+			if err := d.load(d.segments - 1); err != nil {
+				return 0, err
+			}
+		}
+		return 0, io.EOF
+	}
+	i := d.pos / encSegmentSize
+	if i != d.seg {
+		if err := d.load(i); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, d.buf[d.pos-i*encSegmentSize:])
+	d.pos += int64(n)
+	return n, nil
+}
+
+// load decrypts segment i into d.buf.
+func (d *decryptingReader) load(i int64) error {
+	sealed := int64(encSegmentSize + encTagSize)
+	off := int64(encHeaderSize) + i*sealed
+	n := min(sealed, d.stored-off)
+	if cap(d.in) < int(n) {
+		d.in = make([]byte, sealed)
+	}
+	if _, err := d.f.ReadAt(d.in[:n], off); err != nil {
+		if err == io.EOF {
+			return errObjectCorrupt
+		}
+		return err
+	}
+	ad := encInnerSegment
+	if i == d.segments-1 {
+		ad = encFinalSegment
+	}
+	buf, err := objectCipher.Open(d.buf[:0], segmentNonce(d.nonce, i), d.in[:n], ad)
+	if err != nil {
+		d.seg = -1
+		return errObjectCorrupt
+	}
+	d.buf, d.seg = buf, i
+	if i == d.segments-1 {
+		d.verified = true
+	}
+	return nil
+}
+
+func (d *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += d.pos
+	case io.SeekEnd:
+		offset += d.size
+	default:
+		return 0, errors.New("seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("seek: negative position")
+	}
+	d.pos = offset
+	return offset, nil
+}
+
+// storedContent returns a reader of the content of the object open as f,
+// as it was stored before any encryption, and its size: decrypted if m
+// records that it was stored encrypted, but still compressed.
+func storedContent(f ObjectReader, fi os.FileInfo, m *objectMeta) (io.ReadSeeker, int64, error) {
+	if !m.Encrypted {
+		return f, fi.Size(), nil
+	}
+	d, err := newDecryptingReader(f, fi.Size())
+	if err != nil {
+		return nil, 0, err
+	}
+	return d, d.Size(), nil
+}
+
+// contentSize returns the size of the content of the object stored in fi,
+// as recorded in m if it was compressed.
+func contentSize(fi os.FileInfo, m *objectMeta) int64 {
+	if m.Compressed {
+		return m.ContentSize
+	}
+	return storedSize(fi, m)
+}
+
+// storedSize returns the size of what storedContent reads of the object
+// stored in fi: without the overhead of encryption if m records that it was
+// encrypted.
+func storedSize(fi os.FileInfo, m *objectMeta) int64 {
+	if !m.Encrypted {
+		return fi.Size()
+	}
+	body := fi.Size() - int64(encHeaderSize)
+	sealed := int64(encSegmentSize + encTagSize)
+	segments := (body + sealed - 1) / sealed
+	return max(body-segments*encTagSize, 0)
+}
+
+// isEncryptedFile reports whether the file f starts like an encrypted object.
+func isEncryptedFile(f io.ReaderAt) bool {
+	var magic [len(encMagic)]byte
+	_, err := f.ReadAt(magic[:], 0)
+	return err == nil && string(magic[:]) == encMagic
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useEncryption enables -encryption-key for the test.
+func useEncryption(t *testing.T) {
+	t.Helper()
+	old := objectCipher
+	if err := loadEncryptionKey(strings.Repeat("ab", 32), ""); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { objectCipher = old })
+}
+
+// testContent returns n bytes of arbitrary content.
+func testContent(n int) []byte {
+	b := make([]byte, n)
+	rand.New(rand.NewSource(int64(n))).Read(b)
+	return b
+}
+
+// encryptTest returns content as stored encrypted.
+func encryptTest(t *testing.T, content []byte) []byte {
+	t.Helper()
+	var stored bytes.Buffer
+	enc, err := newEncryptingWriter(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Written in odd-sized pieces, as bodies arrive
+	for p := content; len(p) > 0; {
+		n := min(len(p), 1000)
+		if _, err := enc.Write(p[:n]); err != nil {
+			t.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := enc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return stored.Bytes()
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	useEncryption(t)
+	for _, tc := range []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"one byte", 1},
+		{"one byte short of a segment", encSegmentSize - 1},
+		{"exactly one segment", encSegmentSize},
+		{"one byte over a segment", encSegmentSize + 1},
+		{"exactly three segments", 3 * encSegmentSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			content := testContent(tc.size)
+			stored := encryptTest(t, content)
+			if tc.size >= 16 && bytes.Contains(stored, content[:16]) {
+				t.Error("content stored in the clear")
+			}
+			d, err := newDecryptingReader(bytes.NewReader(stored), int64(len(stored)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Size() != int64(tc.size) {
+				t.Errorf("Size() = %d, want %d", d.Size(), tc.size)
+			}
+			got, err := io.ReadAll(d)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Errorf("decrypted %d bytes, not the %d written", len(got), tc.size)
+			}
+			if size := storedSize(fakeFileInfo{size: int64(len(stored))}, &objectMeta{Encrypted: true}); size != int64(tc.size) {
+				t.Errorf("storedSize = %d, want %d", size, tc.size)
+			}
+		})
+	}
+}
+
+func TestDecryptingReaderSeek(t *testing.T) {
+	useEncryption(t)
+	content := testContent(3*encSegmentSize + 100)
+	stored := encryptTest(t, content)
+	d, err := newDecryptingReader(bytes.NewReader(stored), int64(len(stored)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{encSegmentSize + 123, io.SeekStart, encSegmentSize + 123},
+		// Backwards into the previous segment
+		{-200, io.SeekCurrent, encSegmentSize + 123 + 1000 - 200},
+		{-10, io.SeekEnd, int64(len(content)) - 10},
+		{5, io.SeekStart, 5},
+	} {
+		pos, err := d.Seek(tc.offset, tc.whence)
+		if err != nil || pos != tc.want {
+			t.Fatalf("Seek(%d, %d) = %d, %v; want %d", tc.offset, tc.whence, pos, err, tc.want)
+		}
+		got := make([]byte, 1000)
+		n, err := io.ReadFull(d, got)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatal(err)
+		}
+		if want := content[pos:min(pos+1000, int64(len(content)))]; !bytes.Equal(got[:n], want) {
+			t.Errorf("read after Seek(%d, %d) differs from the content at %d", tc.offset, tc.whence, pos)
+		}
+	}
+}
+
+// A file cut short at a segment boundary looks like a shorter object; the
+// final-segment marker must give it away.
+func TestDecryptingReaderTruncated(t *testing.T) {
+	useEncryption(t)
+	sealed := encSegmentSize + encTagSize
+	for _, tc := range []struct {
+		name    string
+		size    int
+		storeAt int // bytes of the file kept
+	}{
+		{"after the first of three segments", 2*encSegmentSize + 10, encHeaderSize + sealed},
+		{"before the final segment", 2 * encSegmentSize, encHeaderSize + sealed},
+		{"within a segment", encSegmentSize + 10, encHeaderSize + sealed + 5},
+		{"to the header", 10, encHeaderSize},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			stored := encryptTest(t, testContent(tc.size))[:tc.storeAt]
+			d, err := newDecryptingReader(bytes.NewReader(stored), int64(len(stored)))
+			if err == nil {
+				_, err = io.ReadAll(d)
+			}
+			if !errors.Is(err, errObjectCorrupt) {
+				t.Errorf("err = %v, want errObjectCorrupt", err)
+			}
+		})
+	}
+}
+
+// Content written with another key fails to decrypt.
+func TestDecryptingReaderWrongKey(t *testing.T) {
+	useEncryption(t)
+	stored := encryptTest(t, testContent(100))
+	if err := loadEncryptionKey(strings.Repeat("cd", 32), ""); err != nil {
+		t.Fatal(err)
+	}
+	d, err := newDecryptingReader(bytes.NewReader(stored), int64(len(stored)))
+	if err == nil {
+		_, err = io.ReadAll(d)
+	}
+	if !errors.Is(err, errObjectCorrupt) {
+		t.Errorf("err = %v, want errObjectCorrupt", err)
+	}
+}
+
+func TestEncryptedUploadRoundTrip(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		root := useTempRoot(t)
+		useEncryption(t)
+		old := compressObjects
+		compressObjects = compress
+		t.Cleanup(func() { compressObjects = old })
+
+		content := testContent(encSegmentSize + 1)
+		if w := serve(t, "PUT", "/b/k", bytes.NewReader(content), nil); w.Code != 204 {
+			t.Fatalf("compress %v: PUT: %d %s", compress, w.Code, w.Body)
+		}
+		stored, _ := readTestFile(t, filepath.Join(root, "b", "k"))
+		if !strings.HasPrefix(stored, encMagic) {
+			t.Errorf("compress %v: object not stored encrypted", compress)
+		}
+		w := serve(t, "GET", "/b/k", nil, nil)
+		if w.Code != 200 || !bytes.Equal(w.Body.Bytes(), content) {
+			t.Errorf("compress %v: GET: %d, %d bytes", compress, w.Code, w.Body.Len())
+		}
+		w = serve(t, "GET", "/b/k", nil, map[string][]string{"Range": {"bytes=65530-65535"}})
+		if w.Code != 206 || !bytes.Equal(w.Body.Bytes(), content[65530:65536]) {
+			t.Errorf("compress %v: range GET across a segment boundary: %d %q", compress, w.Code, w.Body)
+		}
+	}
+}
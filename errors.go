@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// s3ErrorResponse is the <Error> document S3 answers failed requests with.
+// SDKs look at Code to decide whether (and how) to retry.
+type s3ErrorResponse struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestId string   `xml:"RequestId"`
+	// Added last, where parsers expecting S3's document skip it as they
+	// do the elements S3 itself adds for some errors
+	DocumentationUrl string `xml:"DocumentationUrl,omitempty"`
+}
+
+// Base URL error codes are appended to for the DocumentationUrl of error
+// documents (-error-docs-url); empty leaves the element out
+var errorDocsURL string
+
+// writeS3Error sends an S3-style XML error. resource is the bucket or object
+// the request addressed, normally r.URL.Path. The RequestId is the one
+// withRequestID set on the response.
+func writeS3Error(w http.ResponseWriter, status int, code, message, resource string) {
+	requestID := w.Header().Get("x-amz-request-id")
+	if requestID == "" {
+		requestID = newRequestID()
+		w.Header().Set("x-amz-request-id", requestID)
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Del("Content-Length")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(s3ErrorResponse{
+		Code:             code,
+		Message:          message,
+		Resource:         resource,
+		RequestId:        requestID,
+		DocumentationUrl: errorDocumentationURL(code),
+	}); err != nil {
+		slog.Error("Writing error response failed", "err", err)
+	}
+}
+
+// errorDocumentationURL returns where the error code is documented, or ""
+// without -error-docs-url.
+func errorDocumentationURL(code string) string {
+	if errorDocsURL == "" {
+		return ""
+	}
+	return errorDocsURL + code
+}
+
+// apiError is a failure to be reported with writeS3Error, for helpers that
+// leave writing the response to their caller.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+// newRequestID returns a random ID in the style of S3's x-amz-request-id.
+func newRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "0000000000000000"
+	}
+	return strings.ToUpper(hex.EncodeToString(b[:]))
+}
+
+// newHostID returns a random token in the style of S3's x-amz-id-2. It
+// means nothing here; some clients just expect it next to the request ID.
+func newHostID() string {
+	var b [48]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(b[:])
+}
+
+type requestIDKey struct{}
+
+// withRequestID gives every request an ID, sent as x-amz-request-id (with an
+// x-amz-id-2 alongside) on the response, whether it succeeds or not, so a
+// client's report can be matched to the request's log line.
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := newRequestID()
+		w.Header().Set("x-amz-request-id", id)
+		w.Header().Set("x-amz-id-2", newHostID())
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// requestIDFrom returns the ID withRequestID gave the request, if any.
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorDocumentationURL(t *testing.T) {
+	old := errorDocsURL
+	t.Cleanup(func() { errorDocsURL = old })
+	for _, base := range []string{"", "https://docs.example.com/errors/"} {
+		errorDocsURL = base
+		w := httptest.NewRecorder()
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", "/b/k")
+
+		var doc s3ErrorResponse
+		if err := xml.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.Code != "NoSuchKey" || doc.Resource != "/b/k" || doc.RequestId == "" {
+			t.Errorf("with -error-docs-url %q: S3's elements changed: %+v", base, doc)
+		}
+		want := ""
+		if base != "" {
+			want = base + "NoSuchKey"
+		}
+		if doc.DocumentationUrl != want {
+			t.Errorf("with -error-docs-url %q: DocumentationUrl = %q, want %q", base, doc.DocumentationUrl, want)
+		}
+		if base == "" && strings.Contains(w.Body.String(), "DocumentationUrl") {
+			t.Errorf("DocumentationUrl sent without -error-docs-url: %s", w.Body)
+		}
+		// After everything S3 sends
+		if base != "" && !strings.Contains(w.Body.String(), "</RequestId><DocumentationUrl>") {
+			t.Errorf("DocumentationUrl not last: %s", w.Body)
+		}
+	}
+}
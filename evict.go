@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Objects not read for this long are deleted by the reaper (0 = disabled)
+var evictIdle time.Duration
+
+// Objects younger than this (by modification time) are never evicted
+var evictMinAge = time.Hour
+
+// How often the reaper scans the store
+var evictInterval = 5 * time.Minute
+
+// touchAccess records a read of the object at path by bumping its atime.
+// Updates are debounced to a tenth of the idle window so that hot objects
+// don't cost a metadata write on every GET. The mtime is passed through
+// unchanged so Last-Modified isn't affected.
+func touchAccess(path string, fi os.FileInfo) {
+	if evictIdle <= 0 {
+		return
+	}
+	now := time.Now()
+	if now.Sub(accessTime(fi)) < evictIdle/10 {
+		return
+	}
+	if err := os.Chtimes(path, now, fi.ModTime()); err != nil {
+		slog.Error("Updating access time failed", "path", path, "err", err)
+	}
+}
+
+// runEvictionReaper periodically deletes idle objects. It never returns.
+func runEvictionReaper() {
+	ticker := time.NewTicker(evictInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		evictIdleObjects()
+	}
+}
+
+// isIdle reports whether the object described by fi may be evicted.
+func isIdle(fi os.FileInfo, now time.Time) bool {
+	return now.Sub(fi.ModTime()) >= evictMinAge && now.Sub(accessTime(fi)) >= evictIdle
+}
+
+// evictObject deletes the idle object at path, which the walk found as fi.
+// It is locked and stated again first, and kept if it was written or read
+// in the meantime. It reports whether the object was evicted.
+func evictObject(path string, fi os.FileInfo, now time.Time) bool {
+	// Handlers lock the absolute path sanitizePath returns
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	defer lockObject(path)()
+	current, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	if !current.Mode().IsRegular() || !current.ModTime().Equal(fi.ModTime()) || current.Size() != fi.Size() || !isIdle(current, now) {
+		return false
+	}
+	if err := os.Remove(path); err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Evicting object failed", "path", path, "err", err)
+		}
+		return false
+	}
+	if err := removeMeta(path); err != nil {
+		slog.Error("Deleting metadata failed", "path", path, "err", err)
+	}
+	recordUsage(path, -current.Size())
+	return true
+}
+
+// evictIdleObjects walks the store once and removes every object that is
+// older than evictMinAge and hasn't been accessed within evictIdle.
+func evictIdleObjects() {
+	now := time.Now()
+	evicted := 0
+	err := filepath.WalkDir(storageRootDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Concurrent deletes can make entries vanish mid-walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Server state such as .txn lives in hidden top-level directories
+		if d.IsDir() && path != storageRootDir && filepath.Dir(path) == filepath.Clean(storageRootDir) && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		// Versioned buckets promise not to lose data
+		if d.IsDir() && filepath.Dir(path) == filepath.Clean(storageRootDir) && bucketVersioning(d.Name()) != "" {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if !isIdle(fi, now) {
+			return nil
+		}
+		if evictObject(path, fi, now) {
+			evicted++
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Scanning store for idle objects failed", "err", err)
+	}
+	if evicted > 0 {
+		slog.Info("Evicted idle objects", "count", evicted, "idle", evictIdle.String())
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestEvictObject(t *testing.T) {
+	root := useTempRoot(t)
+	oldIdle, oldMinAge := evictIdle, evictMinAge
+	evictIdle, evictMinAge = time.Hour, time.Hour
+	t.Cleanup(func() { evictIdle, evictMinAge = oldIdle, oldMinAge })
+
+	now := time.Now()
+	past := now.Add(-2 * time.Hour)
+	idleObject := func(name, data string) (string, os.FileInfo) {
+		path := filepath.Join(root, "b", name)
+		writeTestFile(t, path, data)
+		if err := os.Chtimes(path, past, past); err != nil {
+			t.Fatal(err)
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return path, fi
+	}
+
+	path, fi := idleObject("idle", "data")
+	if !evictObject(path, fi, now) {
+		t.Error("idle object not evicted")
+	}
+	if _, exists := readTestFile(t, path); exists {
+		t.Error("evicted object still stored")
+	}
+
+	// Written again after the walk saw it
+	path, fi = idleObject("rewritten", "data")
+	writeTestFile(t, path, "new data")
+	if err := os.Chtimes(path, past, past.Add(time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if evictObject(path, fi, now) {
+		t.Error("rewritten object evicted")
+	}
+
+	// Read after the walk saw it
+	path, fi = idleObject("read", "data")
+	if err := os.Chtimes(path, now, past); err != nil {
+		t.Fatal(err)
+	}
+	if atimeSupported && evictObject(path, fi, now) {
+		t.Error("object read since the walk evicted")
+	}
+	if _, exists := readTestFile(t, path); atimeSupported && !exists {
+		t.Error("object read since the walk deleted")
+	}
+}
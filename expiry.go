@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A PUT (or multipart upload initiation) may give its object an expiry,
+// with x-amz-expires-at as an RFC 3339 time or x-amz-ttl-seconds from now.
+// From then on the object reads as missing, and the sweeper deletes it the
+// next time it runs, as a DELETE would: into the trash if -trash-ttl is
+// set, and behind a delete marker in a versioned bucket.
+
+// How often the sweeper deletes expired objects (0 = never; they still
+// read as missing)
+var expirySweepInterval = time.Minute
+
+// requestExpiry returns when the object a request writes is to expire as
+// UnixNano, or 0 if it asks for no expiry.
+func requestExpiry(h http.Header, now time.Time) (int64, *apiError) {
+	at, ttl := h.Get("x-amz-expires-at"), h.Get("x-amz-ttl-seconds")
+	switch {
+	case at != "" && ttl != "":
+		return 0, &apiError{http.StatusBadRequest, "InvalidArgument", "Only one of x-amz-expires-at and x-amz-ttl-seconds may be given"}
+	case at != "":
+		t, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			return 0, &apiError{http.StatusBadRequest, "InvalidArgument", "x-amz-expires-at must be an RFC 3339 time"}
+		}
+		return t.UnixNano(), nil
+	case ttl != "":
+		seconds, err := strconv.ParseInt(ttl, 10, 64)
+		if err != nil || seconds <= 0 || seconds > int64(100*365*24*time.Hour/time.Second) {
+			return 0, &apiError{http.StatusBadRequest, "InvalidArgument", "x-amz-ttl-seconds must be a positive number of seconds"}
+		}
+		return now.Add(time.Duration(seconds) * time.Second).UnixNano(), nil
+	}
+	return 0, nil
+}
+
+// isExpired reports whether the object described by m has expired.
+func isExpired(m *objectMeta, now time.Time) bool {
+	return m.ExpiresAt != 0 && now.UnixNano() >= m.ExpiresAt
+}
+
+// setExpiryHeader reports the expiry recorded in m on a GET or HEAD response.
+func setExpiryHeader(w http.ResponseWriter, m *objectMeta) {
+	if m.ExpiresAt != 0 {
+		w.Header().Set("x-amz-expires-at", time.Unix(0, m.ExpiresAt).UTC().Format(time.RFC3339))
+	}
+}
+
+// runExpirySweeper periodically deletes expired objects. It never returns.
+func runExpirySweeper() {
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		sweepExpiredObjects()
+	}
+}
+
+// sweepExpiredObjects walks the store once and deletes every object whose
+// expiry has passed.
+func sweepExpiredObjects() {
+	now := time.Now()
+	root := filepath.Clean(storageRootDir)
+	swept := 0
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Concurrent deletes can make entries vanish mid-walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		// Server state, metadata included, lives in hidden top-level directories
+		if d.IsDir() && path != root && filepath.Dir(path) == root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if m := readMeta(path, fi); m == nil || !isExpired(m, now) {
+			return nil
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return nil
+		}
+		bucket, key, ok := strings.Cut(filepath.ToSlash(rel), "/")
+		if !ok {
+			return nil
+		}
+		if expireObject(bucket, objectKey(key), now) {
+			swept++
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Scanning store for expired objects failed", "err", err)
+	}
+	if swept > 0 {
+		slog.Info("Deleted expired objects", "count", swept)
+	}
+}
+
+// expireObject deletes key from bucket if it has expired by now, and
+// reports whether it did. The key goes through sanitizePath like any
+// request's, so a symlink can't lead the sweeper out of the storage root.
+func expireObject(bucket, key string, now time.Time) bool {
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		return false
+	}
+	if bucketVersioning(bucket) != "" {
+		// The content is kept as a noncurrent version, so a write racing
+		// the check below loses nothing either
+		if !objectExpired(targetPath, now) {
+			return false
+		}
+		if _, err := deleteVersioned(bucket, key, targetPath, ""); err != nil {
+			slog.Error("Deleting expired object failed", "bucket", bucket, "key", key, "err", err)
+			return false
+		}
+		return true
+	}
+	defer lockObject(targetPath)()
+	// It may have been replaced since the walk found it
+	if !objectExpired(targetPath, now) {
+		return false
+	}
+	if err := removeObject(targetPath); err != nil {
+		slog.Error("Deleting expired object failed", "bucket", bucket, "key", key, "err", err)
+		return false
+	}
+	return true
+}
+
+// objectExpired reports whether the object stored at targetPath has expired by now.
+func objectExpired(targetPath string, now time.Time) bool {
+	fi, exists, err := statObject(targetPath)
+	if err != nil || !exists {
+		return false
+	}
+	m := readMeta(targetPath, fi)
+	return m != nil && isExpired(m, now)
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// respondIfOutOfFDs turns a file descriptor exhaustion error (EMFILE/ENFILE)
+// into a 503 SlowDown with Retry-After, so clients back off instead of retrying
+// immediately. It reports whether it handled err.
+func respondIfOutOfFDs(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, syscall.EMFILE) && !errors.Is(err, syscall.ENFILE) {
+		return false
+	}
+	slog.Error("Out of file descriptors; raise the open-files limit (ulimit -n, or LimitNOFILE= for systemd) or lower request concurrency", "usage", fdUsage(), "err", err)
+	w.Header().Set("Retry-After", "1")
+	writeS3Error(w, http.StatusServiceUnavailable, "SlowDown", "Too many open files; please reduce your request rate.", r.URL.Path)
+	return true
+}
+
+// fdUsage describes the process's open descriptor count and limit, as far as
+// the platform lets us know them.
+func fdUsage() string {
+	open := "unknown"
+	// Listing /proc/self/fd needs a descriptor itself, so this fails when
+	// the process is completely out of them
+	if entries, err := os.ReadDir("/proc/self/fd"); err == nil {
+		open = strconv.Itoa(len(entries))
+	}
+	return "open=" + open + " limit=" + fdLimit()
+}
@@ -0,0 +1,16 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func fdLimit() string {
+	var lim syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &lim); err != nil {
+		return "unknown"
+	}
+	return fmt.Sprint(lim.Cur) // Cur is int64 on some BSDs
+}
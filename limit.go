@@ -0,0 +1,25 @@
+package main
+
+import "net/http"
+
+// Most requests served at once (0 = unlimited)
+var maxConcurrent int
+
+// withConcurrencyLimit admits at most maxConcurrent requests at a time.
+// Requests beyond that are not queued but answered with 503 SlowDown and
+// Retry-After, which SDKs retry with backoff, so a burst of uploads can't
+// run the process out of file descriptors or swamp the disk.
+func withConcurrencyLimit(next http.Handler) http.Handler {
+	slots := make(chan struct{}, maxConcurrent)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeS3Error(w, http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate.", r.URL.Path)
+			return
+		}
+		defer func() { <-slots }()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Upper bound (and default) for max-keys, as in S3
+const maxListKeys = 1000
+
+// Timestamp layout S3 uses in XML documents (RFC3339 with milliseconds)
+const s3TimeFormat = "2006-01-02T15:04:05.000Z"
+
+type listObject struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+	// Requested with metadata-fields (a server extension)
+	UserMetadata *listUserMetadata `xml:"UserMetadata,omitempty"`
+}
+
+type listUserMetadata struct {
+	Fields []listMetadataField `xml:"Field"`
+}
+
+type listMetadataField struct {
+	Name  string `xml:"Name"`
+	Value string `xml:"Value"`
+}
+
+// Most user metadata fields a listing may ask for with metadata-fields
+const maxListMetadataFields = 10
+
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type listBucketResult struct {
+	XMLName               xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []listObject   `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listBucketResultV1 is the ListBucketResult of ListObjects (version 1),
+// paginated by marker instead of continuation tokens.
+type listBucketResultV1 struct {
+	XMLName        xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string         `xml:"Name"`
+	Prefix         string         `xml:"Prefix"`
+	Marker         string         `xml:"Marker"`
+	NextMarker     string         `xml:"NextMarker,omitempty"`
+	Delimiter      string         `xml:"Delimiter,omitempty"`
+	MaxKeys        int            `xml:"MaxKeys"`
+	EncodingType   string         `xml:"EncodingType,omitempty"`
+	IsTruncated    bool           `xml:"IsTruncated"`
+	Contents       []listObject   `xml:"Contents"`
+	CommonPrefixes []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// listEntry is an object found while walking a bucket.
+type listEntry struct {
+	key  string
+	path string
+	info fs.FileInfo
+}
+
+// listKeyEncoder returns how keys and prefixes are to be written in a
+// listing: as they are, or URL-encoded for encoding-type=url. The AWS CLI
+// always asks for the latter and decodes what it gets, "+" as a space
+// included, so keys must be encoded for it to see them unchanged.
+func listKeyEncoder(q url.Values) (func(string) string, *apiError) {
+	switch q.Get("encoding-type") {
+	case "":
+		return func(s string) string { return s }, nil
+	case "url":
+		return func(s string) string {
+			// S3 leaves the slashes of folder-style keys as they are
+			return strings.ReplaceAll(url.QueryEscape(s), "%2F", "/")
+		}, nil
+	}
+	return nil, &apiError{http.StatusBadRequest, "InvalidArgument", "Invalid Encoding Method specified in Request"}
+}
+
+// listObjectsHandler handles GET /<bucket>?list-type=2 (ListObjectsV2) and
+// GET /<bucket> (ListObjects, version 1). Both list alike; they differ in
+// how a listing is resumed and in the document returned.
+func listObjectsHandler(w http.ResponseWriter, r *http.Request, bucket string) {
+	q := r.URL.Query()
+	encode, apiErr := listKeyEncoder(q)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	prefix := q.Get("prefix")
+	delimiter := q.Get("delimiter")
+	// Listing resumes after this key (or common prefix): in V2, the one
+	// encoded in continuation-token, else start-after; in V1, marker
+	var v2 bool
+	switch q.Get("list-type") {
+	case "":
+	case "2":
+		v2 = true
+	default:
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "list-type must be 2, or absent for version 1 listings", r.URL.Path)
+		return
+	}
+	startAfter := q.Get("start-after")
+	marker := startAfter
+	token := q.Get("continuation-token")
+	if !v2 {
+		marker = q.Get("marker")
+	} else if token != "" {
+		key, err := base64.URLEncoding.DecodeString(token)
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "The continuation token provided is incorrect", r.URL.Path)
+			return
+		}
+		marker = string(key)
+	}
+	maxKeys := maxListKeys
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer", r.URL.Path)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	since, before, apiErr := listModTimeWindow(q)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	metaFields, apiErr := listMetadataFields(q)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	order, apiErr := listSortOrder(q)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	// Pages only follow on from each other in key order
+	if !order.paginated() && (marker != "" || token != "") {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Only a listing sorted by key can be resumed", r.URL.Path)
+		return
+	}
+
+	debugLog(r, "List request", "prefix", prefix, "delimiter", delimiter)
+
+	if _, err := sanitizePath(bucket, ""); err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	// A transaction commit in progress is listed entirely or not at all
+	txnPublishLock.RLock()
+	entries, err := backend.List(bucket, prefix)
+	txnPublishLock.RUnlock()
+	if errors.Is(err, errNoSuchBucket) {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", r.URL.Path)
+		return
+	}
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Listing bucket failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+	if !order.paginated() {
+		if err := order.sort(bucket, entries); err != nil {
+			if !respondIfOutOfFDs(w, r, err) {
+				slog.Error("Sorting listing failed", "err", err)
+				writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			}
+			return
+		}
+	}
+
+	// With a delimiter, keys containing it after the prefix are rolled up
+	// into one common prefix each; objects and prefixes both count
+	// against max-keys, as in S3. Entries are sorted by key, so a page
+	// ends at a well-defined key that the next one resumes after.
+	// In another sort order, a common prefix takes the place of the first
+	// object under it.
+	// Objects outside a modified-since/modified-before window are skipped
+	// before the roll-up, so a prefix is only listed for objects in it.
+	var objects []StoredObject
+	var prefixes []commonPrefix
+	listedPrefixes := make(map[string]bool)
+	truncated := false
+	last := ""
+	for _, e := range entries {
+		if mt := e.Info.ModTime(); (!since.IsZero() && mt.Before(since)) || (!before.IsZero() && !mt.Before(before)) {
+			continue
+		}
+		cp := ""
+		if delimiter != "" {
+			if i := strings.Index(e.Key[len(prefix):], delimiter); i >= 0 {
+				cp = e.Key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if marker != "" && (e.Key <= marker || (cp != "" && cp <= marker)) {
+			continue
+		}
+		if cp != "" && listedPrefixes[cp] {
+			continue
+		}
+		if len(objects)+len(prefixes) == maxKeys {
+			truncated = true
+			break
+		}
+		if cp != "" {
+			prefixes = append(prefixes, commonPrefix{Prefix: encode(cp)})
+			listedPrefixes[cp] = true
+			last = cp
+		} else {
+			objects = append(objects, e)
+			last = e.Key
+		}
+	}
+	contents := []listObject{}
+	now := time.Now()
+	for _, e := range objects {
+		fi, meta, err := backend.Stat(bucket, e.Key)
+		if err != nil {
+			// Deleted since the walk
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if !respondIfOutOfFDs(w, r, err) {
+				slog.Error("Computing ETag failed", "err", err)
+				writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			}
+			return
+		}
+		if isExpired(meta, now) {
+			continue
+		}
+		contents = append(contents, listObject{
+			Key:          encode(e.Key),
+			LastModified: fi.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         meta.ETag,
+			Size:         contentSize(fi, meta),
+			StorageClass: storageClass(meta),
+			UserMetadata: listedUserMetadata(meta, metaFields),
+		})
+	}
+	keyCount := len(contents) + len(prefixes)
+
+	var result any
+	if v2 {
+		v2Result := listBucketResult{
+			Name:              bucket,
+			Prefix:            encode(prefix),
+			Delimiter:         encode(delimiter),
+			StartAfter:        encode(startAfter),
+			ContinuationToken: token,
+			KeyCount:          keyCount,
+			MaxKeys:           maxKeys,
+			EncodingType:      q.Get("encoding-type"),
+			IsTruncated:       truncated,
+			Contents:          contents,
+			CommonPrefixes:    prefixes,
+		}
+		// The token is the last key or prefix returned; it stays valid
+		// however the bucket changes in between
+		if truncated && order.paginated() {
+			v2Result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(last))
+		}
+		result = v2Result
+	} else {
+		v1Result := listBucketResultV1{
+			Name:           bucket,
+			Prefix:         encode(prefix),
+			Marker:         encode(marker),
+			Delimiter:      encode(delimiter),
+			MaxKeys:        maxKeys,
+			EncodingType:   q.Get("encoding-type"),
+			IsTruncated:    truncated,
+			Contents:       contents,
+			CommonPrefixes: prefixes,
+		}
+		// As in S3, only given with a delimiter; without one, clients
+		// resume after the last key listed, which is the same
+		if truncated && delimiter != "" && order.paginated() {
+			v1Result.NextMarker = encode(last)
+		}
+		result = v1Result
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Writing listing failed", "err", err)
+	}
+	debugLog(r, "Listed objects", "keys", keyCount)
+}
+
+// listModTimeWindow returns the window of modification times, RFC 3339
+// times in modified-since (inclusive) and modified-before (exclusive), a
+// listing is limited to. A bound not given is the zero time.
+func listModTimeWindow(q url.Values) (since, before time.Time, apiErr *apiError) {
+	for _, bound := range []struct {
+		name string
+		t    *time.Time
+	}{{"modified-since", &since}, {"modified-before", &before}} {
+		s := q.Get(bound.name)
+		if s == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return time.Time{}, time.Time{}, &apiError{http.StatusBadRequest, "InvalidArgument", bound.name + " must be an RFC 3339 time"}
+		}
+		*bound.t = t
+	}
+	if !since.IsZero() && !before.IsZero() && !before.After(since) {
+		return time.Time{}, time.Time{}, &apiError{http.StatusBadRequest, "InvalidArgument", "modified-before must be later than modified-since"}
+	}
+	return since, before, nil
+}
+
+// listMetadataFields returns the user metadata fields a listing is to
+// return for each object, named comma-separated in metadata-fields with or
+// without their x-amz-meta- prefix.
+func listMetadataFields(q url.Values) ([]string, *apiError) {
+	s := q.Get("metadata-fields")
+	if s == "" {
+		return nil, nil
+	}
+	var fields []string
+	for _, name := range strings.Split(s, ",") {
+		field := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(name)), userMetaPrefix)
+		if field == "" {
+			return nil, &apiError{http.StatusBadRequest, "InvalidArgument", "metadata-fields must name metadata fields, separated by commas"}
+		}
+		if !slices.Contains(fields, field) {
+			fields = append(fields, field)
+		}
+	}
+	if len(fields) > maxListMetadataFields {
+		return nil, &apiError{http.StatusBadRequest, "InvalidArgument", fmt.Sprintf("metadata-fields may name at most %d fields", maxListMetadataFields)}
+	}
+	return fields, nil
+}
+
+// listedUserMetadata returns the fields of an object's user metadata
+// asked for, in the order asked, or nil if it has none of them.
+func listedUserMetadata(m *objectMeta, fields []string) *listUserMetadata {
+	var listed []listMetadataField
+	for _, field := range fields {
+		if value, ok := m.UserMeta[field]; ok {
+			listed = append(listed, listMetadataField{Name: field, Value: value})
+		}
+	}
+	if listed == nil {
+		return nil
+	}
+	return &listUserMetadata{Fields: listed}
+}
+
+// listOrder is the order of a listing's objects, as given by the sort
+// parameter (a server extension): by key, modification time or size,
+// optionally reversed with a leading "-".
+type listOrder struct {
+	by      string
+	reverse bool
+}
+
+// listSortOrder returns the order asked for with sort, which is by key
+// when it is absent, as in S3.
+func listSortOrder(q url.Values) (listOrder, *apiError) {
+	s := q.Get("sort")
+	order := listOrder{by: strings.TrimPrefix(s, "-"), reverse: strings.HasPrefix(s, "-")}
+	switch order.by {
+	case "":
+		if order.reverse {
+			break
+		}
+		return listOrder{by: "key"}, nil
+	case "key", "mtime", "size":
+		return order, nil
+	}
+	return listOrder{}, &apiError{http.StatusBadRequest, "InvalidArgument", "sort must be key, mtime or size, optionally preceded by -"}
+}
+
+// paginated reports whether listings in this order come in pages that
+// continuation-token, start-after and marker resume: only in key order,
+// in which a page ends at a key the next one starts after.
+func (o listOrder) paginated() bool {
+	return o.by == "key" && !o.reverse
+}
+
+// sort puts entries, listed in key order, in this order. Ties keep their
+// key order. Sorting by size looks up the content size of each object,
+// which may differ from what it takes up as stored.
+func (o listOrder) sort(bucket string, entries []StoredObject) error {
+	var less func(a, b StoredObject) bool
+	switch o.by {
+	case "key":
+		less = func(a, b StoredObject) bool { return a.Key < b.Key }
+	case "mtime":
+		less = func(a, b StoredObject) bool { return a.Info.ModTime().Before(b.Info.ModTime()) }
+	case "size":
+		sizes := make(map[string]int64, len(entries))
+		for _, e := range entries {
+			fi, meta, err := backend.Stat(bucket, e.Key)
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted since the walk, and skipped when listed
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			sizes[e.Key] = contentSize(fi, meta)
+		}
+		less = func(a, b StoredObject) bool { return sizes[a.Key] < sizes[b.Key] }
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		if o.reverse {
+			return less(entries[j], entries[i])
+		}
+		return less(entries[i], entries[j])
+	})
+	return nil
+}
+
+// walkBucket returns every object in the bucket whose key starts with
+// prefix, sorted by key. Only the directory named by the prefix's folder
+// part is walked, in every shard with -shard-depth.
+func walkBucket(bucket, bucketPath, prefix string) ([]listEntry, error) {
+	folder := ""
+	if i := strings.LastIndex(prefix, "/"); i >= 0 {
+		p, err := resolvePath(bucket, prefix[:i], false)
+		if err != nil {
+			return nil, nil
+		}
+		if folder, err = filepath.Rel(bucketPath, p); err != nil {
+			return nil, err
+		}
+	}
+	roots, err := shardRoots(bucketPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []listEntry
+	for _, root := range roots {
+		walkRoot := filepath.Join(root, folder)
+		if root != bucketPath {
+			if err := checkSymlinks(bucketPath, walkRoot); err != nil {
+				return nil, nil
+			}
+		}
+		if err := walkShard(bucketPath, walkRoot, prefix, &entries); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+	return entries, nil
+}
+
+// walkShard appends to entries every object below walkRoot in the bucket
+// at bucketPath whose key starts with prefix.
+func walkShard(bucketPath, walkRoot, prefix string, entries *[]listEntry) error {
+	return filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The prefix folder may not exist, and entries can vanish mid-walk
+			if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(bucketPath, path)
+		if err != nil {
+			return err
+		}
+		key := objectKey(filepath.ToSlash(rel))
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		*entries = append(*entries, listEntry{key: key, path: path, info: info})
+		return nil
+	})
+}
+
+// objectKey maps an on-disk path relative to its bucket back to the
+// client's key, undoing sharding, -ascii-only-keys transliteration and
+// folder markers.
+func objectKey(rel string) string {
+	rel = unshardPath(rel)
+	if folder, ok := strings.CutSuffix(rel, "/"+folderMarkerName); ok {
+		rel = folder + "/"
+	}
+	if asciiOnlyKeys != "transliterate" {
+		return rel
+	}
+	key, err := url.PathUnescape(rel)
+	if err != nil {
+		// Not written by us (e.g. copied in out-of-band); report as-is
+		return rel
+	}
+	return key
+}
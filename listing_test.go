@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listBucket lists /bucket with the query, which must succeed.
+func listBucket(t *testing.T, query string) listBucketResult {
+	t.Helper()
+	w := serve(t, http.MethodGet, "/bucket?list-type=2&"+query, nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing %s: status %d: %s", query, w.Code, w.Body)
+	}
+	var result listBucketResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+// listedKeys returns the keys and then the common prefixes of a listing,
+// comma-separated.
+func listedKeys(result listBucketResult) string {
+	var ks []string
+	for _, c := range result.Contents {
+		ks = append(ks, c.Key)
+	}
+	for _, p := range result.CommonPrefixes {
+		ks = append(ks, p.Prefix)
+	}
+	return strings.Join(ks, ",")
+}
+
+func TestListModTimeWindow(t *testing.T) {
+	root := useTempRoot(t)
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i, key := range []string{"a", "dir/b", "dir/c", "d", "e"} {
+		path := filepath.Join(root, "bucket", filepath.FromSlash(key))
+		writeTestFile(t, path, key)
+		mt := base.Add(time.Duration(i) * time.Hour)
+		if err := os.Chtimes(path, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list := func(query string) listBucketResult {
+		t.Helper()
+		return listBucket(t, query)
+	}
+	keys := listedKeys
+
+	for _, tc := range []struct {
+		query, want string
+	}{
+		{"modified-since=2024-05-01T01:00:00Z", "d,dir/b,dir/c,e"},
+		{"modified-before=2024-05-01T01:00:00Z", "a"},
+		{"modified-since=2024-05-01T01:00:00Z&modified-before=2024-05-01T03:00:00Z", "dir/b,dir/c"},
+		{"modified-since=2024-05-01T02:00:00Z&prefix=dir/", "dir/c"},
+		{"modified-since=2024-05-01T03:00:00Z&delimiter=/", "d,e"},
+		{"modified-before=2024-05-01T02:00:00Z&delimiter=/", "a,dir/"},
+	} {
+		if got := keys(list(tc.query)); got != tc.want {
+			t.Errorf("listing %s = %s, want %s", tc.query, got, tc.want)
+		}
+	}
+
+	// Pages resume within the window
+	window := "modified-since=2024-05-01T01:00:00Z&modified-before=2024-05-01T04:00:00Z"
+	page := list(window + "&max-keys=2")
+	if got := keys(page); got != "d,dir/b" || !page.IsTruncated {
+		t.Fatalf("first page = %s, truncated %v", got, page.IsTruncated)
+	}
+	page = list(window + "&max-keys=2&continuation-token=" + page.NextContinuationToken)
+	if got := keys(page); got != "dir/c" || page.IsTruncated {
+		t.Errorf("second page = %s, truncated %v", got, page.IsTruncated)
+	}
+
+	empty := list("modified-since=2030-01-01T00:00:00Z")
+	if len(empty.Contents) != 0 || empty.IsTruncated || empty.KeyCount != 0 {
+		t.Errorf("listing an empty window = %+v", empty)
+	}
+
+	for _, query := range []string{
+		"modified-since=yesterday",
+		"modified-before=2024-05-01",
+		"modified-since=2024-05-01T02:00:00Z&modified-before=2024-05-01T01:00:00Z",
+		"modified-since=2024-05-01T02:00:00Z&modified-before=2024-05-01T02:00:00Z",
+	} {
+		if w := serve(t, http.MethodGet, "/bucket?"+query, nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("listing %s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestListSortOrder(t *testing.T) {
+	root := useTempRoot(t)
+	base := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	// Key, age order and size order all differ; b and c are the same size
+	for _, o := range []struct {
+		key  string
+		data string
+		age  int
+	}{
+		{"a", "xxx", 2},
+		{"b", "x", 3},
+		{"c", "x", 0},
+		{"dir/d", "xxxx", 1},
+		{"dir/e", "xx", 4},
+	} {
+		path := filepath.Join(root, "bucket", filepath.FromSlash(o.key))
+		writeTestFile(t, path, o.data)
+		mt := base.Add(-time.Duration(o.age) * time.Hour)
+		if err := os.Chtimes(path, mt, mt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		query, want string
+	}{
+		{"", "a,b,c,dir/d,dir/e"},
+		{"sort=key", "a,b,c,dir/d,dir/e"},
+		{"sort=-key", "dir/e,dir/d,c,b,a"},
+		{"sort=mtime", "dir/e,b,a,dir/d,c"},
+		{"sort=-mtime", "c,dir/d,a,b,dir/e"},
+		// Ties stay in key order
+		{"sort=size", "b,c,dir/e,a,dir/d"},
+		{"sort=-size", "dir/d,a,dir/e,b,c"},
+		{"sort=-mtime&max-keys=2", "c,dir/d"},
+		{"sort=-size&prefix=dir/", "dir/d,dir/e"},
+		// A common prefix is listed where its first object is
+		{"sort=-mtime&delimiter=/&max-keys=2", "c,dir/"},
+		{"sort=mtime&delimiter=/&max-keys=2", "b,dir/"},
+	} {
+		if got := listedKeys(listBucket(t, tc.query)); got != tc.want {
+			t.Errorf("listing %s = %s, want %s", tc.query, got, tc.want)
+		}
+	}
+
+	// Another order is truncated without a way to resume
+	page := listBucket(t, "sort=-mtime&max-keys=2")
+	if !page.IsTruncated || page.NextContinuationToken != "" {
+		t.Errorf("truncated sorted listing: truncated %v, token %q", page.IsTruncated, page.NextContinuationToken)
+	}
+	w := serve(t, http.MethodGet, "/bucket?sort=-mtime&max-keys=2", nil, nil)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "<NextMarker>") {
+		t.Errorf("sorted V1 listing = %d %s", w.Code, w.Body)
+	}
+	// Key order pages as before
+	page = listBucket(t, "sort=key&max-keys=2")
+	if page.NextContinuationToken == "" {
+		t.Fatal("no continuation token in key order")
+	}
+	if got := listedKeys(listBucket(t, "sort=key&continuation-token="+page.NextContinuationToken)); got != "c,dir/d,dir/e" {
+		t.Errorf("second page in key order = %s", got)
+	}
+
+	for _, query := range []string{
+		"list-type=2&sort=name",
+		"list-type=2&sort=-",
+		"list-type=2&sort=+size",
+		"list-type=2&sort=mtime&start-after=a",
+		"list-type=2&sort=-key&continuation-token=" + page.NextContinuationToken,
+		"sort=size&marker=a",
+	} {
+		if w := serve(t, http.MethodGet, "/bucket?"+query, nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("listing %s: status %d, want 400", query, w.Code)
+		}
+	}
+}
+
+func TestListMetadataFields(t *testing.T) {
+	useTempRoot(t)
+	for key, header := range map[string]http.Header{
+		"a": {"X-Amz-Meta-Color": {"red"}, "X-Amz-Meta-Owner": {"ann"}, "X-Amz-Meta-Size": {"l"}},
+		"b": {"X-Amz-Meta-Owner": {"bob"}},
+		"c": nil,
+	} {
+		if w := serve(t, http.MethodPut, "/bucket/"+key, strings.NewReader(key), header); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: status %d: %s", key, w.Code, w.Body)
+		}
+	}
+	fields := func(c listObject) string {
+		if c.UserMetadata == nil {
+			return "-"
+		}
+		var listed []string
+		for _, f := range c.UserMetadata.Fields {
+			listed = append(listed, f.Name+"="+f.Value)
+		}
+		return strings.Join(listed, ",")
+	}
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"-", "-", "-"}},
+		{"metadata-fields=owner", []string{"owner=ann", "owner=bob", "-"}},
+		// In the order asked, prefixed or not, whatever the case
+		{"metadata-fields=X-Amz-Meta-Owner,color,missing,owner", []string{"owner=ann,color=red", "owner=bob", "-"}},
+	} {
+		result := listBucket(t, tc.query)
+		if len(result.Contents) != 3 {
+			t.Fatalf("listing %s: %d objects", tc.query, len(result.Contents))
+		}
+		for i, c := range result.Contents {
+			if got := fields(c); got != tc.want[i] {
+				t.Errorf("listing %s: %s has %s, want %s", tc.query, c.Key, got, tc.want[i])
+			}
+		}
+	}
+
+	// Fields are left out of the document unless asked for
+	w := serve(t, http.MethodGet, "/bucket?list-type=2&metadata-fields=owner", nil, nil)
+	body := w.Body.String()
+	if !strings.Contains(body, "<UserMetadata><Field><Name>owner</Name><Value>ann</Value></Field></UserMetadata>") || strings.Count(body, "<UserMetadata>") != 2 {
+		t.Errorf("listing with metadata-fields = %s", body)
+	}
+	// Version 1 listings project them too
+	w = serve(t, http.MethodGet, "/bucket?metadata-fields=color", nil, nil)
+	if strings.Count(w.Body.String(), "<Name>color</Name>") != 1 {
+		t.Errorf("V1 listing with metadata-fields = %s", w.Body)
+	}
+
+	tooMany := "metadata-fields=f0"
+	for i := 1; i <= maxListMetadataFields; i++ {
+		tooMany += ",f" + strconv.Itoa(i)
+	}
+	for _, query := range []string{tooMany, "metadata-fields=owner,,color", "metadata-fields=x-amz-meta-"} {
+		if w := serve(t, http.MethodGet, "/bucket?list-type=2&"+query, nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("listing %s: status %d, want 400", query, w.Code)
+		}
+	}
+}
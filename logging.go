@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Fraction of successful requests whose log lines are written (1 = all)
+var logSampleRate = 1.0
+
+// Requests taking at least this long are always logged, sampled or not
+var logSlowThreshold = time.Second
+
+// setupLogging installs the default slog logger, writing to stderr in the
+// given format ("json" or "text") and dropping records below level.
+func setupLogging(format string, level slog.Level) error {
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	switch format {
+	case "json":
+		h = slog.NewJSONHandler(os.Stderr, opts)
+	case "text":
+		h = slog.NewTextHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("invalid -log-format %q: must be 'json' or 'text'", format)
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
+
+// fatal logs an error and exits; for startup failures.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+type requestLogKey struct{}
+
+// requestLog carries the per-request sampling decision. Debug records of an
+// unsampled request are held back until we know whether it failed or was slow.
+type requestLog struct {
+	sampled bool
+	pending []slog.Record
+}
+
+// debugLog logs a per-request debug record with slog-style key/value args,
+// honoring the request's sampling decision. Errors should be logged with
+// slog.Error so they are never dropped.
+func debugLog(r *http.Request, msg string, args ...any) {
+	ctx := r.Context()
+	if !slog.Default().Enabled(ctx, slog.LevelDebug) {
+		return
+	}
+	rec := slog.NewRecord(time.Now(), slog.LevelDebug, msg, 0)
+	rec.Add(args...)
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok && !rl.sampled {
+		rl.pending = append(rl.pending, rec)
+		return
+	}
+	slog.Default().Handler().Handle(ctx, rec)
+}
+
+// statusRecorder remembers the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (s *statusRecorder) WriteHeader(code int) {
+	if s.status == 0 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusRecorder) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	n, err := s.ResponseWriter.Write(b)
+	s.bytes += int64(n)
+	return n, err
+}
+
+// countingBody counts the bytes read from a request body.
+type countingBody struct {
+	io.ReadCloser
+	n int64
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+// withRequestLog writes one structured line per request once it has been
+// served. Sampling is decided up front: unsampled requests are only logged
+// (along with their debug records) if they ended in an error status or
+// exceeded logSlowThreshold.
+func withRequestLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rl := &requestLog{sampled: logSampleRate >= 1 || rand.Float64() < logSampleRate}
+		rec := &statusRecorder{ResponseWriter: w}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		start := time.Now()
+		defer trackRequest(r)()
+
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl)))
+
+		elapsed := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if accessLog != nil {
+			accessLog.write(&accessLogEntry{r: r, header: rec.Header(), status: rec.status, bytes: rec.bytes, start: start, elapsed: elapsed})
+		}
+		if !rl.sampled {
+			if rec.status < http.StatusBadRequest && elapsed < logSlowThreshold {
+				return
+			}
+			for _, p := range rl.pending {
+				slog.Default().Handler().Handle(r.Context(), p)
+			}
+		}
+		bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		slog.Info("Request",
+			"request_id", requestIDFrom(r.Context()),
+			"method", r.Method,
+			"bucket", bucket,
+			"key", key,
+			"status", rec.status,
+			"bytes_in", body.n,
+			"bytes_out", rec.bytes,
+			"duration_ms", float64(elapsed.Microseconds())/1000,
+			"remote", r.RemoteAddr,
+		)
+	})
+}
@@ -1,25 +1,191 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"flag"
 	"fmt"
+	"hash"
 	"io"
-	"log"
+	"io/fs"
+	"log/slog"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 // Storage root directory - configurable via command line
 var storageRootDir string
 
+// How non-ASCII keys are handled: "" (allow), "reject" or "transliterate"
+var asciiOnlyKeys string
+
+// Largest object accepted on upload, in bytes (0 = unlimited)
+var maxObjectSize int64
+
+// Whether a PUT with an empty body is refused rather than stored as an
+// empty object
+var rejectEmpty bool
+
+// Whether symbolic links under the storage root are followed wherever they
+// point; if not, paths that resolve outside the root are refused
+var followSymlinks bool
+
+// errSymlinkEscape is returned by sanitizePath for a path that leads out of
+// the storage root through a symbolic link.
+var errSymlinkEscape = errors.New("access denied: the path leads outside the storage root through a symbolic link")
+
+// errEntityTooLarge is returned from an upload body that runs past
+// maxObjectSize.
+var errEntityTooLarge = errors.New("object exceeds -max-object-size")
+
+// transliterateKey maps a key to an ASCII-only form for storage on disk.
+// Every byte >= 0x80 is written as %XX (its UTF-8 encoding in hex), and
+// a literal '%' becomes %25, so the mapping is reversible with plain
+// percent-decoding: "café/日記.txt" is stored as "caf%C3%A9/%E6%97%A5%E8%A8%98.txt".
+func transliterateKey(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c >= 0x80 || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// applyKeyCharset enforces the -ascii-only-keys mode on a key.
+func applyKeyCharset(key string) (string, error) {
+	switch asciiOnlyKeys {
+	case "reject":
+		for i := 0; i < len(key); i++ {
+			if key[i] >= 0x80 {
+				return "", errors.New("invalid key: non-ASCII characters are not allowed")
+			}
+		}
+	case "transliterate":
+		// Always escape, even for pure-ASCII keys, so a key containing a
+		// literal "%C3%A9" can't collide with one containing "é".
+		return transliterateKey(key), nil
+	}
+	return key, nil
+}
+
+// splitRequestPath splits a request's path into the bucket and, if there
+// is one, the key, as strings.SplitN would. It works on the path as the
+// client sent it (EscapedPath): the bucket ends at the first literal "/",
+// and each part is then percent-decoded exactly once, so "my%20file.txt"
+// names "my file.txt" and a decoded "%2F" can't move the bucket boundary.
+// "+" stays a plus sign, as in S3: only query strings use it for spaces.
+func splitRequestPath(r *http.Request) []string {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/", 2)
+	for i, part := range parts {
+		decoded, err := url.PathUnescape(part)
+		if err != nil {
+			// EscapedPath only returns valid escapes; fall back regardless
+			return strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+		}
+		parts[i] = decoded
+	}
+	return parts
+}
+
+// Longest key S3 accepts, in bytes of UTF-8
+const maxKeyLength = 1024
+
+// validateKey checks a key the way S3 does and returns it normalized: "."
+// segments and empty segments are dropped and ".." removes the segment
+// before it, as the router does for URL paths, so a key given in a request
+// body or header names the same object as it would in a URL.
+func validateKey(key string) (string, *apiError) {
+	if len(key) > maxKeyLength {
+		return "", &apiError{http.StatusBadRequest, "KeyTooLongError", "Your key is too long"}
+	}
+	if !utf8.ValidString(key) {
+		return "", &apiError{http.StatusBadRequest, "InvalidArgument", "Object key must be valid UTF-8"}
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x20 || key[i] == 0x7f {
+			return "", &apiError{http.StatusBadRequest, "InvalidArgument", "Object key must not contain NUL or control characters"}
+		}
+	}
+
+	var segments []string
+	for _, s := range strings.Split(key, "/") {
+		switch s {
+		case "", ".":
+		case "..":
+			if len(segments) == 0 {
+				return "", &apiError{http.StatusBadRequest, "InvalidArgument", "Object key resolves outside its bucket"}
+			}
+			segments = segments[:len(segments)-1]
+		default:
+			segments = append(segments, s)
+		}
+	}
+	if len(segments) == 0 {
+		return "", &apiError{http.StatusBadRequest, "InvalidArgument", "Object key must name an object"}
+	}
+	normalized := strings.Join(segments, "/")
+	if strings.HasSuffix(key, "/") {
+		normalized += "/"
+	}
+	return normalized, nil
+}
+
 // sanitizePath takes a bucket name and a key (possibly containing slashes),
-// and returns the absolute path where that object should live.
-// It also verifies no “../” path-traversal escapes the root.
+// and returns the absolute path where that object should live, below its
+// shard directories with -shard-depth. It also verifies no “../”
+// path-traversal escapes the root.
 func sanitizePath(bucket, key string) (string, error) {
+	return resolvePath(bucket, key, true)
+}
+
+// resolvePath is sanitizePath, leaving out the shard directories unless
+// sharded is set.
+func resolvePath(bucket, key string, sharded bool) (string, error) {
+	key, err := applyKeyCharset(key)
+	if err != nil {
+		return "", err
+	}
+
+	// Names starting with "." are reserved for server state such as .txn
+	if strings.HasPrefix(bucket, ".") {
+		return "", errors.New("invalid bucket: names starting with '.' are reserved")
+	}
+	for _, segment := range strings.Split(key, "/") {
+		if isTempFile(segment) {
+			return "", errors.New("invalid key: names starting with " + tempFilePrefix + " are reserved")
+		}
+		if segment == folderMarkerName {
+			return "", errors.New("invalid key: " + folderMarkerName + " is reserved")
+		}
+	}
+
 	// Join bucket and key under storageRootDir
 	joined := filepath.Join(storageRootDir, bucket, key)
+	if key != "" && strings.HasSuffix(key, "/") {
+		joined = filepath.Join(joined, folderMarkerName)
+	}
 	// Clean the path (e.g. remove “..” segments)
 	cleaned := filepath.Clean(joined)
 
@@ -34,215 +200,1554 @@ func sanitizePath(bucket, key string) (string, error) {
 	}
 
 	// Ensure absTarget is under absRoot
-	if !strings.HasPrefix(absTarget, absRoot+string(os.PathSeparator)) && absTarget != absRoot {
+	if !isWithin(absRoot, absTarget) {
 		return "", errors.New("invalid path: path traversal detected")
 	}
+	// Keys given in request bodies and headers (batch delete, copy source)
+	// haven't been cleaned by the router; they must not climb out of their bucket
+	if key != "" {
+		bucketDir := filepath.Join(absRoot, bucket)
+		if !isWithin(bucketDir, absTarget) || absTarget == bucketDir {
+			return "", errors.New("invalid key: the key resolves outside its bucket")
+		}
+		if sharded && shardDepth > 0 {
+			rel, err := filepath.Rel(bucketDir, absTarget)
+			if err != nil {
+				return "", err
+			}
+			absTarget = filepath.Join(bucketDir, shardPath(rel))
+		}
+	}
+	if err := checkSymlinks(absRoot, absTarget); err != nil {
+		return "", err
+	}
 	return absTarget, nil
 }
 
+// checkSymlinks returns errSymlinkEscape if, unless -follow-symlinks is
+// set, symbolic links lead absTarget outside absRoot.
+func checkSymlinks(absRoot, absTarget string) error {
+	if followSymlinks {
+		return nil
+	}
+	realRoot, err := resolveExisting(absRoot)
+	if err != nil {
+		return err
+	}
+	realTarget, err := resolveExisting(absTarget)
+	if err != nil {
+		return err
+	}
+	if !isWithin(realRoot, realTarget) {
+		return errSymlinkEscape
+	}
+	return nil
+}
+
+// resolveExisting evaluates the symbolic links in the longest existing
+// prefix of p and appends the rest, so a path about to be created resolves
+// to where it would be created.
+func resolveExisting(p string) (string, error) {
+	var rest []string
+	for {
+		resolved, err := filepath.EvalSymlinks(p)
+		if err == nil {
+			return filepath.Join(append([]string{resolved}, rest...)...), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) && !errors.Is(err, syscall.ENOTDIR) {
+			return "", err
+		}
+		parent := filepath.Dir(p)
+		if parent == p {
+			return p, nil
+		}
+		rest = append([]string{filepath.Base(p)}, rest...)
+		p = parent
+	}
+}
+
+// writePathError answers a request whose bucket or key sanitizePath
+// refused.
+func writePathError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, errSymlinkEscape) {
+		slog.Warn("Refused a path leading outside the storage root", "path", r.URL.Path)
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "Access Denied", r.URL.Path)
+		return
+	}
+	writeS3Error(w, http.StatusBadRequest, "InvalidArgument", err.Error(), r.URL.Path)
+}
+
+// isWithin reports whether target is dir or below it. Both must be clean
+// absolute paths. Unlike a string prefix test, it doesn't take a sibling
+// such as /data/store-evil to be inside /data/store.
+func isWithin(dir, target string) bool {
+	rel, err := filepath.Rel(dir, target)
+	if err != nil || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(os.PathSeparator))
+}
+
+// Uploads in progress are written to files named with this prefix next to
+// their target (or in stagingDirName); listings and scans skip them
+const tempFilePrefix = ".s3fs-tmp-"
+
+func isTempFile(name string) bool {
+	return strings.HasPrefix(name, tempFilePrefix)
+}
+
+// A key ending in "/", such as the S3 console creates for an empty folder,
+// is stored in a file of this name in the folder's directory
+const folderMarkerName = ".s3fs-folder"
+
+// S3 subresources we recognize but don't implement, with the feature they belong to.
+// Requests naming one get 501 rather than being served as a plain object request.
+var unsupportedSubresources = map[string]string{
+	"torrent": "BitTorrent distribution",
+}
+
+// rejectUnsupportedSubresource answers 501 if the query names an unsupported
+// subresource, and reports whether it did.
+func rejectUnsupportedSubresource(w http.ResponseWriter, r *http.Request) bool {
+	query := r.URL.Query()
+	for sub, feature := range unsupportedSubresources {
+		if _, ok := query[sub]; ok {
+			writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "The ?"+sub+" subresource ("+feature+") is not supported", r.URL.Path)
+			return true
+		}
+	}
+	return false
+}
+
+// contentTypeFor picks the Content-Type served for an object: the type
+// given when it was uploaded, else the type registered for its extension
+// (-mime-types-file, then Go's built-in table), else the bucket's configured
+// default, else application/octet-stream.
+func contentTypeFor(bucket, key string, m *objectMeta) string {
+	if m.ContentType != "" {
+		return m.ContentType
+	}
+	if ct := mime.TypeByExtension(filepath.Ext(key)); ct != "" {
+		return ct
+	}
+	if ct := bucketConfigs[bucket].DefaultContentType; ct != "" {
+		return ct
+	}
+	return "application/octet-stream"
+}
+
 // uploadHandler handles PUT /<bucket>/<key...>
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	// Only accept PUT
-	if r.Method != http.MethodPut {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	// e.g. /my-bucket/folder/file.txt → "my-bucket", "folder/file.txt"
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
 		return
 	}
 
-	// Trim leading slash, then split off the bucket name
-	// e.g. /my-bucket/folder/file.txt → ["my-bucket", "folder/file.txt"]
-	trimmed := strings.TrimPrefix(r.URL.Path, "/")
-	parts := strings.SplitN(trimmed, "/", 2)
-	if len(parts) < 1 || parts[0] == "" {
-		http.Error(w, "Bad Request: missing bucket", http.StatusBadRequest)
+	// Resolve and sanitize filesystem path
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		writePathError(w, r, err)
 		return
 	}
-	bucket := parts[0]
-	var key string
-	if len(parts) == 2 {
-		key = parts[1]
-	} else {
-		// If no key provided (e.g. “PUT /my-bucket/”), treat as empty key,
-		// but we don’t allow empty keys. Return 400.
-		http.Error(w, "Bad Request: missing key", http.StatusBadRequest)
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
 		return
 	}
 
-	log.Printf("Debug: %s request received for bucket=%s, key=%s", r.Method, bucket, key)
+	// Every check that doesn't need the body comes before the first read of
+	// it and before anything is written, so a client that sent Expect:
+	// 100-continue is refused without transmitting the body (net/http only
+	// sends the 100 once the handler reads). Those decided by headers alone
+	// come first; then those needing the object's lock.
+	if maxObjectSize > 0 && r.ContentLength > maxObjectSize {
+		writeS3Error(w, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", r.URL.Path)
+		return
+	}
+	// A copy has no body by design, nor has a folder marker
+	if rejectEmpty && r.ContentLength == 0 && r.Header.Get("x-amz-copy-source") == "" && !strings.HasSuffix(key, "/") {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", "The request body is empty; this server refuses empty objects.", r.URL.Path)
+		return
+	}
 
-	// Resolve and sanitize filesystem path
-	targetPath, err := sanitizePath(bucket, key)
+	meta := metaFromRequest(r.Header)
+	if meta == nil {
+		writeS3Error(w, http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size", r.URL.Path)
+		return
+	}
+	wantMD5, err := requestContentMD5(r)
 	if err != nil {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		writeS3Error(w, http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was not valid", r.URL.Path)
+		return
+	}
+	checksum, apiErr := requestChecksum(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	expiresAt, apiErr := requestExpiry(r.Header, time.Now())
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	class, apiErr := requestStorageClass(r.Header)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	// Within a transaction the object is written to a staging file and only
+	// published on commit; otherwise writePath is chosen below
+	var writePath string
+	var t *txn
+	if id := r.Header.Get("x-txn-id"); id != "" {
+		var apiErr *apiError
+		if t, apiErr = lookupTxn(id, bucket); t == nil {
+			writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+			return
+		}
+		if !t.beginWrite() {
+			writeS3Error(w, http.StatusNotFound, "NoSuchTransaction", "The specified transaction does not exist: "+id, r.URL.Path)
+			return
+		}
+		defer t.endWrite()
+		writePath = t.newStagedFile()
+	}
+
+	// A key can't be both an object and a folder prefix of other objects
+	if fi, err := os.Stat(targetPath); err == nil && fi.IsDir() {
+		writeS3Error(w, http.StatusConflict, "KeyConflict", "Key "+key+" is a folder prefix of existing objects", r.URL.Path)
 		return
 	}
 
-	// Ensure the parent directory exists
-	parentDir := filepath.Dir(targetPath)
-	if err := os.MkdirAll(parentDir, 0o755); err != nil {
-		log.Printf("Error creating directories: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// Conditional writes (If-None-Match: *, If-Match) against the current object
+	defer lockObject(targetPath)()
+	if !checkWritePreconditions(w, r, bucket, key) {
 		return
 	}
 
-	// Create/truncate the file and stream the request body into it
-	f, err := os.Create(targetPath)
+	// In a versioned bucket the upload is written next to the object's
+	// history, and only replaces the current version once it is complete
+	versioned := t == nil && bucketVersioning(bucket) != ""
+	// Bytes of the bucket's usage the write frees: the object it replaces,
+	// unless that is kept as a noncurrent version or, for a staged write,
+	// stays in place until the commit
+	var replaced int64
+	if !versioned && t == nil {
+		replaced = objectSize(targetPath)
+	}
+	if versioned {
+		if writePath, err = versionStagingFile(bucket, targetPath); err != nil {
+			slog.Error("Creating version staging file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+	}
+
+	// A server-side copy takes its content from the source object instead
+	// of the request body
+	var body io.Reader = r.Body
+	var src *copySource
+	if r.Header.Get("x-amz-copy-source") != "" {
+		if src = openCopySource(w, r); src == nil {
+			return
+		}
+		defer src.file.Close()
+		if src.path == targetPath {
+			writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "This copy request is illegal because it is trying to copy an object to itself.", r.URL.Path)
+			return
+		}
+		body = src.content
+		// There is no request body for a Content-MD5 or checksum to
+		// describe; a checksum algorithm alone is computed afresh
+		wantMD5 = nil
+		if checksum != nil {
+			checksum.want, checksum.trailer = "", false
+		}
+		// As in S3, the source's metadata is kept unless asked to replace it
+		if r.Header.Get("x-amz-metadata-directive") != "REPLACE" {
+			copied := src.meta
+			meta = &copied
+		} else {
+			// Tags and checksums are not metadata; S3 copies them either way
+			meta.Tags = src.meta.Tags
+			meta.ChecksumAlgorithm, meta.Checksum = src.meta.ChecksumAlgorithm, src.meta.Checksum
+		}
+	}
+	if expiresAt != 0 {
+		meta.ExpiresAt = expiresAt
+	}
+	// A copy is STANDARD unless it asks otherwise, as in S3
+	meta.StorageClass = class
+	// Also cuts off chunked bodies and clients that send more than announced
+	if maxObjectSize > 0 {
+		body = &sizeLimitedReader{r: body, remaining: maxObjectSize}
+	}
+	// Room in the bucket quota is reserved up front when the size is
+	// known, and a body of unknown size is cut off where it runs out
+	size := r.ContentLength
+	if src != nil {
+		size = src.size
+	}
+	quota, handled := respondIfOverQuota(w, r, bucket, size, replaced)
+	if handled {
+		return
+	}
+	defer quota.release()
+	if quota != nil {
+		body = &quotaReader{r: body, q: quota}
+	}
+
+	// Versions and transactions are written to a file of their own first,
+	// whose directory and the object's must exist; a plain PUT leaves that
+	// to the backend
+	if writePath != "" {
+		parentDir := filepath.Dir(targetPath)
+		if t != nil {
+			parentDir = filepath.Dir(writePath)
+		}
+		if err := makeDirs(parentDir); err != nil {
+			if errors.Is(err, syscall.ENOTDIR) {
+				writeS3Error(w, http.StatusConflict, "KeyConflict", "A parent of key "+key+" is an existing object", r.URL.Path)
+				return
+			}
+			if respondIfDiskFull(w, r, err) {
+				return
+			}
+			slog.Error("Creating directories failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+	}
+	// The object's history is only created for an upload being written,
+	// and goes again with a failed one, so a refused upload can't leave
+	// the bucket looking versioned
+	if versioned {
+		historyDir := filepath.Dir(writePath)
+		if err := makeDirs(historyDir); err != nil {
+			if respondIfDiskFull(w, r, err) {
+				return
+			}
+			slog.Error("Creating directories failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		// Only removed while empty: a published version keeps it
+		defer os.Remove(historyDir)
+	}
+
+	// The body is hashed for the ETag (and any checksum) as it streams to
+	// storage, compressed and encrypted on the way as configured. A plain
+	// PUT goes to the backend, which only replaces the object once the
+	// body has been read and checked in full, so readers never see a
+	// partial object and a failed upload leaves the previous one intact.
+	content, err := newUploadReader(body, checksum)
 	if err != nil {
-		log.Printf("Error creating file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		slog.Error("Writing file failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
 		return
 	}
-	defer f.Close()
+	var checksumErr *apiError
+	content.check = func() error {
+		if src == nil {
+			if err := checkBodyLength(r, content.n); err != nil {
+				return err
+			}
+		}
+		if wantMD5 != nil && !bytes.Equal(content.md5.Sum(nil), wantMD5) {
+			return errBadDigest
+		}
+		meta.ETag = "\"" + hex.EncodeToString(content.md5.Sum(nil)) + "\""
+		// A copy is stored as the server does now, whatever the source was
+		meta.Encrypted = content.encrypted
+		meta.Compressed, meta.ContentSize = content.compressed, 0
+		if content.compressed {
+			meta.ContentSize = content.n
+		}
+		if checksum != nil {
+			value, apiErr := checksum.verify(r)
+			if apiErr != nil {
+				checksumErr = apiErr
+				return errChecksumMismatch
+			}
+			meta.ChecksumAlgorithm, meta.Checksum = checksum.alg.name, value
+		}
+		return nil
+	}
 
-	// Copy body to file (streaming)
-	if _, err := io.Copy(f, r.Body); err != nil {
-		log.Printf("Error writing file: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	var fi fs.FileInfo
+	var versionID string
+	switch {
+	case versioned:
+		fi, versionID, err = storeVersion(bucket, key, targetPath, writePath, content, meta)
+	case t != nil:
+		fi, err = writeStagedFile(writePath, content)
+	default:
+		fi, err = backend.Put(bucket, key, content, meta)
+	}
+	copied := content.n
+	if err != nil {
+		if errors.Is(err, errChecksumMismatch) {
+			writeS3Error(w, checksumErr.status, checksumErr.code, checksumErr.message, r.URL.Path)
+			return
+		}
+		writeUploadError(w, r, err, bucket, key, copied, src != nil)
 		return
 	}
+	quota.settle(fi.Size() - replaced)
+	if t != nil {
+		t.stage(key, targetPath, writePath, meta)
+	}
+	// Content bytes, and what they take up as stored
+	debugLog(r, "Stored object", "bucket", bucket, "key", key, "bytes", copied, "stored_bytes", fi.Size())
 
-	log.Printf("Debug: Successfully processed %s request for bucket=%s, key=%s", r.Method, bucket, key)
+	setVersionHeaders(w, versionID, false)
+	if src != nil {
+		if src.versionID != "" {
+			w.Header().Set("x-amz-copy-source-version-id", src.versionID)
+		}
+		writeCopyResult(w, "CopyObjectResult", meta.ETag, fi.ModTime())
+		return
+	}
 
-	// Respond with 204 No Content (same as S3 when no ETag/key metadata is returned)
+	// Respond with 204 No Content, carrying the ETag of the stored object
+	w.Header().Set("ETag", meta.ETag)
+	if checksum != nil {
+		w.Header().Set(checksum.alg.header, meta.Checksum)
+	}
 	w.WriteHeader(http.StatusNoContent)
 }
 
 // downloadHandler handles GET /<bucket>/<key...>
 func downloadHandler(w http.ResponseWriter, r *http.Request) {
-	// Only accept GET
-	if r.Method != http.MethodGet {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
 		return
 	}
 
-	trimmed := strings.TrimPrefix(r.URL.Path, "/")
-	parts := strings.SplitN(trimmed, "/", 2)
-	if len(parts) < 1 || parts[0] == "" {
-		http.Error(w, "Bad Request: missing bucket", http.StatusBadRequest)
+	if !refererAllowed(bucket, r) {
+		slog.Info("Blocked hotlinked request", "method", r.Method, "bucket", bucket, "key", key, "referer", r.Referer())
+		writeS3Error(w, http.StatusForbidden, "AccessDenied", "Hotlinking is not allowed for this bucket", r.URL.Path)
 		return
 	}
-	bucket := parts[0]
-	var key string
-	if len(parts) == 2 {
-		key = parts[1]
-	} else {
-		http.Error(w, "Bad Request: missing key", http.StatusBadRequest)
+	if err := checkResponseOverrides(r.URL.Query()); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", err.Error(), r.URL.Path)
 		return
 	}
 
-	log.Printf("Debug: %s request received for bucket=%s, key=%s", r.Method, bucket, key)
-
 	targetPath, err := sanitizePath(bucket, key)
 	if err != nil {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		writePathError(w, r, err)
+		return
+	}
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	// ?versionId= reads an older version in a versioned bucket
+	ref, apiErr := readVersion(bucket, targetPath, r.URL.Query().Get("versionId"))
+	setVersionHeaders(w, ref.versionID, ref.deleteMarker)
+	setReadVersionAllow(w, apiErr)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
 		return
 	}
 
-	// Open the file
-	f, err := os.Open(targetPath)
+	// Open the file; a transaction commit in progress is seen entirely or not at all
+	txnPublishLock.RLock()
+	f, fi, meta, err := ref.open(bucket, key, targetPath)
+	txnPublishLock.RUnlock()
 	if err != nil {
-		if os.IsNotExist(err) {
-			http.Error(w, "Not Found", http.StatusNotFound)
+		if respondIfOutOfFDs(w, r, err) {
+			return
+		}
+		// Also a folder prefix, or a key below an existing object
+		if errors.Is(err, fs.ErrNotExist) {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", r.URL.Path)
 		} else {
-			log.Printf("Error opening file: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			slog.Error("Opening file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
 		}
 		return
 	}
 	defer f.Close()
 
-	// Optionally, set Content-Type based on file extension,
-	// but here we default to application/octet-stream for simplicity.
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(key)+"\"")
+	// An expired object is gone, whether or not the sweeper got to it yet
+	if r.URL.Query().Get("versionId") == "" && isExpired(meta, time.Now()) {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", r.URL.Path)
+		return
+	}
+	content, size, err := objectContent(f, fi, meta)
+	if err != nil {
+		slog.Error("Opening object failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	w.Header().Set("ETag", meta.ETag)
+	setLastModified(w, fi.ModTime())
+	w.Header().Set("Accept-Ranges", "bytes")
+	if !checkReadPreconditions(w, r, meta.ETag, fi.ModTime()) {
+		return
+	}
+	// A check before anything is sent takes a read of its own, of the
+	// whole object whatever part of it is asked for
+	checkFirst := verifyOnRead && verifyOnReadMismatch != "abort" && contentVerifiable(meta)
+	if checkFirst {
+		intact, err := checkContent(content, bucket, key, meta)
+		if err != nil {
+			slog.Error("Verifying object failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		if !intact {
+			if verifyOnReadMismatch == "fail" {
+				writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+				return
+			}
+			w.Header().Set("Warning", corruptWarning)
+		}
+	}
+
+	// Serve a single byte range if one was asked for, and is still wanted
+	// after If-Range
+	rangeHeader := r.Header.Get("Range")
+	if !ifRangeMatches(r, meta.ETag, fi.ModTime()) {
+		rangeHeader = ""
+	}
+	start, length, partial, err := parseRange(rangeHeader, size)
+	if err != nil {
+		w.Header().Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		writeS3Error(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable", r.URL.Path)
+		return
+	}
+	var body io.Reader = content
+	status := http.StatusOK
+	if partial {
+		if _, err := content.Seek(start, io.SeekStart); err != nil {
+			slog.Error("Seeking file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		body = io.LimitReader(content, length)
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, start+length-1, size))
+	} else {
+		length = size
+	}
+	// A compressed object goes out as stored to clients that can
+	// decompress it themselves
+	if meta.Compressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	gzipped := sendCompressed(r, meta, partial)
+	if gzipped {
+		if body, length, err = compressedContent(f, fi, meta); err != nil {
+			slog.Error("Opening object failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	w.Header().Set("Content-Type", contentTypeFor(bucket, key, meta))
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	setMetaHeaders(w, meta)
+	setExpiryHeader(w, meta)
+	// The checksum describes the content, not the gzip stream
+	setChecksumHeader(w, r, meta, partial || gzipped)
+	setResponseOverrides(w, r)
+	w.WriteHeader(status)
+
+	// Optional read-ahead of the following objects (server extension)
+	if n := prefetchCount(r.Header.Get("x-prefetch-next")); n > 0 {
+		startPrefetch(bucket, key, targetPath, n)
+	}
+
+	// Stream the file (or the requested slice of it) back. A whole object
+	// not checked yet is checked against its ETag on the way with
+	// -verify-on-read, which can only fail it by cutting the connection
+	// short, the status being sent already.
+	if verifyOnRead && !checkFirst && !partial && !gzipped {
+		body = newVerifyingReader(body, length, bucket, key, meta)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		if errors.Is(err, errCorruptObject) {
+			panic(http.ErrAbortHandler)
+		}
+		slog.Error("Streaming file failed", "err", err)
+	}
+}
+
+// headHandler handles HEAD /<bucket>/<key...>
+func headHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		w.WriteHeader(apiErr.status)
+		return
+	}
+
+	if !refererAllowed(bucket, r) {
+		slog.Info("Blocked hotlinked request", "method", r.Method, "bucket", bucket, "key", key, "referer", r.Referer())
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err := checkResponseOverrides(r.URL.Query()); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	targetPath, err := sanitizePath(bucket, key)
+	if errors.Is(err, errSymlinkEscape) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		w.WriteHeader(apiErr.status)
+		return
+	}
+
+	// HEAD responses carry no body, so errors are reported by status alone
+	ref, apiErr := readVersion(bucket, targetPath, r.URL.Query().Get("versionId"))
+	setVersionHeaders(w, ref.versionID, ref.deleteMarker)
+	setReadVersionAllow(w, apiErr)
+	if apiErr != nil {
+		w.WriteHeader(apiErr.status)
+		return
+	}
+	// A transaction commit in progress is seen entirely or not at all
+	txnPublishLock.RLock()
+	fi, meta, err := ref.stat(bucket, key, targetPath)
+	txnPublishLock.RUnlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Stating file failed", "err", err)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		return
+	}
+	if r.URL.Query().Get("versionId") == "" && isExpired(meta, time.Now()) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	setLastModified(w, fi.ModTime())
+	w.Header().Set("ETag", meta.ETag)
+	w.Header().Set("Accept-Ranges", "bytes")
+	if !checkReadPreconditions(w, r, meta.ETag, fi.ModTime()) {
+		return
+	}
+	w.Header().Set("Content-Type", contentTypeFor(bucket, key, meta))
+	w.Header().Set("Content-Length", strconv.FormatInt(contentSize(fi, meta), 10))
+	if meta.Compressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+	}
+	gzipped := sendCompressed(r, meta, false)
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Set("Content-Length", strconv.FormatInt(compressedSize(fi, meta), 10))
+	}
+	setMetaHeaders(w, meta)
+	setExpiryHeader(w, meta)
+	setChecksumHeader(w, r, meta, gzipped)
+	setResponseOverrides(w, r)
 	w.WriteHeader(http.StatusOK)
 
-	// Stream the file back
-	if _, err := io.Copy(w, f); err != nil {
-		log.Printf("Error streaming file: %v", err)
+}
+
+// Query parameters that override a GET or HEAD response header, as in S3.
+// Objects are otherwise served without Content-Disposition, so browsers may
+// display them inline.
+var responseOverrides = map[string]string{
+	"response-content-type":        "Content-Type",
+	"response-content-disposition": "Content-Disposition",
+	"response-cache-control":       "Cache-Control",
+	"response-content-language":    "Content-Language",
+	"response-content-encoding":    "Content-Encoding",
+	"response-expires":             "Expires",
+}
+
+// checkResponseOverrides validates the response-* query parameters, so a
+// value that isn't a valid header is refused rather than sent.
+func checkResponseOverrides(q url.Values) error {
+	for param := range responseOverrides {
+		v := q.Get(param)
+		if v == "" {
+			continue
+		}
+		for i := 0; i < len(v); i++ {
+			if c := v[i]; (c < ' ' && c != '\t') || c == 0x7f {
+				return fmt.Errorf("%s contains a control character", param)
+			}
+		}
+		if param == "response-content-type" {
+			if _, _, err := mime.ParseMediaType(v); err != nil {
+				return fmt.Errorf("%s is not a valid media type", param)
+			}
+		}
 	}
-	log.Printf("Debug: Successfully processed %s request for bucket=%s, key=%s", r.Method, bucket, key)
+	return nil
 }
 
-// deleteHandler handles DELETE /<bucket>/<key...>
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
-	// Only accept DELETE
-	if r.Method != http.MethodDelete {
-		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+// setResponseOverrides applies the headers requested with response-* query
+// parameters, which checkResponseOverrides has accepted.
+func setResponseOverrides(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	for param, header := range responseOverrides {
+		if v := q.Get(param); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+}
+
+// requestContentMD5 decodes the request's Content-MD5 header, returning nil
+// if there is none.
+func requestContentMD5(r *http.Request) ([]byte, error) {
+	h := r.Header.Get("Content-MD5")
+	if h == "" {
+		return nil, nil
+	}
+	sum, err := base64.StdEncoding.DecodeString(h)
+	if err != nil {
+		return nil, err
+	}
+	if len(sum) != md5.Size {
+		return nil, errors.New("Content-MD5 is not an MD5 digest")
+	}
+	return sum, nil
+}
+
+// sizeLimitedReader fails with errEntityTooLarge once more than remaining
+// bytes are read, whatever Content-Length claimed.
+type sizeLimitedReader struct {
+	r         io.Reader
+	remaining int64
+	err       error // returned past the limit instead of errEntityTooLarge
+}
+
+func (l *sizeLimitedReader) Read(p []byte) (int, error) {
+	// One byte past the limit is enough to tell the body is too large
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = 0
+		if l.err != nil {
+			return n, l.err
+		}
+		return n, errEntityTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// uploadAborted reports whether an error reading r's body means the client
+// disconnected or sent less than its Content-Length, rather than a fault of
+// ours.
+func uploadAborted(r *http.Request, err error) bool {
+	return r.Context().Err() != nil || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errIncompleteBody)
+}
+
+// errIncompleteBody is returned by checkBodyLength for a body that ended
+// before its Content-Length.
+var errIncompleteBody = errors.New("request body is shorter than its Content-Length")
+
+// checkBodyLength returns errIncompleteBody unless n, the bytes read from
+// r's body until it ended, is what r declared. net/http already fails a
+// short HTTP/1.x body with io.ErrUnexpectedEOF; this also holds for bodies
+// that end early without an error.
+func checkBodyLength(r *http.Request, n int64) error {
+	if r.ContentLength >= 0 && n != r.ContentLength {
+		return errIncompleteBody
+	}
+	return nil
+}
+
+// writeUploadError answers an upload that failed with err, from reading
+// its body (of which copied bytes of content arrived, from a copy's source
+// if copy) or from storing it.
+func writeUploadError(w http.ResponseWriter, r *http.Request, err error, bucket, key string, copied int64, copy bool) {
+	if errors.Is(err, errContentSHA256Mismatch) {
+		writeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match what was computed", r.URL.Path)
+		return
+	}
+	if errors.Is(err, errEntityTooLarge) {
+		debugLog(r, "Discarded upload over -max-object-size", "bucket", bucket, "key", key, "bytes_received", copied, "max_object_size", maxObjectSize)
+		writeS3Error(w, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", r.URL.Path)
+		return
+	}
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaExceeded(w, r, bucket)
+		return
+	}
+	if errors.Is(err, errBadDigest) {
+		writeS3Error(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received", r.URL.Path)
+		return
+	}
+	if respondIfChunkError(w, r, err) || respondIfRequestTimeout(w, r, err) {
+		return
+	}
+	// Usually nobody is left to read the response, but the log tells an
+	// aborted upload from a failing disk
+	if !copy && uploadAborted(r, err) {
+		slog.Info("Upload aborted by client", "bucket", bucket, "key", key, "err", err)
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.", r.URL.Path)
 		return
 	}
+	if errors.Is(err, syscall.ENOTDIR) {
+		writeS3Error(w, http.StatusConflict, "KeyConflict", "A parent of key "+key+" is an existing object", r.URL.Path)
+		return
+	}
+	if errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.EEXIST) {
+		writeS3Error(w, http.StatusConflict, "KeyConflict", "Key "+key+" is a folder prefix of existing objects", r.URL.Path)
+		return
+	}
+	if respondIfOutOfFDs(w, r, err) || respondIfDiskFull(w, r, err) {
+		return
+	}
+	slog.Error("Storing object failed", "err", err)
+	writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+}
+
+// errBadDigest and errChecksumMismatch end an upload whose content doesn't
+// match its Content-MD5 or additional checksum.
+var (
+	errBadDigest        = errors.New("content does not match Content-MD5")
+	errChecksumMismatch = errors.New("content does not match its checksum")
+)
+
+// uploadReader reads an upload's body as it is to be stored: compressed
+// with -compress and encrypted with -encryption-key. The content is
+// hashed on the way, and at its end check is run, whose error takes the
+// place of io.EOF, so that a backend discards an upload that fails it.
+type uploadReader struct {
+	body  io.Reader
+	check func() error
+
+	in      io.Writer    // takes the content
+	closers []io.Closer  // flush what in holds back, innermost first
+	out     bytes.Buffer // what is to be stored, ready to be read
+	chunk   [32 << 10]byte
+	err     error
+
+	md5                   hash.Hash
+	n                     int64 // content bytes read from body
+	encrypted, compressed bool
+}
+
+// newUploadReader returns an uploadReader of body, also hashing it into
+// checksum's hash if there is one.
+func newUploadReader(body io.Reader, checksum *uploadChecksum) (*uploadReader, error) {
+	u := &uploadReader{body: body, md5: md5.New()}
+	var stored io.Writer = &u.out
+	if objectCipher != nil {
+		enc, err := newEncryptingWriter(stored)
+		if err != nil {
+			return nil, err
+		}
+		stored, u.encrypted = enc, true
+		u.closers = append(u.closers, enc)
+	}
+	if compressObjects {
+		gz, err := newCompressingWriter(stored)
+		if err != nil {
+			return nil, err
+		}
+		stored, u.compressed = gz, true
+		// Flushed into the encryption before it is
+		u.closers = append([]io.Closer{gz}, u.closers...)
+	}
+	writers := []io.Writer{stored, u.md5}
+	if checksum != nil {
+		writers = append(writers, checksum.hash)
+	}
+	u.in = io.MultiWriter(writers...)
+	return u, nil
+}
+
+func (u *uploadReader) Read(p []byte) (int, error) {
+	for u.out.Len() == 0 && u.err == nil {
+		u.fill()
+	}
+	if u.out.Len() > 0 {
+		return u.out.Read(p)
+	}
+	return 0, u.err
+}
 
-	trimmed := strings.TrimPrefix(r.URL.Path, "/")
-	parts := strings.SplitN(trimmed, "/", 2)
-	if len(parts) < 1 || parts[0] == "" {
-		http.Error(w, "Bad Request: missing bucket", http.StatusBadRequest)
+// fill moves the next chunk of the body to out, or ends the content.
+func (u *uploadReader) fill() {
+	n, err := u.body.Read(u.chunk[:])
+	u.n += int64(n)
+	if _, werr := u.in.Write(u.chunk[:n]); werr != nil {
+		u.err = werr
 		return
 	}
-	bucket := parts[0]
-	var key string
-	if len(parts) == 2 {
-		key = parts[1]
-	} else {
-		http.Error(w, "Bad Request: missing key", http.StatusBadRequest)
+	if err != io.EOF {
+		u.err = err
 		return
 	}
+	for _, c := range u.closers {
+		if err := c.Close(); err != nil {
+			u.err = err
+			return
+		}
+	}
+	if u.err = io.EOF; u.check != nil {
+		if err := u.check(); err != nil {
+			u.err = err
+		}
+	}
+}
+
+// fileMeta returns the metadata that can be recovered from an object's file
+// alone: the quoted hex MD5 of its content, as S3 uses for single-part
+// objects, and whether the file holds that encrypted or compressed.
+func fileMeta(path string) (*objectMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m := &objectMeta{}
+	var content io.ReadSeeker = f
+	if m.Encrypted = isEncryptedFile(f); m.Encrypted {
+		fi, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if content, err = newDecryptingReader(f, fi.Size()); err != nil {
+			return nil, err
+		}
+	}
+	var magic [len(gzipMagic)]byte
+	n, err := io.ReadFull(content, magic[:])
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	m.Compressed = string(magic[:n]) == gzipMagic
+	if _, err := content.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if m.Compressed {
+		// The size is only known once it has all been decompressed
+		if content, err = newDecompressingReader(content, -1); err != nil {
+			return nil, err
+		}
+	}
+	h := md5.New()
+	size, err := io.Copy(h, content)
+	if err != nil {
+		return nil, err
+	}
+	if m.Compressed {
+		m.ContentSize = size
+	}
+	m.ETag = "\"" + hex.EncodeToString(h.Sum(nil)) + "\""
+	return m, nil
+}
 
-	log.Printf("Debug: %s request received for bucket=%s, key=%s", r.Method, bucket, key)
+// deleteHandler handles DELETE /<bucket>/<key...>
+func deleteHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
 
 	targetPath, err := sanitizePath(bucket, key)
 	if err != nil {
-		http.Error(w, "Invalid path", http.StatusBadRequest)
+		writePathError(w, r, err)
+		return
+	}
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
 		return
 	}
 
-	// Delete the file
-	if err := os.Remove(targetPath); err != nil {
-		if os.IsNotExist(err) {
-			// S3 returns 204 even if object doesn't exist
-			w.WriteHeader(http.StatusNoContent)
-		} else {
-			log.Printf("Error deleting file: %v", err)
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// Compare-and-delete with If-Match; the check and the delete happen
+	// under the same lock, so a write can't slip in between
+	defer lockObject(targetPath)()
+	if !checkDeletePreconditions(w, r, bucket, key) {
+		return
+	}
+
+	// A versioned bucket keeps what is deleted, behind a delete marker,
+	// unless a specific version is deleted
+	versionID := r.URL.Query().Get("versionId")
+	if bucketVersioning(bucket) != "" {
+		res, err := deleteVersionedLocked(bucket, key, targetPath, versionID)
+		if err != nil {
+			slog.Error("Deleting version failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
 		}
+		setVersionHeaders(w, res.versionID, res.deleteMarker)
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if versionID != "" && versionID != nullVersionID {
+		writeS3Error(w, http.StatusNotFound, "NoSuchVersion", "The specified version does not exist.", r.URL.Path)
 		return
 	}
 
-	log.Printf("Debug: Successfully processed %s request for bucket=%s, key=%s", r.Method, bucket, key)
+	if err := backend.Delete(bucket, key); err != nil {
+		slog.Error("Deleting file failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
 
-	// Successfully deleted - return 204 No Content (S3 compatible)
+	// Return 204 No Content (S3 compatible), whether or not the object existed
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteObject removes the object stored at targetPath and its metadata.
+// A missing object is not an error, as in S3.
+func deleteObject(targetPath string) error {
+	// A folder prefix is not an object; like a missing key, there is
+	// nothing to delete (and we must not rmdir it)
+	fi, statErr := os.Stat(targetPath)
+	if statErr == nil && fi.IsDir() {
+		return nil
+	}
+
+	if err := os.Remove(targetPath); err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return nil
+		}
+		return err
+	}
+	if statErr == nil {
+		recordUsage(targetPath, -fi.Size())
+	}
+
+	if err := removeMeta(targetPath); err != nil {
+		slog.Error("Deleting metadata failed", "err", err)
+	}
+	return nil
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "presign" {
+		os.Exit(runPresign(os.Args[2:]))
+	}
+
 	// Parse command line arguments
-	if len(os.Args) < 2 {
-		fmt.Fprintf(os.Stderr, "Usage: %s <storage-root-path>\n", os.Args[0])
+	addr := flag.String("addr", ":8080", "address to listen on, e.g. 127.0.0.1:9000 (default from S3FS_ADDR if set)")
+	flag.StringVar(&storageRootDir, "root", "", "storage root directory (may instead be given as the first argument, or in S3FS_ROOT)")
+	flag.Float64Var(&logSampleRate, "log-sample-rate", 1, "fraction (0-1) of successful requests to log; errors and slow requests are always logged")
+	logLevel := slog.LevelInfo
+	flag.TextVar(&logLevel, "log-level", logLevel, "minimum level of log records to write: debug, info, warn or error")
+	logFormat := flag.String("log-format", "json", "log output format: 'json' or 'text'")
+	flag.BoolVar(&traceRequests, "trace", false, "log every request on arrival with its headers, query parameters and resolved filesystem path, credentials redacted")
+	accessLogPath := flag.String("access-log", "", "file to append an access log line per request to, reopened on SIGHUP; empty writes none")
+	accessLogFormat := flag.String("access-log-format", "common", "access log line format: 'common', 'combined' or an Apache LogFormat string such as '%h %t \"%r\" %>s %b %D'")
+	flag.DurationVar(&logSlowThreshold, "log-slow-threshold", time.Second, "requests taking at least this long are logged regardless of sampling")
+	flag.StringVar(&asciiOnlyKeys, "ascii-only-keys", "", "handling of non-ASCII keys: 'reject' (400) or 'transliterate' (reversible %XX escaping); empty allows full Unicode")
+	flag.Int64Var(&bucketQuota, "bucket-quota", 0, "most bytes of objects each bucket may hold (0 = unlimited)")
+	flag.Uint64Var(&minFreeInodes, "min-free-inodes", 0, "refuse writes with 507 while the filesystem of the storage root has fewer free inodes than this (0 = no check)")
+	flag.Int64Var(&spoolThreshold, "spool-threshold", spoolThreshold, "bytes of a request body needed whole (DeleteObjects and CompleteMultipartUpload documents, form upload files) kept in memory; larger ones are spooled to a temp file in <storage-root>/.staging")
+	flag.Int64Var(&maxObjectSize, "max-object-size", 0, "largest object accepted on upload, in bytes (0 = unlimited)")
+	flag.BoolVar(&useStaging, "staging", false, "write uploads in progress to <storage-root>/.staging rather than next to their target, so filesystem watchers of the buckets only see finished objects")
+	flag.IntVar(&renameRetries, "rename-retries", renameRetries, "times to retry publishing a written object when the rename fails with EBUSY or ESTALE, as network filesystems may report transiently")
+	flag.IntVar(&maxConcurrent, "max-concurrent", 0, "most requests served at once; more are answered with 503 SlowDown (0 = unlimited)")
+	flag.IntVar(&prefetchMax, "prefetch-max", 0, "maximum number of following objects an x-prefetch-next GET hint may read ahead (0 disables prefetching)")
+	flag.BoolVar(&rejectEmpty, "reject-empty", false, "answer PUTs with an empty body (Content-Length: 0) and no x-amz-copy-source with 400 IncompleteBody instead of storing an empty object")
+	flag.BoolVar(&webdavEnabled, "webdav", false, "also serve WebDAV (PROPFIND, MKCOL, OPTIONS) for mounting the store in desktop clients")
+	flag.IntVar(&shardDepth, "shard-depth", 0, "store objects this many directory levels (0-3) below their bucket, named by hash, to keep directories small; fixed once a storage root holds objects")
+	flag.BoolVar(&requireBucket, "require-bucket", false, "answer object requests for buckets not created with PUT /<bucket> with 404 NoSuchBucket instead of creating them on first write")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "follow symbolic links under the storage root even where they lead outside it")
+	dirModeFlag := flag.String("dir-mode", "0755", "octal permissions of the directories created under the storage root, applied regardless of the umask")
+	fileModeFlag := flag.String("file-mode", "0644", "octal permissions of the object and metadata files created under the storage root, applied regardless of the umask")
+	h2cEnabled := flag.Bool("h2c", false, "also accept HTTP/2 over plain HTTP (h2c), with prior knowledge or an Upgrade: h2c, for h2-aware proxies in front")
+	flag.BoolVar(&strictHTTP, "strict-http", false, "reject requests with conflicting Content-Length/Transfer-Encoding headers (request smuggling defense)")
+	bucketConfigPath := flag.String("bucket-config", "", "path to a JSON file with per-bucket settings")
+	policyPath := flag.String("policy-file", "", "path to a JSON file mapping buckets to the HTTP methods allowed on them, reloaded on SIGHUP; empty allows everything")
+	flag.DurationVar(&evictIdle, "evict-idle", 0, "delete objects not read within this duration (0 disables idle eviction)")
+	flag.DurationVar(&evictMinAge, "evict-min-age", time.Hour, "never evict objects modified more recently than this")
+	flag.DurationVar(&evictInterval, "evict-interval", 5*time.Minute, "how often to scan for idle objects")
+	flag.DurationVar(&expirySweepInterval, "expiry-sweep-interval", expirySweepInterval, "how often to delete objects whose x-amz-expires-at or x-amz-ttl-seconds has passed (0 = never; they still read as missing)")
+	flag.DurationVar(&trashTTL, "trash-ttl", 0, "keep deleted objects from unversioned buckets in the trash this long, restorable with POST ?undelete (0 = delete immediately)")
+	mimeTypesPath := flag.String("mime-types-file", "", "path to an Apache mime.types or JSON (extension -> type) file extending the built-in content type table")
+	flag.StringVar(&accessKey, "access-key", "", "access key ID clients must sign requests with (AWS Signature V4); authentication is disabled if unset")
+	flag.StringVar(&secretKey, "secret-key", "", "secret access key matching -access-key")
+	flag.BoolVar(&debugSigV4, "debug-sigv4", false, "log the canonical request and string to sign the server computed when a signature doesn't match")
+	flag.BoolVar(&presignedURLs, "presigned-urls", true, "with -access-key, also accept requests presigned in the query string")
+	flag.StringVar(&errorDocsURL, "error-docs-url", "", "base URL error codes are appended to for a DocumentationUrl in error documents, e.g. https://docs.example.com/errors/; empty leaves it out")
+	corsOrigin := flag.String("cors-origin", "", "origins allowed to make cross-origin (CORS) requests: * or a comma-separated list such as https://app.example.com; empty disables CORS")
+	encryptionKey := flag.String("encryption-key", "", "256-bit key, as 64 hex digits, to encrypt object content at rest with (AES-256-GCM); empty stores content as sent")
+	encryptionKeyFile := flag.String("encryption-key-file", "", "file holding the -encryption-key, as 64 hex digits or 32 raw bytes")
+	flag.BoolVar(&verifyOnRead, "verify-on-read", false, "check objects read whole against their ETag as they are sent, cutting the connection short when the content doesn't match")
+	flag.StringVar(&verifyOnReadMismatch, "verify-on-read-mismatch", verifyOnReadMismatch, "with -verify-on-read, what a GET of a corrupt object gets: 'abort' (checked while sent, connection cut at the end), 'fail' (checked first, 500 InternalError) or 'warn' (checked first, served with a Warning header)")
+	flag.BoolVar(&compressObjects, "compress", false, "gzip-compress new objects as they are stored, serving them decompressed (or as is to clients accepting gzip)")
+	flag.StringVar(&baseDomain, "base-domain", "", "domain whose subdomains name buckets for virtual-hosted-style requests, e.g. s3.example.com; empty accepts path-style requests only")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate file to serve HTTPS with (requires -tls-key)")
+	tlsKey := flag.String("tls-key", "", "PEM private key file matching -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version to accept: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma-separated TLS 1.2 cipher suites to offer, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256; empty uses Go's defaults (TLS 1.3 suites are not configurable)")
+	flag.BoolVar(&httpsOnly, "https-only", false, "with -tls-cert, redirect requests made over plain HTTP (on -http-addr) to HTTPS rather than serving them")
+	flag.BoolVar(&httpsRedirect, "https-redirect", true, "with -https-only, redirect plain HTTP requests with 301; false refuses them with 403")
+	httpAddr := flag.String("http-addr", "", "with -https-only, also listen for plain HTTP on this address, e.g. :80, answering only with redirects to HTTPS")
+	publicBaseURLFlag := flag.String("public-base-url", "", "base URL absolute object URLs in responses, such as the Location of a completed multipart upload, are built on path-style, e.g. https://s3.example.com; empty uses the request's scheme and host")
+	bucketURLMap := flag.String("bucket-url-map", "", "comma-separated bucket=URL pairs, such as photos=https://photos.example.com, of buckets served under hostnames of their own; their object URLs are the URL and the key, ahead of -public-base-url")
+	publicURLFlag := flag.String("public-url", "", "base URL clients reach the server at over HTTPS, e.g. https://s3.example.com, for -https-only redirects; empty keeps the request's host on the port of -addr")
+	flag.DurationVar(&hstsMaxAge, "hsts-max-age", 0, "with -tls-cert, send Strict-Transport-Security with this max-age on every response (0 = no header)")
+	adminAddr := flag.String("admin-addr", "", "separate address to serve /metrics, /healthz, /readyz, /admin/stats and /_rebuild on, e.g. 127.0.0.1:9090; empty serves the first three on -addr")
+	flag.IntVar(&metricsBucketLabels, "metrics-bucket-labels", metricsBucketLabels, "most distinct buckets to label request metrics with; requests to others are counted under bucket=\"other\" (0 = no per-bucket labels)")
+	flag.StringVar(&adminToken, "admin-token", "", "bearer token every request to -admin-addr must carry (Authorization: Bearer <token>); empty requires none")
+	flag.DurationVar(&readHeaderTimeout, "read-header-timeout", readHeaderTimeout, "how long a client may take to send a request's headers (0 = no limit)")
+	flag.DurationVar(&readTimeout, "read-timeout", 0, "how long a client may take to send a whole request, body included (0 = no limit; -min-upload-rate still applies)")
+	flag.DurationVar(&writeTimeout, "write-timeout", 0, "how long writing a response may take, from the end of the request's headers (0 = no limit)")
+	flag.DurationVar(&idleTimeout, "idle-timeout", idleTimeout, "how long a keep-alive connection may wait for its next request (0 = no limit)")
+	flag.Int64Var(&minUploadRate, "min-upload-rate", minUploadRate, "least average rate, in bytes per second, request bodies must arrive at after -min-upload-grace; slower uploads are cut off with 400 RequestTimeout (0 = no minimum)")
+	flag.DurationVar(&minUploadGrace, "min-upload-grace", minUploadGrace, "how long a request body may take before -min-upload-rate applies")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "on SIGINT/SIGTERM, how long to wait for in-flight requests before closing their connections, logging which requests that interrupts")
+	flag.DurationVar(&txnTimeout, "txn-timeout", 15*time.Minute, "abort multi-object transactions left uncommitted for longer than this")
+	flag.DurationVar(&uploadExpiry, "multipart-expiry", uploadExpiry, "abort multipart uploads neither completed nor aborted this long after they were started (0 = never)")
+	flag.IntVar(&maxPartNumber, "multipart-max-parts", maxPartNumber, "highest part number, and so most parts, a multipart upload may have")
+	flag.Int64Var(&minPartSize, "multipart-min-part-size", minPartSize, "smallest size in bytes of every part of a completed multipart upload but the last (0 = no minimum)")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] -root <storage-root-path>\n       %s [flags] <storage-root-path>\n       %s presign [flags] /<bucket>/<key>\n", os.Args[0], os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	// The root and address come from a flag, else the environment, else the
+	// default. The storage root used to be the only argument; keep accepting
+	// it that way, ahead of the environment.
+	setFlags := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { setFlags[f.Name] = true })
+	rootSource := "flag"
+	if storageRootDir == "" {
+		storageRootDir, rootSource = flag.Arg(0), "argument"
+	}
+	if storageRootDir == "" {
+		storageRootDir, rootSource = os.Getenv("S3FS_ROOT"), "env"
+	}
+	addrSource := "default"
+	if setFlags["addr"] {
+		addrSource = "flag"
+	} else if env := os.Getenv("S3FS_ADDR"); env != "" {
+		*addr, addrSource = env, "env"
+	}
+	if storageRootDir == "" {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	if err := setupLogging(*logFormat, logLevel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
-	storageRootDir = os.Args[1]
+
+	if logSampleRate < 0 || logSampleRate > 1 {
+		fatal("Invalid -log-sample-rate: must be between 0 and 1", "value", logSampleRate)
+	}
+	if spoolThreshold < 0 {
+		fatal("Invalid -spool-threshold: must not be negative", "value", spoolThreshold)
+	}
+	if maxObjectSize < 0 {
+		fatal("Invalid -max-object-size: must not be negative", "value", maxObjectSize)
+	}
+	if errorDocsURL != "" {
+		if u, err := url.Parse(errorDocsURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fatal("Invalid -error-docs-url: must be an http or https URL", "value", errorDocsURL)
+		}
+	}
+	if renameRetries < 0 {
+		fatal("Invalid -rename-retries: must not be negative", "value", renameRetries)
+	}
+	if shardDepth < 0 || shardDepth > maxShardDepth {
+		fatal("Invalid -shard-depth: must be between 0 and 3", "value", shardDepth)
+	}
+	for name, d := range map[string]time.Duration{"read-header-timeout": readHeaderTimeout, "read-timeout": readTimeout, "write-timeout": writeTimeout, "idle-timeout": idleTimeout, "min-upload-grace": minUploadGrace} {
+		if d < 0 {
+			fatal("Invalid -"+name+": must not be negative", "value", d.String())
+		}
+	}
+	if adminToken != "" && *adminAddr == "" {
+		fatal("Invalid -admin-token: requires -admin-addr")
+	}
+	if minUploadRate < 0 {
+		fatal("Invalid -min-upload-rate: must not be negative", "value", minUploadRate)
+	}
+	if metricsBucketLabels < 0 {
+		fatal("Invalid -metrics-bucket-labels: must not be negative", "value", metricsBucketLabels)
+	}
+	if maxConcurrent < 0 {
+		fatal("Invalid -max-concurrent: must not be negative", "value", maxConcurrent)
+	}
+	if verifyOnReadMismatch != "abort" && verifyOnReadMismatch != "fail" && verifyOnReadMismatch != "warn" {
+		fatal("Invalid -verify-on-read-mismatch: must be 'abort', 'fail' or 'warn'", "value", verifyOnReadMismatch)
+	}
+	if asciiOnlyKeys != "" && asciiOnlyKeys != "reject" && asciiOnlyKeys != "transliterate" {
+		fatal("Invalid -ascii-only-keys: must be 'reject' or 'transliterate'", "value", asciiOnlyKeys)
+	}
+	if (accessKey == "") != (secretKey == "") {
+		fatal("-access-key and -secret-key must be given together")
+	}
+	if *corsOrigin != "" {
+		var err error
+		if corsOrigins, err = parseCORSOrigins(*corsOrigin); err != nil {
+			fatal("Invalid CORS configuration", "err", err)
+		}
+	}
+	var err error
+	if dirMode, err = parseMode(*dirModeFlag, 0o700); err != nil {
+		fatal("Invalid -dir-mode: "+err.Error(), "value", *dirModeFlag)
+	}
+	if fileMode, err = parseMode(*fileModeFlag, 0o600); err != nil {
+		fatal("Invalid -file-mode: "+err.Error(), "value", *fileModeFlag)
+	}
+	baseDomain = strings.Trim(strings.ToLower(baseDomain), ".")
+	if strings.ContainsAny(baseDomain, "/:") {
+		fatal("Invalid -base-domain: must be a host name without scheme or port", "value", baseDomain)
+	}
+	if *accessLogPath != "" {
+		var err error
+		if accessLog, err = openAccessLog(*accessLogPath, *accessLogFormat); err != nil {
+			fatal("Unable to open access log", "err", err)
+		}
+		slog.Info("Writing access log", "path", *accessLogPath, "format", *accessLogFormat)
+		go accessLog.reopenOnSIGHUP()
+	}
+	if *encryptionKey != "" && *encryptionKeyFile != "" {
+		fatal("-encryption-key and -encryption-key-file are mutually exclusive")
+	}
+	if *encryptionKey != "" || *encryptionKeyFile != "" {
+		if err := loadEncryptionKey(*encryptionKey, *encryptionKeyFile); err != nil {
+			fatal("Invalid encryption key", "err", err)
+		}
+		slog.Info("Encrypting stored objects")
+	}
+	if compressObjects {
+		slog.Info("Compressing stored objects")
+	}
+	// Strict mode only understands HTTP/1.x framing
+	if *h2cEnabled && strictHTTP {
+		fatal("-h2c cannot be combined with -strict-http")
+	}
+	var tlsConfig *tls.Config
+	if (*tlsCert == "") != (*tlsKey == "") {
+		fatal("-tls-cert and -tls-key must be given together")
+	}
+	if *tlsCert != "" {
+		// A TLS-terminating proxy in front may well disagree on framing,
+		// but the inspector can't see it: below the TLS layer it reads
+		// encrypted records, and a wrapper around the *tls.Conn hides it
+		// from net/http, which then neither fills in r.TLS nor negotiates
+		// HTTP/2 (whose framing it doesn't follow anyway)
+		if strictHTTP {
+			fatal("-strict-http cannot be combined with -tls-cert; terminate TLS at the proxy instead")
+		}
+		if *h2cEnabled {
+			fatal("-h2c cannot be combined with -tls-cert, which negotiates HTTP/2 itself")
+		}
+		var err error
+		if tlsConfig, err = loadTLSConfig(*tlsCert, *tlsKey, *tlsMinVersion, *tlsCiphers); err != nil {
+			fatal("Invalid TLS configuration", "err", err)
+		}
+	}
+	if *tlsCiphers != "" && tlsConfig == nil {
+		fatal("-tls-ciphers requires -tls-cert")
+	}
+	if httpsOnly && tlsConfig == nil {
+		fatal("-https-only requires -tls-cert: detecting plain HTTP needs the server to terminate TLS")
+	}
+	if *httpAddr != "" && !httpsOnly {
+		fatal("-http-addr requires -https-only")
+	}
+	if hstsMaxAge < 0 {
+		fatal("Invalid -hsts-max-age: must not be negative", "value", hstsMaxAge.String())
+	}
+	if hstsMaxAge > 0 && tlsConfig == nil {
+		fatal("-hsts-max-age requires -tls-cert")
+	}
+	if *publicBaseURLFlag != "" {
+		u, err := parseBaseURL(*publicBaseURLFlag)
+		if err != nil {
+			fatal("Invalid -public-base-url: "+err.Error(), "value", *publicBaseURLFlag)
+		}
+		publicBaseURL = u
+	}
+	if *bucketURLMap != "" {
+		urls, err := parseBucketURLMap(*bucketURLMap)
+		if err != nil {
+			fatal("Invalid -bucket-url-map: "+err.Error(), "value", *bucketURLMap)
+		}
+		bucketURLs = urls
+	}
+	if *publicURLFlag != "" {
+		u, err := parsePublicURL(*publicURLFlag)
+		if err != nil {
+			fatal("Invalid -public-url: "+err.Error(), "value", *publicURLFlag)
+		}
+		publicURL = u
+	}
+	if _, port, err := net.SplitHostPort(*addr); err == nil {
+		httpsPort = port
+	}
+
+	if *bucketConfigPath != "" {
+		configs, err := loadBucketConfig(*bucketConfigPath)
+		if err != nil {
+			fatal("Unable to load bucket config", "err", err)
+		}
+		bucketConfigs = configs
+		slog.Info("Loaded bucket settings", "buckets", len(configs), "file", *bucketConfigPath)
+	}
+	if *policyPath != "" {
+		policy, err := loadPolicy(*policyPath)
+		if err != nil {
+			fatal("Unable to load bucket policy", "err", err)
+		}
+		activePolicy.Store(&policy)
+		slog.Info("Loaded bucket policy", "buckets", len(policy), "file", *policyPath)
+		go reloadPolicyOnSIGHUP(*policyPath)
+	}
+
+	if *mimeTypesPath != "" {
+		n, err := loadMimeTypesFile(*mimeTypesPath)
+		if err != nil {
+			fatal("Unable to load MIME types", "err", err)
+		}
+		slog.Info("Loaded content type mappings", "mappings", n, "file", *mimeTypesPath)
+	}
 
 	// Ensure storage root exists
-	if err := os.MkdirAll(storageRootDir, 0o755); err != nil {
-		log.Fatalf("Unable to create storage root '%s': %v", storageRootDir, err)
-	}
-
-	// Use DefaultServeMux; register a single catch-all handler
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		switch r.Method {
-		case http.MethodPut:
-			uploadHandler(w, r)
-		case http.MethodGet:
-			downloadHandler(w, r)
-		case http.MethodDelete:
-			deleteHandler(w, r)
-		default:
-			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	if err := makeDirs(storageRootDir); err != nil {
+		fatal("Unable to create storage root", "root", storageRootDir, "err", err)
+	}
+	if err := checkShardLayout(); err != nil {
+		fatal("Unable to use storage root", "root", storageRootDir, "err", err)
+	}
+	if shardDepth > 0 {
+		slog.Info("Sharding objects", "shard_depth", shardDepth)
+	}
+	// Request bodies are spooled there even without -staging
+	if err := prepareStagingDir(); err != nil {
+		fatal("Unable to create staging directory", "err", err)
+	}
+	if useStaging {
+		slog.Info("Staging writes", "dir", filepath.Join(storageRootDir, stagingDirName))
+	}
+
+	if err := recoverTxns(); err != nil {
+		fatal("Unable to clear stale transactions", "err", err)
+	}
+	go runTxnJanitor()
+
+	if uploadExpiry < 0 {
+		fatal("Invalid -multipart-expiry: must not be negative", "value", uploadExpiry.String())
+	}
+	if maxPartNumber < 1 {
+		fatal("Invalid -multipart-max-parts: must be positive", "value", maxPartNumber)
+	}
+	if minPartSize < 0 {
+		fatal("Invalid -multipart-min-part-size: must not be negative", "value", minPartSize)
+	}
+	if err := loadUploads(); err != nil {
+		fatal("Unable to load multipart uploads", "err", err)
+	}
+	if uploadExpiry > 0 {
+		go runUploadJanitor()
+	}
+
+	if evictIdle > 0 {
+		if !atimeSupported {
+			fatal("-evict-idle is not supported on this platform: file access times are unavailable")
+		}
+		if evictInterval <= 0 {
+			fatal("Invalid -evict-interval: must be positive", "value", evictInterval.String())
+		}
+		slog.Info("Idle eviction enabled", "idle", evictIdle.String(), "min_age", evictMinAge.String(), "interval", evictInterval.String())
+		go runEvictionReaper()
+	}
+	if expirySweepInterval < 0 {
+		fatal("Invalid -expiry-sweep-interval: must not be negative", "value", expirySweepInterval.String())
+	}
+	if expirySweepInterval > 0 {
+		go runExpirySweeper()
+	}
+	if trashTTL < 0 {
+		fatal("Invalid -trash-ttl: must not be negative", "value", trashTTL.String())
+	}
+	if trashTTL > 0 {
+		slog.Info("Keeping deleted objects in the trash", "ttl", trashTTL.String())
+		go runTrashPurger()
+	}
+
+	var api http.Handler = http.HandlerFunc(serveAPI)
+	if *policyPath != "" {
+		api = withPolicy(api)
+	}
+	if baseDomain != "" {
+		api = withVirtualHost(api)
+		slog.Info("Accepting virtual-hosted-style requests", "base_domain", baseDomain)
+	}
+	if accessKey != "" {
+		api = withSigV4(api)
+		slog.Info("Requiring AWS Signature V4 authentication", "access_key", accessKey)
+	}
+	if len(corsOrigins) > 0 {
+		api = withCORS(api)
+		slog.Info("Allowing cross-origin requests", "origins", corsOrigins)
+	}
+	if maxConcurrent > 0 {
+		api = withConcurrencyLimit(api)
+		slog.Info("Limiting concurrent requests", "max_concurrent", maxConcurrent)
+	}
+	api = withRequestLog(withMetrics(api))
+	if traceRequests {
+		api = withTrace(api)
+		slog.Info("Tracing requests")
+	}
+	api = withRequestID(api)
+	admin := newAdminMux()
+	if *adminAddr == "" {
+		// Routed ahead of the catch-all so they aren't taken for buckets
+		for _, path := range []string{"/metrics", "/healthz", "/readyz"} {
+			http.Handle(path, plainGetOr(admin, api))
+		}
+	}
+	http.Handle("/", api)
+
+	slog.Info("Starting S3-FS-Go", "addr", *addr, "addr_source", addrSource, "root", storageRootDir, "root_source", rootSource, "tls", tlsConfig != nil)
+	ln, err := net.Listen("tcp", *addr)
+	if err != nil {
+		fatal("Server failed", "err", err)
+	}
+	var handler http.Handler = http.DefaultServeMux
+	if strictHTTP {
+		ln = strictListener{ln}
+		handler = withStrictHTTP(handler)
+		slog.Info("Strict HTTP framing checks enabled")
+	}
+	if minUploadRate > 0 {
+		handler = withMinUploadRate(handler)
+	}
+	if httpsOnly || hstsMaxAge > 0 {
+		handler = withHTTPSOnly(handler)
+	}
+	slog.Info("Connection timeouts", "read_header", readHeaderTimeout.String(), "read", readTimeout.String(), "write", writeTimeout.String(), "idle", idleTimeout.String(), "min_upload_rate", minUploadRate, "min_upload_grace", minUploadGrace.String())
+	server := &http.Server{
+		Handler:           handler,
+		ConnContext:       strictConnContext,
+		ConnState:         countConn,
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+	if *h2cEnabled {
+		// Registered with the server so shutdown sends h2c connections a
+		// GOAWAY, as it would over TLS
+		h2s := &http2.Server{}
+		if err := http2.ConfigureServer(server, h2s); err != nil {
+			fatal("Configuring HTTP/2 failed", "err", err)
+		}
+		server.Handler = h2c.NewHandler(handler, h2s)
+		slog.Info("Accepting HTTP/2 over plain HTTP (h2c)")
+	}
+
+	// With -admin-addr, metrics and probes get a listener of their own, so
+	// they can stay off the network the API is exposed on
+	var adminServer *http.Server
+	if *adminAddr != "" {
+		adminLn, err := net.Listen("tcp", *adminAddr)
+		if err != nil {
+			fatal("Admin server failed", "err", err)
+		}
+		// Only here, where no bucket can be named /admin
+		admin.HandleFunc("/admin/stats", statsHandler)
+		admin.HandleFunc("/_rebuild", rebuildHandler)
+		var adminHandler http.Handler = admin
+		if adminToken != "" {
+			adminHandler = withAdminToken(admin)
 		}
-	})
+		adminServer = &http.Server{
+			Handler:  adminHandler,
+			ErrorLog: slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		}
+		slog.Info("Serving metrics, health probes and storage statistics", "admin_addr", *adminAddr, "token_required", adminToken != "")
+		go func() {
+			if err := adminServer.Serve(adminLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("Admin server failed", "err", err)
+			}
+		}()
+	}
+
+	// With -http-addr, plain HTTP is only accepted to send clients to HTTPS
+	var httpServer *http.Server
+	if *httpAddr != "" {
+		httpLn, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			fatal("Plain HTTP server failed", "err", err)
+		}
+		httpServer = &http.Server{
+			Handler:           withHTTPSOnly(http.NotFoundHandler()),
+			ReadHeaderTimeout: readHeaderTimeout,
+			IdleTimeout:       idleTimeout,
+			ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		}
+		slog.Info("Sending plain HTTP requests to HTTPS", "http_addr", *httpAddr, "redirect", httpsRedirect)
+		go func() {
+			if err := httpServer.Serve(httpLn); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				fatal("Plain HTTP server failed", "err", err)
+			}
+		}()
+	}
+
+	// On SIGINT/SIGTERM stop accepting connections and let in-flight
+	// requests finish, so uploads aren't cut off mid-write
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		if tlsConfig != nil {
+			// The certificate is already in TLSConfig
+			serveErr <- server.ServeTLS(ln, "", "")
+			return
+		}
+		serveErr <- server.Serve(ln)
+	}()
+
+	select {
+	case err := <-serveErr:
+		fatal("Server failed", "err", err)
+	case <-ctx.Done():
+	}
+	stop() // a second signal kills the process immediately
 
-	addr := ":8080"
-	log.Printf("Starting S3-FS-Go on %s, storing at %s", addr, storageRootDir)
-	log.Printf("Debug: Server configured with handlers for PUT, GET, DELETE methods")
-	if err := http.ListenAndServe(addr, nil); err != nil {
-		log.Fatalf("Server failed: %v", err)
+	slog.Info("Shutting down: waiting for in-flight requests", "timeout", shutdownTimeout.String())
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	if adminServer != nil {
+		// Probes fail from here on, telling the orchestrator we are going
+		adminServer.Close()
+	}
+	if httpServer != nil {
+		httpServer.Close()
 	}
-}
\ No newline at end of file
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		if !errors.Is(err, context.DeadlineExceeded) {
+			fatal("Shutdown failed", "err", err)
+		}
+		logInterruptedRequests()
+		server.Close()
+	}
+	slog.Info("Server stopped")
+}
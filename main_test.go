@@ -0,0 +1,735 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// useTempRoot points the server at a fresh storage root for the test.
+func useTempRoot(t *testing.T) string {
+	t.Helper()
+	old := storageRootDir
+	storageRootDir = t.TempDir()
+	t.Cleanup(func() { storageRootDir = old })
+	return storageRootDir
+}
+
+// writeTestFile creates the file at path, and its directories, with data.
+func writeTestFile(t *testing.T, path, data string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the content of the file at path, or "" with false
+// if there is none.
+func readTestFile(t *testing.T, path string) (string, bool) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return "", false
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data), true
+}
+
+// serve sends a request for target through the API's router and returns
+// the response.
+func serve(t *testing.T, method, target string, body io.Reader, header http.Header) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(method, target, body)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	serveAPI(w, r)
+	return w
+}
+
+// fakeFileInfo describes a regular file of the given size.
+type fakeFileInfo struct {
+	size    int64
+	modTime time.Time
+}
+
+func (fi fakeFileInfo) Name() string       { return "file" }
+func (fi fakeFileInfo) Size() int64        { return fi.size }
+func (fi fakeFileInfo) Mode() os.FileMode  { return 0o644 }
+func (fi fakeFileInfo) ModTime() time.Time { return fi.modTime }
+func (fi fakeFileInfo) IsDir() bool        { return false }
+func (fi fakeFileInfo) Sys() any           { return nil }
+
+func TestSymlinkEscape(t *testing.T) {
+	root := useTempRoot(t)
+	outside := t.TempDir()
+	writeTestFile(t, filepath.Join(root, "b", "real"), "inside")
+	if err := os.Symlink("/etc/passwd", filepath.Join(root, "b", "passwd")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "b", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(root, "b", "real"), filepath.Join(root, "b", "alias")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range []string{"GET", "HEAD"} {
+		if w := serve(t, method, "/b/passwd", nil, nil); w.Code != http.StatusForbidden {
+			t.Errorf("%s through a link to /etc/passwd: %d, want 403", method, w.Code)
+		}
+	}
+	// The parent of the key leads outside
+	if w := serve(t, "PUT", "/b/escape/new", strings.NewReader("data"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("PUT through a linked parent: %d, want 403", w.Code)
+	}
+	if _, exists := readTestFile(t, filepath.Join(outside, "new")); exists {
+		t.Error("PUT through a linked parent wrote outside the storage root")
+	}
+	if w := serve(t, "PUT", "/b/escape/deeper/new", strings.NewReader("data"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("PUT below a linked parent: %d, want 403", w.Code)
+	}
+	if _, err := os.Stat(filepath.Join(outside, "deeper")); !os.IsNotExist(err) {
+		t.Error("PUT below a linked parent created directories outside the storage root")
+	}
+
+	// Links that stay inside are followed
+	if w := serve(t, "GET", "/b/alias", nil, nil); w.Code != 200 || w.Body.String() != "inside" {
+		t.Errorf("GET through a link inside the root: %d %q", w.Code, w.Body)
+	}
+
+	old := followSymlinks
+	followSymlinks = true
+	t.Cleanup(func() { followSymlinks = old })
+	if w := serve(t, "GET", "/b/passwd", nil, nil); w.Code != 200 {
+		t.Errorf("GET with -follow-symlinks: %d, want 200", w.Code)
+	}
+}
+
+func TestIsWithin(t *testing.T) {
+	for _, tc := range []struct {
+		dir, target string
+		want        bool
+	}{
+		{"/data/store", "/data/store", true},
+		{"/data/store", "/data/store/bucket/key", true},
+		{"/data/store", "/data/store-evil", false},
+		{"/data/store", "/data/store-evil/bucket/key", false},
+		{"/data/store", "/data", false},
+		{"/data/store", "/etc/passwd", false},
+		{"/data/store", "/data/store/..data", true},
+		{"/", "/etc/passwd", true},
+	} {
+		if got := isWithin(tc.dir, tc.target); got != tc.want {
+			t.Errorf("isWithin(%q, %q) = %v, want %v", tc.dir, tc.target, got, tc.want)
+		}
+	}
+}
+
+func TestSanitizePathStaysInside(t *testing.T) {
+	root := useTempRoot(t)
+	for _, tc := range []struct {
+		bucket, key string
+	}{
+		{"bucket", "../../etc/passwd"},
+		{"bucket", "a/../../other/key"},
+		{"bucket", ".."},
+		{"..", "etc/passwd"},
+	} {
+		if p, err := sanitizePath(tc.bucket, tc.key); err == nil {
+			t.Errorf("sanitizePath(%q, %q) = %q, want an error", tc.bucket, tc.key, p)
+		}
+	}
+
+	// A sibling of the root sharing its name as a prefix
+	evil := root + "-evil"
+	if err := os.MkdirAll(evil, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(evil) })
+	if p, err := sanitizePath("bucket", "../../"+filepath.Base(evil)+"/key"); err == nil {
+		t.Errorf("sanitizePath into %s = %q, want an error", evil, p)
+	}
+
+	// A bucket that is a link leading outside
+	if err := os.Symlink(evil, filepath.Join(root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sanitizePath("linked", "key"); !errors.Is(err, errSymlinkEscape) {
+		t.Errorf("key in a bucket linked outside: err = %v, want errSymlinkEscape", err)
+	}
+	if w := serve(t, "PUT", "/linked/key", strings.NewReader("data"), nil); w.Code != http.StatusForbidden {
+		t.Errorf("PUT into a bucket linked outside: %d, want 403", w.Code)
+	}
+	if _, exists := readTestFile(t, filepath.Join(evil, "key")); exists {
+		t.Error("PUT into a bucket linked outside wrote there")
+	}
+
+	// The storage root itself may be reached through a link
+	link := filepath.Join(t.TempDir(), "root")
+	if err := os.Symlink(root, link); err != nil {
+		t.Fatal(err)
+	}
+	storageRootDir = link
+	if _, err := sanitizePath("bucket", "key"); err != nil {
+		t.Errorf("key below a linked storage root: %v", err)
+	}
+}
+
+// Concurrent PUTs of one key must leave exactly one of them, whole, and
+// readers in the meantime see only whole objects.
+func TestConcurrentPutsOfOneKey(t *testing.T) {
+	useTempRoot(t)
+	const writers = 20
+	const size = 256 << 10
+	body := func(i int) []byte {
+		return bytes.Repeat([]byte{byte('A' + i)}, size)
+	}
+	whole := func(data []byte) bool {
+		return len(data) == size && bytes.Count(data, data[:1]) == size
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			if w := serve(t, "PUT", "/b/k", bytes.NewReader(body(i)), nil); w.Code != 204 {
+				t.Errorf("PUT %d: %d %s", i, w.Code, w.Body)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			w := serve(t, "GET", "/b/k", nil, nil)
+			if w.Code == 200 && !whole(w.Body.Bytes()) {
+				t.Errorf("GET during the PUTs read a mix of %d bytes", w.Body.Len())
+			}
+		}()
+	}
+	wg.Wait()
+
+	w := serve(t, "GET", "/b/k", nil, nil)
+	if w.Code != 200 || !whole(w.Body.Bytes()) {
+		t.Fatalf("final GET: %d, %d bytes, not one whole write", w.Code, w.Body.Len())
+	}
+	sum := md5.Sum(w.Body.Bytes())
+	if etag := w.Header().Get("ETag"); etag != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Errorf("ETag %s doesn't describe the content", etag)
+	}
+	entries, err := os.ReadDir(filepath.Join(storageRootDir, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("bucket holds %d files, want only the object", len(entries))
+	}
+}
+
+// failingBody is a request body that records being read and fails.
+type failingBody struct {
+	read bool
+}
+
+func (b *failingBody) Read(p []byte) (int, error) {
+	b.read = true
+	return 0, errors.New("body read")
+}
+
+// An upload refused for its headers must be answered without reading the
+// body, so that a client waiting on Expect: 100-continue never sends it.
+func TestUploadRefusedBeforeReadingBody(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "existing"), "data")
+	oldMax := maxObjectSize
+	maxObjectSize = 100
+	t.Cleanup(func() { maxObjectSize = oldMax })
+
+	for _, tc := range []struct {
+		name   string
+		key    string
+		length int64
+		header http.Header
+		quota  int64
+		want   int
+	}{
+		{"create-only of an existing key", "existing", 10, http.Header{"If-None-Match": {"*"}}, 0, http.StatusPreconditionFailed},
+		{"If-Match of another ETag", "existing", 10, http.Header{"If-Match": {`"0123"`}}, 0, http.StatusPreconditionFailed},
+		{"over the bucket quota", "new/key", 50, nil, 20, http.StatusForbidden},
+		{"over -max-object-size", "new/key", 1000, nil, 0, http.StatusBadRequest},
+		{"malformed Content-MD5", "new/key", 10, http.Header{"Content-Md5": {"not base64"}}, 0, http.StatusBadRequest},
+		{"unknown storage class", "new/key", 10, http.Header{"X-Amz-Storage-Class": {"NO_SUCH_CLASS"}}, 0, http.StatusBadRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			useQuota(t, tc.quota)
+			body := &failingBody{}
+			r := httptest.NewRequest("PUT", "/b/"+tc.key, body)
+			r.ContentLength = tc.length
+			for name, values := range tc.header {
+				r.Header[name] = values
+			}
+			w := httptest.NewRecorder()
+			serveAPI(w, r)
+			if w.Code != tc.want {
+				t.Errorf("status %d, want %d: %s", w.Code, tc.want, w.Body)
+			}
+			if body.read {
+				t.Error("body read before refusing the upload")
+			}
+			if _, err := os.Stat(filepath.Join(root, "b", "new")); !os.IsNotExist(err) {
+				t.Error("refused upload created directories")
+			}
+		})
+	}
+}
+
+// A body shorter than its Content-Length is an interrupted upload: it must
+// be refused, leaving no object or temporary file and any previous object
+// as it was.
+func TestShortBody(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "existing"), "previous")
+	for _, key := range []string{"new", "existing"} {
+		r := httptest.NewRequest("PUT", "/b/"+key, strings.NewReader("0123456789"))
+		r.ContentLength = 1000
+		w := httptest.NewRecorder()
+		serveAPI(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<Code>IncompleteBody</Code>") {
+			t.Errorf("PUT %s with a short body: %d %s, want 400 IncompleteBody", key, w.Code, w.Body)
+		}
+	}
+	if _, exists := readTestFile(t, filepath.Join(root, "b", "new")); exists {
+		t.Error("short upload stored")
+	}
+	if got, _ := readTestFile(t, filepath.Join(root, "b", "existing")); got != "previous" {
+		t.Errorf("short upload replaced the object with %q", got)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isTempFile(e.Name()) {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+// A key naming a folder prefix (a directory on disk) is no object: a PUT
+// of it conflicts, and a GET or DELETE finds nothing, leaving the folder's
+// objects alone.
+func TestKeyNamingFolder(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "data", "x"), "inside")
+
+	w := serve(t, http.MethodPut, "/b/data", strings.NewReader("object"), nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "<Code>KeyConflict</Code>") || !strings.Contains(w.Body.String(), "folder prefix") {
+		t.Errorf("PUT of a folder prefix: %d %s, want 409 KeyConflict", w.Code, w.Body)
+	}
+	// Below an object is no better
+	w = serve(t, http.MethodPut, "/b/data/x/y", strings.NewReader("object"), nil)
+	if w.Code != http.StatusConflict || !strings.Contains(w.Body.String(), "<Code>KeyConflict</Code>") {
+		t.Errorf("PUT below an object: %d %s, want 409 KeyConflict", w.Code, w.Body)
+	}
+	w = serve(t, http.MethodGet, "/b/data", nil, nil)
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "<Code>NoSuchKey</Code>") {
+		t.Errorf("GET of a folder prefix: %d %s, want 404 NoSuchKey", w.Code, w.Body)
+	}
+	if w := serve(t, http.MethodDelete, "/b/data", nil, nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE of a folder prefix: %d %s, want 204", w.Code, w.Body)
+	}
+	if got, _ := readTestFile(t, filepath.Join(root, "b", "data", "x")); got != "inside" {
+		t.Errorf("object in the folder is %q after the requests", got)
+	}
+	entries, err := os.ReadDir(filepath.Join(root, "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if isTempFile(e.Name()) {
+			t.Errorf("temporary file %s left behind", e.Name())
+		}
+	}
+}
+
+// HEAD and GET of a folder prefix find no object, while a folder marker
+// stored with a PUT of the key with its trailing slash is one.
+func TestHeadOfFolder(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "folder", "x"), "inside")
+	if w := serve(t, http.MethodPut, "/b/marked/", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT of a folder marker: %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, http.MethodPut, "/b/marked/x", strings.NewReader("inside"), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT into the marked folder: %d %s", w.Code, w.Body)
+	}
+
+	for _, tc := range []struct {
+		target string
+		want   int
+	}{
+		{"/b/folder", http.StatusNotFound},
+		{"/b/folder/", http.StatusNotFound},
+		{"/b/marked", http.StatusNotFound},
+		{"/b/marked/", http.StatusOK},
+		{"/b/folder/x", http.StatusOK},
+	} {
+		w := serve(t, http.MethodHead, tc.target, nil, nil)
+		if w.Code != tc.want || w.Body.Len() != 0 {
+			t.Errorf("HEAD %s: %d with %d bytes of body, want %d", tc.target, w.Code, w.Body.Len(), tc.want)
+		}
+		if tc.want == http.StatusNotFound && (w.Header().Get("ETag") != "" || w.Header().Get("Last-Modified") != "") {
+			t.Errorf("HEAD %s describes an object: %v", tc.target, w.Header())
+		}
+		if tc.want == http.StatusOK && w.Header().Get("ETag") == "" {
+			t.Errorf("HEAD %s: no ETag", tc.target)
+		}
+		if w := serve(t, http.MethodGet, tc.target, nil, nil); w.Code != tc.want {
+			t.Errorf("GET %s: %d, want %d", tc.target, w.Code, tc.want)
+		}
+	}
+	// A marker is an empty object
+	w := serve(t, http.MethodHead, "/b/marked/", nil, nil)
+	if got := w.Header().Get("Content-Length"); got != "0" {
+		t.Errorf("HEAD of a folder marker: Content-Length %q, want 0", got)
+	}
+}
+
+// A GET of an intermediate prefix of a nested key is answered with a
+// complete NoSuchKey error document, not the start of a failed stream.
+func TestGetOfDirectory(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "a", "b", "c"), "nested")
+
+	for _, key := range []string{"a", "a/b"} {
+		w := serve(t, http.MethodGet, "/b/"+key, nil, nil)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("GET %s: %d, want 404", key, w.Code)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("GET %s: Content-Type %q", key, ct)
+		}
+		for _, name := range []string{"ETag", "Last-Modified", "Accept-Ranges"} {
+			if v := w.Header().Get(name); v != "" {
+				t.Errorf("GET %s: %s %q on an error", key, name, v)
+			}
+		}
+		body := w.Body.Bytes()
+		var doc s3ErrorResponse
+		if err := xml.Unmarshal(body, &doc); err != nil {
+			t.Errorf("GET %s: body %q is no error document: %v", key, body, err)
+			continue
+		}
+		if doc.Code != "NoSuchKey" || doc.Resource != "/b/"+key {
+			t.Errorf("GET %s: error %+v", key, doc)
+		}
+		// Nothing of the directory follows the document
+		if i := bytes.Index(body, []byte("</Error>")); i < 0 || len(bytes.TrimSpace(body[i+len("</Error>"):])) != 0 {
+			t.Errorf("GET %s: trailing bytes in %q", key, body)
+		}
+	}
+	if w := serve(t, http.MethodGet, "/b/a/b/c", nil, nil); w.Code != http.StatusOK || w.Body.String() != "nested" {
+		t.Errorf("GET of the nested key: %d %q", w.Code, w.Body)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	ascii := func(n int) string { return strings.Repeat("a", n) }
+	for _, tc := range []struct {
+		name string
+		key  string
+		want string // normalized key, or the error code
+	}{
+		{"1024 bytes ending in a 2-byte rune", ascii(1022) + "é", ascii(1022) + "é"},
+		{"1025 bytes, the boundary inside a rune", ascii(1023) + "é", "KeyTooLongError"},
+		{"1024 bytes cut inside a rune", ascii(1023) + "é"[:1], "InvalidArgument"},
+		{"1024 bytes ending in a 4-byte rune", ascii(1020) + "😀", ascii(1020) + "😀"},
+		{"4-byte rune straddling the boundary", ascii(1021) + "😀", "KeyTooLongError"},
+		{"NUL", "a\x00b", "InvalidArgument"},
+		{"newline", "a\nb", "InvalidArgument"},
+		{"tab", "a\tb", "InvalidArgument"},
+		{"DEL", "a\x7fb", "InvalidArgument"},
+		{"dot segment", "a/./b", "a/b"},
+		{"empty segments", "a//b///c", "a/b/c"},
+		{"dot-dot segment", "a/b/../c", "a/c"},
+		{"leading dot-dot", "../a", "InvalidArgument"},
+		{"dot-dot past the bucket", "a/../../b", "InvalidArgument"},
+		{"only dots", "./.", "InvalidArgument"},
+		{"folder marker kept", "a/./b/", "a/b/"},
+		{"dots within a name", "a/..b/c..", "a/..b/c.."},
+	} {
+		got, apiErr := validateKey(tc.key)
+		if apiErr != nil {
+			got = apiErr.code
+		}
+		if got != tc.want {
+			t.Errorf("%s: validateKey = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestSplitRequestPath(t *testing.T) {
+	root := useTempRoot(t)
+	if err := os.MkdirAll(filepath.Join(root, "b"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		target string // as a client sends it
+		key    string
+	}{
+		{"/b/with%20space", "with space"},
+		{"/b/plus+sign", "plus+sign"},
+		{"/b/encoded%2Bplus", "encoded+plus"},
+		{"/b/caf%C3%A9/%E6%97%A5%E6%9C%AC", "café/日本"},
+		{"/b/a%2Fb", "a/b"},
+		{"/b/percent%2520", "percent%20"},
+		{"/b/dir/a%20b+c", "dir/a b+c"},
+	} {
+		r := httptest.NewRequest("GET", tc.target, nil)
+		if got := splitRequestPath(r); len(got) != 2 || got[0] != "b" || got[1] != tc.key {
+			t.Errorf("splitRequestPath(%s) = %q, want [b %s]", tc.target, got, tc.key)
+		}
+
+		// A request whose URL was built already decoded, without RawPath
+		decoded := httptest.NewRequest("GET", "/", nil)
+		decoded.URL.Path = "/b/" + tc.key
+		decoded.URL.RawPath = ""
+		if got := splitRequestPath(decoded); len(got) != 2 || got[1] != tc.key {
+			t.Errorf("splitRequestPath of decoded %q = %q", tc.key, got)
+		}
+
+		// The key stored is the one a listing hands back
+		if w := serve(t, "PUT", tc.target, strings.NewReader("x"), nil); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", tc.target, w.Code, w.Body)
+		}
+		w := serve(t, "GET", "/b?list-type=2&encoding-type=url&prefix="+url.QueryEscape(tc.key), nil, nil)
+		var result listBucketResult
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatalf("listing after PUT %s: %v: %s", tc.target, err, w.Body)
+		}
+		var keys []string
+		for _, c := range result.Contents {
+			key, err := url.QueryUnescape(c.Key)
+			if err != nil {
+				t.Fatalf("listed key %q: %v", c.Key, err)
+			}
+			keys = append(keys, key)
+		}
+		if len(keys) != 1 || keys[0] != tc.key {
+			t.Errorf("PUT %s listed as %q, want [%s]", tc.target, keys, tc.key)
+		}
+		if w := serve(t, "DELETE", tc.target, nil, nil); w.Code != http.StatusNoContent {
+			t.Fatalf("DELETE %s: %d %s", tc.target, w.Code, w.Body)
+		}
+	}
+}
+
+// failingRename makes renames to target fail with err the first failures
+// times, counting every attempt.
+func failingRename(t *testing.T, target string, err error, failures int) *int {
+	t.Helper()
+	attempts := 0
+	oldRename, oldDelay := rename, renameRetryDelay
+	rename = func(from, to string) error {
+		if to != target {
+			return os.Rename(from, to)
+		}
+		attempts++
+		if attempts <= failures {
+			return &os.LinkError{Op: "rename", Old: from, New: to, Err: err}
+		}
+		return os.Rename(from, to)
+	}
+	renameRetryDelay = time.Millisecond
+	t.Cleanup(func() { rename, renameRetryDelay = oldRename, oldDelay })
+	return &attempts
+}
+
+func TestRenameRetry(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		err      error
+		failures int
+		code     int
+		attempts int
+	}{
+		{"transient EBUSY", syscall.EBUSY, 2, http.StatusNoContent, 3},
+		{"transient ESTALE", syscall.ESTALE, renameRetries, http.StatusNoContent, renameRetries + 1},
+		{"persistent EBUSY", syscall.EBUSY, 100, http.StatusInternalServerError, renameRetries + 1},
+		{"EXDEV", syscall.EXDEV, 1, http.StatusInternalServerError, 1},
+	} {
+		root := useTempRoot(t)
+		if err := os.MkdirAll(filepath.Join(root, "b"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		attempts := failingRename(t, filepath.Join(root, "b", "k"), tc.err, tc.failures)
+		w := serve(t, "PUT", "/b/k", strings.NewReader("content"), nil)
+		if w.Code != tc.code {
+			t.Errorf("%s: PUT answered %d %s, want %d", tc.name, w.Code, w.Body, tc.code)
+		}
+		if *attempts != tc.attempts {
+			t.Errorf("%s: %d rename attempts, want %d", tc.name, *attempts, tc.attempts)
+		}
+		got, stored := readTestFile(t, filepath.Join(root, "b", "k"))
+		if stored != (tc.code == http.StatusNoContent) || stored && got != "content" {
+			t.Errorf("%s: object stored %v with %q", tc.name, stored, got)
+		}
+		entries, err := os.ReadDir(filepath.Join(root, "b"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range entries {
+			if isTempFile(e.Name()) {
+				t.Errorf("%s: temporary file %s left behind", tc.name, e.Name())
+			}
+		}
+	}
+}
+
+func TestStaging(t *testing.T) {
+	root := useTempRoot(t)
+	oldStaging := useStaging
+	useStaging = true
+	t.Cleanup(func() { useStaging = oldStaging })
+	stagingDir := filepath.Join(root, stagingDirName)
+	writeTestFile(t, filepath.Join(stagingDir, tempFilePrefix+"crashed"), "partial")
+	if err := prepareStagingDir(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := os.ReadDir(stagingDir); len(entries) != 0 {
+		t.Errorf("staging directory holds %d leftover files after startup", len(entries))
+	}
+
+	target := filepath.Join(root, "b", "dir", "k")
+	var from string
+	oldRename := rename
+	rename = func(oldpath, newpath string) error {
+		if newpath == target {
+			from = oldpath
+		}
+		return oldRename(oldpath, newpath)
+	}
+	t.Cleanup(func() { rename = oldRename })
+
+	if w := serve(t, "PUT", "/b/dir/k", strings.NewReader("content"), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT answered %d %s", w.Code, w.Body)
+	}
+	if filepath.Dir(from) != stagingDir || !isTempFile(filepath.Base(from)) {
+		t.Errorf("object renamed into place from %s, want a temp file in %s", from, stagingDir)
+	}
+	if got, _ := readTestFile(t, target); got != "content" {
+		t.Errorf("object holds %q", got)
+	}
+	if entries, _ := os.ReadDir(stagingDir); len(entries) != 0 {
+		t.Errorf("staging directory holds %d files after the upload", len(entries))
+	}
+}
+
+// useASCIIOnlyKeys sets -ascii-only-keys for the duration of the test.
+func useASCIIOnlyKeys(t *testing.T, mode string) {
+	t.Helper()
+	old := asciiOnlyKeys
+	asciiOnlyKeys = mode
+	t.Cleanup(func() { asciiOnlyKeys = old })
+}
+
+func TestASCIIOnlyKeysReject(t *testing.T) {
+	root := useTempRoot(t)
+	useASCIIOnlyKeys(t, "reject")
+
+	for _, key := range []string{"café.txt", "日記.txt", "folder/ñ/x", "Ünïcödé"} {
+		target := "/b/" + url.PathEscape(key)
+		for _, method := range []string{http.MethodPut, http.MethodGet, http.MethodDelete} {
+			w := serve(t, method, target, strings.NewReader("data"), nil)
+			if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "non-ASCII") {
+				t.Errorf("%s %s: %d %s, want 400", method, key, w.Code, w.Body)
+			}
+		}
+		if w := serve(t, http.MethodHead, target, nil, nil); w.Code != http.StatusBadRequest {
+			t.Errorf("HEAD %s: %d, want 400", key, w.Code)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(root, "b")); len(entries) != 0 {
+		t.Errorf("rejected keys left %d entries in the bucket", len(entries))
+	}
+	// ASCII keys are unaffected
+	if w := serve(t, http.MethodPut, "/b/plain.txt", strings.NewReader("data"), nil); w.Code != http.StatusNoContent {
+		t.Errorf("PUT of an ASCII key: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestASCIIOnlyKeysTransliterate(t *testing.T) {
+	root := useTempRoot(t)
+	useASCIIOnlyKeys(t, "transliterate")
+
+	for _, tc := range []struct {
+		key, stored string
+	}{
+		{"café.txt", "caf%C3%A9.txt"},
+		{"日記/今日.txt", "%E6%97%A5%E8%A8%98/%E4%BB%8A%E6%97%A5.txt"},
+		{"100%.txt", "100%25.txt"},
+		// Can't be taken for the escaped form of "é"
+		{"caf%C3%A9.txt", "caf%25C3%25A9.txt"},
+	} {
+		if got := transliterateKey(tc.key); got != tc.stored {
+			t.Errorf("transliterateKey(%q) = %q, want %q", tc.key, got, tc.stored)
+		}
+		target := "/b/" + strings.ReplaceAll(url.PathEscape(tc.key), "%2F", "/")
+		if w := serve(t, http.MethodPut, target, strings.NewReader(tc.key), nil); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", tc.key, w.Code, w.Body)
+		}
+		if got, ok := readTestFile(t, filepath.Join(root, "b", filepath.FromSlash(tc.stored))); !ok || got != tc.key {
+			t.Errorf("%s stored as %q: %q, %v", tc.key, tc.stored, got, ok)
+		}
+		if w := serve(t, http.MethodGet, target, nil, nil); w.Code != http.StatusOK || w.Body.String() != tc.key {
+			t.Errorf("GET %s: %d %q", tc.key, w.Code, w.Body)
+		}
+	}
+
+	// Listings give the keys as sent, and take prefixes in that form too
+	w := serve(t, http.MethodGet, "/b?list-type=2", nil, nil)
+	var result listBucketResult
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, c := range result.Contents {
+		keys = append(keys, c.Key)
+	}
+	if got, want := strings.Join(keys, ","), "100%.txt,caf%C3%A9.txt,café.txt,日記/今日.txt"; got != want {
+		t.Errorf("listed keys %s, want %s", got, want)
+	}
+	w = serve(t, http.MethodGet, "/b?list-type=2&delimiter=/&prefix="+url.QueryEscape("日記/"), nil, nil)
+	if !strings.Contains(w.Body.String(), "<Key>日記/今日.txt</Key>") {
+		t.Errorf("listing with a non-ASCII prefix: %s", w.Body)
+	}
+	w = serve(t, http.MethodGet, "/b?list-type=2&delimiter=/", nil, nil)
+	if !strings.Contains(w.Body.String(), "<Prefix>日記/</Prefix>") {
+		t.Errorf("common prefix of a non-ASCII folder: %s", w.Body)
+	}
+	if w := serve(t, http.MethodDelete, "/b/"+url.PathEscape("café.txt"), nil, nil); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE: %d", w.Code)
+	}
+	if _, ok := readTestFile(t, filepath.Join(root, "b", "caf%C3%A9.txt")); ok {
+		t.Error("DELETE left the transliterated file")
+	}
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Per-object metadata lives in a parallel tree under the storage root:
+// the object <root>/<bucket>/<key> has its metadata in
+// <root>/.meta/<bucket>/<key>. Mirroring the object tree exactly means
+// metadata can never collide with, or be listed as, an object.
+
+// Directory under the storage root holding object metadata
+const metaDirName = ".meta"
+
+// objectMeta is the JSON document stored for each object.
+type objectMeta struct {
+	ETag string `json:"etag"`
+	// Content-Type, Cache-Control and Expires supplied with the PUT, if any
+	ContentType  string `json:"contentType,omitempty"`
+	CacheControl string `json:"cacheControl,omitempty"`
+	Expires      string `json:"expires,omitempty"`
+	// x-amz-storage-class supplied with the PUT, if not STANDARD
+	StorageClass string `json:"storageClass,omitempty"`
+	// x-amz-meta-* headers, keyed by lower-case name without the prefix
+	UserMeta map[string]string `json:"userMeta,omitempty"`
+	// Tags set with PUT ?tagging
+	Tags map[string]string `json:"tags,omitempty"`
+	// Additional checksum verified or computed on upload: its algorithm
+	// (e.g. "CRC32") and base64 value
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"`
+	Checksum          string `json:"checksum,omitempty"`
+	// Whether the file holds the content encrypted with -encryption-key
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Whether the content is stored compressed with -compress, and then
+	// its uncompressed size
+	Compressed  bool  `json:"compressed,omitempty"`
+	ContentSize int64 `json:"contentSize,omitempty"`
+	// When the object expires (UnixNano), from x-amz-expires-at or
+	// x-amz-ttl-seconds; 0 if it never does
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// When the object was moved to the trash (UnixNano); 0 unless trashed
+	DeletedAt int64 `json:"deletedAt,omitempty"`
+	// Size and modification time (UnixNano) of the file the metadata was
+	// recorded for, so changes made behind our back are detected
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"`
+}
+
+// Prefix of user metadata headers
+const userMetaPrefix = "x-amz-meta-"
+
+// Most bytes of user metadata (names plus values) an object may carry, as in S3
+const maxUserMetaBytes = 2 << 10
+
+// metaFromRequest collects the metadata a PUT (or multipart upload
+// initiation) asks to store with the object. It returns nil if the user
+// metadata exceeds maxUserMetaBytes.
+func metaFromRequest(h http.Header) *objectMeta {
+	m := &objectMeta{
+		ContentType:  h.Get("Content-Type"),
+		CacheControl: h.Get("Cache-Control"),
+		Expires:      h.Get("Expires"),
+	}
+	size := 0
+	for name, values := range h {
+		lname := strings.ToLower(name)
+		if !strings.HasPrefix(lname, userMetaPrefix) {
+			continue
+		}
+		if m.UserMeta == nil {
+			m.UserMeta = map[string]string{}
+		}
+		field := strings.TrimPrefix(lname, userMetaPrefix)
+		m.UserMeta[field] = strings.Join(values, ",")
+		size += len(field) + len(m.UserMeta[field])
+	}
+	if size > maxUserMetaBytes {
+		return nil
+	}
+	return m
+}
+
+// Storage classes a PUT may name in x-amz-storage-class, as in S3. The
+// class is recorded and reported back, but every object is stored alike.
+var storageClasses = map[string]bool{
+	"STANDARD":            true,
+	"REDUCED_REDUNDANCY":  true,
+	"STANDARD_IA":         true,
+	"ONEZONE_IA":          true,
+	"INTELLIGENT_TIERING": true,
+	"GLACIER":             true,
+	"GLACIER_IR":          true,
+	"DEEP_ARCHIVE":        true,
+	"OUTPOSTS":            true,
+	"SNOW":                true,
+	"EXPRESS_ONEZONE":     true,
+}
+
+// requestStorageClass returns the storage class a PUT (or multipart upload
+// initiation) asks for, or "" for STANDARD, the default.
+func requestStorageClass(h http.Header) (string, *apiError) {
+	class := h.Get("x-amz-storage-class")
+	if class == "" || class == "STANDARD" {
+		return "", nil
+	}
+	if !storageClasses[class] {
+		return "", &apiError{http.StatusBadRequest, "InvalidStorageClass", "The storage class you specified is not valid"}
+	}
+	return class, nil
+}
+
+// storageClass returns the storage class of the object described by m, as
+// listings report it.
+func storageClass(m *objectMeta) string {
+	if m.StorageClass == "" {
+		return "STANDARD"
+	}
+	return m.StorageClass
+}
+
+// setMetaHeaders replays the stored Cache-Control, Expires, storage class,
+// user metadata and tag count on a GET or HEAD response.
+func setMetaHeaders(w http.ResponseWriter, m *objectMeta) {
+	if m.CacheControl != "" {
+		w.Header().Set("Cache-Control", m.CacheControl)
+	}
+	if m.Expires != "" {
+		w.Header().Set("Expires", m.Expires)
+	}
+	// As in S3, STANDARD goes without saying
+	if m.StorageClass != "" {
+		w.Header().Set("x-amz-storage-class", m.StorageClass)
+	}
+	for field, value := range m.UserMeta {
+		w.Header().Set(userMetaPrefix+field, value)
+	}
+	if len(m.Tags) > 0 {
+		w.Header().Set("x-amz-tagging-count", strconv.Itoa(len(m.Tags)))
+	}
+}
+
+// metaPath returns where the metadata of the object stored at objectPath lives.
+func metaPath(objectPath string) (string, error) {
+	absRoot, err := filepath.Abs(storageRootDir)
+	if err != nil {
+		return "", err
+	}
+	absObject, err := filepath.Abs(objectPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absObject)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(absRoot, metaDirName, rel), nil
+}
+
+// readMeta loads the metadata of the object at objectPath if it still
+// describes the file as it is now (fi), and returns nil otherwise.
+func readMeta(objectPath string, fi os.FileInfo) *objectMeta {
+	m := readMetaRecord(objectPath)
+	if m == nil || m.Size != fi.Size() || m.ModTime != fi.ModTime().UnixNano() {
+		return nil
+	}
+	return m
+}
+
+// readMetaRecord loads the metadata recorded for the object at objectPath,
+// current or not, and returns nil if there is none.
+func readMetaRecord(objectPath string) *objectMeta {
+	p, err := metaPath(objectPath)
+	if err != nil {
+		return nil
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil
+	}
+	var m objectMeta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil
+	}
+	return &m
+}
+
+// writeMeta stores metadata for the object at objectPath, stamping it with
+// the file's current size and modification time. The file is replaced
+// atomically so readers never see a partial document.
+func writeMeta(objectPath string, fi os.FileInfo, m *objectMeta) error {
+	p, err := metaPath(objectPath)
+	if err != nil {
+		return err
+	}
+	m.Size = fi.Size()
+	m.ModTime = fi.ModTime().UnixNano()
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := makeDirs(filepath.Dir(p)); err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data)
+}
+
+// Modes of the directories and files the server creates under the storage
+// root (-dir-mode, -file-mode). They are applied as given, whatever the
+// umask.
+var (
+	dirMode  os.FileMode = 0o755
+	fileMode os.FileMode = 0o644
+)
+
+// parseMode parses an octal permission mode such as "0750" for a flag,
+// which must grant the owner at least need.
+func parseMode(s string, need os.FileMode) (os.FileMode, error) {
+	v, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || v > 0o777 {
+		return 0, errors.New("must be octal permissions such as 0755")
+	}
+	mode := os.FileMode(v)
+	if mode&need != need {
+		return 0, fmt.Errorf("must grant the owner at least %#o, which the server needs", need)
+	}
+	return mode, nil
+}
+
+// makeDirs is os.MkdirAll, creating directories with dirMode.
+func makeDirs(path string) error {
+	if fi, err := os.Stat(path); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		return &os.PathError{Op: "mkdir", Path: path, Err: syscall.ENOTDIR}
+	}
+	if parent := filepath.Dir(path); parent != path {
+		if err := makeDirs(parent); err != nil {
+			return err
+		}
+	}
+	if err := os.Mkdir(path, dirMode); err != nil {
+		// Created concurrently
+		if fi, statErr := os.Stat(path); statErr == nil && fi.IsDir() {
+			return nil
+		}
+		return err
+	}
+	// Mkdir's mode is narrowed by the umask
+	return os.Chmod(path, dirMode)
+}
+
+// createFile creates or truncates the file at path with fileMode.
+func createFile(path string) (*os.File, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(fileMode); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// Hidden directory under the storage root that temp files are written to
+// with -staging, so that watchers of the buckets only see finished files
+const stagingDirName = ".staging"
+
+// Whether temp files go to stagingDirName rather than next to their target
+var useStaging bool
+
+// Filesystem the staging directory is on, if known
+var stagingDevice struct {
+	dev   uint64
+	known bool
+}
+
+// prepareStagingDir creates the staging directory, emptied of temp files
+// left by writes a crash cut short.
+func prepareStagingDir() error {
+	dir := filepath.Join(storageRootDir, stagingDirName)
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := makeDirs(dir); err != nil {
+		return err
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	stagingDevice.dev, stagingDevice.known = fileDevice(fi)
+	return nil
+}
+
+// tempFileDir returns the directory a temp file to be renamed into dir is
+// created in: the staging directory with -staging, unless dir is on
+// another filesystem (a bucket that is a mount point of its own), where
+// the rename would fail, and dir itself otherwise.
+func tempFileDir(dir string) string {
+	if !useStaging {
+		return dir
+	}
+	if stagingDevice.known {
+		if fi, err := os.Stat(dir); err == nil {
+			if dev, ok := fileDevice(fi); ok && dev != stagingDevice.dev {
+				return dir
+			}
+		}
+	}
+	return filepath.Join(storageRootDir, stagingDirName)
+}
+
+// createTempFile creates a file to be renamed into dir once written, in
+// tempFileDir(dir). Unlike os.CreateTemp's private 0600, it gets fileMode.
+func createTempFile(dir string) (*os.File, error) {
+	f, err := os.CreateTemp(tempFileDir(dir), tempFilePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+	if err := f.Chmod(fileMode); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	return f, nil
+}
+
+// Times a rename failing with EBUSY or ESTALE, as on network mounts, is
+// retried (-rename-retries)
+var renameRetries = 3
+
+// Wait before the first retry of a rename, doubled for each further one
+var renameRetryDelay = 10 * time.Millisecond
+
+// os.Rename, replaced in tests to make it fail
+var rename = os.Rename
+
+// renameFile renames from to to as os.Rename does, retrying a few times
+// with backoff while that fails with an error a network filesystem may
+// report transiently. Other errors, EXDEV included, are returned at once.
+func renameFile(from, to string) error {
+	err := rename(from, to)
+	for attempt := 1; attempt <= renameRetries && isTransientRenameError(err); attempt++ {
+		delay := renameRetryDelay << (attempt - 1)
+		slog.Debug("Retrying rename", "from", from, "to", to, "attempt", attempt, "delay", delay, "err", err)
+		time.Sleep(delay)
+		err = rename(from, to)
+	}
+	return err
+}
+
+func isTransientRenameError(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || errors.Is(err, syscall.ESTALE)
+}
+
+// writeFileAtomic replaces path with data so that readers never see a
+// partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := createTempFile(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := renameFile(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// removeMeta deletes the metadata of the object at objectPath, if any.
+func removeMeta(objectPath string) error {
+	p, err := metaPath(objectPath)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// loadMeta returns the metadata of the object at objectPath. When there is
+// no current record the ETag is recomputed by hashing the file (and recorded
+// for next time), decrypting and decompressing it if it starts like an
+// object stored that way; anything else the record held is lost with it.
+func loadMeta(objectPath string, fi os.FileInfo) (*objectMeta, error) {
+	if m := readMeta(objectPath, fi); m != nil && m.ETag != "" {
+		return m, nil
+	}
+	m, err := fileMeta(objectPath)
+	if err != nil {
+		return nil, err
+	}
+	// Caching is best-effort; the ETag is correct either way
+	writeMeta(objectPath, fi, m)
+	return m, nil
+}
+
+// objectETag returns the ETag of the object at objectPath.
+func objectETag(objectPath string, fi os.FileInfo) (string, error) {
+	m, err := loadMeta(objectPath, fi)
+	if err != nil {
+		return "", err
+	}
+	return m.ETag, nil
+}
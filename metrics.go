@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "s3fs_http_requests_total",
+		Help: "HTTP requests served, by method, status code and bucket.",
+	}, []string{"method", "code", "bucket"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "s3fs_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by method and bucket.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "bucket"})
+	bytesReceived = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3fs_received_bytes_total",
+		Help: "Request body bytes read (uploads).",
+	})
+	bytesSent = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3fs_sent_bytes_total",
+		Help: "Response body bytes written (downloads).",
+	})
+	requestsInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "s3fs_http_requests_in_flight",
+		Help: "HTTP requests currently being served.",
+	})
+	corruptReads = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "s3fs_corrupt_reads_total",
+		Help: "Reads of objects whose content did not match their ETag (-verify-on-read).",
+	})
+)
+
+// Most distinct buckets the request metrics are labeled with; requests
+// to any other bucket are counted under "other" (0 = no bucket label)
+var metricsBucketLabels = 100
+
+// Bucket label for buckets beyond metricsBucketLabels or not on disk
+const otherBucketLabel = "other"
+
+// Buckets given a label of their own so far, in the order first served
+var labeledBuckets struct {
+	sync.Mutex
+	names map[string]bool
+}
+
+type bucketLabelKey struct{}
+
+// Walking the store is expensive, so scrapes reuse a recent count
+const storeStatsMaxAge = time.Minute
+
+var storeStats struct {
+	sync.Mutex
+	taken time.Time
+	stats *storageStats
+}
+
+// Per-bucket size gauges, labeled like the request metrics
+var (
+	bucketStoredBytesDesc = prometheus.NewDesc("s3fs_bucket_stored_bytes",
+		"Size of the objects stored in a bucket, as stored, counted at most once a minute.", []string{"bucket"}, nil)
+	bucketLogicalBytesDesc = prometheus.NewDesc("s3fs_bucket_logical_bytes",
+		"Size of the content of the objects stored in a bucket, counted at most once a minute.", []string{"bucket"}, nil)
+	bucketCompressionRatioDesc = prometheus.NewDesc("s3fs_bucket_compression_ratio",
+		"Logical to stored size of the objects in a bucket, counted at most once a minute.", []string{"bucket"}, nil)
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, bytesReceived, bytesSent, requestsInFlight, corruptReads)
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "s3fs_objects",
+		Help: "Objects stored, counted at most once a minute.",
+	}, func() float64 {
+		return float64(currentStoreStats().Objects)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "s3fs_stored_bytes",
+		Help: "Total size of stored objects, as stored, counted at most once a minute.",
+	}, func() float64 {
+		return float64(currentStoreStats().Bytes)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "s3fs_logical_bytes",
+		Help: "Total size of the content of stored objects, counted at most once a minute.",
+	}, func() float64 {
+		return float64(currentStoreStats().LogicalBytes)
+	}))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "s3fs_compression_ratio",
+		Help: "Logical to stored size of all objects, counted at most once a minute.",
+	}, func() float64 {
+		return currentStoreStats().CompressionRatio
+	}))
+	prometheus.MustRegister(bucketSizeCollector{})
+}
+
+// bucketSizeCollector exports the per-bucket size gauges. Buckets that
+// have a label of their own in the request metrics get one here too; the
+// rest are added up under "other", and with no bucket labels there are
+// none of these.
+type bucketSizeCollector struct{}
+
+func (bucketSizeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- bucketStoredBytesDesc
+	ch <- bucketLogicalBytesDesc
+	ch <- bucketCompressionRatioDesc
+}
+
+func (bucketSizeCollector) Collect(ch chan<- prometheus.Metric) {
+	if metricsBucketLabels == 0 {
+		return
+	}
+	stats := currentStoreStats()
+	labeledBuckets.Lock()
+	sizes := map[string]bucketStats{}
+	for bucket, b := range stats.Buckets {
+		label := bucket
+		if !labeledBuckets.names[bucket] {
+			label = otherBucketLabel
+		}
+		sum := sizes[label]
+		sum.Bytes += b.Bytes
+		sum.LogicalBytes += b.LogicalBytes
+		sizes[label] = sum
+	}
+	labeledBuckets.Unlock()
+	for label, b := range sizes {
+		ch <- prometheus.MustNewConstMetric(bucketStoredBytesDesc, prometheus.GaugeValue, float64(b.Bytes), label)
+		ch <- prometheus.MustNewConstMetric(bucketLogicalBytesDesc, prometheus.GaugeValue, float64(b.LogicalBytes), label)
+		ch <- prometheus.MustNewConstMetric(bucketCompressionRatioDesc, prometheus.GaugeValue, compressionRatio(b.LogicalBytes, b.Bytes), label)
+	}
+}
+
+// withMetrics records the request counters and duration histogram for
+// every request, plus the bytes moved in either direction and the number
+// of requests in flight. The first two are labeled by bucket, as chosen
+// by metricsBucketLabel.
+func withMetrics(next http.Handler) http.Handler {
+	counted := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		body := &countingBody{ReadCloser: r.Body}
+		r.Body = body
+		next.ServeHTTP(rec, r)
+		bytesReceived.Add(float64(body.n))
+		bytesSent.Add(float64(rec.bytes))
+	})
+	bucketLabel := promhttp.WithLabelFromCtx("bucket", func(ctx context.Context) string {
+		label, _ := ctx.Value(bucketLabelKey{}).(string)
+		return label
+	})
+	instrumented := promhttp.InstrumentHandlerInFlight(requestsInFlight,
+		promhttp.InstrumentHandlerCounter(requestsTotal,
+			promhttp.InstrumentHandlerDuration(requestDuration, counted, bucketLabel), bucketLabel))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), bucketLabelKey{}, metricsBucketLabel(r))
+		instrumented.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// metricsBucketLabel returns the bucket label for the request's metrics:
+// "" if it names no bucket or per-bucket labels are off, the bucket if it
+// exists and is among the first metricsBucketLabels buckets served, and
+// "other" otherwise. Clients can name any bucket they like, so the cap
+// keeps them from growing the metrics without bound.
+func metricsBucketLabel(r *http.Request) string {
+	if metricsBucketLabels == 0 {
+		return ""
+	}
+	bucket, _ := requestTarget(r)
+	if bucket == "" {
+		return ""
+	}
+
+	labeledBuckets.Lock()
+	defer labeledBuckets.Unlock()
+	if labeledBuckets.names[bucket] {
+		return bucket
+	}
+	if len(labeledBuckets.names) >= metricsBucketLabels {
+		return otherBucketLabel
+	}
+	// Requests to buckets that don't exist don't use up a label
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		return otherBucketLabel
+	}
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		return otherBucketLabel
+	}
+	if labeledBuckets.names == nil {
+		labeledBuckets.names = map[string]bool{}
+	}
+	labeledBuckets.names[bucket] = true
+	return bucket
+}
+
+// currentStoreStats returns the counts of stored objects and their sizes,
+// walking the store if the last count is older than storeStatsMaxAge. A
+// failed walk keeps the last count, if any.
+func currentStoreStats() *storageStats {
+	storeStats.Lock()
+	defer storeStats.Unlock()
+	if storeStats.stats != nil && time.Since(storeStats.taken) < storeStatsMaxAge {
+		return storeStats.stats
+	}
+
+	storeStats.taken = time.Now()
+	stats, err := walkStats()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			slog.Error("Scanning store for metrics failed", "err", err)
+		}
+		if storeStats.stats != nil {
+			return storeStats.stats
+		}
+		stats = &storageStats{Buckets: map[string]bucketStats{}, CompressionRatio: 1}
+	}
+	storeStats.stats = stats
+	return stats
+}
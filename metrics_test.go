@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useBucketLabels caps per-bucket metric labels at n for the test, with
+// no buckets labeled yet.
+func useBucketLabels(t *testing.T, n int) {
+	t.Helper()
+	oldLabels, oldNames := metricsBucketLabels, labeledBuckets.names
+	metricsBucketLabels = n
+	labeledBuckets.names = nil
+	t.Cleanup(func() { metricsBucketLabels, labeledBuckets.names = oldLabels, oldNames })
+}
+
+func TestMetricsBucketLabel(t *testing.T) {
+	root := useTempRoot(t)
+	for _, bucket := range []string{"a", "b", "c"} {
+		if err := os.MkdirAll(filepath.Join(root, bucket), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	useBucketLabels(t, 2)
+
+	for _, tc := range []struct {
+		target, want string
+	}{
+		{"/", ""},
+		{"/missing/key", "other"},
+		{"/a/key", "a"},
+		{"/b", "b"},
+		{"/c/key", "other"},
+		{"/a/other-key", "a"},
+		{"/..", "other"},
+	} {
+		if got := metricsBucketLabel(httptest.NewRequest(http.MethodGet, tc.target, nil)); got != tc.want {
+			t.Errorf("label for %s = %q, want %q", tc.target, got, tc.want)
+		}
+	}
+
+	useBucketLabels(t, 0)
+	if got := metricsBucketLabel(httptest.NewRequest(http.MethodGet, "/a/key", nil)); got != "" {
+		t.Errorf("label with labels off = %q, want empty", got)
+	}
+}
+
+func TestMetricsBucketLabelVirtualHost(t *testing.T) {
+	root := useTempRoot(t)
+	if err := os.MkdirAll(filepath.Join(root, "photos"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	useBucketLabels(t, 10)
+	oldDomain := baseDomain
+	baseDomain = "s3.example.com"
+	t.Cleanup(func() { baseDomain = oldDomain })
+
+	r := httptest.NewRequest(http.MethodGet, "/cat.jpg", nil)
+	r.Host = "photos.s3.example.com"
+	if got := metricsBucketLabel(r); got != "photos" {
+		t.Errorf("label = %q, want photos", got)
+	}
+}
+
+func TestWithMetricsLabelsBucket(t *testing.T) {
+	root := useTempRoot(t)
+	if err := os.MkdirAll(filepath.Join(root, "labeled"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	useBucketLabels(t, 1)
+
+	h := withMetrics(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	counter := requestsTotal.WithLabelValues("put", "204", "labeled")
+	other := requestsTotal.WithLabelValues("put", "204", "other")
+	before, otherBefore := testutil.ToFloat64(counter), testutil.ToFloat64(other)
+	for _, target := range []string{"/labeled/a", "/labeled/b", "/unlabeled/c"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, target, nil))
+	}
+	if got := testutil.ToFloat64(counter) - before; got != 2 {
+		t.Errorf("requests counted for labeled = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(other) - otherBefore; got != 1 {
+		t.Errorf("requests counted for other = %v, want 1", got)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// loadMimeTypesFile registers extension-to-type mappings from a file with
+// mime.AddExtensionType, overriding Go's built-in table for the listed
+// extensions. Files ending in .json hold an object of extension -> type;
+// anything else is read as Apache mime.types ("type ext1 ext2 ...", with
+// # comments). It returns the number of mappings loaded.
+func loadMimeTypesFile(path string) (int, error) {
+	mappings := map[string]string{}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return 0, err
+		}
+		if err := json.Unmarshal(data, &mappings); err != nil {
+			return 0, fmt.Errorf("parsing %s: %w", path, err)
+		}
+	} else {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for lineNo := 1; scanner.Scan(); lineNo++ {
+			line := scanner.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			if len(fields) == 1 {
+				return 0, fmt.Errorf("%s:%d: type %q has no extensions", path, lineNo, fields[0])
+			}
+			for _, ext := range fields[1:] {
+				mappings[ext] = fields[0]
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return 0, err
+		}
+	}
+
+	for ext, typ := range mappings {
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		if err := mime.AddExtensionType(strings.ToLower(ext), typ); err != nil {
+			return 0, fmt.Errorf("%s: mapping %s -> %s: %w", path, ext, typ, err)
+		}
+	}
+	return len(mappings), nil
+}
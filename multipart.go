@@ -0,0 +1,1019 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Multipart uploads: parts are written below <root>/.uploads/<id>/ and
+// concatenated into the object on completion. Like transaction staging this
+// lives inside the storage root so the final rename stays on one filesystem.
+// Each upload is recorded in <id>/upload.json as well, so that uploads in
+// progress survive a restart.
+
+// Directory under the storage root holding the parts of multipart uploads
+const uploadsDirName = ".uploads"
+
+// File in an upload's directory recording it
+const uploadRecordName = "upload.json"
+
+// Uploads neither completed nor aborted this long after they were started
+// are aborted (0 = never)
+var uploadExpiry = 7 * 24 * time.Hour
+
+// Highest part number accepted (-multipart-max-parts), 10,000 as in S3
+var maxPartNumber = 10000
+
+// Smallest size of any part but the last of a completed upload
+// (-multipart-min-part-size), 5 MiB as in S3
+var minPartSize int64 = 5 << 20
+
+type multipartUpload struct {
+	id     string
+	bucket string
+	key    string
+	target string
+	dir    string
+	meta   *objectMeta // metadata given at initiation
+	// When the upload was started
+	initiated time.Time
+
+	// Part uploads hold mu shared while writing; complete and abort hold it
+	// exclusively so they never see a half-written part
+	mu   sync.RWMutex
+	done bool
+
+	partsMu sync.Mutex
+	parts   map[int]string // part number -> ETag
+}
+
+var (
+	uploadsMu sync.Mutex
+	uploads   = map[string]*multipartUpload{}
+)
+
+// isMultipartRequest reports whether a request addresses the multipart upload API.
+func isMultipartRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	_, initiate := q["uploads"]
+	_, upload := q["uploadId"]
+	return initiate || upload
+}
+
+// multipartHandler handles GET /<bucket>?uploads (list uploads), POST
+// /<bucket>/<key>?uploads (initiate), PUT ...?partNumber=N&uploadId=...
+// (upload part), GET ...?uploadId=... (list parts), POST ...?uploadId=...
+// (complete) and DELETE ...?uploadId=... (abort)
+func multipartHandler(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["uploads"]; ok && isBucketRequest(r) && r.Method == http.MethodGet {
+		listMultipartUploadsHandler(w, r)
+		return
+	}
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	q := r.URL.Query()
+	if _, ok := q["uploads"]; ok {
+		if r.Method != http.MethodPost {
+			writeMethodNotAllowed(w, r, http.MethodPost)
+			return
+		}
+		initiateMultipartUpload(w, r, bucket, key)
+		return
+	}
+
+	u, apiErr := lookupUpload(q.Get("uploadId"), bucket, key)
+	if u == nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listPartsHandler(w, r, u)
+	case http.MethodPut:
+		uploadPart(w, r, u)
+	case http.MethodPost:
+		completeMultipartUpload(w, r, u)
+	case http.MethodDelete:
+		abortUpload(u)
+		debugLog(r, "Aborted multipart upload", "upload_id", u.id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete)
+	}
+}
+
+func initiateMultipartUpload(w http.ResponseWriter, r *http.Request, bucket, key string) {
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	meta := metaFromRequest(r.Header)
+	if meta == nil {
+		writeS3Error(w, http.StatusBadRequest, "MetadataTooLarge", "Your metadata headers exceed the maximum allowed metadata size", r.URL.Path)
+		return
+	}
+	expiresAt, apiErr := requestExpiry(r.Header, time.Now())
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	meta.ExpiresAt = expiresAt
+	if meta.StorageClass, apiErr = requestStorageClass(r.Header); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	// Parts are stored the way the assembled object will be
+	meta.Encrypted = objectCipher != nil
+
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		slog.Error("Starting multipart upload failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	id := hex.EncodeToString(b[:])
+	u := &multipartUpload{
+		id:        id,
+		bucket:    bucket,
+		key:       key,
+		target:    targetPath,
+		dir:       filepath.Join(storageRootDir, uploadsDirName, id),
+		meta:      meta,
+		initiated: time.Now(),
+		parts:     map[int]string{},
+	}
+	err = makeDirs(u.dir)
+	if err == nil {
+		err = u.save()
+	}
+	if err != nil {
+		os.RemoveAll(u.dir)
+		slog.Error("Starting multipart upload failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	uploadsMu.Lock()
+	uploads[id] = u
+	uploadsMu.Unlock()
+
+	debugLog(r, "Started multipart upload", "upload_id", id)
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		UploadId string   `xml:"UploadId"`
+	}{Bucket: bucket, Key: key, UploadId: id})
+}
+
+// lookupUpload finds an in-progress upload of bucket/key, or returns the
+// error to reject the request with.
+func lookupUpload(id, bucket, key string) (*multipartUpload, *apiError) {
+	if id == "" {
+		return nil, &apiError{http.StatusBadRequest, "InvalidArgument", "Missing uploadId"}
+	}
+	uploadsMu.Lock()
+	u := uploads[id]
+	uploadsMu.Unlock()
+	if u == nil || u.bucket != bucket || u.key != key {
+		return nil, &apiError{http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist: " + id}
+	}
+	return u, nil
+}
+
+func uploadPart(w http.ResponseWriter, r *http.Request, u *multipartUpload) {
+	n, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || n < 1 || n > maxPartNumber {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Part number must be an integer between 1 and "+strconv.Itoa(maxPartNumber), r.URL.Path)
+		return
+	}
+	wantMD5, err := requestContentMD5(r)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidDigest", "The Content-MD5 you specified was not valid", r.URL.Path)
+		return
+	}
+	checksum, apiErr := requestChecksum(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	// UploadPartCopy takes the part from an existing object instead of
+	// the body
+	var body io.Reader = r.Body
+	size := r.ContentLength
+	var src *copySource
+	if r.Header.Get("x-amz-copy-source") != "" {
+		if src = openCopySource(w, r); src == nil {
+			return
+		}
+		defer src.file.Close()
+		body, size = src.content, src.size
+		wantMD5 = nil
+		if checksum != nil {
+			checksum.want, checksum.trailer = "", false
+		}
+	}
+	if maxObjectSize > 0 && size > maxObjectSize {
+		writeS3Error(w, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", r.URL.Path)
+		return
+	}
+	// Parts count against the bucket quota as they are stored; a part
+	// uploaded again frees the bytes of the one it replaces
+	partPath := filepath.Join(u.dir, strconv.Itoa(n))
+	quota, handled := respondIfOverQuota(w, r, u.bucket, size, fileSize(partPath))
+	if handled {
+		return
+	}
+	defer quota.release()
+
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.done {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist: "+u.id, r.URL.Path)
+		return
+	}
+
+	// Write to a temporary file first so a failed or concurrent retry of the
+	// part can't leave a mix of two bodies behind
+	f, err := os.CreateTemp(u.dir, "part-*")
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) && !respondIfDiskFull(w, r, err) {
+			slog.Error("Creating part file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+	if maxObjectSize > 0 {
+		body = &sizeLimitedReader{r: body, remaining: maxObjectSize}
+	}
+	if quota != nil {
+		body = &quotaReader{r: body, q: quota}
+	}
+	var out io.Writer = f
+	var enc *encryptingWriter
+	if u.meta.Encrypted {
+		if enc, err = newEncryptingWriter(f); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			slog.Error("Writing part file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		out = enc
+	}
+	hash := md5.New()
+	writers := []io.Writer{out, hash}
+	if checksum != nil {
+		writers = append(writers, checksum.hash)
+	}
+	copied, err := io.Copy(io.MultiWriter(writers...), body)
+	if err == nil && src == nil {
+		err = checkBodyLength(r, copied)
+	}
+	if err == nil && enc != nil {
+		err = enc.Close()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		if errors.Is(err, errContentSHA256Mismatch) {
+			writeS3Error(w, http.StatusBadRequest, "XAmzContentSHA256Mismatch", "The provided x-amz-content-sha256 does not match what was computed", r.URL.Path)
+			return
+		}
+		if errors.Is(err, errEntityTooLarge) {
+			debugLog(r, "Discarded part over -max-object-size", "upload_id", u.id, "part", n, "bytes_received", copied, "max_object_size", maxObjectSize)
+			writeS3Error(w, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", r.URL.Path)
+			return
+		}
+		if errors.Is(err, errQuotaExceeded) {
+			writeQuotaExceeded(w, r, u.bucket)
+			return
+		}
+		if respondIfChunkError(w, r, err) {
+			return
+		}
+		if respondIfRequestTimeout(w, r, err) {
+			return
+		}
+		if uploadAborted(r, err) {
+			slog.Info("Part upload aborted by client", "upload_id", u.id, "part", n, "err", err)
+			writeS3Error(w, http.StatusBadRequest, "IncompleteBody", "You did not provide the number of bytes specified by the Content-Length HTTP header.", r.URL.Path)
+			return
+		}
+		if respondIfDiskFull(w, r, err) {
+			return
+		}
+		slog.Error("Writing part file failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	sum := hash.Sum(nil)
+	if wantMD5 != nil && !bytes.Equal(sum, wantMD5) {
+		os.Remove(f.Name())
+		writeS3Error(w, http.StatusBadRequest, "BadDigest", "The Content-MD5 you specified did not match what we received", r.URL.Path)
+		return
+	}
+	etag := "\"" + hex.EncodeToString(sum) + "\""
+	// Part checksums are verified but not kept: the assembled object has
+	// no checksum of its own
+	var partChecksum string
+	if checksum != nil {
+		if partChecksum, apiErr = checksum.verify(r); apiErr != nil {
+			os.Remove(f.Name())
+			writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+			return
+		}
+	}
+
+	u.partsMu.Lock()
+	stored := fileSize(f.Name())
+	replacedPart := fileSize(partPath)
+	err = renameFile(f.Name(), partPath)
+	if err == nil {
+		u.parts[n] = etag
+		quota.settle(stored - replacedPart)
+		if err := u.save(); err != nil {
+			// Not fatal until a restart, which forgets the part
+			slog.Error("Saving multipart upload failed", "upload_id", u.id, "err", err)
+		}
+	}
+	u.partsMu.Unlock()
+	if err != nil {
+		os.Remove(f.Name())
+		slog.Error("Storing part failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+
+	debugLog(r, "Stored multipart upload part", "upload_id", u.id, "part", n, "bytes", copied)
+	if checksum != nil {
+		w.Header().Set(checksum.alg.header, partChecksum)
+	}
+	if src != nil {
+		if src.versionID != "" {
+			w.Header().Set("x-amz-copy-source-version-id", src.versionID)
+		}
+		writeCopyResult(w, "CopyPartResult", etag, time.Now())
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+type completeMultipartUploadRequest struct {
+	Parts []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+func completeMultipartUpload(w http.ResponseWriter, r *http.Request, u *multipartUpload) {
+	var req completeMultipartUploadRequest
+	body, err := spoolBody(r.Body)
+	if respondIfSpoolFailed(w, r, err) {
+		return
+	}
+	if err == nil {
+		err = xml.NewDecoder(body).Decode(&req)
+		body.Close()
+	}
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", "The CompleteMultipartUpload document is not well-formed", r.URL.Path)
+		return
+	}
+	if len(req.Parts) == 0 {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", "The CompleteMultipartUpload document lists no parts", r.URL.Path)
+		return
+	}
+
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist: "+u.id, r.URL.Path)
+		return
+	}
+
+	// Parts must be listed as 1, 2, 3, ... and match what was uploaded
+	hash := md5.New()
+	var size int64
+	for i, p := range req.Parts {
+		if p.PartNumber != i+1 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPartOrder", "Parts must be listed in contiguous ascending order starting at 1", r.URL.Path)
+			return
+		}
+		etag, ok := u.parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, "\"") != strings.Trim(etag, "\"") {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart", "Part "+strconv.Itoa(p.PartNumber)+" was not uploaded or its ETag does not match", r.URL.Path)
+			return
+		}
+		sum, _ := hex.DecodeString(strings.Trim(etag, "\""))
+		hash.Write(sum)
+		fi, err := os.Stat(filepath.Join(u.dir, strconv.Itoa(p.PartNumber)))
+		if err != nil {
+			slog.Error("Stating part failed", "upload_id", u.id, "part", p.PartNumber, "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		partSize := contentSize(fi, u.meta)
+		if i < len(req.Parts)-1 && partSize < minPartSize {
+			writeS3Error(w, http.StatusBadRequest, "EntityTooSmall", "Your proposed upload is smaller than the minimum allowed size: part "+strconv.Itoa(p.PartNumber)+" is "+strconv.FormatInt(partSize, 10)+" bytes, and every part but the last must be at least "+strconv.FormatInt(minPartSize, 10), r.URL.Path)
+			return
+		}
+		size += partSize
+	}
+	if maxObjectSize > 0 && size > maxObjectSize {
+		writeS3Error(w, http.StatusBadRequest, "EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size.", r.URL.Path)
+		return
+	}
+	etag := fmt.Sprintf("\"%s-%d\"", hex.EncodeToString(hash.Sum(nil)), len(req.Parts))
+
+	// A key can't be both an object and a folder prefix of other objects
+	if fi, err := os.Stat(u.target); err == nil && fi.IsDir() {
+		writeS3Error(w, http.StatusConflict, "KeyConflict", "Key "+u.key+" is a folder prefix of existing objects", r.URL.Path)
+		return
+	}
+	if err := makeDirs(filepath.Dir(u.target)); err != nil {
+		if errors.Is(err, syscall.ENOTDIR) {
+			writeS3Error(w, http.StatusConflict, "KeyConflict", "A parent of key "+u.key+" is an existing object", r.URL.Path)
+			return
+		}
+		slog.Error("Creating directories failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+
+	defer lockObject(u.target)()
+	// The parts are removed once the object is assembled from them, and
+	// the object replaced is freed unless kept as a noncurrent version
+	versioned := bucketVersioning(u.bucket) != ""
+	var replaced int64
+	if !versioned {
+		replaced = objectSize(u.target)
+	}
+	if bucketQuota > 0 {
+		parts, err := walkUsage(u.dir)
+		if err != nil {
+			slog.Error("Computing bucket usage failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		replaced += parts
+	}
+	quota, handled := respondIfOverQuota(w, r, u.bucket, size, replaced)
+	if handled {
+		return
+	}
+	defer quota.release()
+	assembled := filepath.Join(u.dir, "object")
+	if err := concatParts(assembled, u.dir, len(req.Parts), u.meta.Encrypted, compressObjects); err != nil {
+		os.Remove(assembled)
+		if !respondIfOutOfFDs(w, r, err) && !respondIfDiskFull(w, r, err) {
+			slog.Error("Assembling multipart upload failed", "upload_id", u.id, "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+	var versionID string
+	if versioned {
+		versionID, err = publishVersion(u.bucket, u.key, u.target, assembled)
+	} else {
+		err = renameFile(assembled, u.target)
+	}
+	if err != nil {
+		os.Remove(assembled)
+		if errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.EEXIST) {
+			writeS3Error(w, http.StatusConflict, "KeyConflict", "Key "+u.key+" is a folder prefix of existing objects", r.URL.Path)
+			return
+		}
+		slog.Error("Publishing multipart upload failed", "upload_id", u.id, "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	u.done = true
+	forgetUpload(u)
+
+	u.meta.ETag = etag
+	if compressObjects {
+		u.meta.Compressed, u.meta.ContentSize = true, size
+	}
+	if fi, err := os.Stat(u.target); err != nil {
+		slog.Error("Stating file failed", "err", err)
+		forgetUsage(u.bucket)
+	} else {
+		quota.settle(fi.Size() - replaced)
+		if err := writeMeta(u.target, fi, u.meta); err != nil {
+			slog.Error("Writing metadata failed", "err", err)
+		}
+	}
+
+	debugLog(r, "Completed multipart upload", "upload_id", u.id, "parts", len(req.Parts))
+	setVersionHeaders(w, versionID, false)
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+		Location string   `xml:"Location"`
+		Bucket   string   `xml:"Bucket"`
+		Key      string   `xml:"Key"`
+		ETag     string   `xml:"ETag"`
+	}{Location: objectURL(r, u.bucket, u.key), Bucket: u.bucket, Key: u.key, ETag: etag})
+}
+
+// concatParts writes parts 1..n stored in dir, in order, to dst. Encrypted
+// parts are decrypted and their content encrypted afresh as one object, and
+// with compress it is compressed for the object as well.
+func concatParts(dst, dir string, n int, encrypted, compress bool) error {
+	out, err := createFile(dst)
+	if err != nil {
+		return err
+	}
+	var w io.Writer = out
+	var enc *encryptingWriter
+	if encrypted {
+		if enc, err = newEncryptingWriter(out); err != nil {
+			out.Close()
+			return err
+		}
+		w = enc
+	}
+	var gz *gzip.Writer
+	if compress {
+		if gz, err = newCompressingWriter(w); err != nil {
+			out.Close()
+			return err
+		}
+		w = gz
+	}
+	for i := 1; i <= n; i++ {
+		in, err := os.Open(filepath.Join(dir, strconv.Itoa(i)))
+		if err != nil {
+			out.Close()
+			return err
+		}
+		var part io.Reader = in
+		if encrypted {
+			var fi os.FileInfo
+			if fi, err = in.Stat(); err == nil {
+				part, err = newDecryptingReader(in, fi.Size())
+			}
+		}
+		if err == nil {
+			_, err = io.Copy(w, part)
+		}
+		in.Close()
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	if enc != nil {
+		if err := enc.Close(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// abortUpload discards an upload and its parts.
+func abortUpload(u *multipartUpload) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.done {
+		return
+	}
+	u.done = true
+	dropDirUsage(u.bucket, u.dir)
+	forgetUpload(u)
+}
+
+type listMultipartUploadsResult struct {
+	XMLName            xml.Name       `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListMultipartUploadsResult"`
+	Bucket             string         `xml:"Bucket"`
+	KeyMarker          string         `xml:"KeyMarker"`
+	UploadIdMarker     string         `xml:"UploadIdMarker"`
+	NextKeyMarker      string         `xml:"NextKeyMarker,omitempty"`
+	NextUploadIdMarker string         `xml:"NextUploadIdMarker,omitempty"`
+	Prefix             string         `xml:"Prefix"`
+	Delimiter          string         `xml:"Delimiter,omitempty"`
+	MaxUploads         int            `xml:"MaxUploads"`
+	EncodingType       string         `xml:"EncodingType,omitempty"`
+	IsTruncated        bool           `xml:"IsTruncated"`
+	Uploads            []listedUpload `xml:"Upload"`
+	CommonPrefixes     []commonPrefix `xml:"CommonPrefixes"`
+}
+
+type listedUpload struct {
+	Key          string   `xml:"Key"`
+	UploadId     string   `xml:"UploadId"`
+	Initiator    struct{} `xml:"Initiator"`
+	Owner        struct{} `xml:"Owner"`
+	StorageClass string   `xml:"StorageClass"`
+	Initiated    string   `xml:"Initiated"`
+
+	initiated time.Time
+}
+
+// listMultipartUploadsHandler handles GET /<bucket>?uploads
+// (ListMultipartUploads): the uploads of the bucket neither completed nor
+// aborted, by key and then by when they were started. It honors prefix,
+// delimiter, key-marker, upload-id-marker and max-uploads.
+func listMultipartUploadsHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := splitRequestPath(r)[0]
+	q := r.URL.Query()
+	encode, apiErr := listKeyEncoder(q)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	prefix, delimiter := q.Get("prefix"), q.Get("delimiter")
+	keyMarker, uploadIDMarker := q.Get("key-marker"), q.Get("upload-id-marker")
+	maxUploads := maxListKeys
+	if s := q.Get("max-uploads"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "max-uploads must be a non-negative integer", r.URL.Path)
+			return
+		}
+		if n < maxUploads {
+			maxUploads = n
+		}
+	}
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", r.URL.Path)
+		return
+	}
+
+	var all []listedUpload
+	uploadsMu.Lock()
+	for _, u := range uploads {
+		if u.bucket == bucket && strings.HasPrefix(u.key, prefix) {
+			all = append(all, listedUpload{Key: u.key, UploadId: u.id, StorageClass: storageClass(u.meta), initiated: u.initiated})
+		}
+	}
+	uploadsMu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i], all[j]
+		if a.Key != b.Key {
+			return a.Key < b.Key
+		}
+		if !a.initiated.Equal(b.initiated) {
+			return a.initiated.Before(b.initiated)
+		}
+		return a.UploadId < b.UploadId
+	})
+
+	// Resume after the marker: past all of key-marker's uploads, or just
+	// past upload-id-marker of it
+	if keyMarker != "" {
+		start := len(all)
+		for i, u := range all {
+			if u.Key > keyMarker {
+				start = i
+				break
+			}
+			if u.Key == keyMarker && uploadIDMarker != "" && u.UploadId == uploadIDMarker {
+				start = i + 1
+				break
+			}
+		}
+		all = all[start:]
+	}
+
+	// With a delimiter, keys containing it after the prefix are rolled up
+	// into common prefixes, which count against max-uploads, as in listings
+	result := listMultipartUploadsResult{
+		Bucket:         bucket,
+		KeyMarker:      encode(keyMarker),
+		UploadIdMarker: uploadIDMarker,
+		Prefix:         encode(prefix),
+		Delimiter:      encode(delimiter),
+		MaxUploads:     maxUploads,
+		EncodingType:   q.Get("encoding-type"),
+	}
+	lastKey, lastID := "", ""
+	for _, u := range all {
+		cp := ""
+		if delimiter != "" {
+			if i := strings.Index(u.Key[len(prefix):], delimiter); i >= 0 {
+				cp = u.Key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if cp != "" && (cp == lastKey || (keyMarker != "" && cp <= keyMarker)) {
+			continue
+		}
+		if len(result.Uploads)+len(result.CommonPrefixes) == maxUploads {
+			result.IsTruncated = true
+			break
+		}
+		if cp != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(cp)})
+			lastKey, lastID = cp, ""
+			continue
+		}
+		u.Initiated = u.initiated.UTC().Format(s3TimeFormat)
+		lastKey, lastID = u.Key, u.UploadId
+		u.Key = encode(u.Key)
+		result.Uploads = append(result.Uploads, u)
+	}
+	if result.IsTruncated && lastKey != "" {
+		result.NextKeyMarker, result.NextUploadIdMarker = encode(lastKey), lastID
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Writing multipart upload listing failed", "err", err)
+	}
+	debugLog(r, "Listed multipart uploads", "uploads", len(result.Uploads))
+}
+
+type listPartsResult struct {
+	XMLName              xml.Name     `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListPartsResult"`
+	Bucket               string       `xml:"Bucket"`
+	Key                  string       `xml:"Key"`
+	UploadId             string       `xml:"UploadId"`
+	Initiator            struct{}     `xml:"Initiator"`
+	Owner                struct{}     `xml:"Owner"`
+	StorageClass         string       `xml:"StorageClass"`
+	PartNumberMarker     int          `xml:"PartNumberMarker"`
+	NextPartNumberMarker int          `xml:"NextPartNumberMarker,omitempty"`
+	MaxParts             int          `xml:"MaxParts"`
+	EncodingType         string       `xml:"EncodingType,omitempty"`
+	IsTruncated          bool         `xml:"IsTruncated"`
+	Parts                []listedPart `xml:"Part"`
+}
+
+type listedPart struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+// listPartsHandler handles GET /<bucket>/<key>?uploadId=... (ListParts):
+// the parts of the upload stored so far, by part number, honoring
+// part-number-marker and max-parts.
+func listPartsHandler(w http.ResponseWriter, r *http.Request, u *multipartUpload) {
+	q := r.URL.Query()
+	encode, apiErr := listKeyEncoder(q)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	marker := 0
+	if s := q.Get("part-number-marker"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "part-number-marker must be a non-negative integer", r.URL.Path)
+			return
+		}
+		marker = n
+	}
+	maxParts := maxListKeys
+	if s := q.Get("max-parts"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "max-parts must be a non-negative integer", r.URL.Path)
+			return
+		}
+		if n < maxParts {
+			maxParts = n
+		}
+	}
+
+	// Held shared so completion or abort can't remove the parts meanwhile
+	u.mu.RLock()
+	defer u.mu.RUnlock()
+	if u.done {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload", "The specified upload does not exist: "+u.id, r.URL.Path)
+		return
+	}
+	u.partsMu.Lock()
+	numbers := make([]int, 0, len(u.parts))
+	etags := make(map[int]string, len(u.parts))
+	for n, etag := range u.parts {
+		if n > marker {
+			numbers = append(numbers, n)
+			etags[n] = etag
+		}
+	}
+	u.partsMu.Unlock()
+	sort.Ints(numbers)
+
+	result := listPartsResult{
+		Bucket:           u.bucket,
+		Key:              encode(u.key),
+		UploadId:         u.id,
+		StorageClass:     storageClass(u.meta),
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+		EncodingType:     q.Get("encoding-type"),
+		Parts:            []listedPart{},
+	}
+	for _, n := range numbers {
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		fi, err := os.Stat(filepath.Join(u.dir, strconv.Itoa(n)))
+		if err != nil {
+			if !respondIfOutOfFDs(w, r, err) {
+				slog.Error("Stating part failed", "upload_id", u.id, "part", n, "err", err)
+				writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			}
+			return
+		}
+		result.Parts = append(result.Parts, listedPart{
+			PartNumber:   n,
+			LastModified: fi.ModTime().UTC().Format(s3TimeFormat),
+			ETag:         etags[n],
+			Size:         storedSize(fi, u.meta),
+		})
+	}
+	if result.IsTruncated && len(result.Parts) > 0 {
+		result.NextPartNumberMarker = result.Parts[len(result.Parts)-1].PartNumber
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Writing part listing failed", "err", err)
+	}
+	debugLog(r, "Listed multipart upload parts", "upload_id", u.id, "parts", len(result.Parts))
+}
+
+// uploadRecord is what upload.json records of an upload.
+type uploadRecord struct {
+	Bucket    string         `json:"bucket"`
+	Key       string         `json:"key"`
+	Meta      *objectMeta    `json:"meta"`
+	Initiated time.Time      `json:"initiated"`
+	Parts     map[int]string `json:"parts"` // part number -> ETag
+}
+
+// save records the upload in its directory. Unless the upload is new,
+// u.partsMu must be held.
+func (u *multipartUpload) save() error {
+	data, err := json.Marshal(uploadRecord{
+		Bucket:    u.bucket,
+		Key:       u.key,
+		Meta:      u.meta,
+		Initiated: u.initiated,
+		Parts:     u.parts,
+	})
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(u.dir, uploadRecordName), data)
+}
+
+// loadUploads picks up the uploads left in progress by a previous run.
+// Those that have expired, or whose record is missing or unreadable, are
+// discarded, as are the leftovers of part uploads and completions the
+// restart interrupted.
+func loadUploads() error {
+	dir := filepath.Join(storageRootDir, uploadsDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	now := time.Now()
+	for _, e := range entries {
+		u, err := loadUpload(filepath.Join(dir, e.Name()), e.Name())
+		if err == nil && uploadExpiry > 0 && now.Sub(u.initiated) > uploadExpiry {
+			err = errors.New("expired")
+		}
+		if err != nil {
+			slog.Warn("Discarding stale multipart upload", "upload_id", e.Name(), "err", err)
+			if err := os.RemoveAll(filepath.Join(dir, e.Name())); err != nil {
+				return err
+			}
+			continue
+		}
+		uploads[u.id] = u
+	}
+	if len(uploads) > 0 {
+		slog.Info("Resumed multipart uploads", "count", len(uploads))
+	}
+	return nil
+}
+
+// loadUpload reads the upload stored in dir, removing what isn't one of
+// its parts.
+func loadUpload(dir, id string) (*multipartUpload, error) {
+	data, err := os.ReadFile(filepath.Join(dir, uploadRecordName))
+	if err != nil {
+		return nil, err
+	}
+	var rec uploadRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, err
+	}
+	if rec.Meta == nil {
+		return nil, errors.New("no metadata recorded")
+	}
+	target, err := sanitizePath(rec.Bucket, rec.Key)
+	if err != nil {
+		return nil, err
+	}
+	u := &multipartUpload{
+		id:        id,
+		bucket:    rec.Bucket,
+		key:       rec.Key,
+		target:    target,
+		dir:       dir,
+		meta:      rec.Meta,
+		initiated: rec.Initiated,
+		parts:     map[int]string{},
+	}
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		n, err := strconv.Atoi(f.Name())
+		if etag, ok := rec.Parts[n]; err == nil && ok {
+			u.parts[n] = etag
+		} else if f.Name() != uploadRecordName {
+			os.RemoveAll(filepath.Join(dir, f.Name()))
+		}
+	}
+	return u, nil
+}
+
+// runUploadJanitor aborts multipart uploads started longer than
+// uploadExpiry ago. It never returns.
+func runUploadJanitor() {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*multipartUpload
+		uploadsMu.Lock()
+		for _, u := range uploads {
+			if time.Since(u.initiated) > uploadExpiry {
+				expired = append(expired, u)
+			}
+		}
+		uploadsMu.Unlock()
+		for _, u := range expired {
+			slog.Info("Aborting expired multipart upload", "upload_id", u.id, "bucket", u.bucket, "key", u.key, "expiry", uploadExpiry.String())
+			abortUpload(u)
+		}
+	}
+}
+
+func forgetUpload(u *multipartUpload) {
+	uploadsMu.Lock()
+	delete(uploads, u.id)
+	uploadsMu.Unlock()
+	if err := os.RemoveAll(u.dir); err != nil {
+		slog.Error("Removing multipart upload parts failed", "upload_id", u.id, "err", err)
+	}
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// useUploads starts the test without multipart uploads in progress.
+func useUploads(t *testing.T) {
+	t.Helper()
+	old := uploads
+	uploads = map[string]*multipartUpload{}
+	t.Cleanup(func() { uploads = old })
+}
+
+func TestLoadUploads(t *testing.T) {
+	root := useTempRoot(t)
+	useUploads(t)
+
+	dir := filepath.Join(root, uploadsDirName)
+	saved := &multipartUpload{
+		id:        "live",
+		bucket:    "b",
+		key:       "dir/k",
+		dir:       filepath.Join(dir, "live"),
+		meta:      &objectMeta{ContentType: "text/plain"},
+		initiated: time.Now().Add(-time.Hour),
+		parts:     map[int]string{1: `"etag1"`},
+	}
+	writeTestFile(t, filepath.Join(saved.dir, "1"), "part one")
+	// Interrupted part upload and completion
+	writeTestFile(t, filepath.Join(saved.dir, "part-123"), "half a part")
+	writeTestFile(t, filepath.Join(saved.dir, "object"), "half an object")
+	// Stored but not recorded before the restart
+	writeTestFile(t, filepath.Join(saved.dir, "2"), "part two")
+	if err := saved.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	expired := &multipartUpload{
+		id:        "expired",
+		bucket:    "b",
+		key:       "k",
+		dir:       filepath.Join(dir, "expired"),
+		meta:      &objectMeta{},
+		initiated: time.Now().Add(-2 * uploadExpiry),
+		parts:     map[int]string{},
+	}
+	writeTestFile(t, filepath.Join(expired.dir, "1"), "part")
+	if err := expired.save(); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir, "unrecorded", "1"), "part")
+
+	if err := loadUploads(); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 1 {
+		t.Fatalf("loaded %d uploads, want 1", len(uploads))
+	}
+	u := uploads["live"]
+	if u == nil {
+		t.Fatal("upload not loaded")
+	}
+	if u.bucket != "b" || u.key != "dir/k" || u.meta.ContentType != "text/plain" {
+		t.Errorf("loaded bucket %q, key %q, content type %q", u.bucket, u.key, u.meta.ContentType)
+	}
+	if want, _ := sanitizePath("b", "dir/k"); u.target != want {
+		t.Errorf("target = %q, want %q", u.target, want)
+	}
+	if !u.initiated.Equal(saved.initiated) {
+		t.Errorf("initiated = %v, want %v", u.initiated, saved.initiated)
+	}
+	if len(u.parts) != 1 || u.parts[1] != `"etag1"` {
+		t.Errorf("parts = %v, want part 1 only", u.parts)
+	}
+	for _, name := range []string{"part-123", "object", "2"} {
+		if _, err := os.Stat(filepath.Join(u.dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s left in the upload's directory", name)
+		}
+	}
+	for _, id := range []string{"expired", "unrecorded"} {
+		if _, err := os.Stat(filepath.Join(dir, id)); !os.IsNotExist(err) {
+			t.Errorf("directory of discarded upload %s left behind", id)
+		}
+	}
+}
+
+func TestShortPartBody(t *testing.T) {
+	useTempRoot(t)
+	useUploads(t)
+	w := serve(t, "POST", "/b/k?uploads", nil, nil)
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &initiated); err != nil || initiated.UploadId == "" {
+		t.Fatalf("initiating: %d %s", w.Code, w.Body)
+	}
+
+	r := httptest.NewRequest("PUT", "/b/k?partNumber=1&uploadId="+initiated.UploadId, strings.NewReader("0123456789"))
+	r.ContentLength = 1000
+	w = httptest.NewRecorder()
+	serveAPI(w, r)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<Code>IncompleteBody</Code>") {
+		t.Errorf("part with a short body: %d %s, want 400 IncompleteBody", w.Code, w.Body)
+	}
+	u := uploads[initiated.UploadId]
+	if len(u.parts) != 0 {
+		t.Errorf("short part recorded: %v", u.parts)
+	}
+	entries, err := os.ReadDir(u.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != uploadRecordName {
+		t.Errorf("upload directory holds %d files after the short part", len(entries))
+	}
+}
+
+// initiateUpload starts a multipart upload of target and returns its ID.
+func initiateUpload(t *testing.T, target string) string {
+	t.Helper()
+	w := serve(t, "POST", target+"?uploads", nil, nil)
+	var initiated struct {
+		UploadId string `xml:"UploadId"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &initiated); err != nil || initiated.UploadId == "" {
+		t.Fatalf("initiating %s: %d %s", target, w.Code, w.Body)
+	}
+	return initiated.UploadId
+}
+
+// uploadTestPart stores part n of an upload of target and returns its ETag.
+func uploadTestPart(t *testing.T, target, id string, n int, content string) string {
+	t.Helper()
+	w := serve(t, "PUT", target+"?partNumber="+strconv.Itoa(n)+"&uploadId="+id, strings.NewReader(content), nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("uploading part %d of %s: %d %s", n, target, w.Code, w.Body)
+	}
+	return w.Header().Get("ETag")
+}
+
+func TestListMultipartUploads(t *testing.T) {
+	useTempRoot(t)
+	useUploads(t)
+	if w := serve(t, "PUT", "/b", nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("creating bucket: %d %s", w.Code, w.Body)
+	}
+
+	// Started concurrently, as by a client uploading a folder
+	keys := []string{"a", "dir/x", "dir/y", "dir/sub/z", "k", "k", "other/w"}
+	ids := make([]string, len(keys))
+	var wg sync.WaitGroup
+	for i, key := range keys {
+		wg.Add(1)
+		go func(i int, key string) {
+			defer wg.Done()
+			ids[i] = initiateUpload(t, "/b/"+key)
+		}(i, key)
+	}
+	wg.Wait()
+	initiateUpload(t, "/elsewhere/a")
+	// Completed and aborted uploads are not listed
+	etag := uploadTestPart(t, "/b/a", ids[0], 1, "content")
+	complete := `<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>` + etag + `</ETag></Part></CompleteMultipartUpload>`
+	if w := serve(t, "POST", "/b/a?uploadId="+ids[0], strings.NewReader(complete), nil); w.Code != http.StatusOK {
+		t.Fatalf("completing: %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, "DELETE", "/b/other/w?uploadId="+ids[6], nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("aborting: %d %s", w.Code, w.Body)
+	}
+
+	type listing struct {
+		NextKeyMarker      string
+		NextUploadIdMarker string
+		IsTruncated        bool
+		Uploads            []struct{ Key, UploadId, Initiated string } `xml:"Upload"`
+		CommonPrefixes     []struct{ Prefix string }
+	}
+	list := func(query string) listing {
+		t.Helper()
+		w := serve(t, "GET", "/b?uploads"+query, nil, nil)
+		var l listing
+		if err := xml.Unmarshal(w.Body.Bytes(), &l); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("listing uploads%s: %d %s", query, w.Code, w.Body)
+		}
+		return l
+	}
+
+	// Page through them one at a time
+	var listed []string
+	query := "&max-uploads=1"
+	for pages := 0; ; pages++ {
+		if pages > len(keys) {
+			t.Fatal("listing doesn't end")
+		}
+		l := list(query)
+		for _, u := range l.Uploads {
+			if _, err := time.Parse(s3TimeFormat, u.Initiated); err != nil {
+				t.Errorf("upload %s initiated %q", u.UploadId, u.Initiated)
+			}
+			listed = append(listed, u.Key+" "+u.UploadId)
+		}
+		if !l.IsTruncated {
+			break
+		}
+		query = "&max-uploads=1&key-marker=" + url.QueryEscape(l.NextKeyMarker) + "&upload-id-marker=" + l.NextUploadIdMarker
+	}
+	firstK, secondK := ids[4], ids[5]
+	if uploads[firstK].initiated.After(uploads[secondK].initiated) {
+		firstK, secondK = secondK, firstK
+	}
+	want := []string{"dir/sub/z " + ids[3], "dir/x " + ids[1], "dir/y " + ids[2], "k " + firstK, "k " + secondK}
+	if strings.Join(listed, ",") != strings.Join(want, ",") {
+		t.Errorf("listed %q, want %q", listed, want)
+	}
+
+	l := list("&prefix=dir/&delimiter=/")
+	if len(l.Uploads) != 2 || l.Uploads[0].Key != "dir/x" || l.Uploads[1].Key != "dir/y" || len(l.CommonPrefixes) != 1 || l.CommonPrefixes[0].Prefix != "dir/sub/" {
+		t.Errorf("listing with a delimiter: %+v", l)
+	}
+	l = list("&key-marker=k")
+	if len(l.Uploads) != 0 {
+		t.Errorf("listing after key-marker k: %+v", l)
+	}
+	if w := serve(t, "GET", "/b?uploads&max-uploads=x", nil, nil); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid max-uploads: %d", w.Code)
+	}
+	if w := serve(t, "GET", "/missing?uploads", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("listing uploads of a missing bucket: %d", w.Code)
+	}
+}
+
+func TestListParts(t *testing.T) {
+	useTempRoot(t)
+	useUploads(t)
+	id := initiateUpload(t, "/b/k")
+	etags := map[int]string{}
+	for _, n := range []int{5, 1, 2} {
+		etags[n] = uploadTestPart(t, "/b/k", id, n, strings.Repeat("x", n))
+	}
+
+	type listing struct {
+		NextPartNumberMarker int
+		IsTruncated          bool
+		Parts                []struct {
+			PartNumber   int
+			ETag         string
+			Size         int64
+			LastModified string
+		} `xml:"Part"`
+	}
+	list := func(query string) listing {
+		t.Helper()
+		w := serve(t, "GET", "/b/k?uploadId="+id+query, nil, nil)
+		var l listing
+		if err := xml.Unmarshal(w.Body.Bytes(), &l); w.Code != http.StatusOK || err != nil {
+			t.Fatalf("listing parts%s: %d %s", query, w.Code, w.Body)
+		}
+		return l
+	}
+
+	l := list("&max-parts=2")
+	if !l.IsTruncated || l.NextPartNumberMarker != 2 || len(l.Parts) != 2 || l.Parts[0].PartNumber != 1 || l.Parts[1].PartNumber != 2 {
+		t.Fatalf("first page: %+v", l)
+	}
+	l2 := list("&part-number-marker=2")
+	if l2.IsTruncated || len(l2.Parts) != 1 || l2.Parts[0].PartNumber != 5 {
+		t.Fatalf("second page: %+v", l2)
+	}
+	for _, p := range append(l.Parts, l2.Parts...) {
+		if p.ETag != etags[p.PartNumber] || p.Size != int64(p.PartNumber) {
+			t.Errorf("part %d: ETag %s, size %d; want %s, %d", p.PartNumber, p.ETag, p.Size, etags[p.PartNumber], p.PartNumber)
+		}
+		if _, err := time.Parse(s3TimeFormat, p.LastModified); err != nil {
+			t.Errorf("part %d last modified %q", p.PartNumber, p.LastModified)
+		}
+	}
+
+	for _, target := range []string{"/b/k?uploadId=unknown", "/b/other?uploadId=" + id} {
+		w := serve(t, "GET", target, nil, nil)
+		if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "<Code>NoSuchUpload</Code>") {
+			t.Errorf("GET %s: %d %s, want 404 NoSuchUpload", target, w.Code, w.Body)
+		}
+	}
+}
+
+// completeTestUpload completes the upload of target from the parts with
+// the given ETags, numbered from 1.
+func completeTestUpload(t *testing.T, target, id string, etags ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	var doc strings.Builder
+	doc.WriteString("<CompleteMultipartUpload>")
+	for i, etag := range etags {
+		doc.WriteString("<Part><PartNumber>" + strconv.Itoa(i+1) + "</PartNumber><ETag>" + etag + "</ETag></Part>")
+	}
+	doc.WriteString("</CompleteMultipartUpload>")
+	return serve(t, "POST", target+"?uploadId="+id, strings.NewReader(doc.String()), nil)
+}
+
+func TestMinimumPartSize(t *testing.T) {
+	root := useTempRoot(t)
+	useUploads(t)
+	id := initiateUpload(t, "/b/k")
+	small := uploadTestPart(t, "/b/k", id, 1, strings.Repeat("a", int(minPartSize-1)))
+	last := uploadTestPart(t, "/b/k", id, 2, "tail")
+
+	w := completeTestUpload(t, "/b/k", id, small, last)
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<Code>EntityTooSmall</Code>") {
+		t.Fatalf("completing with an undersized first part: %d %s, want 400 EntityTooSmall", w.Code, w.Body)
+	}
+	if _, exists := readTestFile(t, filepath.Join(root, "b", "k")); exists {
+		t.Fatal("refused upload stored")
+	}
+
+	// The upload is still in progress, and the part can be sent again
+	full := uploadTestPart(t, "/b/k", id, 1, strings.Repeat("a", int(minPartSize)))
+	if w := completeTestUpload(t, "/b/k", id, full, last); w.Code != http.StatusOK {
+		t.Fatalf("completing with a full first part: %d %s", w.Code, w.Body)
+	}
+	if got, _ := readTestFile(t, filepath.Join(root, "b", "k")); int64(len(got)) != minPartSize+4 {
+		t.Errorf("stored %d bytes, want %d", len(got), minPartSize+4)
+	}
+
+	// Only the last part may be small, however small the limit
+	old := minPartSize
+	minPartSize = 0
+	t.Cleanup(func() { minPartSize = old })
+	id = initiateUpload(t, "/b/tiny")
+	a, b := uploadTestPart(t, "/b/tiny", id, 1, "a"), uploadTestPart(t, "/b/tiny", id, 2, "b")
+	if w := completeTestUpload(t, "/b/tiny", id, a, b); w.Code != http.StatusOK {
+		t.Errorf("completing tiny parts with -multipart-min-part-size 0: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestPartNumberLimit(t *testing.T) {
+	useTempRoot(t)
+	useUploads(t)
+	old := maxPartNumber
+	maxPartNumber = 3
+	t.Cleanup(func() { maxPartNumber = old })
+	id := initiateUpload(t, "/b/k")
+	for _, n := range []string{"0", "4", "-1", "x"} {
+		w := serve(t, "PUT", "/b/k?partNumber="+n+"&uploadId="+id, strings.NewReader("part"), nil)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<Code>InvalidArgument</Code>") {
+			t.Errorf("part number %s: %d %s, want 400 InvalidArgument", n, w.Code, w.Body)
+		}
+	}
+	uploadTestPart(t, "/b/k", id, 3, "part")
+}
+
+func TestCompositeETag(t *testing.T) {
+	useTempRoot(t)
+	useUploads(t)
+	oldMin := minPartSize
+	minPartSize = 0
+	t.Cleanup(func() { minPartSize = oldMin })
+
+	id := initiateUpload(t, "/b/k")
+	parts := []string{"hello ", "world"}
+	var etags []string
+	var partSums []byte
+	for i, content := range parts {
+		etags = append(etags, uploadTestPart(t, "/b/k", id, i+1, content))
+		sum := md5.Sum([]byte(content))
+		partSums = append(partSums, sum[:]...)
+	}
+	sum := md5.Sum(partSums)
+	want := `"` + hex.EncodeToString(sum[:]) + `-2"`
+
+	w := completeTestUpload(t, "/b/k", id, etags...)
+	var completed struct {
+		ETag string `xml:"ETag"`
+	}
+	if err := xml.Unmarshal(w.Body.Bytes(), &completed); err != nil {
+		t.Fatalf("completing: %d %s", w.Code, w.Body)
+	}
+	if completed.ETag != want {
+		t.Errorf("completion ETag = %s, want %s", completed.ETag, want)
+	}
+	for _, method := range []string{"GET", "HEAD"} {
+		if got := serve(t, method, "/b/k", nil, nil).Header().Get("ETag"); got != want {
+			t.Errorf("%s ETag = %s, want %s", method, got, want)
+		}
+	}
+
+	var listing listBucketResult
+	if err := xml.Unmarshal(serve(t, "GET", "/b?list-type=2", nil, nil).Body.Bytes(), &listing); err != nil {
+		t.Fatal(err)
+	}
+	if len(listing.Contents) != 1 || listing.Contents[0].ETag != want {
+		t.Errorf("listed %+v, want ETag %s", listing.Contents, want)
+	}
+
+	w = serve(t, "GET", "/b/k?attributes", nil, http.Header{"X-Amz-Object-Attributes": {"ObjectParts"}})
+	if !strings.Contains(w.Body.String(), "<PartsCount>2</PartsCount>") {
+		t.Errorf("attributes = %s, want 2 parts", w.Body)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Responses that name an object by absolute URL, such as the Location of
+// CompleteMultipartUpload, build it from the first of: the bucket's entry
+// in -bucket-url-map, -public-base-url, and the scheme and host the
+// request came in on.
+
+// Base URL the server is reachable at from outside (-public-base-url),
+// which object URLs append the bucket and key to; nil uses the request's
+// scheme and host
+var publicBaseURL *url.URL
+
+// Base URLs of buckets served under CDN or other hostnames of their own
+// (-bucket-url-map), which object URLs append just the key to
+var bucketURLs map[string]*url.URL
+
+// parseBaseURL parses a base URL for -public-base-url or -bucket-url-map:
+// http or https, a host, and optionally a path prefix.
+func parseBaseURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+		return nil, errors.New("must be an http or https URL without query, such as https://cdn.example.com")
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+	u.RawPath = ""
+	return u, nil
+}
+
+// parseBucketURLMap parses -bucket-url-map: comma-separated bucket=URL
+// pairs, such as photos=https://photos.example.com.
+func parseBucketURLMap(s string) (map[string]*url.URL, error) {
+	urls := map[string]*url.URL{}
+	for _, pair := range strings.Split(s, ",") {
+		bucket, raw, ok := strings.Cut(pair, "=")
+		bucket, raw = strings.TrimSpace(bucket), strings.TrimSpace(raw)
+		if !ok || bucket == "" || strings.ContainsAny(bucket, "/\\") || strings.HasPrefix(bucket, ".") {
+			return nil, fmt.Errorf("%q must be bucket=URL", pair)
+		}
+		if urls[bucket] != nil {
+			return nil, fmt.Errorf("bucket %s is mapped twice", bucket)
+		}
+		u, err := parseBaseURL(raw)
+		if err != nil {
+			return nil, fmt.Errorf("URL of bucket %s: %v", bucket, err)
+		}
+		urls[bucket] = u
+	}
+	return urls, nil
+}
+
+// objectURL returns the absolute URL of key in bucket for a response to r.
+// Without a configured base it is virtual-hosted-style if r was, and
+// path-style otherwise.
+func objectURL(r *http.Request, bucket, key string) string {
+	if base := bucketURLs[bucket]; base != nil {
+		return appendURLPath(base, key)
+	}
+	if publicBaseURL != nil {
+		return appendURLPath(publicBaseURL, bucket+"/"+key)
+	}
+	if r.Host == "" {
+		return (&url.URL{Path: "/" + bucket + "/" + key}).EscapedPath()
+	}
+	base := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		base.Scheme = "https"
+	}
+	if baseDomain != "" && virtualHostBucket(r) == bucket {
+		return appendURLPath(base, key)
+	}
+	return appendURLPath(base, bucket+"/"+key)
+}
+
+// appendURLPath returns base with "/" and p appended to its path, escaped.
+func appendURLPath(base *url.URL, p string) string {
+	u := *base
+	u.Path += "/" + p
+	return u.String()
+}
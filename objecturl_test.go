@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// useObjectURLs sets -public-base-url and -bucket-url-map for the test.
+func useObjectURLs(t *testing.T, base string, buckets map[string]*url.URL) {
+	t.Helper()
+	oldBase, oldBuckets := publicBaseURL, bucketURLs
+	publicBaseURL, bucketURLs = nil, buckets
+	if base != "" {
+		u, err := parseBaseURL(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		publicBaseURL = u
+	}
+	t.Cleanup(func() { publicBaseURL, bucketURLs = oldBase, oldBuckets })
+}
+
+func TestParseBucketURLMap(t *testing.T) {
+	urls, err := parseBucketURLMap("photos=https://photos.example.com/, docs = http://cdn.example.com/docs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(urls) != 2 || urls["photos"].String() != "https://photos.example.com" || urls["docs"].String() != "http://cdn.example.com/docs" {
+		t.Errorf("parsed %v", urls)
+	}
+	for _, bad := range []string{
+		"photos",
+		"=https://photos.example.com",
+		"photos=photos.example.com",
+		"photos=ftp://photos.example.com",
+		"photos=https://photos.example.com?x=1",
+		"photos=https://a.example.com,photos=https://b.example.com",
+		".meta=https://photos.example.com",
+		"a/b=https://photos.example.com",
+	} {
+		if _, err := parseBucketURLMap(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestObjectURL(t *testing.T) {
+	oldDomain := baseDomain
+	t.Cleanup(func() { baseDomain = oldDomain })
+	baseDomain = "s3.example.com"
+	photos, _ := parseBaseURL("https://photos.example.com/cdn/")
+
+	request := func(host string, secure bool) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/", nil)
+		r.Host = host
+		if secure {
+			r.TLS = &tls.ConnectionState{}
+		}
+		return r
+	}
+	for _, tc := range []struct {
+		name    string
+		base    string
+		r       *http.Request
+		bucket  string
+		want    string
+		buckets map[string]*url.URL
+	}{
+		{"request host", "", request("localhost:8080", false), "b", "http://localhost:8080/b/dir/a%20b.txt", nil},
+		{"request over TLS", "", request("s3.example.com", true), "b", "https://s3.example.com/b/dir/a%20b.txt", nil},
+		{"virtual host", "", request("b.s3.example.com", true), "b", "https://b.s3.example.com/dir/a%20b.txt", nil},
+		{"public base URL", "https://public.example.com/s3/", request("localhost:8080", false), "b", "https://public.example.com/s3/b/dir/a%20b.txt", nil},
+		{"bucket URL", "https://public.example.com", request("localhost:8080", false), "photos", "https://photos.example.com/cdn/dir/a%20b.txt", map[string]*url.URL{"photos": photos}},
+		{"unmapped bucket", "https://public.example.com", request("localhost:8080", false), "b", "https://public.example.com/b/dir/a%20b.txt", map[string]*url.URL{"photos": photos}},
+		{"no host", "", request("", false), "b", "/b/dir/a%20b.txt", nil},
+	} {
+		useObjectURLs(t, tc.base, tc.buckets)
+		if got := objectURL(tc.r, tc.bucket, "dir/a b.txt"); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestCompleteMultipartUploadLocation(t *testing.T) {
+	useTempRoot(t)
+	useUploads(t)
+	oldMin := minPartSize
+	minPartSize = 0
+	t.Cleanup(func() { minPartSize = oldMin })
+
+	for base, want := range map[string]string{
+		"":                           "http://example.com/b/k",
+		"https://public.example.com": "https://public.example.com/b/k",
+	} {
+		useObjectURLs(t, base, nil)
+		id := initiateUpload(t, "/b/k")
+		w := completeTestUpload(t, "/b/k", id, uploadTestPart(t, "/b/k", id, 1, "part"))
+		var result struct {
+			Location string `xml:"Location"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil || result.Location != want {
+			t.Errorf("base %q: Location %q, want %q (%v)", base, result.Location, want, err)
+		}
+	}
+}
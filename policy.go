@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// With -policy-file, requests are only served for the methods the policy
+// allows on their bucket, a coarse read-only versus read-write separation.
+// The file is a JSON object mapping bucket names to the methods allowed,
+// with "*" for every bucket not listed:
+//
+//	{"public": ["GET"], "uploads": ["GET", "PUT"], "*": ["GET", "PUT", "DELETE"]}
+//
+// Buckets the policy doesn't cover allow every method. SIGHUP reloads it.
+
+// bucketPolicy maps bucket names (or "*") to the set of methods allowed.
+type bucketPolicy map[string]map[string]bool
+
+// Methods a policy may allow
+var policyMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete}
+
+// The policy in force; nil while there is none
+var activePolicy atomic.Pointer[bucketPolicy]
+
+// policyMethod returns the method a request needs the policy to allow:
+// that of the operation it amounts to, so that a bucket allowing GET and
+// PUT but not DELETE can't be emptied by a multi-object delete. POSTs other
+// than ?delete write, as do all multipart requests but listings, which
+// clean up after themselves when aborted. WebDAV methods need the S3
+// method they stand in for.
+func policyMethod(r *http.Request) string {
+	if isMultipartRequest(r) && r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return http.MethodPut
+	}
+	if r.Method == http.MethodPost {
+		if _, ok := r.URL.Query()["delete"]; ok {
+			return http.MethodDelete
+		}
+		return http.MethodPut
+	}
+	return davPolicyMethod(r.Method)
+}
+
+// loadPolicy reads a policy file.
+func loadPolicy(path string) (bucketPolicy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string][]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	policy := bucketPolicy{}
+	for bucket, methods := range raw {
+		allowed := map[string]bool{}
+		for _, m := range methods {
+			m = strings.ToUpper(m)
+			if !isPolicyMethod(m) {
+				return nil, fmt.Errorf("bucket %q: invalid method %q: want one of %s", bucket, m, strings.Join(policyMethods, ", "))
+			}
+			allowed[m] = true
+		}
+		// HEAD is a GET without the body
+		if allowed[http.MethodGet] {
+			allowed[http.MethodHead] = true
+		}
+		policy[bucket] = allowed
+	}
+	return policy, nil
+}
+
+func isPolicyMethod(m string) bool {
+	for _, pm := range policyMethods {
+		if m == pm {
+			return true
+		}
+	}
+	return false
+}
+
+// allows reports whether the policy lets method be used on bucket.
+func (p bucketPolicy) allows(bucket, method string) bool {
+	allowed, ok := p[bucket]
+	if !ok {
+		if allowed, ok = p["*"]; !ok {
+			return true
+		}
+	}
+	return allowed[method]
+}
+
+// reloadPolicyOnSIGHUP reloads the policy from path whenever the process
+// gets SIGHUP, keeping the old one if the file is invalid. It never
+// returns.
+func reloadPolicyOnSIGHUP(path string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		policy, err := loadPolicy(path)
+		if err != nil {
+			slog.Error("Reloading bucket policy failed; keeping the previous one", "file", path, "err", err)
+			continue
+		}
+		activePolicy.Store(&policy)
+		slog.Info("Reloaded bucket policy", "buckets", len(policy), "file", path)
+	}
+}
+
+// withPolicy refuses requests the bucket policy doesn't allow with 403
+// AccessDenied. Requests are checked by what they do (see policyMethod),
+// and a copy also needs GET on its source's bucket. Requests naming no
+// bucket, such as ListBuckets, are not covered.
+func withPolicy(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := activePolicy.Load()
+		if policy == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		bucket := splitRequestPath(r)[0]
+		if method := policyMethod(r); bucket != "" && !policy.allows(bucket, method) {
+			slog.Info("Blocked by bucket policy", "method", r.Method, "bucket", bucket, "needs", method)
+			writeS3Error(w, http.StatusForbidden, "AccessDenied", "The bucket policy does not allow "+method+" requests to this bucket", r.URL.Path)
+			return
+		}
+		if source := r.Header.Get("x-amz-copy-source"); source != "" {
+			source, _, _ = strings.Cut(source, "?")
+			if unescaped, err := url.PathUnescape(source); err == nil {
+				source = unescaped
+			}
+			srcBucket, _, _ := strings.Cut(strings.TrimPrefix(source, "/"), "/")
+			if srcBucket != "" && !policy.allows(srcBucket, http.MethodGet) {
+				slog.Info("Blocked by bucket policy", "method", r.Method, "bucket", bucket, "source_bucket", srcBucket)
+				writeS3Error(w, http.StatusForbidden, "AccessDenied", "The bucket policy does not allow reading the copy source's bucket", r.URL.Path)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
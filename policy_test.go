@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPolicyChecksOperation(t *testing.T) {
+	policy := bucketPolicy{"b": {http.MethodGet: true, http.MethodHead: true, http.MethodPut: true}}
+	activePolicy.Store(&policy)
+	t.Cleanup(func() { activePolicy.Store(nil) })
+	handler := withPolicy(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, tc := range []struct {
+		method, target string
+		want           string // the method the request needs
+	}{
+		{"POST", "/b?delete", http.MethodDelete},
+		{"POST", "/b/k?uploads", http.MethodPut},
+		{"PUT", "/b/k?partNumber=1&uploadId=u", http.MethodPut},
+		{"POST", "/b/k?uploadId=u", http.MethodPut},
+		{"DELETE", "/b/k?uploadId=u", http.MethodPut},
+		{"GET", "/b?uploads", http.MethodGet},
+		{"GET", "/b/k?uploadId=u", http.MethodGet},
+		{"POST", "/b/k?undelete", http.MethodPut},
+		{"POST", "/b?txn-begin", http.MethodPut},
+		{"POST", "/b", http.MethodPut},
+		{"DELETE", "/b/k", http.MethodDelete},
+		{"GET", "/b/k", http.MethodGet},
+		{methodMkcol, "/b/dir/", http.MethodPut},
+		{methodPropfind, "/b/", http.MethodGet},
+	} {
+		r := httptest.NewRequest(tc.method, tc.target, nil)
+		if got := policyMethod(r); got != tc.want {
+			t.Errorf("%s %s needs %s, want %s", tc.method, tc.target, got, tc.want)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		wantCode := http.StatusOK
+		if tc.want == http.MethodDelete {
+			wantCode = http.StatusForbidden
+		}
+		if w.Code != wantCode {
+			t.Errorf("%s %s with DELETE disallowed: %d, want %d", tc.method, tc.target, w.Code, wantCode)
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Browser HTML forms upload with POST /<bucket> and a multipart/form-data
+// body: a "key" field, optional fields for the object's metadata, and
+// finally the "file" part holding the content. The upload itself is
+// handed to uploadHandler as if it were a PUT.
+
+// Upper bound on the size of the form fields preceding the file, as in S3
+const maxPostFieldBytes = 20 << 10
+
+// Form fields passed on to uploadHandler as request headers; x-amz-meta-*
+// fields are passed on too
+var postHeaderFields = []string{"Content-Type", "Cache-Control", "Expires", "Content-MD5", "x-amz-storage-class"}
+
+func isPostObjectRequest(r *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// postObjectHandler handles POST /<bucket> with a multipart/form-data body
+// (PostObject). It answers 204 No Content, or redirects to the form's
+// success_action_redirect.
+func postObjectHandler(w http.ResponseWriter, r *http.Request) {
+	parts := splitRequestPath(r)
+	if parts[0] == "" {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "Missing bucket name", r.URL.Path)
+		return
+	}
+	if len(parts) == 2 && parts[1] != "" {
+		writeMethodNotAllowed(w, r, plusDAVMethods(http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete)...)
+		return
+	}
+	bucket := parts[0]
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data.", r.URL.Path)
+		return
+	}
+
+	// Field names are case-insensitive; fields after the file are ignored
+	fields := map[string]string{}
+	fieldBytes := 0
+	var file io.Reader
+	var filename string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if respondIfRequestTimeout(w, r, err) {
+			return
+		}
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data.", r.URL.Path)
+			return
+		}
+		name := strings.ToLower(part.FormName())
+		if name == "file" {
+			file, filename = part, part.FileName()
+			break
+		}
+		value, err := io.ReadAll(io.LimitReader(part, int64(maxPostFieldBytes-fieldBytes+1)))
+		if respondIfRequestTimeout(w, r, err) {
+			return
+		}
+		if err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data.", r.URL.Path)
+			return
+		}
+		if fieldBytes += len(name) + len(value); fieldBytes > maxPostFieldBytes {
+			writeS3Error(w, http.StatusBadRequest, "MaxPostPreDataLengthExceeded", "Your POST request fields preceding the upload file were too large.", r.URL.Path)
+			return
+		}
+		fields[name] = string(value)
+	}
+	if file == nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "POST requires exactly one file upload per request.", r.URL.Path)
+		return
+	}
+	key, ok := fields["key"]
+	if !ok || key == "" {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "Bucket POST must contain a field named 'key'. If it is specified, please check the order of the fields.", r.URL.Path)
+		return
+	}
+	key = strings.ReplaceAll(key, "${filename}", filename)
+
+	// Had whole, the file's size is known before the upload starts, so it
+	// is checked against -max-object-size and the quota up front. Past
+	// the size limit there's no need to read on.
+	if maxObjectSize > 0 {
+		file = io.LimitReader(file, maxObjectSize+1)
+	}
+	spooled, err := spoolBody(file)
+	if respondIfRequestTimeout(w, r, err) || respondIfSpoolFailed(w, r, err) {
+		return
+	}
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedPOSTRequest", "The body of your POST request is not well-formed multipart/form-data.", r.URL.Path)
+		return
+	}
+	defer spooled.Close()
+
+	header := http.Header{}
+	for _, name := range postHeaderFields {
+		if value, ok := fields[strings.ToLower(name)]; ok {
+			header.Set(name, value)
+		}
+	}
+	for name, value := range fields {
+		if strings.HasPrefix(name, userMetaPrefix) {
+			header.Set(name, value)
+		}
+	}
+
+	put := r.Clone(r.Context())
+	put.Method = http.MethodPut
+	put.URL = &url.URL{Path: "/" + bucket + "/" + key}
+	put.Header = header
+	put.Body = io.NopCloser(spooled)
+	put.ContentLength = spooled.size
+	debugLog(r, "Form upload", "key", key)
+
+	redirect := fields["success_action_redirect"]
+	if redirect == "" {
+		redirect = fields["redirect"]
+	}
+	target, err := url.Parse(redirect)
+	if redirect == "" || err != nil || !target.IsAbs() {
+		uploadHandler(w, put)
+		return
+	}
+	uploadHandler(&postRedirectWriter{ResponseWriter: w, target: target, bucket: bucket, key: key}, put)
+}
+
+// postRedirectWriter turns the 204 of a successful form upload into a
+// redirect to the form's success_action_redirect, passing on the bucket,
+// key and ETag of the new object as S3 does. Errors are left as they are.
+type postRedirectWriter struct {
+	http.ResponseWriter
+	target *url.URL
+	bucket string
+	key    string
+}
+
+func (p *postRedirectWriter) WriteHeader(code int) {
+	if code != http.StatusNoContent {
+		p.ResponseWriter.WriteHeader(code)
+		return
+	}
+	q := p.target.Query()
+	q.Set("bucket", p.bucket)
+	q.Set("key", p.key)
+	q.Set("etag", p.Header().Get("ETag"))
+	target := *p.target
+	target.RawQuery = q.Encode()
+	p.Header().Set("Location", target.String())
+	p.ResponseWriter.WriteHeader(http.StatusSeeOther)
+}
+
+func (p *postRedirectWriter) Unwrap() http.ResponseWriter {
+	return p.ResponseWriter
+}
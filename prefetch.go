@@ -0,0 +1,101 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Maximum number of objects a single x-prefetch-next hint may read ahead (0 = disabled)
+var prefetchMax int
+
+// Upper bound on bytes read ahead per prefetched object
+const prefetchMaxBytes = 64 << 20
+
+// Only one read-ahead runs at a time; hints arriving while it is busy are dropped
+var prefetchSlot = make(chan struct{}, 1)
+
+// prefetchCount returns how many following objects the x-prefetch-next
+// header asks for, capped at -prefetch-max. Invalid values mean none.
+func prefetchCount(hint string) int {
+	if prefetchMax <= 0 || hint == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(hint)
+	if err != nil || n <= 0 {
+		return 0
+	}
+	if n > prefetchMax {
+		n = prefetchMax
+	}
+	return n
+}
+
+// startPrefetch reads the n objects whose keys follow key in its folder,
+// warming the OS page cache for sequential scanners. It is best-effort:
+// errors are ignored and the work is skipped when another prefetch is
+// already in flight.
+func startPrefetch(bucket, key, targetPath string, n int) {
+	select {
+	case prefetchSlot <- struct{}{}:
+	default:
+		return
+	}
+
+	go func() {
+		defer func() { <-prefetchSlot }()
+
+		for _, path := range prefetchPaths(bucket, key, targetPath, n) {
+			f, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			io.CopyN(io.Discard, f, prefetchMaxBytes)
+			f.Close()
+		}
+	}()
+}
+
+// prefetchPaths returns the files of up to n objects whose keys follow
+// key, stored at targetPath, in its folder.
+func prefetchPaths(bucket, key, targetPath string, n int) []string {
+	var paths []string
+	if shardDepth > 0 {
+		// The folder's objects are spread over every shard, so they are
+		// found as a listing finds them
+		folder := key[:strings.LastIndex(key, "/")+1]
+		bucketPath, err := sanitizePath(bucket, "")
+		if err != nil {
+			return nil
+		}
+		entries, err := walkBucket(bucket, bucketPath, folder)
+		if err != nil {
+			return nil
+		}
+		i := sort.Search(len(entries), func(i int) bool { return entries[i].key > key })
+		for ; i < len(entries) && len(paths) < n; i++ {
+			// Objects in subfolders aren't the folder's own
+			if !strings.Contains(entries[i].key[len(folder):], "/") {
+				paths = append(paths, entries[i].path)
+			}
+		}
+		return paths
+	}
+
+	dir, name := filepath.Split(targetPath)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	// os.ReadDir already sorts by filename; search for our position
+	i := sort.Search(len(entries), func(i int) bool { return entries[i].Name() > name })
+	for ; i < len(entries) && len(paths) < n; i++ {
+		if entries[i].Type().IsRegular() && !isTempFile(entries[i].Name()) {
+			paths = append(paths, filepath.Join(dir, entries[i].Name()))
+		}
+	}
+	return paths
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPrefetchPaths(t *testing.T) {
+	for _, depth := range []int{0, 2} {
+		root := useTempRoot(t)
+		useShardDepth(t, depth)
+		for _, key := range []string{"dir/a", "dir/b", "dir/c", "dir/sub/x", "dir/d", "other"} {
+			writeTestFile(t, filepath.Join(root, "b", shardPath(filepath.FromSlash(key))), key)
+		}
+		target, err := sanitizePath("b", "dir/a")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var got []string
+		for _, path := range prefetchPaths("b", "dir/a", target, 3) {
+			data, _ := readTestFile(t, path)
+			got = append(got, data)
+		}
+		// Sorted by key, without the subfolder's objects
+		if want := "dir/b,dir/c,dir/d"; strings.Join(got, ",") != want {
+			t.Errorf("shard depth %d: prefetched %v, want %s", depth, got, want)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/hmac"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Whether requests signed in the query string (presigned URLs) are accepted
+// with authentication enabled
+var presignedURLs = true
+
+// Longest validity of a presigned URL, as in S3
+const maxPresignExpiry = 7 * 24 * time.Hour
+
+// The server doesn't check the region, but a signature needs one
+const presignRegion = "us-east-1"
+
+// verifyPresigned checks a request carrying its SigV4 signature in the
+// query string (X-Amz-Algorithm, X-Amz-Credential, X-Amz-Date,
+// X-Amz-Expires, X-Amz-SignedHeaders and X-Amz-Signature). The payload is
+// always UNSIGNED-PAYLOAD, as SDKs presign it.
+func verifyPresigned(r *http.Request) *apiError {
+	if !presignedURLs {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Presigned URLs are disabled on this server"}
+	}
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != "AWS4-HMAC-SHA256" {
+		return &apiError{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Algorithm must be AWS4-HMAC-SHA256"}
+	}
+	auth := &sigV4Auth{signature: q.Get("X-Amz-Signature")}
+	if !auth.parseCredential(q.Get("X-Amz-Credential")) {
+		return &apiError{http.StatusBadRequest, "AuthorizationQueryParametersError", "Malformed or missing X-Amz-Credential"}
+	}
+	if q.Get("X-Amz-SignedHeaders") == "" || auth.signature == "" {
+		return &apiError{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-SignedHeaders and X-Amz-Signature are required"}
+	}
+	auth.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	if auth.accessKey != accessKey {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Unknown access key " + auth.accessKey}
+	}
+	if auth.service != "s3" {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Credential scope must be for service s3"}
+	}
+	signedHost := false
+	for _, h := range auth.signedHeaders {
+		signedHost = signedHost || h == "host"
+	}
+	if !signedHost {
+		return &apiError{http.StatusForbidden, "AccessDenied", "The host header must be signed"}
+	}
+
+	amzDate := q.Get("X-Amz-Date")
+	t, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return &apiError{http.StatusBadRequest, "AuthorizationQueryParametersError", "Missing or malformed X-Amz-Date"}
+	}
+	if auth.date != t.Format(amzShortFormat) {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Credential scope date does not match X-Amz-Date"}
+	}
+	seconds, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || seconds < 1 || time.Duration(seconds)*time.Second > maxPresignExpiry {
+		return &apiError{http.StatusBadRequest, "AuthorizationQueryParametersError", "X-Amz-Expires must be between 1 and 604800 seconds"}
+	}
+
+	canonical := canonicalRequest(r, withoutQueryParam(r.URL.RawQuery, "X-Amz-Signature"), auth.signedHeaders, unsignedPayload)
+	want := sigV4Signature(secretKey, auth, amzDate, canonical)
+	if !hmac.Equal([]byte(want), []byte(auth.signature)) {
+		logSignatureMismatch(r, "Presigned URL signature mismatch", auth, amzDate, canonical)
+		return &apiError{http.StatusForbidden, "AccessDenied", "The request signature does not match the signature computed with the configured secret key"}
+	}
+
+	// Checked after the signature, so only genuine URLs are told they expired
+	now := time.Now()
+	if t.After(now.Add(maxClockSkew)) {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Request is not valid yet"}
+	}
+	if now.After(t.Add(time.Duration(seconds) * time.Second)) {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Request has expired"}
+	}
+	return nil
+}
+
+// withoutQueryParam drops every occurrence of the named parameter from a
+// raw query string, leaving the rest untouched.
+func withoutQueryParam(rawQuery, name string) string {
+	var kept []string
+	for _, p := range strings.Split(rawQuery, "&") {
+		k, _, _ := strings.Cut(p, "=")
+		if unescapeQueryPart(k) != name {
+			kept = append(kept, p)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// presignURL returns a URL for method on path (/<bucket>/<key>) under
+// endpoint, signed with the configured credentials and valid for expires
+// from now.
+func presignURL(method, endpoint, path string, expires time.Duration, now time.Time) (string, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil || base.Host == "" || (base.Scheme != "http" && base.Scheme != "https") {
+		return "", fmt.Errorf("invalid endpoint %q: must be an http:// or https:// URL", endpoint)
+	}
+	now = now.UTC()
+	auth := &sigV4Auth{
+		accessKey:     accessKey,
+		date:          now.Format(amzShortFormat),
+		region:        presignRegion,
+		service:       "s3",
+		signedHeaders: []string{"host"},
+	}
+	auth.scope = auth.date + "/" + auth.region + "/" + auth.service + "/aws4_request"
+	amzDate := now.Format(amzDateFormat)
+
+	q := url.Values{}
+	q.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	q.Set("X-Amz-Credential", auth.accessKey+"/"+auth.scope)
+	q.Set("X-Amz-Date", amzDate)
+	q.Set("X-Amz-Expires", strconv.Itoa(int(expires/time.Second)))
+	q.Set("X-Amz-SignedHeaders", strings.Join(auth.signedHeaders, ";"))
+	rawQuery := q.Encode()
+
+	req := &http.Request{Method: method, URL: &url.URL{Path: path}, Host: base.Host}
+	signature := sigV4Signature(secretKey, auth, amzDate, canonicalRequest(req, rawQuery, auth.signedHeaders, unsignedPayload))
+	return base.Scheme + "://" + base.Host + awsURIEncode(path, false) + "?" + rawQuery + "&X-Amz-Signature=" + signature, nil
+}
+
+// runPresign implements the "presign" subcommand, printing a presigned URL
+// for the object given as /<bucket>/<key>. It returns the exit code.
+func runPresign(args []string) int {
+	fs := flag.NewFlagSet("presign", flag.ContinueOnError)
+	method := fs.String("method", http.MethodGet, "HTTP method the URL is valid for, e.g. GET or PUT")
+	endpoint := fs.String("endpoint", "http://localhost:8080", "base URL clients reach the server at")
+	expires := fs.Duration("expires", time.Hour, "how long the URL stays valid (at most 168h)")
+	fs.StringVar(&accessKey, "access-key", "", "access key ID the server is started with")
+	fs.StringVar(&secretKey, "secret-key", "", "secret access key matching -access-key")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s presign [flags] /<bucket>/<key>\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 || accessKey == "" || secretKey == "" {
+		fs.Usage()
+		return 2
+	}
+	if *expires < time.Second || *expires > maxPresignExpiry {
+		fmt.Fprintln(os.Stderr, "-expires must be between 1s and 168h")
+		return 2
+	}
+	path := "/" + strings.TrimPrefix(fs.Arg(0), "/")
+	u, err := presignURL(strings.ToUpper(*method), *endpoint, path, *expires, time.Now())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	fmt.Println(u)
+	return 0
+}
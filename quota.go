@@ -0,0 +1,335 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Most bytes of objects a bucket may hold (0 = unlimited)
+var bucketQuota int64
+
+// errQuotaExceeded is returned from an upload body that runs past what the
+// bucket's quota leaves room for.
+var errQuotaExceeded = errors.New("upload exceeds -bucket-quota")
+
+// usageCache holds the bytes each bucket takes up: its objects, and what
+// is kept on its behalf elsewhere under the storage root (noncurrent
+// versions, the trash, multipart parts and transaction staging). A
+// bucket's usage is computed by walking all of those the first time a
+// quota check needs it, then kept up to date as objects are written and
+// deleted. Changes too involved to account for (transaction commits,
+// version deletes) drop the usage so it is recomputed on next use.
+//
+// Writes reserve room before their body is read, under the bucket's
+// lock, so concurrent uploads can't together take it past its quota.
+type usageCache struct {
+	mu      sync.Mutex
+	buckets map[string]*bucketUsageEntry
+}
+
+type bucketUsageEntry struct {
+	mu       sync.Mutex
+	known    bool
+	used     int64
+	reserved int64 // by writes in progress
+}
+
+var bucketUsage = usageCache{buckets: make(map[string]*bucketUsageEntry)}
+
+func (c *usageCache) entry(bucket string) *bucketUsageEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := c.buckets[bucket]
+	if e == nil {
+		e = &bucketUsageEntry{}
+		c.buckets[bucket] = e
+	}
+	return e
+}
+
+// load makes sure e.used is known, walking bucket if needed. e.mu must be
+// held.
+func (e *bucketUsageEntry) load(bucket string) error {
+	if e.known {
+		return nil
+	}
+	used, err := walkBucketUsage(bucket)
+	if err != nil {
+		return err
+	}
+	e.used, e.known = used, true
+	return nil
+}
+
+// add adjusts a bucket's cached usage; a bucket not yet walked is left to
+// be walked.
+func (c *usageCache) add(bucket string, delta int64) {
+	e := c.entry(bucket)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.known {
+		e.used = max(e.used+delta, 0)
+	}
+}
+
+func (c *usageCache) forget(bucket string) {
+	e := c.entry(bucket)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.known = false
+}
+
+// walkBucketUsage sums the sizes of everything stored for bucket.
+func walkBucketUsage(bucket string) (int64, error) {
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		return 0, err
+	}
+	dirs := []string{
+		bucketPath,
+		filepath.Join(storageRootDir, trashDirName, bucket),
+	}
+	uploadsMu.Lock()
+	for _, u := range uploads {
+		if u.bucket == bucket {
+			dirs = append(dirs, u.dir)
+		}
+	}
+	uploadsMu.Unlock()
+	txnsMu.Lock()
+	for _, t := range txns {
+		if t.bucket == bucket {
+			dirs = append(dirs, t.dir)
+		}
+	}
+	txnsMu.Unlock()
+
+	var used int64
+	for _, dir := range dirs {
+		n, err := walkUsage(dir)
+		if err != nil {
+			return 0, err
+		}
+		used += n
+	}
+	// Version histories, less the indexes describing them
+	n, err := walkUsage(filepath.Join(storageRootDir, versionsDirName, bucket), versionIndexName, versioningStatusName)
+	if err != nil {
+		return 0, err
+	}
+	return used + n, nil
+}
+
+// walkUsage sums the sizes of the files under dir, but for those named
+// one of skip.
+func walkUsage(dir string, skip ...string) (int64, error) {
+	var used int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) || slices.Contains(skip, d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		used += fi.Size()
+		return nil
+	})
+	return used, err
+}
+
+// quotaReservation is room in a bucket held for a write in progress. A
+// nil reservation is unlimited.
+type quotaReservation struct {
+	bucket string
+	// Bytes held in the bucket's reserved count
+	bytes int64
+	// Bytes the write frees when it completes, such as those of an
+	// object it replaces
+	credit int64
+}
+
+// reserveQuota holds room for a write of size bytes (-1 if not yet known)
+// to bucket that frees credit bytes, or returns errQuotaExceeded if the
+// bucket hasn't the room. The reservation must be settled or released.
+func reserveQuota(bucket string, size, credit int64) (*quotaReservation, error) {
+	if bucketQuota <= 0 {
+		return nil, nil
+	}
+	q := &quotaReservation{bucket: bucket, credit: credit}
+	if err := q.grow(max(size, 0)); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// grow holds n more bytes for the write.
+func (q *quotaReservation) grow(n int64) error {
+	e := bucketUsage.entry(q.bucket)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.load(q.bucket); err != nil {
+		return err
+	}
+	if e.used+e.reserved+n-q.credit > bucketQuota {
+		return errQuotaExceeded
+	}
+	e.reserved += n
+	q.bytes += n
+	return nil
+}
+
+// settle ends the reservation of a completed write, which changed the
+// bucket's usage by delta bytes.
+func (q *quotaReservation) settle(delta int64) {
+	if q == nil {
+		return
+	}
+	e := bucketUsage.entry(q.bucket)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reserved -= q.bytes
+	q.bytes = 0
+	if e.known {
+		e.used = max(e.used+delta, 0)
+	}
+}
+
+// release ends the reservation of a write that stored nothing. Calling it
+// after settle does nothing.
+func (q *quotaReservation) release() {
+	if q == nil {
+		return
+	}
+	e := bucketUsage.entry(q.bucket)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.reserved -= q.bytes
+	q.bytes = 0
+}
+
+// quotaReader grows a reservation as a body of unknown size (or one
+// longer than announced) is read, failing with errQuotaExceeded once the
+// bucket runs out of room.
+type quotaReader struct {
+	r    io.Reader
+	q    *quotaReservation
+	read int64
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	n, err := qr.r.Read(p)
+	qr.read += int64(n)
+	if over := qr.read - qr.q.bytes; over > 0 {
+		if growErr := qr.q.grow(over); growErr != nil {
+			return n, growErr
+		}
+	}
+	return n, err
+}
+
+// respondIfOverQuota reserves room for a write of size bytes (-1 if not
+// yet known) to bucket that frees credit bytes, refusing it if that would
+// take the bucket over -bucket-quota. It reports whether it answered the
+// request. The reservation, nil if there is no quota, must be settled or
+// released.
+func respondIfOverQuota(w http.ResponseWriter, r *http.Request, bucket string, size, credit int64) (q *quotaReservation, handled bool) {
+	q, err := reserveQuota(bucket, size, credit)
+	if errors.Is(err, errQuotaExceeded) {
+		writeQuotaExceeded(w, r, bucket)
+		return nil, true
+	}
+	if err != nil {
+		slog.Error("Computing bucket usage failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return nil, true
+	}
+	return q, false
+}
+
+func writeQuotaExceeded(w http.ResponseWriter, r *http.Request, bucket string) {
+	slog.Info("Refused upload over bucket quota", "bucket", bucket, "quota", bucketQuota)
+	writeS3Error(w, http.StatusForbidden, "QuotaExceeded", "The upload would take the bucket over its quota of "+strconv.FormatInt(bucketQuota, 10)+" bytes", r.URL.Path)
+}
+
+// fileSize returns the size of the file at path, or 0 if there is none.
+func fileSize(path string) int64 {
+	if fi, err := os.Stat(path); err == nil && fi.Mode().IsRegular() {
+		return fi.Size()
+	}
+	return 0
+}
+
+// objectSize returns the size of the object at path, or 0 if there is none.
+func objectSize(path string) int64 {
+	if fi, exists, _ := statObject(path); exists {
+		return fi.Size()
+	}
+	return 0
+}
+
+// recordUsage accounts for delta bytes having been added to (or, if
+// negative, removed from) the bucket holding the object at path.
+func recordUsage(path string, delta int64) {
+	if bucketQuota <= 0 || delta == 0 {
+		return
+	}
+	if bucket := bucketOfPath(path); bucket != "" {
+		bucketUsage.add(bucket, delta)
+	}
+}
+
+// dropDirUsage accounts for dir, which holds data stored for bucket such
+// as multipart parts, being removed. It must be called before removing it.
+func dropDirUsage(bucket, dir string) {
+	if bucketQuota <= 0 {
+		return
+	}
+	n, err := walkUsage(dir)
+	if err != nil {
+		bucketUsage.forget(bucket)
+		return
+	}
+	bucketUsage.add(bucket, -n)
+}
+
+// forgetUsage has bucket's usage recomputed when next needed.
+func forgetUsage(bucket string) {
+	if bucketQuota > 0 {
+		bucketUsage.forget(bucket)
+	}
+}
+
+// bucketOfPath returns the bucket an object path under the storage root,
+// or in the bucket's trash or version history, belongs to.
+func bucketOfPath(path string) string {
+	absRoot, err := filepath.Abs(storageRootDir)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(absRoot, path)
+	if err != nil || !isWithin(absRoot, path) {
+		return ""
+	}
+	bucket, rest, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	// The trash and version histories are kept per bucket
+	if bucket == trashDirName || bucket == versionsDirName {
+		bucket, _, _ = strings.Cut(rest, "/")
+	}
+	return bucket
+}
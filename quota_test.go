@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// useQuota sets -bucket-quota for the test, starting from an empty usage
+// cache.
+func useQuota(t *testing.T, quota int64) {
+	t.Helper()
+	oldQuota, oldUsage := bucketQuota, bucketUsage.buckets
+	bucketQuota = quota
+	bucketUsage.buckets = make(map[string]*bucketUsageEntry)
+	t.Cleanup(func() { bucketQuota, bucketUsage.buckets = oldQuota, oldUsage })
+}
+
+func TestWalkBucketUsage(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "object"), "12345")
+	writeTestFile(t, filepath.Join(root, "b", tempFilePrefix+"upload"), "in progress")
+	writeTestFile(t, filepath.Join(root, versionsDirName, "b", versioningStatusName), "Enabled")
+	writeTestFile(t, filepath.Join(root, versionsDirName, "b", "0a1b", versionIndexName), "{}")
+	writeTestFile(t, filepath.Join(root, versionsDirName, "b", "0a1b", "v1"), "123")
+	writeTestFile(t, filepath.Join(root, trashDirName, "b", "deleted"), "12")
+	writeTestFile(t, filepath.Join(root, "other", "object"), "not counted")
+
+	used, err := walkBucketUsage("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used != 10 {
+		t.Errorf("usage = %d, want 10 (object, noncurrent version and trash)", used)
+	}
+}
+
+func TestReserveQuotaConcurrent(t *testing.T) {
+	root := useTempRoot(t)
+	useQuota(t, 100)
+	writeTestFile(t, filepath.Join(root, "b", "object"), strings.Repeat("x", 10))
+
+	// 90 bytes are left: room for three uploads of 30 at a time
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var granted []*quotaReservation
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q, err := reserveQuota("b", 30, 0)
+			if err != nil && !errors.Is(err, errQuotaExceeded) {
+				t.Error(err)
+			}
+			if q != nil {
+				mu.Lock()
+				granted = append(granted, q)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if len(granted) != 3 {
+		t.Fatalf("%d reservations granted, want 3", len(granted))
+	}
+
+	// Released room can be reserved again; settled room stays used
+	granted[0].release()
+	granted[1].settle(30)
+	if _, err := reserveQuota("b", 31, 0); !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("reserving past the quota: err = %v, want errQuotaExceeded", err)
+	}
+	if _, err := reserveQuota("b", 30, 0); err != nil {
+		t.Errorf("reserving released room: %v", err)
+	}
+	// An overwrite may use the room of the object it replaces
+	if _, err := reserveQuota("b", 10, 10); err != nil {
+		t.Errorf("reserving with credit: %v", err)
+	}
+}
+
+func TestQuotaReader(t *testing.T) {
+	useTempRoot(t)
+	useQuota(t, 10)
+
+	q, err := reserveQuota("b", -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := io.Copy(io.Discard, &quotaReader{r: strings.NewReader(strings.Repeat("x", 20)), q: q})
+	if !errors.Is(err, errQuotaExceeded) {
+		t.Errorf("reading past the quota: err = %v, want errQuotaExceeded", err)
+	}
+	if n > 20 {
+		t.Errorf("read %d bytes", n)
+	}
+	q.release()
+
+	q, err = reserveQuota("b", -1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.Copy(io.Discard, &quotaReader{r: strings.NewReader(strings.Repeat("x", 10)), q: q}); err != nil {
+		t.Errorf("reading within the quota: %v", err)
+	}
+	if q.bytes != 10 {
+		t.Errorf("reserved %d bytes, want 10", q.bytes)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// errRangeNotSatisfiable means a Range header can't be served (416).
+var errRangeNotSatisfiable = errors.New("range not satisfiable")
+
+// parseRange interprets a Range header against an object of the given size
+// and returns the byte slice to serve. ok is false when the whole object
+// should be sent, either because there is no Range header or because it is
+// malformed (which RFC 9110 says to ignore). Only single byte ranges are
+// supported: "a-b", "a-" and the suffix form "-n". Multiple ranges, and
+// ranges starting past the end of the object, yield errRangeNotSatisfiable.
+func parseRange(header string, size int64) (start, length int64, ok bool, err error) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, 0, false, nil
+	}
+	if strings.Contains(spec, ",") {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false, nil
+	}
+
+	if first == "" {
+		// Suffix range: the final n bytes
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return 0, 0, false, nil
+		}
+		if n == 0 || size == 0 {
+			return 0, 0, false, errRangeNotSatisfiable
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, true, nil
+	}
+
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false, nil
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false, nil
+		}
+		if end > size-1 {
+			end = size - 1
+		}
+	}
+	if start >= size {
+		return 0, 0, false, errRangeNotSatisfiable
+	}
+	return start, end - start + 1, true, nil
+}
+
+// parseCopySourceRange interprets an x-amz-copy-source-range header against
+// a copy source of the given size. Unlike Range, S3 only accepts the
+// complete form "bytes=first-last", and a range the source doesn't fully
+// cover is an error rather than being cut short.
+func parseCopySourceRange(header string, size int64) (start, length int64, apiErr *apiError) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	first, last, dash := strings.Cut(spec, "-")
+	start, err1 := strconv.ParseInt(first, 10, 64)
+	end, err2 := strconv.ParseInt(last, 10, 64)
+	if !found || !dash || err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, &apiError{http.StatusBadRequest, "InvalidArgument", "The x-amz-copy-source-range value must be of the form bytes=first-last where first and last are the zero-based offsets of the first and last bytes to copy"}
+	}
+	if end >= size {
+		return 0, 0, &apiError{http.StatusRequestedRangeNotSatisfiable, "InvalidRange", "The requested range is not satisfiable"}
+	}
+	return start, end - start + 1, nil
+}
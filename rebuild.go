@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// POST /_rebuild on the -admin-addr listener resyncs the state the server
+// derives from the store with what is on disk, after files were copied,
+// restored or removed behind its back: the metadata of every object, the
+// bucket usage -bucket-quota checks against, and the counts of
+// /admin/stats and the metrics. Requests are served meanwhile, each object
+// being locked only while its metadata is redone, and running it again
+// changes nothing.
+
+// One rebuild at a time
+var rebuilding sync.Mutex
+
+// rebuildSummary is what a rebuild reports having found and changed.
+type rebuildSummary struct {
+	Buckets int   `json:"buckets"`
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+	// Metadata records recomputed from the content, for objects that had
+	// none or whose file changed
+	MetadataRebuilt int `json:"metadata_rebuilt"`
+	// Records kept, content type and user metadata included, for objects
+	// whose file was touched but whose content is the same
+	MetadataRestamped int `json:"metadata_restamped"`
+	// Records of objects that no longer exist
+	MetadataRemoved int `json:"metadata_removed"`
+	// Objects whose content couldn't be read to redo their record, such as
+	// ones encrypted with another key; they are logged
+	MetadataFailed int `json:"metadata_failed"`
+	// Cached bucket usage that was off, by bucket
+	Usage      map[string]usageChange `json:"usage"`
+	DurationMS int64                  `json:"duration_ms"`
+}
+
+type usageChange struct {
+	Before int64 `json:"before"`
+	After  int64 `json:"after"`
+}
+
+// rebuildHandler serves POST /_rebuild. It rewrites server state, so it
+// is refused unless the admin listener requires -admin-token.
+func rebuildHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if adminToken == "" {
+		http.Error(w, "rebuilding requires -admin-token", http.StatusForbidden)
+		return
+	}
+	if !rebuilding.TryLock() {
+		http.Error(w, "a rebuild is already running", http.StatusConflict)
+		return
+	}
+	defer rebuilding.Unlock()
+
+	summary, err := rebuild()
+	if err != nil {
+		slog.Error("Rebuilding server state failed", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(summary); err != nil {
+		slog.Error("Writing rebuild summary failed", "err", err)
+	}
+}
+
+// rebuild redoes the metadata of every bucket, then the usage and counts
+// that are derived from the store. The caller holds rebuilding.
+func rebuild() (*rebuildSummary, error) {
+	start := time.Now()
+	summary := &rebuildSummary{Usage: map[string]usageChange{}}
+	entries, err := os.ReadDir(storageRootDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		// Server state lives in hidden top-level directories
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if err := rebuildBucketMeta(e.Name(), summary); err != nil {
+			return nil, err
+		}
+		summary.Buckets++
+		slog.Info("Rebuilt bucket metadata", "bucket", e.Name(), "buckets_done", summary.Buckets)
+	}
+	if err := rebuildUsage(summary); err != nil {
+		return nil, err
+	}
+
+	stats, err := walkStats()
+	if err != nil {
+		return nil, err
+	}
+	summary.Objects, summary.Bytes = stats.Objects, stats.Bytes
+	statsCache.mu.Lock()
+	statsCache.stats, statsCache.computed = stats, time.Now()
+	statsCache.mu.Unlock()
+	storeStats.Lock()
+	storeStats.stats, storeStats.taken = stats, time.Now()
+	storeStats.Unlock()
+
+	summary.DurationMS = time.Since(start).Milliseconds()
+	slog.Info("Rebuilt server state", "buckets", summary.Buckets, "objects", summary.Objects,
+		"metadata_rebuilt", summary.MetadataRebuilt, "metadata_restamped", summary.MetadataRestamped,
+		"metadata_removed", summary.MetadataRemoved, "metadata_failed", summary.MetadataFailed, "usage_corrected", len(summary.Usage))
+	return summary, nil
+}
+
+// rebuildBucketMeta gives every object of bucket a current metadata record
+// and removes the records of objects that are gone.
+func rebuildBucketMeta(bucket string, summary *rebuildSummary) error {
+	// Absolute, as the paths objects are locked by
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		return err
+	}
+	err = filepath.WalkDir(bucketPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Concurrent deletes can make entries vanish mid-walk
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		return rebuildObjectMeta(path, summary)
+	})
+	if err != nil {
+		return err
+	}
+
+	metaBucket, err := metaPath(bucketPath)
+	if err != nil {
+		return err
+	}
+	return filepath.WalkDir(metaBucket, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(metaBucket, p)
+		if err != nil {
+			return err
+		}
+		objectPath := filepath.Join(bucketPath, rel)
+		defer lockObject(objectPath)()
+		if _, err := os.Lstat(objectPath); !errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		summary.MetadataRemoved++
+		return nil
+	})
+}
+
+// rebuildObjectMeta makes the metadata record of the object stored at path
+// current. A stale record whose ETag still matches the content is kept,
+// with what else it holds, and restamped; otherwise the record is redone
+// from the content, as a read would.
+func rebuildObjectMeta(path string, summary *rebuildSummary) error {
+	defer lockObject(path)()
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if m := readMeta(path, fi); m != nil && m.ETag != "" {
+		return nil
+	}
+	m, err := fileMeta(path)
+	if err != nil {
+		slog.Error("Rebuilding object metadata failed", "path", path, "err", err)
+		summary.MetadataFailed++
+		return nil
+	}
+	if old := readMetaRecord(path); old != nil && old.ETag == m.ETag && old.Compressed == m.Compressed && old.Encrypted == m.Encrypted {
+		old.ContentSize = m.ContentSize
+		m = old
+		summary.MetadataRestamped++
+	} else {
+		summary.MetadataRebuilt++
+	}
+	return writeMeta(path, fi, m)
+}
+
+// rebuildUsage walks again every bucket whose usage is cached, recording
+// those it was off for. Writes to a bucket wait for its walk; buckets not
+// walked yet are left to be walked on first use.
+func rebuildUsage(summary *rebuildSummary) error {
+	bucketUsage.mu.Lock()
+	buckets := make([]string, 0, len(bucketUsage.buckets))
+	for bucket := range bucketUsage.buckets {
+		buckets = append(buckets, bucket)
+	}
+	bucketUsage.mu.Unlock()
+	sort.Strings(buckets)
+
+	for _, bucket := range buckets {
+		e := bucketUsage.entry(bucket)
+		e.mu.Lock()
+		if !e.known {
+			e.mu.Unlock()
+			continue
+		}
+		before := e.used
+		e.known = false
+		err := e.load(bucket)
+		after := e.used
+		e.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		if before != after {
+			summary.Usage[bucket] = usageChange{Before: before, After: after}
+			slog.Warn("Corrected cached bucket usage", "bucket", bucket, "before", before, "after", after)
+		}
+	}
+	return nil
+}
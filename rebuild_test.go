@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// postRebuild serves POST /_rebuild and decodes its summary.
+func postRebuild(t *testing.T) rebuildSummary {
+	t.Helper()
+	w := httptest.NewRecorder()
+	rebuildHandler(w, httptest.NewRequest(http.MethodPost, "/_rebuild", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("rebuild: %d %s", w.Code, w.Body)
+	}
+	var summary rebuildSummary
+	if err := json.Unmarshal(w.Body.Bytes(), &summary); err != nil {
+		t.Fatal(err)
+	}
+	return summary
+}
+
+func TestRebuild(t *testing.T) {
+	root := useTempRoot(t)
+	useQuota(t, 1<<20)
+	oldToken := adminToken
+	adminToken = "secret"
+	oldStats, oldStoreStats := statsCache.stats, storeStats.stats
+	t.Cleanup(func() {
+		adminToken = oldToken
+		statsCache.stats, storeStats.stats = oldStats, oldStoreStats
+	})
+
+	header := http.Header{"Content-Type": {"text/plain"}, "X-Amz-Meta-Note": {"kept"}}
+	for _, key := range []string{"touched", "changed"} {
+		if w := serve(t, http.MethodPut, "/b/"+key, strings.NewReader("content"), header); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", key, w.Code, w.Body)
+		}
+	}
+	// Behind the server's back: a file restored with another mtime, one
+	// rewritten, one copied in, and one deleted along with its object
+	later := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(root, "b", "touched"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(root, "b", "changed"), "other content")
+	writeTestFile(t, filepath.Join(root, "b", "copied"), "copied in")
+	writeTestFile(t, filepath.Join(root, metaDirName, "b", "gone"), `{"etag":"\"x\""}`)
+	// and a cached usage that is off
+	e := bucketUsage.entry("b")
+	e.mu.Lock()
+	e.used = 12345
+	e.mu.Unlock()
+	want, err := walkBucketUsage("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	summary := postRebuild(t)
+	if summary.Buckets != 1 || summary.Objects != 3 || summary.MetadataRebuilt != 2 ||
+		summary.MetadataRestamped != 1 || summary.MetadataRemoved != 1 || summary.MetadataFailed != 0 {
+		t.Errorf("summary %+v", summary)
+	}
+	if got := summary.Usage["b"]; got.Before != 12345 || got.After != want {
+		t.Errorf("usage change %+v, want 12345 to %d", got, want)
+	}
+	if e.used != want {
+		t.Errorf("cached usage %d, want %d", e.used, want)
+	}
+
+	// The touched object keeps its metadata; the others have it redone
+	w := serve(t, http.MethodHead, "/b/touched", nil, nil)
+	if w.Header().Get("Content-Type") != "text/plain" || w.Header().Get("X-Amz-Meta-Note") != "kept" {
+		t.Errorf("touched object: Content-Type %q, note %q", w.Header().Get("Content-Type"), w.Header().Get("X-Amz-Meta-Note"))
+	}
+	for key, content := range map[string]string{"changed": "other content", "copied": "copied in"} {
+		fi, err := os.Stat(filepath.Join(root, "b", key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sum := md5.Sum([]byte(content))
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if m := readMeta(filepath.Join(root, "b", key), fi); m == nil || m.ETag != etag {
+			t.Errorf("%s: metadata %+v, want ETag %s", key, m, etag)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, metaDirName, "b", "gone")); !os.IsNotExist(err) {
+		t.Errorf("metadata of a missing object kept: %v", err)
+	}
+	if stats := statsCache.stats; stats == nil || stats.Objects != 3 {
+		t.Errorf("cached storage statistics %+v, want 3 objects", stats)
+	}
+
+	// Once in sync, running it again changes nothing
+	again := postRebuild(t)
+	if again.MetadataRebuilt != 0 || again.MetadataRestamped != 0 || again.MetadataRemoved != 0 || len(again.Usage) != 0 {
+		t.Errorf("second rebuild changed %+v", again)
+	}
+}
+
+func TestRebuildGated(t *testing.T) {
+	useTempRoot(t)
+	oldToken := adminToken
+	t.Cleanup(func() { adminToken = oldToken })
+
+	adminToken = ""
+	w := httptest.NewRecorder()
+	rebuildHandler(w, httptest.NewRequest(http.MethodPost, "/_rebuild", nil))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("rebuild without -admin-token: %d, want 403", w.Code)
+	}
+
+	adminToken = "secret"
+	w = httptest.NewRecorder()
+	rebuildHandler(w, httptest.NewRequest(http.MethodGet, "/_rebuild", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: %d, want 405", w.Code)
+	}
+
+	rebuilding.Lock()
+	w = httptest.NewRecorder()
+	rebuildHandler(w, httptest.NewRequest(http.MethodPost, "/_rebuild", nil))
+	rebuilding.Unlock()
+	if w.Code != http.StatusConflict {
+		t.Errorf("rebuild while one runs: %d, want 409", w.Code)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// A route sends requests with its method (any if "") that match (all if
+// nil) to its handler.
+type route struct {
+	method string
+	match  func(r *http.Request) bool
+	handle http.HandlerFunc
+}
+
+// routes are tried in order, and the first that fits serves the request:
+// subresources go before the bucket and object requests they qualify.
+var routes = []route{
+	{"", isMultipartRequest, multipartHandler},
+	{"", isTaggingRequest, taggingHandler},
+	{http.MethodGet, isBucketRequest, bucketHandler},
+	{http.MethodPut, isBucketRequest, bucketHandler},
+	{http.MethodHead, isBucketRequest, bucketHandler},
+	{http.MethodDelete, isBucketRequest, bucketHandler},
+	{http.MethodPost, isTxnRequest, txnHandler},
+	{http.MethodPost, hasQuery("delete"), deleteObjectsHandler},
+	{http.MethodPost, isPostObjectRequest, postObjectHandler},
+	{http.MethodPost, hasQuery("undelete"), undeleteHandler},
+	{methodPropfind, isWebDAVRequest, propfindHandler},
+	{methodMkcol, isWebDAVRequest, mkcolHandler},
+	{http.MethodOptions, isWebDAVRequest, davOptionsHandler},
+	{http.MethodGet, hasQuery("attributes"), objectAttributesHandler},
+	{http.MethodPut, nil, uploadHandler},
+	{http.MethodGet, nil, downloadHandler},
+	{http.MethodHead, nil, headHandler},
+	{http.MethodDelete, nil, deleteHandler},
+}
+
+// hasQuery returns a route matcher for requests whose query has param.
+func hasQuery(param string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		_, ok := r.URL.Query()[param]
+		return ok
+	}
+}
+
+// serveAPI serves the S3 API: everything but the admin endpoints.
+func serveAPI(w http.ResponseWriter, r *http.Request) {
+	if rejectUnsupportedSubresource(w, r) {
+		return
+	}
+	if isCreatingRequest(r) && respondIfOutOfInodes(w, r) {
+		return
+	}
+	// Unless authentication already did, strip the framing SDKs may
+	// wrap uploads in; with nothing to check chunk signatures against
+	// they are ignored
+	if isAWSChunked(r) {
+		if apiErr := decodeAWSChunked(r, nil); apiErr != nil {
+			writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+			return
+		}
+	}
+	for _, rt := range routes {
+		if (rt.method == "" || rt.method == r.Method) && (rt.match == nil || rt.match(r)) {
+			rt.handle(w, r)
+			return
+		}
+	}
+	writeMethodNotAllowed(w, r, allowedMethods(r)...)
+}
+
+// Methods a route may be for, in the order Allow lists them
+var routeMethods = []string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete, http.MethodOptions, methodPropfind, methodMkcol}
+
+// allowedMethods returns the methods other than its own that some route
+// would serve the request with. OPTIONS is included while -cors-origin is
+// set, for preflights are answered before routing.
+func allowedMethods(r *http.Request) []string {
+	var allowed []string
+	probe := r.Clone(r.Context())
+	for _, m := range routeMethods {
+		if m == r.Method {
+			continue
+		}
+		probe.Method = m
+		ok := m == http.MethodOptions && len(corsOrigins) > 0
+		for _, rt := range routes {
+			if rt.method == m && (rt.match == nil || rt.match(probe)) {
+				ok = true
+				break
+			}
+		}
+		if ok {
+			allowed = append(allowed, m)
+		}
+	}
+	return allowed
+}
+
+// writeMethodNotAllowed answers a request with 405 MethodNotAllowed, listing
+// the methods the resource does support in Allow, as HTTP requires.
+func writeMethodNotAllowed(w http.ResponseWriter, r *http.Request, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against this resource.", r.URL.Path)
+}
+
+// parseRequest returns the bucket and key a request's path names, the key
+// validated with validateKey, or "" if the path names just the bucket. A
+// path without a bucket is an error.
+func parseRequest(r *http.Request) (bucket, key string, apiErr *apiError) {
+	parts := splitRequestPath(r)
+	if parts[0] == "" {
+		return "", "", &apiError{http.StatusBadRequest, "InvalidRequest", "Missing bucket name"}
+	}
+	if len(parts) < 2 || parts[1] == "" {
+		return parts[0], "", nil
+	}
+	if key, apiErr = validateKey(parts[1]); apiErr != nil {
+		return "", "", apiErr
+	}
+	return parts[0], key, nil
+}
+
+// parseObjectRequest is parseRequest for requests that must name an object.
+func parseObjectRequest(r *http.Request) (bucket, key string, apiErr *apiError) {
+	bucket, key, apiErr = parseRequest(r)
+	if apiErr == nil && key == "" {
+		return "", "", &apiError{http.StatusBadRequest, "InvalidRequest", "Missing object key"}
+	}
+	return bucket, key, apiErr
+}
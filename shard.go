@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// With -shard-depth N, objects are stored N directory levels below their
+// bucket rather than directly in it, so that a bucket of millions of keys
+// doesn't become one huge directory. Each level is named by two hex
+// digits of the SHA-256 of the object's path below the bucket:
+//
+//	<bucket>/photos/cat.jpg   ->   <bucket>/3f/a1/photos/cat.jpg
+//
+// Keys map to the same path on every request, and listings strip the
+// shard directories again, so clients see the keyspace they always did.
+// The depth a root was first used with is recorded in it, and starting
+// with another is refused: objects would go missing.
+
+// Directory levels of sharding below each bucket (0 = none)
+var shardDepth int
+
+// Deepest sharding supported: 256^3 directories per bucket
+const maxShardDepth = 3
+
+// Hidden directory under the storage root recording its layout
+const layoutDirName = ".layout"
+
+// shardPath returns where an object whose path below its bucket is rel
+// lives relative to the bucket: under its shard directories.
+func shardPath(rel string) string {
+	if shardDepth == 0 {
+		return rel
+	}
+	sum := sha256.Sum256([]byte(filepath.ToSlash(rel)))
+	digits := hex.EncodeToString(sum[:shardDepth])
+	dirs := make([]string, 0, shardDepth+1)
+	for i := 0; i < len(digits); i += 2 {
+		dirs = append(dirs, digits[i:i+2])
+	}
+	return filepath.Join(append(dirs, rel)...)
+}
+
+// unshardPath returns rel, a slash-separated path below a bucket, without
+// its shard directories. A path too shallow to be sharded, which no
+// object of ours has, is returned as it is.
+func unshardPath(rel string) string {
+	rest := rel
+	for i := 0; i < shardDepth; i++ {
+		var ok bool
+		if _, rest, ok = strings.Cut(rest, "/"); !ok {
+			return rel
+		}
+	}
+	return rest
+}
+
+// shardRoots returns the directories objects of the bucket at bucketPath
+// are stored below: the bucket itself, or every shard directory in it.
+func shardRoots(bucketPath string) ([]string, error) {
+	roots := []string{bucketPath}
+	for i := 0; i < shardDepth; i++ {
+		var next []string
+		for _, dir := range roots {
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				// Shards vanish as their bucket is deleted
+				if os.IsNotExist(err) {
+					continue
+				}
+				return nil, err
+			}
+			for _, e := range entries {
+				if e.IsDir() && isShardName(e.Name()) {
+					next = append(next, filepath.Join(dir, e.Name()))
+				}
+			}
+		}
+		roots = next
+	}
+	return roots, nil
+}
+
+// isShardName reports whether name could be a shard directory's.
+func isShardName(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil && strings.ToLower(name) == name
+}
+
+// checkShardLayout makes sure the storage root is laid out for
+// -shard-depth, recording the depth in a root that has no objects yet.
+func checkShardLayout() error {
+	layoutFile := filepath.Join(storageRootDir, layoutDirName, "shard-depth")
+	data, err := os.ReadFile(layoutFile)
+	if err == nil {
+		recorded, err := strconv.Atoi(strings.TrimSpace(string(data)))
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", layoutFile, err)
+		}
+		if recorded != shardDepth {
+			return fmt.Errorf("the storage root is sharded with -shard-depth %d; see the README on changing it", recorded)
+		}
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if shardDepth == 0 {
+		return nil
+	}
+	stored, err := hasObjects(storageRootDir)
+	if err != nil {
+		return err
+	}
+	if stored {
+		return errors.New("the storage root holds unsharded objects; see the README on changing -shard-depth")
+	}
+	if err := makeDirs(filepath.Dir(layoutFile)); err != nil {
+		return err
+	}
+	return os.WriteFile(layoutFile, []byte(strconv.Itoa(shardDepth)+"\n"), 0o644)
+}
+
+// hasObjects reports whether any bucket under root holds a file.
+func hasObjects(root string) (bool, error) {
+	root = filepath.Clean(root)
+	found := false
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		// Server state lives in hidden top-level directories
+		if d.IsDir() && path != root && filepath.Dir(path) == root && strings.HasPrefix(d.Name(), ".") {
+			return filepath.SkipDir
+		}
+		if !d.IsDir() && filepath.Dir(path) != root {
+			found = true
+			return fs.SkipAll
+		}
+		return nil
+	})
+	return found, err
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/xml"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useShardDepth sets -shard-depth for the test.
+func useShardDepth(t *testing.T, depth int) {
+	t.Helper()
+	old := shardDepth
+	shardDepth = depth
+	t.Cleanup(func() { shardDepth = old })
+}
+
+func TestShardPathRoundTrip(t *testing.T) {
+	useShardDepth(t, 2)
+	for _, rel := range []string{"a", "photos/cat.jpg", "deep/er/key with spaces", "ünïcode/ключ"} {
+		sharded := filepath.ToSlash(shardPath(filepath.FromSlash(rel)))
+		dirs := strings.Split(sharded, "/")
+		if len(dirs) < 3 || !isShardName(dirs[0]) || !isShardName(dirs[1]) {
+			t.Errorf("shardPath(%q) = %q, want two shard directories first", rel, sharded)
+		}
+		if got := unshardPath(sharded); got != rel {
+			t.Errorf("unshardPath(%q) = %q, want %q", sharded, got, rel)
+		}
+	}
+}
+
+func TestShardedObjects(t *testing.T) {
+	root := useTempRoot(t)
+	useShardDepth(t, 2)
+
+	keys := []string{"photos/cat.jpg", "photos/dog.jpg", "readme.txt"}
+	for _, key := range keys {
+		if w := serve(t, "PUT", "/b/"+key, strings.NewReader("content of "+key), nil); w.Code != 204 {
+			t.Fatalf("PUT %s: %d %s", key, w.Code, w.Body)
+		}
+	}
+
+	for _, key := range keys {
+		// Stored below its shard directories, not at the key's path
+		path := filepath.Join(root, "b", shardPath(filepath.FromSlash(key)))
+		if got, _ := readTestFile(t, path); got != "content of "+key {
+			t.Errorf("%s stored at %s: %q", key, path, got)
+		}
+		if _, exists := readTestFile(t, filepath.Join(root, "b", filepath.FromSlash(key))); exists {
+			t.Errorf("%s stored unsharded", key)
+		}
+		w := serve(t, "GET", "/b/"+key, nil, nil)
+		if w.Code != 200 || w.Body.String() != "content of "+key {
+			t.Errorf("GET %s: %d %q", key, w.Code, w.Body)
+		}
+	}
+
+	var result struct {
+		Contents []struct {
+			Key string `xml:"Key"`
+		} `xml:"Contents"`
+		CommonPrefixes []struct {
+			Prefix string `xml:"Prefix"`
+		} `xml:"CommonPrefixes"`
+	}
+	w := serve(t, "GET", "/b?list-type=2", nil, nil)
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("listing: %v: %s", err, w.Body)
+	}
+	var listed []string
+	for _, c := range result.Contents {
+		listed = append(listed, c.Key)
+	}
+	if strings.Join(listed, ",") != strings.Join(keys, ",") {
+		t.Errorf("listed %v, want %v", listed, keys)
+	}
+
+	result.Contents, result.CommonPrefixes = nil, nil
+	w = serve(t, "GET", "/b?list-type=2&delimiter=/", nil, nil)
+	if err := xml.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("listing: %v: %s", err, w.Body)
+	}
+	if len(result.CommonPrefixes) != 1 || result.CommonPrefixes[0].Prefix != "photos/" {
+		t.Errorf("common prefixes %v, want photos/", result.CommonPrefixes)
+	}
+	if len(result.Contents) != 1 || result.Contents[0].Key != "readme.txt" {
+		t.Errorf("listed %v with delimiter, want readme.txt", result.Contents)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// When -shutdown-timeout runs out, the connections still open are closed.
+// So that the log says what that cut off, withRequestLog registers every
+// request while it is served, and the server's ConnState hook counts its
+// open connections.
+
+// activeRequest is a request being served.
+type activeRequest struct {
+	id     string
+	method string
+	bucket string
+	key    string
+	start  time.Time
+}
+
+var activeRequests struct {
+	sync.Mutex
+	set map[*activeRequest]bool
+}
+
+// Connections to the API server not yet closed or hijacked
+var openConns atomic.Int64
+
+// trackRequest registers r as being served until the returned func is
+// called.
+func trackRequest(r *http.Request) func() {
+	bucket, key := requestTarget(r)
+	a := &activeRequest{id: requestIDFrom(r.Context()), method: r.Method, bucket: bucket, key: key, start: time.Now()}
+	activeRequests.Lock()
+	if activeRequests.set == nil {
+		activeRequests.set = map[*activeRequest]bool{}
+	}
+	activeRequests.set[a] = true
+	activeRequests.Unlock()
+	return func() {
+		activeRequests.Lock()
+		delete(activeRequests.set, a)
+		activeRequests.Unlock()
+	}
+}
+
+// countConn is the API server's ConnState hook.
+func countConn(c net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		openConns.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		openConns.Add(-1)
+	}
+}
+
+// logInterruptedRequests logs, oldest first, the requests still being
+// served as their connections are about to be closed, and how many
+// connections that is.
+func logInterruptedRequests() {
+	activeRequests.Lock()
+	active := make([]*activeRequest, 0, len(activeRequests.set))
+	for a := range activeRequests.set {
+		active = append(active, a)
+	}
+	activeRequests.Unlock()
+	sort.Slice(active, func(i, j int) bool { return active[i].start.Before(active[j].start) })
+
+	slog.Warn("Shutdown timeout exceeded; closing remaining connections", "connections", openConns.Load(), "requests", len(active))
+	for _, a := range active {
+		slog.Warn("Interrupting request",
+			"request_id", a.id,
+			"method", a.method,
+			"bucket", a.bucket,
+			"key", a.key,
+			"running_ms", time.Since(a.start).Milliseconds(),
+		)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogInterruptedRequests(t *testing.T) {
+	openConns.Store(0)
+	entered := make(chan struct{})
+	release := make(chan struct{})
+	srv := httptest.NewUnstartedServer(withRequestLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(entered)
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})))
+	srv.Config.ConnState = countConn
+	srv.Start()
+	defer srv.Close()
+	defer close(release)
+
+	go func() {
+		resp, err := http.Get(srv.URL + "/photos/cat%20pic.jpg")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	select {
+	case <-entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("request never reached the handler")
+	}
+
+	buf := captureLog(t)
+	logInterruptedRequests()
+	log := buf.String()
+	for _, want := range []string{"connections=1", "requests=1", "method=GET", "bucket=photos", `key="cat pic.jpg"`} {
+		if !strings.Contains(log, want) {
+			t.Errorf("shutdown log lacks %s:\n%s", want, log)
+		}
+	}
+}
+
+func TestTrackRequest(t *testing.T) {
+	untrack := trackRequest(httptest.NewRequest(http.MethodPut, "/b/k", nil))
+	activeRequests.Lock()
+	n := len(activeRequests.set)
+	activeRequests.Unlock()
+	if n != 1 {
+		t.Fatalf("%d requests tracked, want 1", n)
+	}
+	untrack()
+	activeRequests.Lock()
+	n = len(activeRequests.set)
+	activeRequests.Unlock()
+	if n != 0 {
+		t.Errorf("%d requests tracked after untracking, want 0", n)
+	}
+}
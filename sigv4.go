@@ -0,0 +1,349 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Credentials clients must sign requests with (AWS Signature Version 4).
+// Authentication is disabled while accessKey is empty.
+var (
+	accessKey string
+	secretKey string
+)
+
+// Whether a signature mismatch logs what the server signed (-debug-sigv4)
+var debugSigV4 bool
+
+// Requests dated further than this from the server's clock are refused, as in S3
+const maxClockSkew = 15 * time.Minute
+
+// Layout of x-amz-date and the date part of the credential scope
+const (
+	amzDateFormat  = "20060102T150405Z"
+	amzShortFormat = "20060102"
+)
+
+// Payload hash values that stand for something other than the body's SHA-256
+const (
+	unsignedPayload  = "UNSIGNED-PAYLOAD"
+	streamingPayload = "STREAMING-" // prefix of the aws-chunked variants
+)
+
+// errContentSHA256Mismatch is returned from a request body whose content
+// doesn't match the x-amz-content-sha256 it was signed with.
+var errContentSHA256Mismatch = errors.New("body does not match x-amz-content-sha256")
+
+// withSigV4 refuses requests that are not signed with the configured
+// credentials.
+func withSigV4(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if apiErr := verifySigV4(r); apiErr != nil {
+			slog.Warn("Rejected unauthenticated request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "reason", apiErr.message)
+			writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// sigV4Auth is a parsed "Authorization: AWS4-HMAC-SHA256 ..." header.
+type sigV4Auth struct {
+	accessKey     string
+	scope         string // <date>/<region>/<service>/aws4_request
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+}
+
+func parseSigV4Auth(header string) (*sigV4Auth, bool) {
+	rest, ok := strings.CutPrefix(header, "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return nil, false
+	}
+	a := &sigV4Auth{}
+	for _, field := range strings.Split(rest, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, false
+		}
+		switch name {
+		case "Credential":
+			if !a.parseCredential(value) {
+				return nil, false
+			}
+		case "SignedHeaders":
+			a.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			a.signature = value
+		}
+	}
+	if a.accessKey == "" || len(a.signedHeaders) == 0 || a.signature == "" {
+		return nil, false
+	}
+	return a, true
+}
+
+// parseCredential fills in the key and scope from a
+// "<access-key>/<date>/<region>/<service>/aws4_request" credential.
+func (a *sigV4Auth) parseCredential(value string) bool {
+	parts := strings.Split(value, "/")
+	if len(parts) != 5 || parts[4] != "aws4_request" {
+		return false
+	}
+	a.accessKey = parts[0]
+	a.date, a.region, a.service = parts[1], parts[2], parts[3]
+	a.scope = strings.Join(parts[1:], "/")
+	return true
+}
+
+// verifySigV4 checks the request's Authorization header, returning the
+// error to refuse it with, if any. When the signature covers the body's
+// SHA-256, the body is wrapped so that reading it fails with
+// errContentSHA256Mismatch if the content differs.
+func verifySigV4(r *http.Request) *apiError {
+	if r.URL.Query().Has("X-Amz-Algorithm") {
+		return verifyPresigned(r)
+	}
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Missing Authorization header"}
+	}
+	auth, ok := parseSigV4Auth(header)
+	if !ok {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Malformed or unsupported Authorization header; only AWS4-HMAC-SHA256 is accepted"}
+	}
+	if auth.accessKey != accessKey {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Unknown access key " + auth.accessKey}
+	}
+	if auth.service != "s3" {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Credential scope must be for service s3"}
+	}
+
+	var signedHost, signedContentHash bool
+	for _, h := range auth.signedHeaders {
+		signedHost = signedHost || h == "host"
+		signedContentHash = signedContentHash || h == "x-amz-content-sha256"
+	}
+	if !signedHost {
+		return &apiError{http.StatusForbidden, "AccessDenied", "The host header must be signed"}
+	}
+
+	amzDate := r.Header.Get("x-amz-date")
+	t, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Missing or malformed x-amz-date header"}
+	}
+	if skew := time.Since(t); skew > maxClockSkew || skew < -maxClockSkew {
+		return &apiError{http.StatusForbidden, "RequestTimeTooSkewed", "The difference between the request time and the server's time is too large"}
+	}
+	if auth.date != t.Format(amzShortFormat) {
+		return &apiError{http.StatusForbidden, "AccessDenied", "Credential scope date does not match x-amz-date"}
+	}
+
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	if payloadHash == "" || !signedContentHash {
+		return &apiError{http.StatusBadRequest, "InvalidRequest", "Missing required signed header x-amz-content-sha256"}
+	}
+
+	canonical := canonicalRequest(r, r.URL.RawQuery, auth.signedHeaders, payloadHash)
+	want := sigV4Signature(secretKey, auth, amzDate, canonical)
+	if !hmac.Equal([]byte(want), []byte(auth.signature)) {
+		logSignatureMismatch(r, "SigV4 signature mismatch", auth, amzDate, canonical)
+		return &apiError{http.StatusForbidden, "AccessDenied", "The request signature does not match the signature computed with the configured secret key"}
+	}
+
+	switch {
+	case payloadHash == unsignedPayload:
+	case payloadHash == streamingSignedPayload || payloadHash == streamingSignedPayloadTrailer:
+		return decodeAWSChunked(r, &chunkSigner{
+			key:     sigV4SigningKey(secretKey, auth),
+			amzDate: amzDate,
+			scope:   auth.scope,
+			prev:    auth.signature,
+			trailer: payloadHash == streamingSignedPayloadTrailer,
+		})
+	case payloadHash == streamingUnsignedPayloadTrailer:
+		return decodeAWSChunked(r, nil)
+	case strings.HasPrefix(payloadHash, streamingPayload):
+		return &apiError{http.StatusNotImplemented, "NotImplemented", "Only the " + streamingSignedPayload + ", " + streamingSignedPayloadTrailer + " and " + streamingUnsignedPayloadTrailer + " streaming payloads are supported"}
+	default:
+		want, err := hex.DecodeString(payloadHash)
+		if err != nil || len(want) != sha256.Size {
+			return &apiError{http.StatusBadRequest, "InvalidArgument", "x-amz-content-sha256 must be a hex SHA-256, " + unsignedPayload + " or a streaming value"}
+		}
+		r.Body = &verifyingBody{ReadCloser: r.Body, hash: sha256.New(), want: want}
+	}
+	return nil
+}
+
+// canonicalRequest builds the SigV4 canonical request for r, with rawQuery
+// standing in for its query string.
+func canonicalRequest(r *http.Request, rawQuery string, signedHeaders []string, payloadHash string) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte('\n')
+	b.WriteString(awsURIEncode(r.URL.Path, false))
+	b.WriteByte('\n')
+	b.WriteString(canonicalQuery(rawQuery))
+	b.WriteByte('\n')
+	for _, name := range signedHeaders {
+		var values []string
+		if name == "host" {
+			values = []string{r.Host}
+		} else {
+			// Copied so collapsing whitespace leaves the header itself alone
+			values = append([]string(nil), r.Header.Values(name)...)
+		}
+		for i, v := range values {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(values, ","))
+		b.WriteByte('\n')
+	}
+	b.WriteByte('\n')
+	b.WriteString(strings.Join(signedHeaders, ";"))
+	b.WriteByte('\n')
+	b.WriteString(payloadHash)
+	return b.String()
+}
+
+// canonicalQuery sorts and re-encodes a raw query string, with parameters
+// lacking a value given an empty one ("uploads" becomes "uploads=").
+func canonicalQuery(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+	var params [][2]string
+	for _, p := range strings.Split(rawQuery, "&") {
+		if p == "" {
+			continue
+		}
+		k, v, _ := strings.Cut(p, "=")
+		params = append(params, [2]string{awsURIEncode(unescapeQueryPart(k), true), awsURIEncode(unescapeQueryPart(v), true)})
+	}
+	// Sorted by name, then value
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p[0] + "=" + p[1]
+	}
+	return strings.Join(pairs, "&")
+}
+
+// unescapeQueryPart decodes %XX sequences, leaving "+" alone as SDKs
+// percent-encode spaces; malformed input is used as-is.
+func unescapeQueryPart(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' && i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+			v, _ := hex.DecodeString(s[i+1 : i+3])
+			b.WriteByte(v[0])
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+// awsURIEncode percent-encodes everything but unreserved characters, as
+// SigV4 requires; "/" is kept unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	const upperHex = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperHex[c>>4])
+		b.WriteByte(upperHex[c&15])
+	}
+	return b.String()
+}
+
+// sigV4Signature signs a canonical request with the key derived from secret
+// for the credential scope in auth.
+func sigV4Signature(secret string, auth *sigV4Auth, amzDate, canonical string) string {
+	return hex.EncodeToString(hmacSHA256(sigV4SigningKey(secret, auth), sigV4StringToSign(auth, amzDate, canonical)))
+}
+
+// sigV4StringToSign returns the string a request with the canonical
+// request canonical, dated amzDate, is signed by.
+func sigV4StringToSign(auth *sigV4Auth, amzDate, canonical string) string {
+	hashed := sha256.Sum256([]byte(canonical))
+	return "AWS4-HMAC-SHA256\n" + amzDate + "\n" + auth.scope + "\n" + hex.EncodeToString(hashed[:])
+}
+
+// logSignatureMismatch logs, with -debug-sigv4, what the server signed for
+// a request whose signature didn't match, to compare with what the client
+// signed. Canonical requests carry the signed headers' values, so they are
+// not logged otherwise, and the record is a debug record: -debug-sigv4
+// writes it whatever -log-level is, and log pipelines keeping only
+// warnings and errors drop it.
+func logSignatureMismatch(r *http.Request, msg string, auth *sigV4Auth, amzDate, canonical string) {
+	if !debugSigV4 {
+		return
+	}
+	rec := slog.NewRecord(time.Now(), slog.LevelDebug, msg, 0)
+	rec.Add("method", r.Method, "path", r.URL.Path, "canonical_request", canonical,
+		"string_to_sign", sigV4StringToSign(auth, amzDate, canonical), "client_signature", auth.signature)
+	slog.Default().Handler().Handle(r.Context(), rec)
+}
+
+// sigV4SigningKey derives the key for auth's credential scope from secret.
+func sigV4SigningKey(secret string, auth *sigV4Auth) []byte {
+	key := hmacSHA256([]byte("AWS4"+secret), auth.date)
+	key = hmacSHA256(key, auth.region)
+	key = hmacSHA256(key, auth.service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// verifyingBody hashes a request body as it is read and fails the final
+// read if the content doesn't match the signed hash.
+type verifyingBody struct {
+	io.ReadCloser
+	hash hash.Hash
+	want []byte
+}
+
+func (b *verifyingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !hmac.Equal(b.hash.Sum(nil), b.want) {
+		return n, errContentSHA256Mismatch
+	}
+	return n, err
+}
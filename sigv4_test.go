@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useCredentials makes the server require requests signed with the given
+// key pair.
+func useCredentials(t *testing.T, access, secret string) {
+	t.Helper()
+	oldAccess, oldSecret := accessKey, secretKey
+	accessKey, secretKey = access, secret
+	t.Cleanup(func() { accessKey, secretKey = oldAccess, oldSecret })
+}
+
+// captureLog sends log records to the returned buffer for the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	old := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&buf, nil)))
+	t.Cleanup(func() { slog.SetDefault(old) })
+	return &buf
+}
+
+// signRequest signs r with the configured secret key, as an SDK would,
+// for an unsigned payload.
+func signRequest(r *http.Request) {
+	amzDate := time.Now().UTC().Format(amzDateFormat)
+	r.Header.Set("x-amz-date", amzDate)
+	r.Header.Set("x-amz-content-sha256", unsignedPayload)
+	auth := &sigV4Auth{
+		accessKey:     accessKey,
+		date:          amzDate[:8],
+		region:        "us-east-1",
+		service:       "s3",
+		signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+	}
+	auth.scope = auth.date + "/us-east-1/s3/aws4_request"
+	for name := range r.Header {
+		if name := strings.ToLower(name); name != "x-amz-content-sha256" && name != "x-amz-date" {
+			auth.signedHeaders = append(auth.signedHeaders, name)
+		}
+	}
+	sort.Strings(auth.signedHeaders)
+	canonical := canonicalRequest(r, r.URL.RawQuery, auth.signedHeaders, unsignedPayload)
+	r.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+auth.scope+
+		", SignedHeaders="+strings.Join(auth.signedHeaders, ";")+
+		", Signature="+sigV4Signature(secretKey, auth, amzDate, canonical))
+}
+
+func TestSignatureMismatchLog(t *testing.T) {
+	useCredentials(t, "AKID", "secret")
+	old := slog.Default()
+	t.Cleanup(func() { slog.SetDefault(old) })
+	for _, debug := range []bool{false, true} {
+		debugSigV4 = debug
+		// Written at debug level even where only warnings are
+		var logged bytes.Buffer
+		slog.SetDefault(slog.New(slog.NewTextHandler(&logged, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+		r := httptest.NewRequest("GET", "/b/k", nil)
+		signRequest(r)
+		if apiErr := verifySigV4(r); apiErr != nil {
+			t.Fatalf("correctly signed request refused: %s", apiErr.message)
+		}
+		r.Header.Set("Authorization", strings.Replace(r.Header.Get("Authorization"), "Signature=", "Signature=0", 1))
+		if apiErr := verifySigV4(r); apiErr == nil || apiErr.code != "AccessDenied" {
+			t.Fatalf("wrongly signed request: %v, want AccessDenied", apiErr)
+		}
+
+		log := logged.String()
+		if strings.Contains(log, "level=WARN msg=\"SigV4 signature mismatch\"") {
+			t.Errorf("signature mismatch logged as a warning:\n%s", log)
+		}
+		for _, want := range []string{"level=DEBUG", "canonical_request=", "string_to_sign=", "client_signature=0"} {
+			if got := strings.Contains(log, want); got != debug {
+				t.Errorf("with -debug-sigv4=%v, log has %s: %v\n%s", debug, want, got, log)
+			}
+		}
+	}
+	debugSigV4 = false
+}
+
+func TestCanonicalRequestLeavesHeadersAlone(t *testing.T) {
+	useCredentials(t, "AKID", "secret")
+	r := httptest.NewRequest("PUT", "/b/k", nil)
+	r.Header.Set("x-amz-meta-note", "  two   spaces  ")
+	signRequest(r)
+	if got := r.Header.Get("x-amz-meta-note"); got != "  two   spaces  " {
+		t.Errorf("signing changed the header to %q", got)
+	}
+	if apiErr := verifySigV4(r); apiErr != nil {
+		t.Fatalf("signed request refused: %s", apiErr.message)
+	}
+	if got := r.Header.Get("x-amz-meta-note"); got != "  two   spaces  " {
+		t.Errorf("verifying the signature changed the header to %q", got)
+	}
+}
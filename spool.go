@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Request bodies that must be had whole before they are acted on (the
+// documents of DeleteObjects and CompleteMultipartUpload, and the file of
+// a form upload) are kept in memory up to this many bytes, and spooled to
+// a temp file in the staging directory beyond (-spool-threshold)
+var spoolThreshold int64 = 1 << 20
+
+// errSpool marks a failure to write the spool file, as opposed to one
+// reading the request body.
+var errSpool = errors.New("spooling request body failed")
+
+// spooledBody is the whole of a request body, in memory or in a spool
+// file. Close removes the file.
+type spooledBody struct {
+	io.ReadSeeker
+	size int64
+	file *os.File
+}
+
+// spoolBody reads body to its end. Errors reading it are returned as they
+// are, and those writing the spool file wrapped in errSpool.
+func spoolBody(body io.Reader) (*spooledBody, error) {
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, body, spoolThreshold+1)
+	if err == io.EOF {
+		return &spooledBody{ReadSeeker: bytes.NewReader(buf.Bytes()), size: n}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dir := filepath.Join(storageRootDir, stagingDirName)
+	if err := makeDirs(dir); err != nil {
+		return nil, spoolError(err)
+	}
+	f, err := os.CreateTemp(dir, tempFilePrefix+"spool-*")
+	if err != nil {
+		return nil, spoolError(err)
+	}
+	s := &spooledBody{ReadSeeker: f, file: f}
+	if s.size, err = io.Copy(spoolWriter{f}, io.MultiReader(&buf, body)); err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+		err = spoolError(err)
+	}
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *spooledBody) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	s.file.Close()
+	return os.Remove(s.file.Name())
+}
+
+// spoolWriter tells errors writing the spool file from those reading the
+// body being copied to it.
+type spoolWriter struct{ f *os.File }
+
+func (w spoolWriter) Write(p []byte) (int, error) {
+	n, err := w.f.Write(p)
+	return n, spoolError(err)
+}
+
+func spoolError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %w", errSpool, err)
+}
+
+// respondIfSpoolFailed answers a request whose body couldn't be spooled
+// with 507 if the disk is full, and 500 otherwise. It reports whether it
+// handled err, which it leaves alone unless it is from writing the spool
+// file.
+func respondIfSpoolFailed(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, errSpool) {
+		return false
+	}
+	if !respondIfDiskFull(w, r, err) {
+		slog.Error("Spooling request body failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+	}
+	return true
+}
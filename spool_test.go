@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useSpoolThreshold sets -spool-threshold for the duration of the test.
+func useSpoolThreshold(t *testing.T, n int64) {
+	t.Helper()
+	old := spoolThreshold
+	spoolThreshold = n
+	t.Cleanup(func() { spoolThreshold = old })
+}
+
+// spoolFiles returns the names of the spool files in the staging directory.
+func spoolFiles(t *testing.T) []string {
+	t.Helper()
+	matches, err := filepath.Glob(filepath.Join(storageRootDir, stagingDirName, tempFilePrefix+"spool-*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return matches
+}
+
+// spoolWatcher reads r, recording the spool files found once it is read
+// to its end.
+type spoolWatcher struct {
+	t     *testing.T
+	r     io.Reader
+	found []string
+}
+
+func (s *spoolWatcher) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err == io.EOF {
+		s.found = spoolFiles(s.t)
+	}
+	return n, err
+}
+
+func TestSpoolBody(t *testing.T) {
+	useTempRoot(t)
+	useSpoolThreshold(t, 16)
+
+	for _, content := range []string{"", "below", strings.Repeat("x", 16), strings.Repeat("y", 17), strings.Repeat("z", 100)} {
+		watcher := &spoolWatcher{t: t, r: strings.NewReader(content)}
+		body, err := spoolBody(watcher)
+		if err != nil {
+			t.Fatalf("%d bytes: %v", len(content), err)
+		}
+		spooled := len(content) > 16
+		if got := len(watcher.found) == 1 && body.file != nil; got != spooled {
+			t.Errorf("%d bytes: spooled %v, want %v", len(content), got, spooled)
+		}
+		data, err := io.ReadAll(body)
+		if err != nil || string(data) != content || body.size != int64(len(content)) {
+			t.Errorf("%d bytes: read back %d bytes, size %d, %v", len(content), len(data), body.size, err)
+		}
+		if err := body.Close(); err != nil {
+			t.Error(err)
+		}
+		if files := spoolFiles(t); len(files) != 0 {
+			t.Errorf("%d bytes: spool files left: %v", len(content), files)
+		}
+	}
+
+	// A body that fails part way leaves nothing behind
+	failing := io.MultiReader(strings.NewReader(strings.Repeat("x", 100)), failingReader{})
+	if _, err := spoolBody(failing); !errors.Is(err, errBodyFailed) || errors.Is(err, errSpool) {
+		t.Errorf("body read error: %v", err)
+	}
+	if files := spoolFiles(t); len(files) != 0 {
+		t.Errorf("spool files left after a read error: %v", files)
+	}
+}
+
+var errBodyFailed = errors.New("body failed")
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) { return 0, errBodyFailed }
+
+func TestSpoolBodyFailure(t *testing.T) {
+	root := useTempRoot(t)
+	useSpoolThreshold(t, 64)
+	// The staging directory can't be created where a file is in the way
+	writeTestFile(t, filepath.Join(root, stagingDirName), "in the way")
+
+	if _, err := spoolBody(strings.NewReader(strings.Repeat("x", 100))); !errors.Is(err, errSpool) {
+		t.Errorf("spool write error: %v, want errSpool", err)
+	}
+	body := `<Delete><Object><Key>` + strings.Repeat("k", 100) + `</Key></Object></Delete>`
+	if w := serve(t, http.MethodPost, "/b?delete", strings.NewReader(body), nil); w.Code != http.StatusInternalServerError {
+		t.Errorf("DeleteObjects unable to spool: %d, want 500", w.Code)
+	}
+	// Small bodies are kept in memory and unaffected
+	body = `<Delete><Object><Key>k</Key></Object></Delete>`
+	writeTestFile(t, filepath.Join(root, "b", "k"), "data")
+	if w := serve(t, http.MethodPost, "/b?delete", strings.NewReader(body), nil); w.Code != http.StatusOK {
+		t.Errorf("small DeleteObjects: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestSpooledRequests(t *testing.T) {
+	root := useTempRoot(t)
+	useUploads(t)
+	oldMin := minPartSize
+	minPartSize = 0
+	t.Cleanup(func() { minPartSize = oldMin })
+	const threshold = 256
+	useSpoolThreshold(t, threshold)
+
+	for _, spooled := range []bool{false, true} {
+		pad := ""
+		if spooled {
+			pad = strings.Repeat(" ", threshold)
+		}
+
+		// DeleteObjects
+		writeTestFile(t, filepath.Join(root, "b", "doomed"), "data")
+		doc := `<Delete>` + pad + `<Object><Key>doomed</Key></Object></Delete>`
+		if w := serve(t, http.MethodPost, "/b?delete", strings.NewReader(doc), nil); w.Code != http.StatusOK {
+			t.Errorf("spooled %v: DeleteObjects: %d %s", spooled, w.Code, w.Body)
+		}
+		if _, err := os.Stat(filepath.Join(root, "b", "doomed")); !os.IsNotExist(err) {
+			t.Errorf("spooled %v: object not deleted: %v", spooled, err)
+		}
+
+		// CompleteMultipartUpload
+		id := initiateUpload(t, "/b/assembled")
+		etag := uploadTestPart(t, "/b/assembled", id, 1, "part")
+		doc = `<CompleteMultipartUpload>` + pad + `<Part><PartNumber>1</PartNumber><ETag>` + etag + `</ETag></Part></CompleteMultipartUpload>`
+		if w := serve(t, http.MethodPost, "/b/assembled?uploadId="+id, strings.NewReader(doc), nil); w.Code != http.StatusOK {
+			t.Errorf("spooled %v: CompleteMultipartUpload: %d %s", spooled, w.Code, w.Body)
+		}
+		if got, _ := readTestFile(t, filepath.Join(root, "b", "assembled")); got != "part" {
+			t.Errorf("spooled %v: assembled %q", spooled, got)
+		}
+
+		// Form upload
+		content := "form content" + pad
+		var form bytes.Buffer
+		mw := multipart.NewWriter(&form)
+		mw.WriteField("key", "uploaded")
+		fw, _ := mw.CreateFormFile("file", "f.txt")
+		io.WriteString(fw, content)
+		mw.Close()
+		header := http.Header{"Content-Type": {mw.FormDataContentType()}}
+		if w := serve(t, http.MethodPost, "/b", &form, header); w.Code != http.StatusNoContent {
+			t.Errorf("spooled %v: form upload: %d %s", spooled, w.Code, w.Body)
+		}
+		if got, _ := readTestFile(t, filepath.Join(root, "b", "uploaded")); got != content {
+			t.Errorf("spooled %v: uploaded %d bytes, want %d", spooled, len(got), len(content))
+		}
+
+		if files := spoolFiles(t); len(files) != 0 {
+			t.Errorf("spooled %v: spool files left: %v", spooled, files)
+		}
+	}
+}
+
+func TestSpooledFormUploadSizeLimit(t *testing.T) {
+	useTempRoot(t)
+	useSpoolThreshold(t, 16)
+	old := maxObjectSize
+	maxObjectSize = 100
+	t.Cleanup(func() { maxObjectSize = old })
+
+	var form bytes.Buffer
+	mw := multipart.NewWriter(&form)
+	mw.WriteField("key", "big")
+	fw, _ := mw.CreateFormFile("file", "big.bin")
+	io.WriteString(fw, strings.Repeat("x", 1000))
+	mw.Close()
+	w := serve(t, http.MethodPost, "/b", &form, http.Header{"Content-Type": {mw.FormDataContentType()}})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "<Code>EntityTooLarge</Code>") {
+		t.Errorf("oversized form upload: %d %s", w.Code, w.Body)
+	}
+	if files := spoolFiles(t); len(files) != 0 {
+		t.Errorf("spool files left: %v", files)
+	}
+}
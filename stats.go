@@ -0,0 +1,251 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GET /admin/stats on the -admin-addr listener reports how much the store
+// holds, for capacity planning. Counting means walking every bucket, so
+// the counts are those of the last walk, redone in the background once
+// they are older than statsMaxAge; a request never waits for one. Free disk
+// space is read afresh each time.
+
+// How old the counts may get before a request has them recomputed
+var statsMaxAge = time.Minute
+
+// Token the admin listener requires as "Authorization: Bearer <token>";
+// empty requires none
+var adminToken string
+
+// Bytes are counted as stored, after compression and encryption; logical
+// bytes are the content clients see. Their ratio, logical to stored, is
+// what -compress saves (1 for objects stored as sent, and for none).
+type storageStats struct {
+	ComputedAt       string                 `json:"computed_at"`
+	Objects          int64                  `json:"objects"`
+	Bytes            int64                  `json:"bytes"`
+	LogicalBytes     int64                  `json:"logical_bytes"`
+	CompressionRatio float64                `json:"compression_ratio"`
+	Buckets          map[string]bucketStats `json:"buckets"`
+	Disk             *diskStats             `json:"disk,omitempty"`
+}
+
+type bucketStats struct {
+	Objects          int64   `json:"objects"`
+	Bytes            int64   `json:"bytes"`
+	LogicalBytes     int64   `json:"logical_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+}
+
+// objectStats is what GET /admin/stats?bucket=<bucket>&key=<key> reports
+// about one object.
+type objectStats struct {
+	Bucket           string  `json:"bucket"`
+	Key              string  `json:"key"`
+	Bytes            int64   `json:"bytes"`
+	LogicalBytes     int64   `json:"logical_bytes"`
+	CompressionRatio float64 `json:"compression_ratio"`
+	Compressed       bool    `json:"compressed"`
+	Encrypted        bool    `json:"encrypted"`
+	LastModified     string  `json:"last_modified"` // at full precision
+}
+
+type diskStats struct {
+	TotalBytes     uint64      `json:"total_bytes"`
+	FreeBytes      uint64      `json:"free_bytes"`
+	AvailableBytes uint64      `json:"available_bytes"` // to unprivileged users
+	Inodes         *inodeStats `json:"inodes,omitempty"`
+}
+
+type inodeStats struct {
+	Total uint64 `json:"total"`
+	Free  uint64 `json:"free"`
+}
+
+var statsCache struct {
+	mu        sync.Mutex
+	stats     *storageStats // nil until the first walk completes
+	computed  time.Time
+	computing bool
+}
+
+// statsHandler serves GET /admin/stats, or with bucket and key, the
+// stats of that object. Until the first walk completes it answers 503
+// with Retry-After.
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if q := r.URL.Query(); q.Has("bucket") || q.Has("key") {
+		objectStatsHandler(w, q.Get("bucket"), q.Get("key"))
+		return
+	}
+	statsCache.mu.Lock()
+	cached := statsCache.stats
+	if (cached == nil || time.Since(statsCache.computed) > statsMaxAge) && !statsCache.computing {
+		statsCache.computing = true
+		go refreshStats()
+	}
+	statsCache.mu.Unlock()
+
+	if cached == nil {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "storage statistics are still being computed", http.StatusServiceUnavailable)
+		return
+	}
+	stats := *cached
+	stats.Disk = diskSpace(storageRootDir)
+	writeStats(w, stats)
+}
+
+// objectStatsHandler reports the stats of one object, read afresh.
+func objectStatsHandler(w http.ResponseWriter, bucket, key string) {
+	if bucket == "" || key == "" {
+		http.Error(w, "bucket and key must both be given", http.StatusBadRequest)
+		return
+	}
+	if _, err := sanitizePath(bucket, key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	fi, meta, err := backend.Stat(bucket, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "no such object", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Stating object failed", "err", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	logical := contentSize(fi, meta)
+	writeStats(w, objectStats{
+		Bucket:           bucket,
+		Key:              key,
+		Bytes:            fi.Size(),
+		LogicalBytes:     logical,
+		CompressionRatio: compressionRatio(logical, fi.Size()),
+		Compressed:       meta.Compressed,
+		Encrypted:        meta.Encrypted,
+		LastModified:     fi.ModTime().UTC().Format(time.RFC3339Nano),
+	})
+}
+
+func writeStats(w http.ResponseWriter, stats any) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(stats); err != nil {
+		slog.Error("Writing storage statistics failed", "err", err)
+	}
+}
+
+// compressionRatio returns the ratio of logical to stored bytes, 1 when
+// nothing is stored.
+func compressionRatio(logical, stored int64) float64 {
+	if stored == 0 {
+		return 1
+	}
+	return float64(logical) / float64(stored)
+}
+
+// refreshStats walks the store and caches what it counts. The caller sets
+// statsCache.computing.
+func refreshStats() {
+	start := time.Now()
+	stats, err := walkStats()
+	statsCache.mu.Lock()
+	defer statsCache.mu.Unlock()
+	statsCache.computing = false
+	if err != nil {
+		slog.Error("Computing storage statistics failed", "err", err)
+		return
+	}
+	statsCache.stats, statsCache.computed = stats, start
+	slog.Debug("Computed storage statistics", "objects", stats.Objects, "bytes", stats.Bytes, "duration", time.Since(start).String())
+}
+
+// walkStats counts the objects in every bucket and the bytes they take up
+// on disk, as stored: after compression and encryption, without metadata,
+// noncurrent versions, the trash or unfinished multipart uploads. Their
+// logical size comes from their metadata.
+func walkStats() (*storageStats, error) {
+	entries, err := os.ReadDir(storageRootDir)
+	if err != nil {
+		return nil, err
+	}
+	stats := &storageStats{ComputedAt: time.Now().UTC().Format(time.RFC3339), Buckets: map[string]bucketStats{}}
+	for _, e := range entries {
+		// Server state lives in hidden top-level directories
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		var b bucketStats
+		err := filepath.WalkDir(filepath.Join(storageRootDir, e.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				// Concurrent deletes can make entries vanish mid-walk
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			if !d.Type().IsRegular() || isTempFile(d.Name()) {
+				return nil
+			}
+			fi, err := d.Info()
+			if err != nil {
+				return nil
+			}
+			b.Objects++
+			b.Bytes += fi.Size()
+			b.LogicalBytes += logicalSize(path, fi)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		b.CompressionRatio = compressionRatio(b.LogicalBytes, b.Bytes)
+		stats.Buckets[e.Name()] = b
+		stats.Objects += b.Objects
+		stats.Bytes += b.Bytes
+		stats.LogicalBytes += b.LogicalBytes
+	}
+	stats.CompressionRatio = compressionRatio(stats.LogicalBytes, stats.Bytes)
+	return stats, nil
+}
+
+// logicalSize returns the size of the content of the object stored at
+// path, which is its size on disk if it has no current metadata. Stats
+// don't rehash objects to make up for it, as loadMeta would.
+func logicalSize(path string, fi fs.FileInfo) int64 {
+	m := readMeta(path, fi)
+	if m == nil {
+		return fi.Size()
+	}
+	return contentSize(fi, m)
+}
+
+// withAdminToken requires -admin-token as a bearer token on every request.
+func withAdminToken(next http.Handler) http.Handler {
+	want := []byte("Bearer " + adminToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="s3fs-go admin"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
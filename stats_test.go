@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useCompression turns -compress on for the duration of the test.
+func useCompression(t *testing.T) {
+	t.Helper()
+	old := compressObjects
+	compressObjects = true
+	t.Cleanup(func() { compressObjects = old })
+}
+
+// putSizedObjects stores an object compressed in bucket "packed" and the
+// same content as it is in "plain", returning the size of the content.
+func putSizedObjects(t *testing.T) int {
+	t.Helper()
+	useCompression(t)
+	content := strings.Repeat("compressible ", 1000)
+	if w := serve(t, http.MethodPut, "/packed/k", strings.NewReader(content), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT packed: %d %s", w.Code, w.Body)
+	}
+	compressObjects = false
+	if w := serve(t, http.MethodPut, "/plain/k", strings.NewReader(content), nil); w.Code != http.StatusNoContent {
+		t.Fatalf("PUT plain: %d %s", w.Code, w.Body)
+	}
+	return len(content)
+}
+
+func TestWalkStatsSizes(t *testing.T) {
+	useTempRoot(t)
+	size := int64(putSizedObjects(t))
+
+	stats, err := walkStats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	packed, plain := stats.Buckets["packed"], stats.Buckets["plain"]
+	if packed.LogicalBytes != size || packed.Bytes >= size || packed.CompressionRatio <= 1 {
+		t.Errorf("packed: %+v, want %d logical bytes stored in fewer", packed, size)
+	}
+	if plain.LogicalBytes != size || plain.Bytes != size || plain.CompressionRatio != 1 {
+		t.Errorf("plain: %+v, want %d bytes stored as they are", plain, size)
+	}
+	if stats.LogicalBytes != 2*size || stats.Bytes != packed.Bytes+plain.Bytes {
+		t.Errorf("totals: %d logical, %d stored", stats.LogicalBytes, stats.Bytes)
+	}
+	if want := compressionRatio(2*size, stats.Bytes); stats.CompressionRatio != want {
+		t.Errorf("ratio %v, want %v", stats.CompressionRatio, want)
+	}
+}
+
+func TestObjectStats(t *testing.T) {
+	useTempRoot(t)
+	size := int64(putSizedObjects(t))
+
+	get := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		statsHandler(w, httptest.NewRequest(http.MethodGet, "/admin/stats?"+query, nil))
+		return w
+	}
+	for _, bucket := range []string{"packed", "plain"} {
+		w := get("bucket=" + bucket + "&key=k")
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", bucket, w.Code, w.Body)
+		}
+		var got objectStats
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.LogicalBytes != size || got.Compressed != (bucket == "packed") ||
+			got.CompressionRatio != compressionRatio(got.LogicalBytes, got.Bytes) {
+			t.Errorf("%s: %+v", bucket, got)
+		}
+		if bucket == "packed" && got.Bytes >= size {
+			t.Errorf("packed: %d bytes stored, want fewer than %d", got.Bytes, size)
+		}
+	}
+
+	for _, tc := range []struct {
+		query  string
+		status int
+	}{
+		{"bucket=packed&key=missing", http.StatusNotFound},
+		{"bucket=missing&key=k", http.StatusNotFound},
+		{"bucket=packed", http.StatusBadRequest},
+		{"key=k", http.StatusBadRequest},
+		{"bucket=..&key=k", http.StatusBadRequest},
+	} {
+		if w := get(tc.query); w.Code != tc.status {
+			t.Errorf("%s: %d, want %d", tc.query, w.Code, tc.status)
+		}
+	}
+}
+
+func TestSizeMetrics(t *testing.T) {
+	useTempRoot(t)
+	size := float64(putSizedObjects(t))
+	useBucketLabels(t, 1)
+	labeledBuckets.names = map[string]bool{"packed": true}
+	oldStats := storeStats.stats
+	storeStats.stats = nil
+	t.Cleanup(func() { storeStats.stats = oldStats })
+
+	stats := currentStoreStats()
+	gauge := func(name string) float64 {
+		t.Helper()
+		families, err := prometheus.DefaultGatherer.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, f := range families {
+			if f.GetName() == name {
+				return f.GetMetric()[0].GetGauge().GetValue()
+			}
+		}
+		t.Fatalf("no %s gauge", name)
+		return 0
+	}
+	if got := gauge("s3fs_logical_bytes"); got != 2*size {
+		t.Errorf("s3fs_logical_bytes = %v, want %v", got, 2*size)
+	}
+	if got := gauge("s3fs_stored_bytes"); got != float64(stats.Bytes) {
+		t.Errorf("s3fs_stored_bytes = %v, want %v", got, stats.Bytes)
+	}
+	if got := gauge("s3fs_compression_ratio"); got != stats.CompressionRatio {
+		t.Errorf("s3fs_compression_ratio = %v, want %v", got, stats.CompressionRatio)
+	}
+
+	// The unlabeled bucket is counted under "other"
+	packed, plain := stats.Buckets["packed"], stats.Buckets["plain"]
+	want := fmt.Sprintf(`
+# HELP s3fs_bucket_compression_ratio Logical to stored size of the objects in a bucket, counted at most once a minute.
+# TYPE s3fs_bucket_compression_ratio gauge
+s3fs_bucket_compression_ratio{bucket="other"} 1
+s3fs_bucket_compression_ratio{bucket="packed"} %v
+# HELP s3fs_bucket_logical_bytes Size of the content of the objects stored in a bucket, counted at most once a minute.
+# TYPE s3fs_bucket_logical_bytes gauge
+s3fs_bucket_logical_bytes{bucket="other"} %v
+s3fs_bucket_logical_bytes{bucket="packed"} %v
+# HELP s3fs_bucket_stored_bytes Size of the objects stored in a bucket, as stored, counted at most once a minute.
+# TYPE s3fs_bucket_stored_bytes gauge
+s3fs_bucket_stored_bytes{bucket="other"} %v
+s3fs_bucket_stored_bytes{bucket="packed"} %v
+`, packed.CompressionRatio, size, size, plain.Bytes, packed.Bytes)
+	if err := testutil.CollectAndCompare(bucketSizeCollector{}, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	useBucketLabels(t, 0)
+	if n := testutil.CollectAndCount(bucketSizeCollector{}); n != 0 {
+		t.Errorf("%d per-bucket gauges with bucket labels off, want none", n)
+	}
+}
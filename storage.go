@@ -0,0 +1,408 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// StorageBackend stores objects by bucket and key, along with the metadata
+// recorded for them. The object handlers (PUT, GET, HEAD, DELETE and
+// listing) go through the one in backend. Errors for missing objects
+// satisfy errors.Is(err, fs.ErrNotExist).
+//
+// Versions, transactions, multipart uploads, the trash and idle eviction
+// are features of the filesystem layout and keep working on its paths.
+type StorageBackend interface {
+	// Put stores the content read from r with the metadata m. Reading r
+	// may still fill in m (the ETag is only known at the end of the
+	// content), so m is only recorded once r is fully read. An error from
+	// r leaves the existing object untouched.
+	Put(bucket, key string, r io.Reader, m *objectMeta) (fs.FileInfo, error)
+	// Get opens an object for reading, along with its metadata.
+	Get(bucket, key string) (ObjectReader, fs.FileInfo, *objectMeta, error)
+	// Stat describes an object and returns its metadata without opening it.
+	Stat(bucket, key string) (fs.FileInfo, *objectMeta, error)
+	// Delete removes an object; deleting a missing object is not an error.
+	Delete(bucket, key string) error
+	// List returns the objects whose key starts with prefix, sorted by
+	// key. A bucket that doesn't exist is errNoSuchBucket.
+	List(bucket, prefix string) ([]StoredObject, error)
+}
+
+// ObjectReader reads an object's stored bytes. Ranges are served by
+// seeking, and encrypted objects are decrypted from it by offset.
+type ObjectReader interface {
+	io.ReadSeekCloser
+	io.ReaderAt
+}
+
+// StoredObject is an object returned by StorageBackend.List.
+type StoredObject struct {
+	Key  string
+	Info fs.FileInfo
+}
+
+// Where the object handlers store objects; replaced in tests
+var backend StorageBackend = FSBackend{}
+
+// Both backends implement the interface
+var (
+	_ StorageBackend = FSBackend{}
+	_ StorageBackend = (*InMemoryBackend)(nil)
+)
+
+// errNoSuchBucket is returned by StorageBackend.List for a missing bucket.
+var errNoSuchBucket = errors.New("no such bucket")
+
+// errFolder is returned for a key that is a folder prefix of other objects.
+// There is no such object, so it is also fs.ErrNotExist.
+var errFolder error = folderError{}
+
+type folderError struct{}
+
+func (folderError) Error() string        { return "key is a folder prefix of other objects" }
+func (folderError) Is(target error) bool { return target == fs.ErrNotExist }
+
+// FSBackend stores objects as files under storageRootDir: keys are
+// sanitized and mapped with -ascii-only-keys and -shard-depth, writes go
+// through a temp file and a rename, metadata is kept in .meta, and
+// deletes go to the trash with -trash-ttl.
+type FSBackend struct{}
+
+func (FSBackend) Put(bucket, key string, r io.Reader, m *objectMeta) (fs.FileInfo, error) {
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(targetPath)
+	if err := makeDirs(dir); err != nil {
+		return nil, err
+	}
+	f, err := createTempFile(dir)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := writeOpenFile(f, r)
+	if err == nil {
+		err = renameFile(f.Name(), targetPath)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	if err := writeMeta(targetPath, fi, m); err != nil {
+		// Not fatal: the ETag is recomputed from the content when missing
+		slog.Error("Writing metadata failed", "err", err)
+	}
+	return fi, nil
+}
+
+func (FSBackend) Get(bucket, key string) (ObjectReader, fs.FileInfo, *objectMeta, error) {
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	f, fi, m, err := openObjectFile(targetPath)
+	if err == nil {
+		touchAccess(targetPath, fi)
+	}
+	return f, fi, m, err
+}
+
+func (FSBackend) Stat(bucket, key string) (fs.FileInfo, *objectMeta, error) {
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return statObjectFile(targetPath)
+}
+
+func (FSBackend) Delete(bucket, key string) error {
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		return err
+	}
+	return removeObject(targetPath)
+}
+
+func (FSBackend) List(bucket, prefix string) ([]StoredObject, error) {
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		return nil, err
+	}
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			return nil, errNoSuchBucket
+		}
+		return nil, err
+	}
+	entries, err := walkBucket(bucket, bucketPath, prefix)
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]StoredObject, len(entries))
+	for i, e := range entries {
+		objects[i] = StoredObject{Key: e.key, Info: e.info}
+	}
+	return objects, nil
+}
+
+// openObjectFile opens the object stored at path, such as a version's file,
+// and loads its metadata.
+func openObjectFile(path string) (ObjectReader, fs.FileInfo, *objectMeta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, nil, notExistIfNotDir(err)
+	}
+	fi, err := f.Stat()
+	if err == nil {
+		err = checkObjectFile(fi)
+	}
+	var m *objectMeta
+	if err == nil {
+		m, err = loadMeta(path, fi)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	return f, fi, m, nil
+}
+
+// statObjectFile is openObjectFile without opening the file.
+func statObjectFile(path string) (fs.FileInfo, *objectMeta, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, nil, notExistIfNotDir(err)
+	}
+	if err := checkObjectFile(fi); err != nil {
+		return nil, nil, err
+	}
+	m, err := loadMeta(path, fi)
+	if err != nil {
+		return nil, nil, err
+	}
+	return fi, m, nil
+}
+
+// checkObjectFile returns errFolder for a directory and fs.ErrNotExist for
+// anything else but a regular file, neither of which is an object.
+func checkObjectFile(fi fs.FileInfo) error {
+	if fi.IsDir() {
+		return errFolder
+	}
+	if !fi.Mode().IsRegular() {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// writeStagedFile writes r to a new file at path, such as a transaction's
+// staging file, removing it again if that fails.
+func writeStagedFile(path string, r io.Reader) (fs.FileInfo, error) {
+	f, err := createFile(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := writeOpenFile(f, r)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return fi, nil
+}
+
+// writeOpenFile copies r to f and closes it, returning what it wrote.
+func writeOpenFile(f *os.File, r io.Reader) (fs.FileInfo, error) {
+	_, err := io.Copy(f, r)
+	var fi fs.FileInfo
+	if err == nil {
+		fi, err = f.Stat()
+	}
+	// Closed before any rename, which Windows refuses for open files
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return fi, err
+}
+
+// objectExists reports whether key names an object in bucket, without
+// opening it. A missing key, one below an existing object and a folder
+// prefix all report false with a nil error; only real I/O errors (and keys
+// sanitizePath refuses) are returned.
+func objectExists(bucket, key string) (os.FileInfo, bool, error) {
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		return nil, false, err
+	}
+	return statObject(targetPath)
+}
+
+// statObject is objectExists for the object stored at path, such as a
+// version's file.
+func statObject(path string) (os.FileInfo, bool, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(notExistIfNotDir(err), fs.ErrNotExist) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	// A folder prefix is not an object, nor is anything else but a file
+	if !fi.Mode().IsRegular() {
+		return nil, false, nil
+	}
+	return fi, true, nil
+}
+
+// notExistIfNotDir reports a key below an existing object (ENOTDIR) as
+// missing, which is what it is.
+func notExistIfNotDir(err error) error {
+	if errors.Is(err, syscall.ENOTDIR) {
+		return fs.ErrNotExist
+	}
+	return err
+}
+
+// InMemoryBackend keeps objects in memory, for tests. A key is taken for a
+// folder when other keys continue it with "/", as on disk.
+type InMemoryBackend struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string]memObject
+}
+
+type memObject struct {
+	data    []byte
+	meta    objectMeta
+	modTime time.Time
+}
+
+func NewInMemoryBackend() *InMemoryBackend {
+	return &InMemoryBackend{buckets: make(map[string]map[string]memObject)}
+}
+
+func (b *InMemoryBackend) Put(bucket, key string, r io.Reader, m *objectMeta) (fs.FileInfo, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.isFolder(bucket, key) {
+		return nil, syscall.EISDIR
+	}
+	// A parent of the key can't be an object, as on disk
+	for i := strings.Index(key, "/"); i >= 0; i = nextSlash(key, i) {
+		if _, ok := b.buckets[bucket][key[:i]]; ok {
+			return nil, syscall.ENOTDIR
+		}
+	}
+	if b.buckets[bucket] == nil {
+		b.buckets[bucket] = make(map[string]memObject)
+	}
+	obj := memObject{data: data, meta: *m, modTime: time.Now()}
+	b.buckets[bucket][key] = obj
+	return memFileInfo{key, obj}, nil
+}
+
+func (b *InMemoryBackend) Get(bucket, key string) (ObjectReader, fs.FileInfo, *objectMeta, error) {
+	fi, m, err := b.Stat(bucket, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	// Put replaces the slice rather than writing to it, so it can be shared
+	return memReader{bytes.NewReader(fi.(memFileInfo).obj.data)}, fi, m, nil
+}
+
+func (b *InMemoryBackend) Stat(bucket, key string) (fs.FileInfo, *objectMeta, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.buckets[bucket][key]
+	if !ok {
+		if b.isFolder(bucket, key) {
+			return nil, nil, errFolder
+		}
+		return nil, nil, fs.ErrNotExist
+	}
+	m := obj.meta
+	return memFileInfo{key, obj}, &m, nil
+}
+
+func (b *InMemoryBackend) Delete(bucket, key string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.buckets[bucket], key)
+	return nil
+}
+
+func (b *InMemoryBackend) List(bucket, prefix string) ([]StoredObject, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	objects, ok := b.buckets[bucket]
+	if !ok {
+		return nil, errNoSuchBucket
+	}
+	var listed []StoredObject
+	for key, obj := range objects {
+		if strings.HasPrefix(key, prefix) {
+			listed = append(listed, StoredObject{Key: key, Info: memFileInfo{key, obj}})
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool { return listed[i].Key < listed[j].Key })
+	return listed, nil
+}
+
+// isFolder reports whether key is a folder prefix of stored keys. The
+// caller holds b.mu.
+func (b *InMemoryBackend) isFolder(bucket, key string) bool {
+	// A folder marker is an object of its own
+	if strings.HasSuffix(key, "/") {
+		return false
+	}
+	folder := key + "/"
+	for k := range b.buckets[bucket] {
+		if k != key && strings.HasPrefix(k, folder) {
+			return true
+		}
+	}
+	return false
+}
+
+// nextSlash returns the index of the next "/" in key after i, or -1.
+func nextSlash(key string, i int) int {
+	j := strings.Index(key[i+1:], "/")
+	if j < 0 {
+		return -1
+	}
+	return i + 1 + j
+}
+
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+// memFileInfo describes an in-memory object as a regular file.
+type memFileInfo struct {
+	key string
+	obj memObject
+}
+
+func (fi memFileInfo) Name() string       { return path.Base(fi.key) }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.obj.data)) }
+func (fi memFileInfo) Mode() fs.FileMode  { return 0o644 }
+func (fi memFileInfo) ModTime() time.Time { return fi.obj.modTime }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
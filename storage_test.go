@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useBackend stores objects in b for the duration of the test.
+func useBackend(t *testing.T, b StorageBackend) {
+	t.Helper()
+	old := backend
+	backend = b
+	t.Cleanup(func() { backend = old })
+}
+
+func TestStatObject(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "file"), "data")
+	writeTestFile(t, filepath.Join(root, "b", "folder", "inner"), "data")
+	loop := filepath.Join(root, "b", "loop")
+	if err := os.Symlink(loop, loop); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		path    string
+		exists  bool
+		wantErr bool
+	}{
+		{"object", filepath.Join(root, "b", "file"), true, false},
+		{"missing", filepath.Join(root, "b", "missing"), false, false},
+		{"folder prefix", filepath.Join(root, "b", "folder"), false, false},
+		{"below an object (ENOTDIR)", filepath.Join(root, "b", "file", "below"), false, false},
+		{"symlink loop (ELOOP)", loop, false, true},
+		{"name too long", filepath.Join(root, "b", strings.Repeat("x", 300)), false, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			fi, exists, err := statObject(tc.path)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("err = %v, want error %v", err, tc.wantErr)
+			}
+			if exists != tc.exists {
+				t.Errorf("exists = %v, want %v", exists, tc.exists)
+			}
+			if exists && (fi == nil || fi.Size() != 4) {
+				t.Errorf("FileInfo %v for a 4-byte object", fi)
+			}
+			if !exists && fi != nil {
+				t.Errorf("FileInfo %v for no object", fi)
+			}
+		})
+	}
+}
+
+func TestObjectExists(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "file"), "data")
+	writeTestFile(t, filepath.Join(root, "b", "folder", "inner"), "data")
+
+	for _, tc := range []struct {
+		key     string
+		exists  bool
+		wantErr bool
+	}{
+		{"file", true, false},
+		{"missing", false, false},
+		{"folder", false, false},
+		{"file/below", false, false},
+		// sanitizePath refuses it
+		{"../../escape", false, true},
+	} {
+		_, exists, err := objectExists("b", tc.key)
+		if (err != nil) != tc.wantErr || exists != tc.exists {
+			t.Errorf("objectExists(%q) = %v, %v; want %v, error %v", tc.key, exists, err, tc.exists, tc.wantErr)
+		}
+	}
+}
+
+func TestInMemoryBackendHandlers(t *testing.T) {
+	root := useTempRoot(t)
+	useBackend(t, NewInMemoryBackend())
+	sum := md5.Sum([]byte("hello"))
+	etag := "\"" + hex.EncodeToString(sum[:]) + "\""
+
+	w := serve(t, http.MethodPut, "/b/dir/file", strings.NewReader("hello"), nil)
+	if w.Code != http.StatusNoContent || w.Header().Get("ETag") != etag {
+		t.Fatalf("PUT = %d, ETag %q; want 204, %q", w.Code, w.Header().Get("ETag"), etag)
+	}
+	if _, err := os.Stat(filepath.Join(root, "b", "dir")); !os.IsNotExist(err) {
+		t.Errorf("PUT wrote to the storage root: %v", err)
+	}
+
+	w = serve(t, http.MethodGet, "/b/dir/file", nil, nil)
+	if w.Code != http.StatusOK || w.Body.String() != "hello" || w.Header().Get("ETag") != etag {
+		t.Errorf("GET = %d %q, ETag %q; want 200 \"hello\", %q", w.Code, w.Body, w.Header().Get("ETag"), etag)
+	}
+	w = serve(t, http.MethodGet, "/b/dir/file", nil, http.Header{"Range": {"bytes=1-2"}})
+	if w.Code != http.StatusPartialContent || w.Body.String() != "el" {
+		t.Errorf("ranged GET = %d %q, want 206 \"el\"", w.Code, w.Body)
+	}
+	w = serve(t, http.MethodHead, "/b/dir/file", nil, nil)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Length") != "5" || w.Header().Get("ETag") != etag {
+		t.Errorf("HEAD = %d, Content-Length %q, ETag %q", w.Code, w.Header().Get("Content-Length"), w.Header().Get("ETag"))
+	}
+
+	// Keys conflict as they do on disk
+	for _, tc := range []struct {
+		method, target string
+		want           int
+	}{
+		{http.MethodGet, "/b/dir", http.StatusNotFound},
+		{http.MethodHead, "/b/dir", http.StatusNotFound},
+		{http.MethodGet, "/b/dir/file/below", http.StatusNotFound},
+		{http.MethodPut, "/b/dir", http.StatusConflict},
+		{http.MethodPut, "/b/dir/file/below", http.StatusConflict},
+	} {
+		if w := serve(t, tc.method, tc.target, strings.NewReader("x"), nil); w.Code != tc.want {
+			t.Errorf("%s %s = %d, want %d", tc.method, tc.target, w.Code, tc.want)
+		}
+	}
+
+	w = serve(t, http.MethodGet, "/b?list-type=2&delimiter=/", nil, nil)
+	if !strings.Contains(w.Body.String(), "<Prefix>dir/</Prefix>") || strings.Contains(w.Body.String(), "<Contents>") {
+		t.Errorf("listing with a delimiter = %d %s", w.Code, w.Body)
+	}
+	w = serve(t, http.MethodGet, "/b?list-type=2&prefix=dir/", nil, nil)
+	if body := w.Body.String(); !strings.Contains(body, "<Key>dir/file</Key>") || !strings.Contains(body, "<Size>5</Size>") || !strings.Contains(body, "<ETag>&#34;"+etag[1:len(etag)-1]+"&#34;</ETag>") {
+		t.Errorf("listing = %d %s", w.Code, body)
+	}
+	if w := serve(t, http.MethodGet, "/missing?list-type=2", nil, nil); w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "NoSuchBucket") {
+		t.Errorf("listing a missing bucket = %d %s", w.Code, w.Body)
+	}
+
+	// Conditional writes see the backend's objects
+	if w := serve(t, http.MethodPut, "/b/dir/file", strings.NewReader("again"), http.Header{"If-None-Match": {"*"}}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("PUT If-None-Match: * over an object = %d, want 412", w.Code)
+	}
+	if w := serve(t, http.MethodDelete, "/b/dir/file", nil, http.Header{"If-Match": {`"other"`}}); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("DELETE with a stale If-Match = %d, want 412", w.Code)
+	}
+	if w := serve(t, http.MethodDelete, "/b/dir/file", nil, http.Header{"If-Match": {etag}}); w.Code != http.StatusNoContent {
+		t.Errorf("DELETE = %d, want 204", w.Code)
+	}
+	if w := serve(t, http.MethodGet, "/b/dir/file", nil, nil); w.Code != http.StatusNotFound {
+		t.Errorf("GET after DELETE = %d, want 404", w.Code)
+	}
+	// The folder went with its last object
+	if w := serve(t, http.MethodPut, "/b/dir", strings.NewReader("x"), nil); w.Code != http.StatusNoContent {
+		t.Errorf("PUT to the former folder = %d, want 204", w.Code)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Reject requests with conflicting or ambiguous length/encoding headers
+var strictHTTP bool
+
+// net/http resolves conflicting length headers before a handler runs (it
+// drops Content-Length when Transfer-Encoding is present, collapses
+// duplicate Content-Length values and ignores Transfer-Encoding on
+// HTTP/1.0), so the conflicts are invisible in *http.Request. Strict mode
+// therefore tracks HTTP/1.x framing on the raw connection, inspecting every
+// request head as it is read, and hands a verdict per request to the handler.
+
+// Same limit as http.DefaultMaxHeaderBytes; longer heads are left to net/http
+const strictMaxHeadBytes = 1 << 20
+
+type strictConnKey struct{}
+
+type strictListener struct {
+	net.Listener
+}
+
+func (l strictListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &strictConn{Conn: c}, nil
+}
+
+// strictConnContext exposes the connection's inspector to handlers.
+func strictConnContext(ctx context.Context, c net.Conn) context.Context {
+	if sc, ok := c.(*strictConn); ok {
+		return context.WithValue(ctx, strictConnKey{}, sc)
+	}
+	return ctx
+}
+
+type framingState int
+
+const (
+	stateHead framingState = iota
+	stateBody
+	stateChunkSize
+	stateChunkData
+	stateChunkDataEnd
+	stateTrailer
+	stateStopped // framing unknown or request rejected; nothing more to inspect
+)
+
+// strictConn follows request framing on a connection as bytes are read.
+type strictConn struct {
+	net.Conn
+
+	mu       sync.Mutex
+	state    framingState
+	line     []byte // current head/chunk line being accumulated
+	head     []byte // complete head of the current request
+	remain   int64  // bytes left in the current body or chunk
+	verdicts []string
+}
+
+func (c *strictConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.mu.Lock()
+		c.consume(p[:n])
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+// nextVerdict returns the problem found in the oldest not yet handled
+// request head, or "" if it was clean. Requests on an HTTP/1.x connection
+// are served in order, so verdicts line up with handler invocations.
+func (c *strictConn) nextVerdict() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.verdicts) == 0 {
+		return ""
+	}
+	v := c.verdicts[0]
+	c.verdicts = c.verdicts[1:]
+	return v
+}
+
+func (c *strictConn) consume(b []byte) {
+	for len(b) > 0 {
+		switch c.state {
+		case stateStopped:
+			return
+		case stateBody, stateChunkData:
+			n := int64(len(b))
+			if n > c.remain {
+				n = c.remain
+			}
+			c.remain -= n
+			b = b[n:]
+			if c.remain == 0 {
+				if c.state == stateBody {
+					c.state = stateHead
+				} else {
+					c.state = stateChunkDataEnd
+				}
+			}
+		default:
+			i := bytes.IndexByte(b, '\n')
+			if i < 0 {
+				c.line = append(c.line, b...)
+				b = nil
+			} else {
+				c.line = append(c.line, b[:i+1]...)
+				b = b[i+1:]
+				c.endLine()
+			}
+			if len(c.line)+len(c.head) > strictMaxHeadBytes {
+				c.state = stateStopped
+			}
+		}
+	}
+}
+
+// endLine processes one complete line (terminated by LF) in c.line.
+func (c *strictConn) endLine() {
+	line := c.line
+	c.line = nil
+	trimmed := bytes.TrimRight(line, "\r\n")
+
+	switch c.state {
+	case stateHead:
+		if len(c.head) == 0 && len(trimmed) == 0 {
+			return // stray CRLF between requests is tolerated by net/http
+		}
+		c.head = append(c.head, line...)
+		if len(trimmed) == 0 {
+			c.endHead()
+		}
+	case stateChunkSize:
+		sizeStr := string(trimmed)
+		if i := strings.IndexByte(sizeStr, ';'); i >= 0 {
+			sizeStr = sizeStr[:i]
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(sizeStr), 16, 64)
+		if err != nil || size < 0 {
+			c.state = stateStopped
+			return
+		}
+		if size == 0 {
+			c.state = stateTrailer
+		} else {
+			c.remain = size
+			c.state = stateChunkData
+		}
+	case stateChunkDataEnd:
+		if len(trimmed) != 0 {
+			c.state = stateStopped
+			return
+		}
+		c.state = stateChunkSize
+	case stateTrailer:
+		if len(trimmed) == 0 {
+			c.state = stateHead
+		}
+	}
+}
+
+// endHead inspects a complete request head and sets up body framing.
+func (c *strictConn) endHead() {
+	head := string(c.head)
+	c.head = nil
+
+	lines := strings.Split(strings.ReplaceAll(head, "\r\n", "\n"), "\n")
+	requestLine := lines[0]
+	var contentLengths, transferEncodings []string
+	problem := ""
+	for _, l := range lines[1:] {
+		if l == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(l, ":")
+		if !ok {
+			continue
+		}
+		lname := strings.ToLower(name)
+		if strings.TrimSpace(lname) != lname {
+			if t := strings.TrimSpace(lname); t == "content-length" || t == "transfer-encoding" {
+				problem = "whitespace around " + strings.TrimSpace(name) + " header name"
+			}
+			continue
+		}
+		switch lname {
+		case "content-length":
+			for _, v := range strings.Split(value, ",") {
+				contentLengths = append(contentLengths, strings.TrimSpace(v))
+			}
+		case "transfer-encoding":
+			for _, v := range strings.Split(value, ",") {
+				transferEncodings = append(transferEncodings, strings.ToLower(strings.TrimSpace(v)))
+			}
+		}
+	}
+
+	var length int64
+	switch {
+	case problem != "":
+	case len(contentLengths) > 0 && len(transferEncodings) > 0:
+		problem = "both Content-Length and Transfer-Encoding present"
+	case len(contentLengths) > 1:
+		problem = "multiple Content-Length values"
+	case len(transferEncodings) > 0 && strings.HasSuffix(requestLine, "HTTP/1.0"):
+		problem = "Transfer-Encoding on an HTTP/1.0 request"
+	case len(transferEncodings) > 1 || (len(transferEncodings) == 1 && transferEncodings[0] != "chunked"):
+		problem = "Transfer-Encoding other than a single chunked coding"
+	case len(contentLengths) == 1:
+		n, err := strconv.ParseInt(contentLengths[0], 10, 64)
+		if err != nil || n < 0 || strings.HasPrefix(contentLengths[0], "+") {
+			problem = "invalid Content-Length " + strconv.Quote(contentLengths[0])
+		}
+		length = n
+	}
+
+	c.verdicts = append(c.verdicts, problem)
+	switch {
+	case problem != "":
+		// The request will be refused and the connection closed
+		c.state = stateStopped
+	case len(transferEncodings) > 0:
+		c.state = stateChunkSize
+	case length > 0:
+		c.remain = length
+		c.state = stateBody
+	}
+}
+
+// withStrictHTTP refuses requests whose head was flagged by strictConn.
+func withStrictHTTP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sc, ok := r.Context().Value(strictConnKey{}).(*strictConn); ok && r.ProtoMajor == 1 {
+			if problem := sc.nextVerdict(); problem != "" {
+				slog.Warn("Rejecting possible request smuggling attempt", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "problem", problem)
+				w.Header().Set("Connection", "close")
+				writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "Conflicting message length headers", r.URL.Path)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// startStrictServer serves h behind the strict framing inspector, as
+// -strict-http does, and returns its address.
+func startStrictServer(t *testing.T, h http.Handler) string {
+	t.Helper()
+	srv := httptest.NewUnstartedServer(withStrictHTTP(h))
+	srv.Listener = strictListener{srv.Listener}
+	srv.Config.ConnContext = strictConnContext
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return srv.Listener.Addr().String()
+}
+
+// sendRaw writes raw, one or more requests, on a new connection and reads
+// back a response for each of the methods given.
+func sendRaw(t *testing.T, addr, raw string, methods ...string) []*http.Response {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := io.WriteString(conn, raw); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(conn)
+	var responses []*http.Response
+	for _, method := range methods {
+		resp, err := http.ReadResponse(br, &http.Request{Method: method})
+		if err != nil {
+			t.Fatalf("reading response %d: %v", len(responses)+1, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body = io.NopCloser(strings.NewReader(string(body)))
+		responses = append(responses, resp)
+	}
+	return responses
+}
+
+func TestStrictHTTP(t *testing.T) {
+	var served atomic.Int32
+	addr := startStrictServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, "body="+string(body))
+	}))
+
+	for _, tc := range []struct {
+		name     string
+		raw      string
+		status   int
+		wantBody string
+	}{
+		{
+			"Content-Length",
+			"PUT /b/k HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\n\r\nhello",
+			http.StatusOK, "body=hello",
+		},
+		{
+			"chunked",
+			"PUT /b/k HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			http.StatusOK, "body=hello",
+		},
+		{
+			"no body",
+			"GET /b/k HTTP/1.1\r\nHost: x\r\n\r\n",
+			http.StatusOK, "body=",
+		},
+		{
+			"Content-Length and Transfer-Encoding",
+			"PUT /b/k HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n",
+			http.StatusBadRequest, "",
+		},
+		{
+			"duplicate Content-Length",
+			"PUT /b/k HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+			http.StatusBadRequest, "",
+		},
+		{
+			"Content-Length with two values",
+			"PUT /b/k HTTP/1.1\r\nHost: x\r\nContent-Length: 5, 5\r\n\r\nhello",
+			http.StatusBadRequest, "",
+		},
+		{
+			"conflicting Content-Length",
+			"PUT /b/k HTTP/1.1\r\nHost: x\r\nContent-Length: 5\r\nContent-Length: 6\r\n\r\nhello!",
+			http.StatusBadRequest, "",
+		},
+		{
+			"Transfer-Encoding on HTTP/1.0",
+			"PUT /b/k HTTP/1.0\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n",
+			http.StatusBadRequest, "",
+		},
+		{
+			"whitespace before the colon",
+			"PUT /b/k HTTP/1.1\r\nHost: x\r\nContent-Length : 5\r\n\r\nhello",
+			http.StatusBadRequest, "",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := served.Load()
+			resp := sendRaw(t, addr, tc.raw, "PUT")[0]
+			if resp.StatusCode != tc.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tc.status)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if tc.status == http.StatusOK && string(body) != tc.wantBody {
+				t.Errorf("body %q, want %q", body, tc.wantBody)
+			}
+			// Refused before the handler, by the inspector or net/http
+			if tc.status != http.StatusOK && served.Load() != before {
+				t.Error("rejected request reached the handler")
+			}
+		})
+	}
+}
+
+func TestStrictHTTPPipelined(t *testing.T) {
+	addr := startStrictServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.URL.Path+"="+string(body))
+	}))
+
+	// Verdicts line up with the requests of a connection, bodies included
+	clean := "PUT /one HTTP/1.1\r\nHost: x\r\nContent-Length: 22\r\n\r\nContent-Length: 1\r\n\r\nx" +
+		"PUT /two HTTP/1.1\r\nHost: x\r\nTransfer-Encoding: chunked\r\n\r\n3\r\nabc\r\n0\r\n\r\n"
+	bad := "PUT /three HTTP/1.1\r\nHost: x\r\nContent-Length: 3\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n"
+	responses := sendRaw(t, addr, clean+bad, "PUT", "PUT", "PUT")
+	for i, want := range []string{"/one=Content-Length: 1\r\n\r\nx", "/two=abc"} {
+		body, _ := io.ReadAll(responses[i].Body)
+		if responses[i].StatusCode != http.StatusOK || string(body) != want {
+			t.Errorf("request %d: %d %q, want 200 %q", i+1, responses[i].StatusCode, body, want)
+		}
+	}
+	if resp := responses[2]; resp.StatusCode != http.StatusBadRequest || !resp.Close {
+		t.Errorf("smuggled request: %d, close %v; want 400 and a closed connection", resp.StatusCode, resp.Close)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"unicode/utf8"
+)
+
+// Object tags are kept with the rest of an object's metadata, so like
+// Content-Type and user metadata they are dropped when the object is
+// overwritten and kept when it is copied.
+
+// Limits S3 places on object tags
+const (
+	maxObjectTags     = 10
+	maxTagKeyLength   = 128 // characters
+	maxTagValueLength = 256 // characters
+)
+
+// Upper bound on the size of a Tagging request document
+const maxTaggingBodyBytes = 64 << 10
+
+type tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type taggingRequest struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []tag    `xml:"TagSet>Tag"`
+}
+
+type taggingResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ Tagging"`
+	TagSet  []tag    `xml:"TagSet>Tag"`
+}
+
+func isTaggingRequest(r *http.Request) bool {
+	_, ok := r.URL.Query()["tagging"]
+	return ok
+}
+
+// taggingHandler handles PUT, GET and DELETE of /<bucket>/<key>?tagging
+// (PutObjectTagging, GetObjectTagging and DeleteObjectTagging), optionally
+// for a ?versionId.
+func taggingHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, apiErr := parseRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	if key == "" {
+		writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "Bucket tagging is not supported", r.URL.Path)
+		return
+	}
+	if r.Method != http.MethodPut && r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+
+	// Parse the new tag set before touching the object
+	var tags map[string]string
+	if r.Method == http.MethodPut {
+		var req taggingRequest
+		if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, maxTaggingBodyBytes)).Decode(&req); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML", "The Tagging document is not well-formed", r.URL.Path)
+			return
+		}
+		if tags, apiErr = validateTags(req.TagSet); apiErr != nil {
+			writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+			return
+		}
+	}
+
+	ref, apiErr := readVersion(bucket, targetPath, r.URL.Query().Get("versionId"))
+	if apiErr != nil {
+		setVersionHeaders(w, ref.versionID, ref.deleteMarker)
+		setReadVersionAllow(w, apiErr)
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	setVersionHeaders(w, ref.versionID, ref.deleteMarker)
+	fi, exists, err := statObject(ref.path)
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Stating file failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+	if !exists {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.", r.URL.Path)
+		return
+	}
+	meta, err := loadMeta(ref.path, fi)
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Computing ETag failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		result := taggingResult{TagSet: []tag{}}
+		for k, v := range meta.Tags {
+			result.TagSet = append(result.TagSet, tag{Key: k, Value: v})
+		}
+		sort.Slice(result.TagSet, func(i, j int) bool { return result.TagSet[i].Key < result.TagSet[j].Key })
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, xml.Header)
+		if err := xml.NewEncoder(w).Encode(result); err != nil {
+			slog.Error("Writing tagging failed", "err", err)
+		}
+		return
+	}
+
+	// PUT replaces the whole tag set; DELETE leaves tags nil
+	meta.Tags = tags
+	if err := writeMeta(ref.path, fi, meta); err != nil {
+		if !respondIfDiskFull(w, r, err) {
+			slog.Error("Writing metadata failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+	debugLog(r, "Updated object tags", "tags", len(tags))
+	if r.Method == http.MethodDelete {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// validateTags checks a tag set against S3's limits and returns it as a map.
+func validateTags(set []tag) (map[string]string, *apiError) {
+	if len(set) > maxObjectTags {
+		return nil, &apiError{http.StatusBadRequest, "BadRequest", fmt.Sprintf("Object tags cannot be greater than %d", maxObjectTags)}
+	}
+	tags := make(map[string]string, len(set))
+	for _, t := range set {
+		if t.Key == "" || utf8.RuneCountInString(t.Key) > maxTagKeyLength {
+			return nil, &apiError{http.StatusBadRequest, "InvalidTag", fmt.Sprintf("The TagKey you have provided is invalid: it must be between 1 and %d characters long", maxTagKeyLength)}
+		}
+		if utf8.RuneCountInString(t.Value) > maxTagValueLength {
+			return nil, &apiError{http.StatusBadRequest, "InvalidTag", fmt.Sprintf("The TagValue you have provided is invalid: it must be at most %d characters long", maxTagValueLength)}
+		}
+		if _, dup := tags[t.Key]; dup {
+			return nil, &apiError{http.StatusBadRequest, "InvalidTag", "Cannot provide multiple Tags with the same key"}
+		}
+		tags[t.Key] = t.Value
+	}
+	if len(tags) == 0 {
+		return nil, nil
+	}
+	return tags, nil
+}
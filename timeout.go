@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+)
+
+// The server's own timeouts bound how long a client may take over request
+// heads and whole requests. Request bodies must also keep arriving at an
+// average of at least -min-upload-rate once -min-upload-grace has passed,
+// so that a client trickling an upload (Slowloris style) can't hold a
+// connection and a half-written file for as long as it likes. The
+// deadline moves with every read: a body is cut off as soon as it falls
+// behind, whether it stalls or just crawls.
+
+// Timeouts of the HTTP server (0 = none)
+var (
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       time.Duration
+	writeTimeout      time.Duration
+	idleTimeout       = 2 * time.Minute
+)
+
+// Least average rate request bodies must arrive at, in bytes per second,
+// after the grace period (0 = no minimum)
+var (
+	minUploadRate  int64 = 1024
+	minUploadGrace       = 30 * time.Second
+)
+
+// errRequestTimeout is returned by request bodies that ran past their
+// deadline.
+var errRequestTimeout = errors.New("request body timed out")
+
+// withMinUploadRate enforces -min-upload-rate on request bodies, and
+// reports bodies running past -read-timeout as errRequestTimeout too. It
+// must get the server's own ResponseWriter, to set the connection's
+// deadline.
+func withMinUploadRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Body != nil && r.Body != http.NoBody {
+			b := &minRateBody{ReadCloser: r.Body, rc: http.NewResponseController(w), start: time.Now()}
+			// A later deadline would lift the server's -read-timeout
+			if readTimeout > 0 {
+				b.limit = b.start.Add(readTimeout)
+			}
+			r.Body = b
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// minRateBody is a request body whose every read must complete in time for
+// the body to keep up with minUploadRate.
+type minRateBody struct {
+	io.ReadCloser
+	rc    *http.ResponseController
+	start time.Time
+	limit time.Time // imposed by readTimeout; zero if none
+	n     int64     // bytes read so far
+}
+
+func (b *minRateBody) Read(p []byte) (int, error) {
+	// By then the body must have gone past what it has read so far
+	ahead := time.Duration(b.n/minUploadRate)*time.Second + time.Duration(b.n%minUploadRate)*time.Second/time.Duration(minUploadRate)
+	deadline := b.start.Add(minUploadGrace + ahead)
+	if !b.limit.IsZero() && b.limit.Before(deadline) {
+		deadline = b.limit
+	}
+	// Protocols without deadlines (ErrNotSupported) go unchecked
+	b.rc.SetReadDeadline(deadline)
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	switch {
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return n, errRequestTimeout
+	case err == io.EOF:
+		// Left in place, the deadline would also end the wait for the
+		// connection's next request, or cancel this one's context
+		b.rc.SetReadDeadline(b.limit)
+	}
+	return n, err
+}
+
+// respondIfRequestTimeout answers a request whose body timed out with 400
+// RequestTimeout, as S3 does. It reports whether it handled err.
+func respondIfRequestTimeout(w http.ResponseWriter, r *http.Request, err error) bool {
+	if !errors.Is(err, errRequestTimeout) {
+		return false
+	}
+	slog.Info("Request body timed out", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+	w.Header().Set("Connection", "close")
+	writeS3Error(w, http.StatusBadRequest, "RequestTimeout", "Your socket connection to the server was not read from or written to within the timeout period.", r.URL.Path)
+	return true
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With -https-only, requests that arrive over plain HTTP, on -http-addr,
+// are redirected to HTTPS (or refused with 403 under -https-redirect=false)
+// before anything is read or written, so no object data crosses the
+// network in the clear.
+var (
+	httpsOnly     bool
+	httpsRedirect = true
+	// Scheme and host redirects point at (-public-url); nil keeps the
+	// request's host, on the port HTTPS is served on
+	publicURL *url.URL
+	// Port of -addr, where HTTPS is served
+	httpsPort string
+	// max-age of the Strict-Transport-Security header (0 = none)
+	hstsMaxAge time.Duration
+)
+
+// Accepted -tls-min-version values
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// loadTLSConfig loads the certificate and key for serving HTTPS. Loading them
+// up front makes a bad path or mismatched pair fail at startup rather than
+// on the first handshake. ciphers is the -tls-ciphers list, empty for Go's
+// defaults.
+func loadTLSConfig(certFile, keyFile, minVersion, ciphers string) (*tls.Config, error) {
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid -tls-min-version %q: must be 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	var suites []uint16
+	if ciphers != "" {
+		if version == tls.VersionTLS13 {
+			return nil, fmt.Errorf("-tls-ciphers has no effect with -tls-min-version 1.3, whose cipher suites are not configurable")
+		}
+		var err error
+		if suites, err = parseCipherSuites(ciphers); err != nil {
+			return nil, err
+		}
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	// Without -tls-ciphers, cipher suites are left to Go's defaults, which
+	// track current guidance. Clients offering HTTP/2 get it; the rest fall
+	// back to HTTP/1.1
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   version,
+		CipherSuites: suites,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}, nil
+}
+
+// parseCipherSuites returns the IDs of a comma-separated list of cipher
+// suite names, such as TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256. Only the
+// TLS 1.2 and older suites Go considers secure are accepted: TLS 1.3
+// suites can't be chosen. HTTP/2 requires one of its mandatory suites.
+func parseCipherSuites(list string) ([]uint16, error) {
+	byName := map[string]*tls.CipherSuite{}
+	var names []string
+	for _, s := range tls.CipherSuites() {
+		byName[s.Name] = s
+		if !isTLS13Only(s) {
+			names = append(names, s.Name)
+		}
+	}
+	insecure := map[string]bool{}
+	for _, s := range tls.InsecureCipherSuites() {
+		insecure[s.Name] = true
+	}
+
+	var ids []uint16
+	http2 := false
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		s := byName[name]
+		switch {
+		case insecure[name]:
+			return nil, fmt.Errorf("invalid -tls-ciphers: %s is insecure", name)
+		case s == nil:
+			return nil, fmt.Errorf("invalid -tls-ciphers: unknown cipher suite %q; want names from %s", name, strings.Join(names, ", "))
+		case isTLS13Only(s):
+			return nil, fmt.Errorf("invalid -tls-ciphers: %s is a TLS 1.3 cipher suite, which are not configurable", name)
+		}
+		ids = append(ids, s.ID)
+		http2 = http2 || s.ID == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || s.ID == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("invalid -tls-ciphers: names no cipher suite")
+	}
+	if !http2 {
+		return nil, fmt.Errorf("invalid -tls-ciphers: must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 requires")
+	}
+	return ids, nil
+}
+
+func isTLS13Only(s *tls.CipherSuite) bool {
+	return len(s.SupportedVersions) == 1 && s.SupportedVersions[0] == tls.VersionTLS13
+}
+
+// parsePublicURL checks a -public-url value: an https URL naming a host,
+// without a path.
+func parsePublicURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return nil, fmt.Errorf("must be an https URL naming only a host, such as https://s3.example.com")
+	}
+	return u, nil
+}
+
+// withHTTPSOnly redirects requests that didn't come over TLS to HTTPS, or
+// refuses them, and adds the Strict-Transport-Security header to those
+// that did.
+func withHTTPSOnly(next http.Handler) http.Handler {
+	hsts := "max-age=" + strconv.FormatInt(int64(hstsMaxAge/time.Second), 10)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			if hstsMaxAge > 0 {
+				w.Header().Set("Strict-Transport-Security", hsts)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !httpsRedirect {
+			slog.Info("Refused plain HTTP request", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr)
+			writeS3Error(w, http.StatusForbidden, "AccessDenied", "Requests must be made over HTTPS", r.URL.Path)
+			return
+		}
+		http.Redirect(w, r, httpsURL(r), http.StatusMovedPermanently)
+	})
+}
+
+// httpsURL returns the HTTPS URL of what r asked for over plain HTTP.
+func httpsURL(r *http.Request) string {
+	if publicURL != nil {
+		return "https://" + publicURL.Host + r.URL.RequestURI()
+	}
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if httpsPort != "" && httpsPort != "443" {
+		host = net.JoinHostPort(host, httpsPort)
+	} else if net.ParseIP(host) != nil && net.ParseIP(host).To4() == nil {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + r.URL.RequestURI()
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSOnly(t *testing.T) {
+	oldRedirect, oldURL, oldPort, oldHSTS := httpsRedirect, publicURL, httpsPort, hstsMaxAge
+	t.Cleanup(func() { httpsRedirect, publicURL, httpsPort, hstsMaxAge = oldRedirect, oldURL, oldPort, oldHSTS })
+	hstsMaxAge = 24 * time.Hour
+	served := false
+	handler := withHTTPSOnly(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = true
+	}))
+	public, err := parsePublicURL("https://s3.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		public   bool
+		port     string
+		host     string
+		location string
+	}{
+		{"default port", false, "443", "s3.local:80", "https://s3.local/b/a%20b?uploads="},
+		{"other port", false, "8443", "s3.local:8080", "https://s3.local:8443/b/a%20b?uploads="},
+		{"IPv6", false, "443", "[::1]:80", "https://[::1]/b/a%20b?uploads="},
+		{"public URL", true, "8443", "10.0.0.1:8080", "https://s3.example.com/b/a%20b?uploads="},
+	} {
+		publicURL, httpsPort, httpsRedirect = nil, tc.port, true
+		if tc.public {
+			publicURL = public
+		}
+		served = false
+		r := httptest.NewRequest("PUT", "http://"+tc.host+"/b/a%20b?uploads=", nil)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != tc.location {
+			t.Errorf("%s: %d to %q, want 301 to %q", tc.name, w.Code, w.Header().Get("Location"), tc.location)
+		}
+		if served || w.Header().Get("Strict-Transport-Security") != "" {
+			t.Errorf("%s: plain HTTP request served, or sent HSTS", tc.name)
+		}
+	}
+
+	httpsRedirect = false
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "http://s3.local/b/k", nil))
+	if w.Code != http.StatusForbidden || served {
+		t.Errorf("with -https-redirect=false: %d, served %v, want 403", w.Code, served)
+	}
+
+	r := httptest.NewRequest("GET", "https://s3.local/b/k", nil)
+	r.TLS = &tls.ConnectionState{}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if !served || w.Header().Get("Strict-Transport-Security") != "max-age=86400" {
+		t.Errorf("HTTPS request: served %v, HSTS %q", served, w.Header().Get("Strict-Transport-Security"))
+	}
+}
+
+func TestParsePublicURL(t *testing.T) {
+	for s, ok := range map[string]bool{
+		"https://s3.example.com":       true,
+		"https://s3.example.com:8443/": true,
+		"http://s3.example.com":        false,
+		"https://":                     false,
+		"https://s3.example.com/path":  false,
+		"s3.example.com":               false,
+	} {
+		if _, err := parsePublicURL(s); (err == nil) != ok {
+			t.Errorf("parsePublicURL(%q): %v", s, err)
+		}
+	}
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	suites, err := parseCipherSuites("TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil || len(suites) != 2 || suites[0] != tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || suites[1] != tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384 {
+		t.Errorf("parseCipherSuites = %v, %v", suites, err)
+	}
+	for list, want := range map[string]string{
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_NOT_A_SUITE":          "unknown cipher suite",
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_RSA_WITH_RC4_128_SHA": "insecure",
+		"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,TLS_AES_128_GCM_SHA256":   "TLS 1.3",
+		"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384":                          "HTTP/2 requires",
+		" , ":                                                            "names no cipher suite",
+	} {
+		if _, err := parseCipherSuites(list); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("parseCipherSuites(%q) = %v, want an error saying %q", list, err, want)
+		}
+	}
+	if _, err := loadTLSConfig("missing.crt", "missing.key", "1.3", "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"); err == nil || !strings.Contains(err.Error(), "no effect") {
+		t.Errorf("-tls-ciphers with -tls-min-version 1.3: %v", err)
+	}
+}
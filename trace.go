@@ -0,0 +1,116 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// With -trace, every API request is logged on arrival with all its headers
+// and query parameters and the filesystem path it resolves to, for working
+// out why a client's request isn't doing what it should. Credentials are
+// redacted, and bodies are never logged.
+
+// Whether requests are traced
+var traceRequests bool
+
+// Headers whose values are secrets
+var tracedSecretHeaders = map[string]bool{
+	"Cookie":               true,
+	"Proxy-Authorization":  true,
+	"X-Amz-Security-Token": true,
+	"X-Amz-Server-Side-Encryption-Customer-Key":             true,
+	"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key": true,
+}
+
+// Query parameters whose values are secrets
+var tracedSecretParams = map[string]bool{
+	"X-Amz-Signature":      true,
+	"X-Amz-Security-Token": true,
+	"Signature":            true,
+}
+
+// The signature in an AWS Authorization header; the rest of it, such as
+// the access key and signed headers, is what a signature mismatch is
+// debugged with. Authorization headers of other schemes are redacted whole
+var authSignature = regexp.MustCompile(`(Signature=|:)[^,\s]+$`)
+
+const redacted = "REDACTED"
+
+// withTrace logs each request as -trace asks before passing it on.
+func withTrace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := make([]any, 0, len(r.Header))
+		for _, name := range sortedKeys(r.Header) {
+			value := strings.Join(r.Header[name], ", ")
+			switch {
+			case name == "Authorization" && authSignature.MatchString(value):
+				value = authSignature.ReplaceAllString(value, "${1}"+redacted)
+			case name == "Authorization" || tracedSecretHeaders[name]:
+				value = redacted
+			}
+			headers = append(headers, slog.String(name, value))
+		}
+		q := r.URL.Query()
+		params := make([]any, 0, len(q))
+		for _, name := range sortedKeys(q) {
+			value := strings.Join(q[name], ", ")
+			if tracedSecretParams[name] {
+				value = redacted
+			}
+			params = append(params, slog.String(name, value))
+		}
+		slog.Info("Request trace",
+			"request_id", requestIDFrom(r.Context()),
+			"method", r.Method,
+			"host", r.Host,
+			"uri", r.RequestURI,
+			"proto", r.Proto,
+			"content_length", r.ContentLength,
+			"remote", r.RemoteAddr,
+			slog.Group("headers", headers...),
+			slog.Group("query", params...),
+			"path", traceResolvedPath(r),
+		)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// traceResolvedPath returns the filesystem path r addresses, as the
+// handlers will resolve it, or why it doesn't address one.
+func traceResolvedPath(r *http.Request) string {
+	u := *r.URL
+	if baseDomain != "" {
+		if bucket := virtualHostBucket(r); bucket != "" {
+			prependBucket(&u, bucket)
+		}
+	}
+	// The service itself: listing buckets reads the storage root
+	if u.Path == "/" || u.Path == "" {
+		if root, err := filepath.Abs(storageRootDir); err == nil {
+			return root
+		}
+	}
+	bucket, key, apiErr := parseRequest(&http.Request{URL: &u})
+	if apiErr != nil {
+		return "(none: " + apiErr.message + ")"
+	}
+	p, err := sanitizePath(bucket, key)
+	if err != nil {
+		return "(none: " + err.Error() + ")"
+	}
+	return p
+}
+
+// sortedKeys returns the names in h (a header or query) in order.
+func sortedKeys[V any](h map[string]V) []string {
+	keys := make([]string, 0, len(h))
+	for k := range h {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// With -trash-ttl, deleting an object from an unversioned bucket moves it
+// to <root>/.trash/<bucket>/<key> instead of unlinking it, metadata and
+// all, and the purger removes it for good once it has been there for the
+// TTL. Until then POST /<bucket>/<key>?undelete puts it back. Only the
+// most recently deleted copy of a key is kept.
+
+// Directory under the storage root holding deleted objects
+const trashDirName = ".trash"
+
+// How long deleted objects are kept in the trash (0 = delete immediately)
+var trashTTL time.Duration
+
+// trashPath returns where the object stored at objectPath goes when deleted.
+func trashPath(objectPath string) (string, error) {
+	absRoot, err := filepath.Abs(storageRootDir)
+	if err != nil {
+		return "", err
+	}
+	absObject, err := filepath.Abs(objectPath)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(absRoot, absObject)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(absRoot, trashDirName, rel), nil
+}
+
+// removeObject deletes the object stored at targetPath from an unversioned
+// bucket, moving it to the trash if -trash-ttl is set. A missing object is
+// not an error, as in S3.
+func removeObject(targetPath string) error {
+	if trashTTL <= 0 {
+		return deleteObject(targetPath)
+	}
+	fi, err := os.Stat(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			return nil
+		}
+		return err
+	}
+	// A folder prefix is not an object
+	if fi.IsDir() {
+		return nil
+	}
+	trashed, err := trashPath(targetPath)
+	if err != nil {
+		return err
+	}
+	// Metadata moves along, stamped with the time of deletion
+	m := readMeta(targetPath, fi)
+	if m == nil {
+		m = &objectMeta{}
+	}
+	m.DeletedAt = time.Now().UnixNano()
+
+	err = makeDirs(filepath.Dir(trashed))
+	if err == nil {
+		err = os.Rename(targetPath, trashed)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		// The trash holds a deleted object where this one needs a folder,
+		// or the other way round
+		if errors.Is(err, syscall.ENOTDIR) || errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.EEXIST) {
+			slog.Warn("Trashing object failed; deleting it instead", "path", targetPath, "err", err)
+			return deleteObject(targetPath)
+		}
+		return err
+	}
+	// The trash counts against the bucket's quota too: usage is unchanged
+	if err := writeMeta(trashed, fi, m); err != nil {
+		slog.Error("Writing metadata failed", "err", err)
+	}
+	if err := removeMeta(targetPath); err != nil {
+		slog.Error("Deleting metadata failed", "err", err)
+	}
+	return nil
+}
+
+// undeleteHandler handles POST /<bucket>/<key...>?undelete, moving the
+// object's trashed copy back to its key.
+func undeleteHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	targetPath, err := sanitizePath(bucket, key)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	trashed, err := trashPath(targetPath)
+	if err != nil {
+		slog.Error("Restoring object failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+
+	defer lockObject(targetPath)()
+	fi, err := os.Stat(trashed)
+	if err == nil && fi.IsDir() {
+		err = os.ErrNotExist
+	}
+	if err != nil {
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			writeS3Error(w, http.StatusNotFound, "NoSuchKey", "The specified key is not in the trash.", r.URL.Path)
+			return
+		}
+		slog.Error("Stating file failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	// Restoring never overwrites; the current object has to be deleted first
+	if cur, err := os.Stat(targetPath); err == nil {
+		if cur.IsDir() {
+			writeS3Error(w, http.StatusConflict, "KeyConflict", "Key "+key+" is a folder prefix of existing objects", r.URL.Path)
+		} else {
+			writeS3Error(w, http.StatusConflict, "KeyConflict", "Key "+key+" already exists; delete it before restoring its trashed copy", r.URL.Path)
+		}
+		return
+	}
+	if err := makeDirs(filepath.Dir(targetPath)); err != nil {
+		if errors.Is(err, syscall.ENOTDIR) {
+			writeS3Error(w, http.StatusConflict, "KeyConflict", "A parent of key "+key+" is an existing object", r.URL.Path)
+			return
+		}
+		slog.Error("Creating directories failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	m := readMeta(trashed, fi)
+	if m == nil {
+		m = &objectMeta{}
+	}
+	m.DeletedAt = 0
+	var versionID string
+	if bucketVersioning(bucket) != "" {
+		versionID, err = publishVersion(bucket, key, targetPath, trashed)
+	} else {
+		err = os.Rename(trashed, targetPath)
+	}
+	if err != nil {
+		if errors.Is(err, syscall.EISDIR) || errors.Is(err, syscall.EEXIST) {
+			writeS3Error(w, http.StatusConflict, "KeyConflict", "Key "+key+" is a folder prefix of existing objects", r.URL.Path)
+			return
+		}
+		slog.Error("Restoring object failed", "err", err)
+		writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		return
+	}
+	if err := writeMeta(targetPath, fi, m); err != nil {
+		// Not fatal: the ETag is recomputed from the content when missing
+		slog.Error("Writing metadata failed", "err", err)
+	}
+	if err := removeMeta(trashed); err != nil {
+		slog.Error("Deleting metadata failed", "err", err)
+	}
+
+	debugLog(r, "Restored object from trash")
+	setVersionHeaders(w, versionID, false)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// runTrashPurger periodically deletes objects that have been in the trash
+// for longer than trashTTL. It never returns.
+func runTrashPurger() {
+	interval := min(max(trashTTL/10, time.Second), time.Hour)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		purgeTrash()
+		<-ticker.C
+	}
+}
+
+// purgeTrash walks the trash once and removes every object deleted more
+// than trashTTL ago. Objects whose metadata was lost are aged by their
+// modification time.
+func purgeTrash() {
+	now := time.Now()
+	purged := 0
+	root := filepath.Join(storageRootDir, trashDirName)
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The trash may not exist yet, and entries vanish when restored
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.Type().IsRegular() || isTempFile(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		deleted := fi.ModTime()
+		if m := readMeta(path, fi); m != nil && m.DeletedAt != 0 {
+			deleted = time.Unix(0, m.DeletedAt)
+		}
+		if now.Sub(deleted) < trashTTL {
+			return nil
+		}
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			slog.Error("Purging trashed object failed", "path", path, "err", err)
+			return nil
+		}
+		recordUsage(path, -fi.Size())
+		if err := removeMeta(path); err != nil {
+			slog.Error("Deleting metadata failed", "path", path, "err", err)
+		}
+		purged++
+		return nil
+	})
+	if err != nil {
+		slog.Error("Scanning trash failed", "err", err)
+	}
+	if purged > 0 {
+		slog.Info("Purged trashed objects", "count", purged, "ttl", trashTTL.String())
+	}
+}
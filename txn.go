@@ -0,0 +1,477 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Multi-object transactions (server extension): PUTs carrying x-txn-id are
+// written below <root>/.txn/<id>/ and only renamed into place together on
+// commit. Staging lives inside the storage root so every rename stays on one
+// filesystem.
+
+// Directory under the storage root holding staged transaction objects
+const txnDirName = ".txn"
+
+// Uncommitted transactions older than this are aborted
+var txnTimeout = 15 * time.Minute
+
+type txn struct {
+	id      string
+	bucket  string
+	dir     string
+	created time.Time
+
+	// Staged PUTs hold mu shared while writing; commit and abort hold it
+	// exclusively so they never see a half-written staged object
+	mu   sync.RWMutex
+	done bool
+
+	stagedMu sync.Mutex
+	seq      int
+	staged   map[string]stagedObject // keyed by final object path
+}
+
+type stagedObject struct {
+	key  string
+	file string
+	meta *objectMeta
+}
+
+// beginWrite registers a staged PUT, reporting false if the transaction has
+// already been committed or aborted. A true result must be paired with endWrite.
+func (t *txn) beginWrite() bool {
+	t.mu.RLock()
+	if t.done {
+		t.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (t *txn) endWrite() {
+	t.mu.RUnlock()
+}
+
+// newStagedFile returns a fresh path for one staged PUT. Each PUT gets its
+// own file so a failed upload can't clobber an earlier staged version of the key.
+func (t *txn) newStagedFile() string {
+	t.stagedMu.Lock()
+	defer t.stagedMu.Unlock()
+	t.seq++
+	return filepath.Join(t.dir, "objects", strconv.Itoa(t.seq))
+}
+
+// stage records a completed staged PUT of key (stored at target once
+// committed), replacing any earlier staged version of it.
+func (t *txn) stage(key, target, stagedFile string, meta *objectMeta) {
+	t.stagedMu.Lock()
+	defer t.stagedMu.Unlock()
+	if old, ok := t.staged[target]; ok {
+		os.Remove(old.file)
+	}
+	t.staged[target] = stagedObject{key: key, file: stagedFile, meta: meta}
+}
+
+var (
+	txnsMu sync.Mutex
+	txns   = map[string]*txn{}
+)
+
+// Held shared by GETs while opening an object and exclusively while a commit
+// renames its objects into place, so readers see all of a commit or none of it
+var txnPublishLock sync.RWMutex
+
+// isTxnRequest reports whether a POST addresses the transaction API.
+func isTxnRequest(r *http.Request) bool {
+	q := r.URL.Query()
+	_, begin := q["txn-begin"]
+	_, commit := q["txn-commit"]
+	_, abort := q["txn-abort"]
+	return begin || commit || abort
+}
+
+// txnHandler handles POST /<bucket>?txn-begin, ?txn-commit&txn-id=... and ?txn-abort&txn-id=...
+func txnHandler(w http.ResponseWriter, r *http.Request) {
+	bucket := splitRequestPath(r)[0]
+	if bucket == "" {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest", "Missing bucket name", r.URL.Path)
+		return
+	}
+	if _, err := sanitizePath(bucket, ""); err != nil {
+		writeS3Error(w, http.StatusBadRequest, "InvalidArgument", err.Error(), r.URL.Path)
+		return
+	}
+
+	q := r.URL.Query()
+	if _, ok := q["txn-begin"]; ok {
+		// Commits publish objects directly, bypassing the version history
+		if bucketVersioning(bucket) != "" {
+			writeS3Error(w, http.StatusNotImplemented, "NotImplemented", "Transactions are not supported on versioned buckets", r.URL.Path)
+			return
+		}
+		t, err := beginTxn(bucket)
+		if err != nil {
+			slog.Error("Starting transaction failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		debugLog(r, "Started transaction", "txn_id", t.id)
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, xml.Header)
+		xml.NewEncoder(w).Encode(struct {
+			XMLName       xml.Name `xml:"TransactionResult"`
+			Bucket        string   `xml:"Bucket"`
+			TransactionId string   `xml:"TransactionId"`
+		}{Bucket: bucket, TransactionId: t.id})
+		return
+	}
+
+	t, apiErr := lookupTxn(q.Get("txn-id"), bucket)
+	if t == nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	if _, ok := q["txn-commit"]; ok {
+		n, err := commitTxn(t)
+		if err != nil {
+			var conflict *txnConflictError
+			if errors.As(err, &conflict) {
+				writeS3Error(w, http.StatusConflict, "TransactionConflict", conflict.Error()+"; transaction aborted", r.URL.Path)
+				return
+			}
+			slog.Error("Committing transaction failed", "txn_id", t.id, "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		debugLog(r, "Committed transaction", "txn_id", t.id, "objects", n)
+	} else {
+		abortTxn(t)
+		debugLog(r, "Aborted transaction", "txn_id", t.id)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func beginTxn(bucket string) (*txn, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, err
+	}
+	id := hex.EncodeToString(b[:])
+	t := &txn{
+		id:      id,
+		bucket:  bucket,
+		dir:     filepath.Join(storageRootDir, txnDirName, id),
+		created: time.Now(),
+		staged:  map[string]stagedObject{},
+	}
+	if err := makeDirs(filepath.Join(t.dir, "objects")); err != nil {
+		return nil, err
+	}
+	txnsMu.Lock()
+	txns[id] = t
+	txnsMu.Unlock()
+	return t, nil
+}
+
+// lookupTxn finds an open transaction on bucket, or returns the error to
+// reject the request with.
+func lookupTxn(id, bucket string) (*txn, *apiError) {
+	if id == "" {
+		return nil, &apiError{http.StatusBadRequest, "InvalidArgument", "Missing txn-id"}
+	}
+	txnsMu.Lock()
+	t := txns[id]
+	txnsMu.Unlock()
+	if t == nil {
+		return nil, &apiError{http.StatusNotFound, "NoSuchTransaction", "The specified transaction does not exist: " + id}
+	}
+	if t.bucket != bucket {
+		return nil, &apiError{http.StatusBadRequest, "InvalidArgument", "Transaction " + id + " belongs to bucket " + t.bucket}
+	}
+	return t, nil
+}
+
+// txnConflictError reports a staged key that can't be published.
+type txnConflictError struct {
+	msg string
+}
+
+func (e *txnConflictError) Error() string {
+	return e.msg
+}
+
+// commitJournal records what a commit in progress is renaming, in
+// <root>/.txn/<id>/journal.json, so that one cut short by a crash is rolled
+// back at startup. It is written before the first rename and removed once
+// the last has succeeded: a journal found at startup means the commit
+// never finished. Paths are relative to the storage root.
+type commitJournal struct {
+	Entries []journalEntry `json:"entries"`
+}
+
+type journalEntry struct {
+	// Where the object is published
+	Target string `json:"target"`
+	// The staged object, renamed to Target
+	Staged string `json:"staged"`
+	// Where the object Target held before the commit is moved aside
+	Backup string `json:"backup"`
+	// Whether Target held an object, which rolling back must restore
+	Existed bool `json:"existed"`
+}
+
+// rollback undoes whatever of the entry's renames happened, restoring
+// Target to its state before the commit. It is safe to repeat.
+func (e journalEntry) rollback() error {
+	target := filepath.Join(storageRootDir, e.Target)
+	backup := filepath.Join(storageRootDir, e.Backup)
+	if _, err := os.Lstat(backup); err == nil {
+		return os.Rename(backup, target)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if e.Existed {
+		// Never moved aside, or already restored
+		return nil
+	}
+	_, err := os.Lstat(filepath.Join(storageRootDir, e.Staged))
+	if err == nil {
+		// Never published
+		return nil
+	}
+	if !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// commitTxn publishes every staged object. Existing objects are first moved
+// aside so that, if any rename fails, everything done so far is undone and
+// the previous objects are restored; the journal does the same after a
+// crash. The staged keys are locked against other writes throughout. It
+// returns the number of objects published.
+func commitTxn(t *txn) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return 0, errors.New("transaction already finished")
+	}
+	t.done = true
+	defer forgetTxn(t)
+	defer forgetUsage(t.bucket)
+
+	targets := make([]string, 0, len(t.staged))
+	for target := range t.staged {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	defer lockObjects(targets)()
+
+	var journal commitJournal
+	backupDir := filepath.Join(t.dir, "backup")
+	for i, target := range targets {
+		obj := t.staged[target]
+		fi, err := os.Stat(target)
+		if err == nil && fi.IsDir() {
+			return 0, &txnConflictError{"key " + obj.key + " is a folder prefix of existing objects"}
+		}
+		if err := makeDirs(filepath.Dir(target)); err != nil {
+			if errors.Is(err, syscall.ENOTDIR) {
+				return 0, &txnConflictError{"a parent of key " + obj.key + " is an existing object"}
+			}
+			return 0, err
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		e := journalEntry{
+			Target:  rootRelative(target),
+			Staged:  rootRelative(obj.file),
+			Backup:  rootRelative(filepath.Join(backupDir, strconv.Itoa(i))),
+			Existed: err == nil,
+		}
+		if e.Target == "" || e.Staged == "" || e.Backup == "" {
+			return 0, errors.New("transaction path outside the storage root")
+		}
+		journal.Entries = append(journal.Entries, e)
+	}
+
+	if err := makeDirs(backupDir); err != nil {
+		return 0, err
+	}
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return 0, err
+	}
+	journalPath := filepath.Join(t.dir, "journal.json")
+	if err := writeFileAtomic(journalPath, data); err != nil {
+		return 0, err
+	}
+
+	txnPublishLock.Lock()
+	var commitErr error
+	for i, target := range targets {
+		if journal.Entries[i].Existed {
+			if err := os.Rename(target, filepath.Join(storageRootDir, journal.Entries[i].Backup)); err != nil {
+				commitErr = err
+				break
+			}
+		}
+		if err := os.Rename(t.staged[target].file, target); err != nil {
+			commitErr = err
+			break
+		}
+	}
+	if commitErr == nil {
+		// The commit point: from here on it is not rolled back
+		commitErr = os.Remove(journalPath)
+	}
+	if commitErr != nil {
+		rollbackCommit(t.id, journal)
+	}
+	txnPublishLock.Unlock()
+
+	if commitErr != nil {
+		return 0, commitErr
+	}
+	for _, target := range targets {
+		fi, err := os.Stat(target)
+		if err == nil {
+			err = writeMeta(target, fi, t.staged[target].meta)
+		}
+		if err != nil {
+			// Not fatal: the ETag is recomputed from the content when missing
+			slog.Error("Writing metadata failed", "path", target, "err", err)
+		}
+	}
+	return len(targets), nil
+}
+
+// rootRelative returns path relative to the storage root, or "" if it
+// isn't below it.
+func rootRelative(path string) string {
+	absRoot, err := filepath.Abs(storageRootDir)
+	if err != nil {
+		return ""
+	}
+	absPath, err := filepath.Abs(path)
+	if err != nil || !isWithin(absRoot, absPath) {
+		return ""
+	}
+	rel, err := filepath.Rel(absRoot, absPath)
+	if err != nil {
+		return ""
+	}
+	return rel
+}
+
+// rollbackCommit undoes a commit by its journal, last entry first. It
+// reports whether every entry was rolled back.
+func rollbackCommit(id string, journal commitJournal) bool {
+	ok := true
+	for i := len(journal.Entries) - 1; i >= 0; i-- {
+		e := journal.Entries[i]
+		if err := e.rollback(); err != nil {
+			slog.Error("Restoring object during rollback failed", "txn_id", id, "path", e.Target, "err", err)
+			ok = false
+		}
+	}
+	return ok
+}
+
+// recoverTxns clears the staging directory at startup. Transactions live
+// in memory, so staged objects from a previous run can't be committed; a
+// commit cut short by a crash is rolled back by its journal. A transaction
+// that can't be rolled back is left in place, with the objects it moved
+// aside, for an operator to restore.
+func recoverTxns() error {
+	dir := filepath.Join(storageRootDir, txnDirName)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		txnDir := filepath.Join(dir, e.Name())
+		data, err := os.ReadFile(filepath.Join(txnDir, "journal.json"))
+		if err == nil {
+			var journal commitJournal
+			if err := json.Unmarshal(data, &journal); err != nil {
+				slog.Error("Reading transaction journal failed", "txn_id", e.Name(), "err", err)
+				continue
+			}
+			slog.Warn("Rolling back interrupted transaction commit", "txn_id", e.Name(), "objects", len(journal.Entries))
+			if !rollbackCommit(e.Name(), journal) {
+				slog.Error("Keeping transaction staging directory for manual recovery", "txn_id", e.Name(), "path", txnDir)
+				continue
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.RemoveAll(txnDir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// abortTxn discards a transaction and its staged objects.
+func abortTxn(t *txn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done {
+		return
+	}
+	t.done = true
+	dropDirUsage(t.bucket, t.dir)
+	forgetTxn(t)
+}
+
+func forgetTxn(t *txn) {
+	txnsMu.Lock()
+	delete(txns, t.id)
+	txnsMu.Unlock()
+	if err := os.RemoveAll(t.dir); err != nil {
+		slog.Error("Removing transaction staging directory failed", "txn_id", t.id, "err", err)
+	}
+}
+
+// runTxnJanitor aborts transactions left open longer than txnTimeout. It never returns.
+func runTxnJanitor() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		var expired []*txn
+		txnsMu.Lock()
+		for _, t := range txns {
+			if time.Since(t.created) > txnTimeout {
+				expired = append(expired, t)
+			}
+		}
+		txnsMu.Unlock()
+		for _, t := range expired {
+			slog.Warn("Aborting expired transaction", "txn_id", t.id, "bucket", t.bucket, "timeout", txnTimeout.String())
+			abortTxn(t)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCommitTxn(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, "b", "a"), "old")
+
+	tx, err := beginTxn("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "dir/c"} {
+		staged := tx.newStagedFile()
+		writeTestFile(t, staged, "new "+key)
+		tx.stage(key, filepath.Join(root, "b", key), staged, &objectMeta{})
+	}
+	n, err := commitTxn(tx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("published %d objects, want 2", n)
+	}
+	for _, key := range []string{"a", "dir/c"} {
+		if got, _ := readTestFile(t, filepath.Join(root, "b", key)); got != "new "+key {
+			t.Errorf("%s = %q, want %q", key, got, "new "+key)
+		}
+	}
+	if _, err := os.Stat(tx.dir); !os.IsNotExist(err) {
+		t.Errorf("staging directory left behind: %v", err)
+	}
+}
+
+// A crash part way through a commit leaves its journal behind; the next
+// startup must put back every object as it was before the commit.
+func TestRecoverTxnsRollsBackInterruptedCommit(t *testing.T) {
+	root := useTempRoot(t)
+	txnDir := filepath.Join(root, txnDirName, "0123")
+	rel := func(p string) string {
+		r, err := filepath.Rel(root, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	entry := func(key string, i string, existed bool) journalEntry {
+		return journalEntry{
+			Target:  rel(filepath.Join(root, "b", key)),
+			Staged:  rel(filepath.Join(txnDir, "objects", i)),
+			Backup:  rel(filepath.Join(txnDir, "backup", i)),
+			Existed: existed,
+		}
+	}
+	journal := commitJournal{Entries: []journalEntry{
+		entry("replaced", "0", true),  // moved aside and published
+		entry("created", "1", false),  // published, nothing to move aside
+		entry("aside", "2", true),     // moved aside, crash before publishing
+		entry("untouched", "3", true), // not reached
+		entry("pending", "4", false),  // not reached
+	}}
+
+	writeTestFile(t, filepath.Join(txnDir, "backup", "0"), "old replaced")
+	writeTestFile(t, filepath.Join(root, "b", "replaced"), "new replaced")
+	writeTestFile(t, filepath.Join(root, "b", "created"), "new created")
+	writeTestFile(t, filepath.Join(txnDir, "backup", "2"), "old aside")
+	writeTestFile(t, filepath.Join(txnDir, "objects", "2"), "new aside")
+	writeTestFile(t, filepath.Join(root, "b", "untouched"), "old untouched")
+	writeTestFile(t, filepath.Join(txnDir, "objects", "3"), "new untouched")
+	writeTestFile(t, filepath.Join(txnDir, "objects", "4"), "new pending")
+	data, err := json.Marshal(journal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(txnDir, "journal.json"), string(data))
+
+	if err := recoverTxns(); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"replaced":  "old replaced",
+		"created":   "",
+		"aside":     "old aside",
+		"untouched": "old untouched",
+		"pending":   "",
+	} {
+		got, exists := readTestFile(t, filepath.Join(root, "b", key))
+		if want == "" && exists {
+			t.Errorf("%s = %q, want no object", key, got)
+		} else if want != "" && got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if _, err := os.Stat(txnDir); !os.IsNotExist(err) {
+		t.Errorf("transaction directory left behind: %v", err)
+	}
+}
+
+// Without a journal, a transaction was never being committed and its
+// staged objects are simply discarded.
+func TestRecoverTxnsDiscardsUncommitted(t *testing.T) {
+	root := useTempRoot(t)
+	writeTestFile(t, filepath.Join(root, txnDirName, "0123", "objects", "1"), "staged")
+	writeTestFile(t, filepath.Join(root, "b", "a"), "old")
+
+	if err := recoverTxns(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, txnDirName, "0123")); !os.IsNotExist(err) {
+		t.Errorf("transaction directory left behind: %v", err)
+	}
+	if got, _ := readTestFile(t, filepath.Join(root, "b", "a")); got != "old" {
+		t.Errorf("a = %q, want %q", got, "old")
+	}
+}
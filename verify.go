@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Check the content of objects against their ETag as it is read, to detect
+// corruption at rest (-verify-on-read)
+var verifyOnRead bool
+
+// What a GET of an object found corrupt with -verify-on-read gets
+// (-verify-on-read-mismatch): "abort" streams it, checking it on the way,
+// and cuts the connection at the end; "fail" and "warn" check it before
+// anything is sent, and answer with 500 InternalError or serve it with a
+// Warning header
+var verifyOnReadMismatch = "abort"
+
+// Warning header sent with an object served despite not matching its ETag
+const corruptWarning = `199 - "Object content does not match its ETag"`
+
+// errCorruptObject ends the read of an object whose content doesn't match
+// its ETag.
+var errCorruptObject = errors.New("object content does not match its ETag")
+
+// contentVerifiable reports whether the content of an object described by
+// m can be checked against its ETag, which holds the MD5 of the content
+// unless it is the composite ETag of a multipart upload.
+func contentVerifiable(m *objectMeta) bool {
+	return len(m.ETag) == 2+2*md5.Size && !strings.Contains(m.ETag, "-")
+}
+
+// contentETag returns the ETag of content hashed into h.
+func contentETag(h hash.Hash) string {
+	return "\"" + hex.EncodeToString(h.Sum(nil)) + "\""
+}
+
+// reportCorruptRead logs and counts a read of an object whose content
+// hashed to etag instead of the ETag in m.
+func reportCorruptRead(bucket, key string, m *objectMeta, etag string) {
+	corruptReads.Inc()
+	slog.Error("Object content does not match its ETag", "bucket", bucket, "key", key, "etag", m.ETag, "content_etag", etag)
+}
+
+// checkContent reads the content of the object key described by m from
+// r, reporting whether it matches its ETag, and seeks back to where it
+// starts.
+func checkContent(r io.ReadSeeker, bucket, key string, m *objectMeta) (bool, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return false, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+	if etag := contentETag(h); etag != m.ETag {
+		reportCorruptRead(bucket, key, m, etag)
+		return false, nil
+	}
+	return true, nil
+}
+
+// verifyingReader reads the size bytes of an object's content from r,
+// checking them against its ETag. The last byte is held back until the
+// content has been checked, and withheld if it doesn't match, so that a
+// corrupt object is never delivered whole.
+type verifyingReader struct {
+	r         io.Reader
+	h         hash.Hash
+	remaining int64
+	last      []byte // held back once all was read and found to match
+	err       error
+
+	bucket, key string
+	meta        *objectMeta
+}
+
+// newVerifyingReader returns a reader of r, the size bytes of content of
+// the object key described by m, that fails with errCorruptObject before
+// giving out the last byte if they don't match its ETag. It returns r if
+// the content can't be verified.
+func newVerifyingReader(r io.Reader, size int64, bucket, key string, m *objectMeta) io.Reader {
+	if !contentVerifiable(m) {
+		return r
+	}
+	return &verifyingReader{r: r, h: md5.New(), remaining: size, bucket: bucket, key: key, meta: m}
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.err != nil {
+		n := copy(p, v.last)
+		v.last = v.last[n:]
+		if len(v.last) > 0 {
+			return n, nil
+		}
+		return n, v.err
+	}
+	if v.remaining == 0 {
+		// Only an empty object gets here before its content is checked
+		v.check()
+		return 0, v.err
+	}
+	if int64(len(p)) > v.remaining {
+		p = p[:v.remaining]
+	}
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+	v.remaining -= int64(n)
+	if v.remaining > 0 || n == 0 {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return n, err
+	}
+	if v.check() {
+		v.last = []byte{p[n-1]}
+	}
+	return n - 1, nil
+}
+
+// check reports whether the content read matches the object's ETag. From
+// then on, reads end with io.EOF if it does, and errCorruptObject if not.
+func (v *verifyingReader) check() bool {
+	if etag := contentETag(v.h); etag != v.meta.ETag {
+		reportCorruptRead(v.bucket, v.key, v.meta, etag)
+		v.err = errCorruptObject
+		return false
+	}
+	v.err = io.EOF
+	return true
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// useVerifyOnRead turns -verify-on-read on for the duration of the test.
+func useVerifyOnRead(t *testing.T) {
+	t.Helper()
+	old := verifyOnRead
+	verifyOnRead = true
+	t.Cleanup(func() { verifyOnRead = old })
+}
+
+// corruptObject flips a byte of the object stored at path in place,
+// keeping its size and modification time, as bit rot would.
+func corruptObject(t *testing.T, path string, offset int64) {
+	t.Helper()
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 1)
+	if _, err := f.ReadAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	b[0] ^= 0xff
+	if _, err := f.WriteAt(b, offset); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, fi.ModTime(), fi.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyOnRead(t *testing.T) {
+	root := useTempRoot(t)
+	useVerifyOnRead(t)
+	content := strings.Repeat("content of an object, ", 4096)
+	for _, key := range []string{"good", "bad", "empty"} {
+		body := content
+		if key == "empty" {
+			body = ""
+		}
+		if w := serve(t, http.MethodPut, "/b/"+key, strings.NewReader(body), nil); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", key, w.Code, w.Body)
+		}
+	}
+	corruptObject(t, filepath.Join(root, "b", "bad"), 1000)
+
+	srv := httptest.NewServer(http.HandlerFunc(serveAPI))
+	defer srv.Close()
+	get := func(key, rangeHeader string) (*http.Response, []byte, error) {
+		t.Helper()
+		req, err := http.NewRequest(http.MethodGet, srv.URL+"/b/"+key, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := io.ReadAll(resp.Body)
+		return resp, data, err
+	}
+
+	before := testutil.ToFloat64(corruptReads)
+	for _, key := range []string{"good", "empty"} {
+		resp, data, err := get(key, "")
+		if err != nil || resp.StatusCode != http.StatusOK || len(data) != int(resp.ContentLength) {
+			t.Errorf("GET %s: %d, %d bytes, %v", key, resp.StatusCode, len(data), err)
+		}
+	}
+	if got := testutil.ToFloat64(corruptReads) - before; got != 0 {
+		t.Errorf("intact objects counted %v corrupt reads", got)
+	}
+
+	// The transfer is cut short, without the last byte
+	resp, data, err := get("bad", "")
+	if err == nil || int64(len(data)) >= resp.ContentLength {
+		t.Errorf("GET of a corrupt object: %d of %d bytes, %v; want an incomplete transfer", len(data), resp.ContentLength, err)
+	}
+	if got := testutil.ToFloat64(corruptReads) - before; got != 1 {
+		t.Errorf("corrupt reads counted %v, want 1", got)
+	}
+
+	// Ranges can't be checked against the ETag, and are served as stored
+	resp, data, err = get("bad", "bytes=990-1009")
+	if err != nil || resp.StatusCode != http.StatusPartialContent || len(data) != 20 || string(data) == content[990:1010] {
+		t.Errorf("ranged GET of a corrupt object: %d %q, %v", resp.StatusCode, data, err)
+	}
+	if got := testutil.ToFloat64(corruptReads) - before; got != 1 {
+		t.Errorf("corrupt reads counted %v after a ranged GET, want 1", got)
+	}
+}
+
+func TestVerifyOnReadMismatch(t *testing.T) {
+	root := useTempRoot(t)
+	useVerifyOnRead(t)
+	old := verifyOnReadMismatch
+	t.Cleanup(func() { verifyOnReadMismatch = old })
+	content := strings.Repeat("x", 100)
+	for _, key := range []string{"good", "bad"} {
+		if w := serve(t, http.MethodPut, "/b/"+key, strings.NewReader(content), nil); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", key, w.Code, w.Body)
+		}
+	}
+	corruptObject(t, filepath.Join(root, "b", "bad"), 10)
+	corrupt := content[:10] + string([]byte{'x' ^ 0xff}) + content[11:]
+
+	for _, tc := range []struct {
+		mode, key, rangeHeader string
+		status                 int
+		body                   string
+		warning                bool
+		counted                float64
+	}{
+		{"fail", "good", "", http.StatusOK, content, false, 0},
+		{"fail", "bad", "", http.StatusInternalServerError, "", false, 1},
+		// The whole object is checked, whatever part is asked for
+		{"fail", "bad", "bytes=50-59", http.StatusInternalServerError, "", false, 1},
+		{"warn", "good", "", http.StatusOK, content, false, 0},
+		{"warn", "bad", "", http.StatusOK, corrupt, true, 1},
+		{"warn", "bad", "bytes=5-14", http.StatusPartialContent, corrupt[5:15], true, 1},
+	} {
+		verifyOnReadMismatch = tc.mode
+		var header http.Header
+		if tc.rangeHeader != "" {
+			header = http.Header{"Range": {tc.rangeHeader}}
+		}
+		before := testutil.ToFloat64(corruptReads)
+		w := serve(t, http.MethodGet, "/b/"+tc.key, nil, header)
+		name := tc.mode + " " + tc.key + " " + tc.rangeHeader
+		if w.Code != tc.status {
+			t.Errorf("%s: status %d, want %d", name, w.Code, tc.status)
+		}
+		if tc.status == http.StatusInternalServerError {
+			if !strings.Contains(w.Body.String(), "<Code>InternalError</Code>") {
+				t.Errorf("%s: body %s", name, w.Body)
+			}
+		} else if w.Body.String() != tc.body {
+			t.Errorf("%s: body %q, want %q", name, w.Body, tc.body)
+		}
+		want := ""
+		if tc.warning {
+			want = corruptWarning
+		}
+		if got := w.Header().Get("Warning"); got != want {
+			t.Errorf("%s: Warning %q, want %q", name, got, want)
+		}
+		if got := testutil.ToFloat64(corruptReads) - before; got != tc.counted {
+			t.Errorf("%s: %v corrupt reads counted, want %v", name, got, tc.counted)
+		}
+	}
+}
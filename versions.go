@@ -0,0 +1,844 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Object versioning. The current version of an object stays where an
+// unversioned object lives, so reads, listings and metadata work as before.
+// The history of each key lives in <root>/.versions/<bucket>/<h>/, where h is
+// the SHA-256 of the key's path within the bucket (keeping names short and
+// collision-free):
+//
+//	versions.json  the key and its versions and delete markers, oldest first
+//	<version-id>   the content of each noncurrent version
+//
+// Version files get their metadata in the .meta tree, like objects.
+
+// Directory under the storage root holding version history
+const versionsDirName = ".versions"
+
+const (
+	versionIndexName     = "versions.json"
+	versioningStatusName = "versioning" // in .versions/<bucket>, holds Enabled or Suspended
+)
+
+// Version ID of objects written while versioning is off or suspended
+const nullVersionID = "null"
+
+// Values of a bucket's versioning status
+const (
+	versioningEnabled   = "Enabled"
+	versioningSuspended = "Suspended"
+)
+
+// versionRecord is one version (or delete marker) of a key.
+type versionRecord struct {
+	ID           string `json:"id"`
+	DeleteMarker bool   `json:"deleteMarker,omitempty"`
+	Created      int64  `json:"created"` // UnixNano
+}
+
+// versionIndex is the versions.json document of a key.
+type versionIndex struct {
+	Key      string          `json:"key"`
+	Versions []versionRecord `json:"versions"`
+}
+
+func (idx *versionIndex) latest() *versionRecord {
+	if len(idx.Versions) == 0 {
+		return nil
+	}
+	return &idx.Versions[len(idx.Versions)-1]
+}
+
+func (idx *versionIndex) find(id string) int {
+	for i, v := range idx.Versions {
+		if v.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (idx *versionIndex) remove(i int) {
+	idx.Versions = append(idx.Versions[:i], idx.Versions[i+1:]...)
+}
+
+// Versioning status per bucket, read from disk on first use
+var versioningStatus = struct {
+	sync.Mutex
+	byBucket map[string]string
+}{byBucket: map[string]string{}}
+
+// bucketVersioning returns the bucket's versioning status: "" if versioning
+// was never configured, else versioningEnabled or versioningSuspended.
+func bucketVersioning(bucket string) string {
+	versioningStatus.Lock()
+	defer versioningStatus.Unlock()
+	if s, ok := versioningStatus.byBucket[bucket]; ok {
+		return s
+	}
+	data, err := os.ReadFile(filepath.Join(storageRootDir, versionsDirName, bucket, versioningStatusName))
+	if err != nil && !os.IsNotExist(err) {
+		// Don't cache, so the next request tries again
+		slog.Error("Reading versioning status failed", "bucket", bucket, "err", err)
+		return ""
+	}
+	s := strings.TrimSpace(string(data))
+	versioningStatus.byBucket[bucket] = s
+	return s
+}
+
+// setBucketVersioning records the bucket's versioning status.
+func setBucketVersioning(bucket, status string) error {
+	versioningStatus.Lock()
+	defer versioningStatus.Unlock()
+	dir := filepath.Join(storageRootDir, versionsDirName, bucket)
+	if err := makeDirs(dir); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(filepath.Join(dir, versioningStatusName), []byte(status+"\n")); err != nil {
+		return err
+	}
+	versioningStatus.byBucket[bucket] = status
+	return nil
+}
+
+// removeBucketVersions drops the version history and versioning status of
+// a deleted bucket.
+func removeBucketVersions(bucket string) error {
+	versioningStatus.Lock()
+	defer versioningStatus.Unlock()
+	delete(versioningStatus.byBucket, bucket)
+	dir := filepath.Join(storageRootDir, versionsDirName, bucket)
+	if p, err := metaPath(dir); err == nil {
+		os.RemoveAll(p)
+	}
+	return os.RemoveAll(dir)
+}
+
+// bucketHasVersions reports whether any key of the bucket has noncurrent
+// versions or delete markers. A history directory without an index, such
+// as one an upload in flight is staged in, doesn't count.
+func bucketHasVersions(bucket string) (bool, error) {
+	dir := filepath.Join(storageRootDir, versionsDirName, bucket)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		_, err := os.Stat(filepath.Join(dir, e.Name(), versionIndexName))
+		if err == nil {
+			return true, nil
+		}
+		if !os.IsNotExist(err) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// versionDir returns the directory holding the history of the object at
+// targetPath. It doesn't depend on -shard-depth.
+func versionDir(bucket, targetPath string) (string, error) {
+	absRoot, err := filepath.Abs(storageRootDir)
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(filepath.Join(absRoot, bucket), targetPath)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(unshardPath(filepath.ToSlash(rel))))
+	return filepath.Join(absRoot, versionsDirName, bucket, hex.EncodeToString(sum[:])), nil
+}
+
+func loadVersionIndex(dir string) (*versionIndex, error) {
+	data, err := os.ReadFile(filepath.Join(dir, versionIndexName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &versionIndex{}, nil
+		}
+		return nil, err
+	}
+	var idx versionIndex
+	if err := json.Unmarshal(data, &idx); err != nil {
+		return nil, fmt.Errorf("%s: %w", filepath.Join(dir, versionIndexName), err)
+	}
+	return &idx, nil
+}
+
+// saveVersionIndex writes idx to dir, removing dir once no versions are left.
+func saveVersionIndex(dir string, idx *versionIndex) error {
+	if len(idx.Versions) == 0 {
+		return os.RemoveAll(dir)
+	}
+	data, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	if err := makeDirs(dir); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, versionIndexName), data)
+}
+
+func newVersionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b[:]), nil
+}
+
+// nextVersionID returns the ID a new version gets in a bucket with the
+// given versioning status.
+func nextVersionID(status string) (string, error) {
+	if status == versioningEnabled {
+		return newVersionID()
+	}
+	return nullVersionID, nil
+}
+
+// currentVersion returns the version ID of the object stored at targetPath,
+// and whether there is one. An object without a record in idx was written
+// before versioning was enabled and is the null version.
+func currentVersion(idx *versionIndex, targetPath string) (string, bool) {
+	fi, err := os.Stat(targetPath)
+	if err != nil || !fi.Mode().IsRegular() {
+		return "", false
+	}
+	if l := idx.latest(); l != nil && !l.DeleteMarker {
+		return l.ID, true
+	}
+	return nullVersionID, true
+}
+
+// moveVersion renames an object or version file along with its metadata.
+func moveVersion(from, to string) error {
+	if err := makeDirs(filepath.Dir(to)); err != nil {
+		return err
+	}
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	metaFrom, errFrom := metaPath(from)
+	metaTo, errTo := metaPath(to)
+	if errFrom != nil || errTo != nil {
+		return nil
+	}
+	// Not fatal: the ETag is recomputed from the content when missing
+	makeDirs(filepath.Dir(metaTo))
+	if err := os.Rename(metaFrom, metaTo); err != nil && !os.IsNotExist(err) {
+		slog.Error("Moving metadata failed", "path", from, "err", err)
+	}
+	return nil
+}
+
+// removeVersionFile deletes a noncurrent version's content and metadata.
+func removeVersionFile(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := removeMeta(path); err != nil {
+		slog.Error("Deleting metadata failed", "path", path, "err", err)
+	}
+	return nil
+}
+
+// retireCurrent makes way for a new version (or delete marker) newID of
+// the object at targetPath: the current version is moved into the history,
+// except that a null version is replaced, as there is only ever one.
+func retireCurrent(idx *versionIndex, dir, targetPath, newID string) error {
+	curID, exists := currentVersion(idx, targetPath)
+	if newID == nullVersionID {
+		if i := idx.find(nullVersionID); i >= 0 {
+			if !exists || curID != nullVersionID {
+				if err := removeVersionFile(filepath.Join(dir, nullVersionID)); err != nil {
+					return err
+				}
+			}
+			idx.remove(i)
+		}
+		if exists && curID == nullVersionID {
+			return deleteObject(targetPath)
+		}
+	}
+	if !exists {
+		return nil
+	}
+	if idx.find(curID) < 0 {
+		// Written before versioning was enabled; it becomes the null version
+		fi, err := os.Stat(targetPath)
+		if err != nil {
+			return err
+		}
+		idx.Versions = append(idx.Versions, versionRecord{ID: curID, Created: fi.ModTime().UnixNano()})
+	}
+	return moveVersion(targetPath, filepath.Join(dir, curID))
+}
+
+// versionStagingFile returns a new file name, next to the history of the
+// object at targetPath, for an upload to be written to before
+// publishVersion makes it current. The caller creates the directory once
+// the upload is written, and removes it again if it fails.
+func versionStagingFile(bucket, targetPath string) (string, error) {
+	dir, err := versionDir(bucket, targetPath)
+	if err != nil {
+		return "", err
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, ".upload-"+hex.EncodeToString(b[:])), nil
+}
+
+// storeVersion writes r to file, from versionStagingFile, and publishes it
+// as the current version of key with the metadata m, returning what was
+// written and its version ID. The caller must hold lockObject(targetPath).
+func storeVersion(bucket, key, targetPath, file string, r io.Reader, m *objectMeta) (fs.FileInfo, string, error) {
+	fi, err := writeStagedFile(file, r)
+	if err != nil {
+		return nil, "", err
+	}
+	id, err := publishVersion(bucket, key, targetPath, file)
+	if err != nil {
+		os.Remove(file)
+		return nil, "", err
+	}
+	if err := writeMeta(targetPath, fi, m); err != nil {
+		slog.Error("Writing metadata failed", "err", err)
+	}
+	return fi, id, nil
+}
+
+// publishVersion makes file the current version of key, stored at
+// targetPath, in a versioned bucket and returns its version ID. The
+// caller must hold lockObject(targetPath).
+func publishVersion(bucket, key, targetPath, file string) (string, error) {
+	dir, err := versionDir(bucket, targetPath)
+	if err != nil {
+		return "", err
+	}
+	idx, err := loadVersionIndex(dir)
+	if err != nil {
+		return "", err
+	}
+	idx.Key = key
+	id, err := nextVersionID(bucketVersioning(bucket))
+	if err != nil {
+		return "", err
+	}
+	if err := retireCurrent(idx, dir, targetPath, id); err != nil {
+		return "", err
+	}
+	if err := renameFile(file, targetPath); err != nil {
+		// Put the version we just retired back in place
+		if l := idx.latest(); l != nil && !l.DeleteMarker {
+			moveVersion(filepath.Join(dir, l.ID), targetPath)
+		}
+		return "", err
+	}
+	idx.Versions = append(idx.Versions, versionRecord{ID: id, Created: time.Now().UnixNano()})
+	pruneVersions(bucket, dir, idx)
+	return id, saveVersionIndex(dir, idx)
+}
+
+// pruneVersions deletes the oldest noncurrent versions and delete markers
+// in idx, whose history is in dir, beyond the bucket's keepVersions. The
+// latest version or delete marker is never pruned. The write is done by
+// then, so a version that can't be deleted is only logged, and kept for
+// the next write to try again.
+func pruneVersions(bucket, dir string, idx *versionIndex) {
+	keep := bucketConfigs[bucket].KeepVersions
+	if keep == 0 {
+		return
+	}
+	pruned := 0
+	for ; pruned < len(idx.Versions)-1-keep; pruned++ {
+		rec := idx.Versions[pruned]
+		if rec.DeleteMarker {
+			continue
+		}
+		if err := removeVersionFile(filepath.Join(dir, rec.ID)); err != nil {
+			slog.Error("Pruning version failed", "bucket", bucket, "key", idx.Key, "version_id", rec.ID, "err", err)
+			break
+		}
+	}
+	idx.Versions = append(idx.Versions[:0], idx.Versions[pruned:]...)
+}
+
+// versionedDelete is the outcome of a delete in a versioned bucket, for
+// the x-amz-version-id and x-amz-delete-marker response headers.
+type versionedDelete struct {
+	versionID    string
+	deleteMarker bool
+}
+
+// deleteVersioned deletes key, stored at targetPath, from a versioned
+// bucket. Without a versionID the object is hidden behind a new delete
+// marker; with one, that version (or marker) is removed for good, and if it
+// was the latest the previous version becomes current again.
+func deleteVersioned(bucket, key, targetPath, versionID string) (versionedDelete, error) {
+	defer lockObject(targetPath)()
+	return deleteVersionedLocked(bucket, key, targetPath, versionID)
+}
+
+// deleteVersionedLocked is deleteVersioned for a caller already holding
+// lockObject(targetPath).
+func deleteVersionedLocked(bucket, key, targetPath, versionID string) (versionedDelete, error) {
+	// Versions move in and out of the bucket directory
+	defer forgetUsage(bucket)
+	dir, err := versionDir(bucket, targetPath)
+	if err != nil {
+		return versionedDelete{}, err
+	}
+	idx, err := loadVersionIndex(dir)
+	if err != nil {
+		return versionedDelete{}, err
+	}
+
+	if versionID == "" {
+		id, err := nextVersionID(bucketVersioning(bucket))
+		if err != nil {
+			return versionedDelete{}, err
+		}
+		if err := retireCurrent(idx, dir, targetPath, id); err != nil {
+			return versionedDelete{}, err
+		}
+		idx.Key = key
+		idx.Versions = append(idx.Versions, versionRecord{ID: id, DeleteMarker: true, Created: time.Now().UnixNano()})
+		pruneVersions(bucket, dir, idx)
+		return versionedDelete{versionID: id, deleteMarker: true}, saveVersionIndex(dir, idx)
+	}
+
+	i := idx.find(versionID)
+	if i < 0 {
+		// An object written before versioning was enabled is the null version
+		if curID, exists := currentVersion(idx, targetPath); exists && curID == versionID {
+			return versionedDelete{versionID: versionID}, deleteObject(targetPath)
+		}
+		// As in S3, deleting a version that doesn't exist succeeds
+		return versionedDelete{versionID: versionID}, nil
+	}
+	rec := idx.Versions[i]
+	wasLatest := i == len(idx.Versions)-1
+	switch {
+	case rec.DeleteMarker:
+		// Nothing stored
+	case wasLatest:
+		err = deleteObject(targetPath)
+	default:
+		err = removeVersionFile(filepath.Join(dir, rec.ID))
+	}
+	if err != nil {
+		return versionedDelete{}, err
+	}
+	idx.remove(i)
+	if wasLatest {
+		if l := idx.latest(); l != nil && !l.DeleteMarker {
+			if err := moveVersion(filepath.Join(dir, l.ID), targetPath); err != nil {
+				return versionedDelete{}, err
+			}
+		}
+	}
+	return versionedDelete{versionID: rec.ID, deleteMarker: rec.DeleteMarker}, saveVersionIndex(dir, idx)
+}
+
+// versionRef names the file a read is served from, with the version it
+// holds ("" outside versioned buckets).
+type versionRef struct {
+	path         string
+	versionID    string
+	deleteMarker bool
+}
+
+// readVersion resolves which file holds the version of the object at
+// targetPath a read asks for; an empty versionID asks for the current one.
+// When that is a delete marker the returned path doesn't exist.
+func readVersion(bucket, targetPath, versionID string) (versionRef, *apiError) {
+	if bucketVersioning(bucket) == "" {
+		if versionID != "" && versionID != nullVersionID {
+			return versionRef{}, &apiError{http.StatusNotFound, "NoSuchVersion", "The specified version does not exist."}
+		}
+		return versionRef{path: targetPath}, nil
+	}
+
+	dir, err := versionDir(bucket, targetPath)
+	if err != nil {
+		return versionRef{}, &apiError{http.StatusBadRequest, "InvalidArgument", err.Error()}
+	}
+	idx, err := loadVersionIndex(dir)
+	if err != nil {
+		slog.Error("Reading version index failed", "err", err)
+		return versionRef{}, &apiError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	}
+	curID, exists := currentVersion(idx, targetPath)
+	if versionID == "" {
+		if !exists {
+			if l := idx.latest(); l != nil && l.DeleteMarker {
+				return versionRef{path: targetPath, versionID: l.ID, deleteMarker: true}, nil
+			}
+		}
+		return versionRef{path: targetPath, versionID: curID}, nil
+	}
+	if exists && versionID == curID {
+		return versionRef{path: targetPath, versionID: curID}, nil
+	}
+	i := idx.find(versionID)
+	if i < 0 {
+		return versionRef{}, &apiError{http.StatusNotFound, "NoSuchVersion", "The specified version does not exist."}
+	}
+	if idx.Versions[i].DeleteMarker {
+		// As in S3, a delete marker can't be read
+		return versionRef{versionID: versionID, deleteMarker: true}, &apiError{http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed against a delete marker."}
+	}
+	return versionRef{path: filepath.Join(dir, versionID), versionID: versionID}, nil
+}
+
+// open opens the version ref names of the object key, stored at
+// targetPath: the current one through backend, an older one from the
+// bucket's version history.
+func (ref versionRef) open(bucket, key, targetPath string) (ObjectReader, fs.FileInfo, *objectMeta, error) {
+	if ref.path == targetPath {
+		return backend.Get(bucket, key)
+	}
+	return openObjectFile(ref.path)
+}
+
+// stat is open without opening the file.
+func (ref versionRef) stat(bucket, key, targetPath string) (fs.FileInfo, *objectMeta, error) {
+	if ref.path == targetPath {
+		return backend.Stat(bucket, key)
+	}
+	return statObjectFile(ref.path)
+}
+
+// setVersionHeaders reports the version a response is about.
+func setVersionHeaders(w http.ResponseWriter, versionID string, deleteMarker bool) {
+	if versionID != "" {
+		w.Header().Set("x-amz-version-id", versionID)
+	}
+	if deleteMarker {
+		w.Header().Set("x-amz-delete-marker", "true")
+	}
+}
+
+// setReadVersionAllow adds Allow to the response refusing a read for the
+// error readVersion returned: a delete marker asked for by version ID can
+// only be deleted.
+func setReadVersionAllow(w http.ResponseWriter, apiErr *apiError) {
+	if apiErr != nil && apiErr.status == http.StatusMethodNotAllowed {
+		w.Header().Set("Allow", http.MethodDelete)
+	}
+}
+
+type versioningConfiguration struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ VersioningConfiguration"`
+	Status  string   `xml:"Status,omitempty"`
+}
+
+// versioningHandler handles GET and PUT /<bucket>?versioning
+func versioningHandler(w http.ResponseWriter, r *http.Request, bucket, bucketPath string) {
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", r.URL.Path)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, xml.Header)
+		if err := xml.NewEncoder(w).Encode(versioningConfiguration{Status: bucketVersioning(bucket)}); err != nil {
+			slog.Error("Writing versioning configuration failed", "err", err)
+		}
+	case http.MethodPut:
+		// Any namespace (or none) is accepted on the way in
+		var req struct {
+			Status string `xml:"Status"`
+		}
+		if err := xml.NewDecoder(http.MaxBytesReader(w, r.Body, 64<<10)).Decode(&req); err != nil {
+			writeS3Error(w, http.StatusBadRequest, "MalformedXML", "The VersioningConfiguration document is not well-formed", r.URL.Path)
+			return
+		}
+		if req.Status != versioningEnabled && req.Status != versioningSuspended {
+			writeS3Error(w, http.StatusBadRequest, "IllegalVersioningConfigurationException", "Status must be Enabled or Suspended", r.URL.Path)
+			return
+		}
+		if err := setBucketVersioning(bucket, req.Status); err != nil {
+			slog.Error("Writing versioning status failed", "bucket", bucket, "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+			return
+		}
+		debugLog(r, "Set bucket versioning", "status", req.Status)
+		w.WriteHeader(http.StatusOK)
+	default:
+		writeMethodNotAllowed(w, r, http.MethodGet, http.MethodPut)
+	}
+}
+
+// Set on versionListEntry names so they are not emitted with an empty xmlns
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// versionListEntry is a <Version> or <DeleteMarker> of a ListVersionsResult,
+// depending on XMLName.
+type versionListEntry struct {
+	XMLName      xml.Name
+	Key          string `xml:"Key"`
+	VersionId    string `xml:"VersionId"`
+	IsLatest     bool   `xml:"IsLatest"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag,omitempty"`
+	Size         *int64 `xml:"Size,omitempty"`
+	StorageClass string `xml:"StorageClass,omitempty"`
+}
+
+type listVersionsResult struct {
+	XMLName             xml.Name           `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListVersionsResult"`
+	Name                string             `xml:"Name"`
+	Prefix              string             `xml:"Prefix"`
+	KeyMarker           string             `xml:"KeyMarker"`
+	VersionIdMarker     string             `xml:"VersionIdMarker"`
+	NextKeyMarker       string             `xml:"NextKeyMarker,omitempty"`
+	NextVersionIdMarker string             `xml:"NextVersionIdMarker,omitempty"`
+	MaxKeys             int                `xml:"MaxKeys"`
+	EncodingType        string             `xml:"EncodingType,omitempty"`
+	IsTruncated         bool               `xml:"IsTruncated"`
+	Entries             []versionListEntry // in key order, newest version first
+}
+
+// listVersionsHandler handles GET /<bucket>?versions (ListObjectVersions),
+// honoring prefix, key-marker, version-id-marker and max-keys.
+func listVersionsHandler(w http.ResponseWriter, r *http.Request, bucket, bucketPath string) {
+	q := r.URL.Query()
+	encode, apiErr := listKeyEncoder(q)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	prefix := q.Get("prefix")
+	keyMarker, versionIDMarker := q.Get("key-marker"), q.Get("version-id-marker")
+	maxKeys := maxListKeys
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			writeS3Error(w, http.StatusBadRequest, "InvalidArgument", "max-keys must be a non-negative integer", r.URL.Path)
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		writeS3Error(w, http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist", r.URL.Path)
+		return
+	}
+
+	entries, err := listVersions(bucket, bucketPath, prefix)
+	if err != nil {
+		if !respondIfOutOfFDs(w, r, err) {
+			slog.Error("Listing versions failed", "err", err)
+			writeS3Error(w, http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again.", r.URL.Path)
+		}
+		return
+	}
+
+	// Resume after the marker: past all of key-marker's versions, or just
+	// past version-id-marker of it
+	if keyMarker != "" {
+		start := len(entries)
+		for i, e := range entries {
+			if e.Key > keyMarker {
+				start = i
+				break
+			}
+			if e.Key == keyMarker && versionIDMarker != "" && e.VersionId == versionIDMarker {
+				start = i + 1
+				break
+			}
+		}
+		entries = entries[start:]
+	}
+
+	result := listVersionsResult{
+		Name:            bucket,
+		Prefix:          encode(prefix),
+		KeyMarker:       encode(keyMarker),
+		VersionIdMarker: versionIDMarker,
+		MaxKeys:         maxKeys,
+		EncodingType:    q.Get("encoding-type"),
+		Entries:         entries,
+	}
+	if len(entries) > maxKeys {
+		result.Entries = entries[:maxKeys]
+		result.IsTruncated = true
+		if maxKeys > 0 {
+			last := result.Entries[maxKeys-1]
+			result.NextKeyMarker, result.NextVersionIdMarker = encode(last.Key), last.VersionId
+		}
+	}
+	for i := range result.Entries {
+		result.Entries[i].Key = encode(result.Entries[i].Key)
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(result); err != nil {
+		slog.Error("Writing version listing failed", "err", err)
+	}
+	debugLog(r, "Listed versions", "versions", len(result.Entries))
+}
+
+// listVersions returns every version and delete marker of the keys in the
+// bucket starting with prefix, sorted by key and newest first.
+func listVersions(bucket, bucketPath, prefix string) ([]versionListEntry, error) {
+	// Current objects, some of which have no history yet
+	current := map[string]listEntry{}
+	objects, err := walkBucket(bucket, bucketPath, prefix)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range objects {
+		current[e.key] = e
+	}
+
+	// Keys with a history, including those currently deleted
+	type history struct {
+		idx *versionIndex
+		dir string
+	}
+	histories := map[string]history{}
+	bucketVersions := filepath.Join(storageRootDir, versionsDirName, bucket)
+	dirs, err := os.ReadDir(bucketVersions)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+		dir := filepath.Join(bucketVersions, d.Name())
+		idx, err := loadVersionIndex(dir)
+		if err != nil {
+			return nil, err
+		}
+		if len(idx.Versions) > 0 && strings.HasPrefix(idx.Key, prefix) {
+			histories[idx.Key] = history{idx, dir}
+		}
+	}
+
+	keys := make([]string, 0, len(current)+len(histories))
+	for k := range current {
+		keys = append(keys, k)
+	}
+	for k := range histories {
+		if _, ok := current[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var entries []versionListEntry
+	for _, key := range keys {
+		h, ok := histories[key]
+		if !ok {
+			h.idx = &versionIndex{}
+		}
+		idx, dir := h.idx, h.dir
+		cur, hasCurrent := current[key]
+		curID := ""
+		if hasCurrent {
+			curID, _ = currentVersion(idx, cur.path)
+			if idx.find(curID) < 0 {
+				// Written before versioning was enabled
+				e, err := versionEntry(key, curID, cur.path, true)
+				if err != nil {
+					return nil, err
+				}
+				if e != nil {
+					entries = append(entries, *e)
+				}
+			}
+		}
+		for i := len(idx.Versions) - 1; i >= 0; i-- {
+			v := idx.Versions[i]
+			latest := i == len(idx.Versions)-1 && curID == ""
+			if v.DeleteMarker {
+				entries = append(entries, versionListEntry{
+					XMLName:      xml.Name{Space: s3Namespace, Local: "DeleteMarker"},
+					Key:          key,
+					VersionId:    v.ID,
+					IsLatest:     latest,
+					LastModified: time.Unix(0, v.Created).UTC().Format(s3TimeFormat),
+				})
+				continue
+			}
+			path := filepath.Join(dir, v.ID)
+			if v.ID == curID {
+				path, latest = cur.path, true
+			}
+			e, err := versionEntry(key, v.ID, path, latest)
+			if err != nil {
+				return nil, err
+			}
+			if e != nil {
+				entries = append(entries, *e)
+			}
+		}
+	}
+	return entries, nil
+}
+
+// versionEntry describes the version stored at path, or returns nil if it
+// has vanished since it was found.
+func versionEntry(key, id, path string, latest bool) (*versionListEntry, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	meta, err := loadMeta(path, fi)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	size := contentSize(fi, meta)
+	return &versionListEntry{
+		XMLName:      xml.Name{Space: s3Namespace, Local: "Version"},
+		Key:          key,
+		VersionId:    id,
+		IsLatest:     latest,
+		LastModified: fi.ModTime().UTC().Format(s3TimeFormat),
+		ETag:         meta.ETag,
+		Size:         &size,
+		StorageClass: storageClass(meta),
+	}, nil
+}
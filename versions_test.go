@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// useVersionedBucket creates the bucket with versioning enabled.
+func useVersionedBucket(t *testing.T, bucket string) {
+	t.Helper()
+	if w := serve(t, "PUT", "/"+bucket, nil, nil); w.Code != http.StatusOK {
+		t.Fatalf("creating bucket: %d %s", w.Code, w.Body)
+	}
+	config := `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`
+	if w := serve(t, "PUT", "/"+bucket+"?versioning", strings.NewReader(config), nil); w.Code != http.StatusOK {
+		t.Fatalf("enabling versioning: %d %s", w.Code, w.Body)
+	}
+	t.Cleanup(func() { removeBucketVersions(bucket) })
+}
+
+func TestFailedVersionedUploadLeavesNoHistory(t *testing.T) {
+	root := useTempRoot(t)
+	useVersionedBucket(t, "b")
+
+	// Refused before the body is written, and after
+	header := http.Header{"X-Amz-Copy-Source": {"/b/missing"}}
+	if w := serve(t, "PUT", "/b/k", nil, header); w.Code != http.StatusNotFound {
+		t.Fatalf("copy of a missing source: %d %s", w.Code, w.Body)
+	}
+	header = http.Header{"Content-Md5": {"1B2M2Y8AsgTpgAmY7PhCfg=="}}
+	if w := serve(t, "PUT", "/b/k", strings.NewReader("not empty"), header); w.Code != http.StatusBadRequest {
+		t.Fatalf("upload with a wrong Content-MD5: %d %s", w.Code, w.Body)
+	}
+	entries, _ := os.ReadDir(filepath.Join(root, versionsDirName, "b"))
+	for _, e := range entries {
+		if e.IsDir() {
+			t.Errorf("failed uploads left history directory %s", e.Name())
+		}
+	}
+
+	// An empty history, such as a crash leaves, doesn't keep the bucket either
+	dir, err := versionDir("b", filepath.Join(root, "b", "other"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if w := serve(t, "DELETE", "/b", nil, nil); w.Code != http.StatusNoContent {
+		t.Errorf("deleting the bucket: %d %s", w.Code, w.Body)
+	}
+}
+
+func TestVersionedBucketWithHistoryIsNotEmpty(t *testing.T) {
+	useTempRoot(t)
+	useVersionedBucket(t, "b")
+	for _, content := range []string{"one", "two"} {
+		if w := serve(t, "PUT", "/b/k", strings.NewReader(content), nil); w.Code != http.StatusNoContent {
+			t.Fatalf("PUT: %d %s", w.Code, w.Body)
+		}
+	}
+	if w := serve(t, "DELETE", "/b/k", nil, nil); w.Code != http.StatusNoContent {
+		t.Fatalf("DELETE: %d %s", w.Code, w.Body)
+	}
+	if w := serve(t, "DELETE", "/b", nil, nil); w.Code != http.StatusConflict {
+		t.Errorf("deleting a bucket with versions: %d, want 409", w.Code)
+	}
+}
+
+func TestKeepVersions(t *testing.T) {
+	root := useTempRoot(t)
+	old := bucketConfigs
+	bucketConfigs = map[string]bucketConfig{"b": {KeepVersions: 2}}
+	t.Cleanup(func() { bucketConfigs = old })
+	useVersionedBucket(t, "b")
+	useVersionedBucket(t, "all")
+
+	write := func(bucket, content string) string {
+		t.Helper()
+		w := serve(t, "PUT", "/"+bucket+"/k", strings.NewReader(content), nil)
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("PUT %s: %d %s", content, w.Code, w.Body)
+		}
+		return w.Header().Get("x-amz-version-id")
+	}
+	dir, err := versionDir("b", filepath.Join(root, "b", "k"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The IDs of the versions and delete markers of b/k, oldest first
+	history := func() []string {
+		t.Helper()
+		idx, err := loadVersionIndex(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, v := range idx.Versions {
+			ids = append(ids, v.ID)
+		}
+		return ids
+	}
+	equal := func(got, want []string) bool {
+		return strings.Join(got, ",") == strings.Join(want, ",")
+	}
+
+	var ids []string
+	for _, content := range []string{"one", "two", "three", "four", "five"} {
+		ids = append(ids, write("b", content))
+		write("all", content)
+	}
+	// The current version and the 2 newest noncurrent ones are left
+	if got := history(); !equal(got, ids[2:]) {
+		t.Fatalf("versions after 5 PUTs = %v, want %v", got, ids[2:])
+	}
+	for i, content := range []string{"one", "two", "three", "four", "five"} {
+		w := serve(t, "GET", "/b/k?versionId="+ids[i], nil, nil)
+		switch {
+		case i < 2 && w.Code != http.StatusNotFound:
+			t.Errorf("GET pruned version %d: %d, want 404", i, w.Code)
+		case i >= 2 && (w.Code != http.StatusOK || w.Body.String() != content):
+			t.Errorf("GET version %d: %d %q, want 200 %q", i, w.Code, w.Body, content)
+		}
+		// The current version is stored in the bucket
+		if _, err := os.Stat(filepath.Join(dir, ids[i])); (err == nil) != (i == 2 || i == 3) {
+			t.Errorf("history file of version %d: %v", i, err)
+		}
+	}
+
+	// A delete marker counts as a noncurrent version once it isn't the
+	// latest, and is never pruned while it is
+	w := serve(t, "DELETE", "/b/k", nil, nil)
+	marker := w.Header().Get("x-amz-version-id")
+	if got, want := history(), []string{ids[3], ids[4], marker}; !equal(got, want) {
+		t.Fatalf("versions after DELETE = %v, want %v", got, want)
+	}
+	six := write("b", "six")
+	if got, want := history(), []string{ids[4], marker, six}; !equal(got, want) {
+		t.Fatalf("versions after PUT over a delete marker = %v, want %v", got, want)
+	}
+	write("b", "seven")
+	if got := history(); len(got) != 3 || got[0] != marker {
+		t.Errorf("versions after another PUT = %v, want the delete marker oldest", got)
+	}
+
+	// Buckets without keepVersions keep every version
+	w = serve(t, "GET", "/all?versions", nil, nil)
+	if n := strings.Count(w.Body.String(), "<VersionId>"); n != 5 {
+		t.Errorf("unpruned bucket lists %d versions, want 5", n)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// With -base-domain s3.example.com, a request for mybucket.s3.example.com
+// addresses the bucket mybucket with the whole path as its key
+// (virtual-hosted style), as many S3 clients send by default. Requests for
+// the base domain itself, or any other host, are path-style as before.
+
+// Domain whose subdomains name buckets; empty disables virtual hosting
+var baseDomain string
+
+// virtualHostBucket returns the bucket the request's Host names, or "" if
+// it doesn't name one.
+func virtualHostBucket(r *http.Request) string {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	bucket, ok := strings.CutSuffix(host, "."+baseDomain)
+	if !ok {
+		return ""
+	}
+	return bucket
+}
+
+// requestTarget returns the bucket and key a request names, path-style or,
+// until withVirtualHost has rewritten its path, virtual-hosted-style.
+func requestTarget(r *http.Request) (bucket, key string) {
+	if baseDomain != "" {
+		if b := virtualHostBucket(r); b != "" {
+			return b, strings.TrimPrefix(r.URL.Path, "/")
+		}
+	}
+	parts := splitRequestPath(r)
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	return parts[0], key
+}
+
+// withVirtualHost turns virtual-hosted-style requests into the path-style
+// requests the handlers serve. It runs after signature checks, since the
+// client signed the path as it sent it, and rewrites the URL in place so
+// that the request log, which shares it, reports the bucket too.
+func withVirtualHost(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if bucket := virtualHostBucket(r); bucket != "" {
+			prependBucket(r.URL, bucket)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// prependBucket turns the path of u, a virtual-hosted-style request's URL,
+// into the path-style one for bucket.
+func prependBucket(u *url.URL, bucket string) {
+	u.Path = "/" + bucket + u.Path
+	if u.RawPath != "" {
+		u.RawPath = "/" + bucket + u.RawPath
+	}
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// With -webdav, the server also speaks enough WebDAV (RFC 4918, class 1,
+// without locking) for desktop clients such as Cyberduck to browse and
+// mount the store: buckets and key folders are collections, objects are
+// resources. PROPFIND lists them, MKCOL creates a folder (as a folder
+// marker object, "<prefix>/"), and GET, PUT and DELETE are the S3
+// requests they already are. Properties can't be set, and MOVE and COPY
+// are not supported.
+
+// Whether WebDAV requests are served
+var webdavEnabled bool
+
+// WebDAV methods net/http has no constants for
+const (
+	methodPropfind = "PROPFIND"
+	methodMkcol    = "MKCOL"
+)
+
+// isWebDAVRequest matches every request while -webdav is set; routes using
+// it name the method.
+func isWebDAVRequest(r *http.Request) bool {
+	return webdavEnabled
+}
+
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"DAV: multistatus"`
+	Responses []davResponse `xml:"response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"href"`
+	Propstat davPropstat `xml:"propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"prop"`
+	Status string  `xml:"status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"displayname,omitempty"`
+	ResourceType  davResourceType `xml:"resourcetype"`
+	ContentLength *int64          `xml:"getcontentlength,omitempty"`
+	ContentType   string          `xml:"getcontenttype,omitempty"`
+	ETag          string          `xml:"getetag,omitempty"`
+	LastModified  string          `xml:"getlastmodified,omitempty"`
+	SupportedLock *struct{}       `xml:"supportedlock,omitempty"`
+}
+
+// davResourceType is empty for a resource and holds <collection/> for a
+// collection.
+type davResourceType struct {
+	Collection *struct{} `xml:"collection,omitempty"`
+}
+
+// davPolicyMethod returns the method a bucket policy must allow for a
+// request with method: GET for reading WebDAV methods, PUT for MKCOL and
+// the method itself for all others.
+func davPolicyMethod(method string) string {
+	switch method {
+	case methodPropfind, http.MethodOptions:
+		return http.MethodGet
+	case methodMkcol:
+		return http.MethodPut
+	}
+	return method
+}
+
+// plusDAVMethods returns allowed with the WebDAV methods added while they
+// are served, for the Allow header of a 405 for a bucket or object.
+func plusDAVMethods(allowed ...string) []string {
+	if !webdavEnabled {
+		return allowed
+	}
+	return append(allowed, http.MethodOptions, methodPropfind, methodMkcol)
+}
+
+// davOptionsHandler answers OPTIONS, which clients send to find out that
+// the server speaks WebDAV.
+func davOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("DAV", "1")
+	w.Header().Set("Allow", strings.Join(plusDAVMethods(http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPost, http.MethodDelete), ", "))
+	// Makes Windows' WebDAV client use WebDAV rather than FrontPage
+	w.Header().Set("MS-Author-Via", "DAV")
+	w.WriteHeader(http.StatusOK)
+}
+
+// propfindHandler handles PROPFIND of the root (the buckets), a bucket, a
+// key folder or an object. Whatever properties the body asks for, the
+// same set is returned. Depth 0 describes the resource itself and Depth 1
+// (the default here) also its immediate members; infinity is refused.
+func propfindHandler(w http.ResponseWriter, r *http.Request) {
+	depth := r.Header.Get("Depth")
+	switch depth {
+	case "", "1":
+		depth = "1"
+	case "0":
+	default:
+		writeS3Error(w, http.StatusForbidden, "InvalidRequest", "PROPFIND with Depth: infinity is not supported; use Depth: 0 or 1", r.URL.Path)
+		return
+	}
+	// The body only selects properties
+	io.Copy(io.Discard, io.LimitReader(r.Body, 1<<20))
+
+	var ms davMultistatus
+	var apiErr *apiError
+	if splitRequestPath(r)[0] == "" {
+		ms.Responses, apiErr = davBuckets(depth == "1")
+	} else {
+		var bucket, key string
+		if bucket, key, apiErr = parseRequest(r); apiErr == nil {
+			if _, err := sanitizePath(bucket, key); err != nil {
+				writePathError(w, r, err)
+				return
+			}
+			ms.Responses, apiErr = davMembers(bucket, key, depth == "1")
+		}
+	}
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	fmt.Fprint(w, xml.Header)
+	if err := xml.NewEncoder(w).Encode(ms); err != nil {
+		slog.Error("Writing PROPFIND response failed", "err", err)
+	}
+	debugLog(r, "Listed WebDAV collection", "depth", depth, "responses", len(ms.Responses))
+}
+
+// davBuckets describes the root collection and, with members, the buckets
+// in it.
+func davBuckets(members bool) ([]davResponse, *apiError) {
+	responses := []davResponse{davCollection("/", "", time.Time{})}
+	if !members {
+		return responses, nil
+	}
+	entries, err := os.ReadDir(storageRootDir)
+	if err != nil {
+		slog.Error("Listing buckets failed", "err", err)
+		return nil, &apiError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	}
+	for _, e := range entries {
+		// Dot-directories hold server state (.txn, .meta, ...), not buckets
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		responses = append(responses, davCollection(davHref(e.Name(), ""), e.Name(), info.ModTime()))
+	}
+	return responses, nil
+}
+
+// davMembers describes key in bucket, as an object or else as a folder
+// ("" for the bucket itself), and with members, what the folder holds.
+// Members are found by the S3 listing's walk, rolled up at "/" as a
+// listing with that delimiter would.
+func davMembers(bucket, key string, members bool) ([]davResponse, *apiError) {
+	internalError := &apiError{http.StatusInternalServerError, "InternalError", "We encountered an internal error. Please try again."}
+	bucketPath, err := sanitizePath(bucket, "")
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, "InvalidArgument", err.Error()}
+	}
+	// Folders have no modification time of their own
+	var bucketModTime time.Time
+	if fi, err := os.Stat(bucketPath); err != nil || !fi.IsDir() {
+		if err == nil || os.IsNotExist(err) {
+			return nil, &apiError{http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist"}
+		}
+		slog.Error("Stating bucket failed", "err", err)
+		return nil, internalError
+	} else if key == "" {
+		bucketModTime = fi.ModTime()
+	}
+	now := time.Now()
+	if key != "" && !strings.HasSuffix(key, "/") {
+		targetPath, err := sanitizePath(bucket, key)
+		if err != nil {
+			return nil, &apiError{http.StatusBadRequest, "InvalidArgument", err.Error()}
+		}
+		txnPublishLock.RLock()
+		fi, exists, err := statObject(targetPath)
+		txnPublishLock.RUnlock()
+		if err != nil {
+			slog.Error("Stating file failed", "err", err)
+			return nil, internalError
+		}
+		if exists {
+			resp, err := davObject(bucket, key, targetPath, fi, now)
+			if err != nil {
+				slog.Error("Computing ETag failed", "err", err)
+				return nil, internalError
+			}
+			if resp == nil {
+				return nil, &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+			}
+			return []davResponse{*resp}, nil
+		}
+		key += "/"
+	}
+
+	// A transaction commit in progress is listed entirely or not at all
+	txnPublishLock.RLock()
+	entries, err := walkBucket(bucket, bucketPath, key)
+	txnPublishLock.RUnlock()
+	if err != nil {
+		slog.Error("Listing bucket failed", "err", err)
+		return nil, internalError
+	}
+	// A folder exists while anything is stored below it
+	if key != "" && len(entries) == 0 {
+		return nil, &apiError{http.StatusNotFound, "NoSuchKey", "The specified key does not exist."}
+	}
+	name := bucket
+	if key != "" {
+		name = key[strings.LastIndex(key[:len(key)-1], "/")+1 : len(key)-1]
+	}
+	responses := []davResponse{davCollection(davHref(bucket, key), name, bucketModTime)}
+	if !members {
+		return responses, nil
+	}
+	last := ""
+	for _, e := range entries {
+		rest := e.key[len(key):]
+		// The folder's own marker
+		if rest == "" {
+			continue
+		}
+		if i := strings.Index(rest, "/"); i >= 0 {
+			folder := key + rest[:i+1]
+			if folder != last {
+				responses = append(responses, davCollection(davHref(bucket, folder), rest[:i], time.Time{}))
+				last = folder
+			}
+			continue
+		}
+		resp, err := davObject(bucket, e.key, e.path, e.info, now)
+		if err != nil {
+			// Deleted since the walk
+			if os.IsNotExist(err) {
+				continue
+			}
+			slog.Error("Computing ETag failed", "err", err)
+			return nil, internalError
+		}
+		if resp != nil {
+			responses = append(responses, *resp)
+		}
+	}
+	return responses, nil
+}
+
+// davObject describes the object key stored at path, or returns nil if it
+// has expired.
+func davObject(bucket, key, path string, fi os.FileInfo, now time.Time) (*davResponse, error) {
+	meta, err := loadMeta(path, fi)
+	if err != nil {
+		return nil, err
+	}
+	if isExpired(meta, now) {
+		return nil, nil
+	}
+	size := contentSize(fi, meta)
+	return &davResponse{
+		Href: davHref(bucket, key),
+		Propstat: davPropstat{
+			Prop: davProp{
+				DisplayName:   key[strings.LastIndex(key, "/")+1:],
+				ContentLength: &size,
+				ContentType:   contentTypeFor(bucket, key, meta),
+				ETag:          meta.ETag,
+				LastModified:  fi.ModTime().UTC().Format(http.TimeFormat),
+				SupportedLock: &struct{}{},
+			},
+			Status: "HTTP/1.1 200 OK",
+		},
+	}, nil
+}
+
+// davCollection describes a collection at href; modTime is left out if zero.
+func davCollection(href, name string, modTime time.Time) davResponse {
+	prop := davProp{
+		DisplayName:   name,
+		ResourceType:  davResourceType{Collection: &struct{}{}},
+		SupportedLock: &struct{}{},
+	}
+	if !modTime.IsZero() {
+		prop.LastModified = modTime.UTC().Format(http.TimeFormat)
+	}
+	return davResponse{Href: href, Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"}}
+}
+
+// davHref returns the URL path of key in bucket, escaped.
+func davHref(bucket, key string) string {
+	return (&url.URL{Path: "/" + bucket + "/" + key}).EscapedPath()
+}
+
+// mkcolHandler handles MKCOL of a key folder by storing its folder marker
+// object. A folder that exists, an object in its place and a request body
+// are refused, as RFC 4918 has it; missing parent folders are created
+// along with it, as S3 has no real folders to require.
+func mkcolHandler(w http.ResponseWriter, r *http.Request) {
+	bucket, key, apiErr := parseObjectRequest(r)
+	if apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	if r.ContentLength > 0 || r.Header.Get("Transfer-Encoding") != "" {
+		writeS3Error(w, http.StatusUnsupportedMediaType, "InvalidRequest", "MKCOL takes no request body", r.URL.Path)
+		return
+	}
+	if apiErr := checkBucketExists(bucket); apiErr != nil {
+		writeS3Error(w, apiErr.status, apiErr.code, apiErr.message, r.URL.Path)
+		return
+	}
+	folder := strings.TrimSuffix(key, "/")
+	objectPath, err := sanitizePath(bucket, folder)
+	if err != nil {
+		writePathError(w, r, err)
+		return
+	}
+	if fi, err := os.Stat(objectPath); err == nil {
+		msg := "The folder already exists"
+		if !fi.IsDir() {
+			msg = "An object with the folder's name exists"
+		}
+		writeMkcolExists(w, r, msg)
+		return
+	}
+
+	// The marker is stored by a PUT of it, so that it is versioned,
+	// counted against the quota and encrypted like any other object.
+	// If-None-Match: * makes the upload refuse an existing marker (which
+	// with -shard-depth isn't below objectPath) under the object's lock.
+	put := r.Clone(r.Context())
+	put.Method = http.MethodPut
+	put.URL.Path = "/" + bucket + "/" + folder + "/"
+	put.URL.RawPath = ""
+	put.URL.RawQuery = ""
+	put.Header = http.Header{"If-None-Match": []string{"*"}}
+	put.Body = http.NoBody
+	put.ContentLength = 0
+	uploadHandler(&mkcolResponseWriter{ResponseWriter: w, r: r}, put)
+}
+
+// writeMkcolExists answers a MKCOL of a collection that already exists,
+// which WebDAV says is 405 Method Not Allowed.
+func writeMkcolExists(w http.ResponseWriter, r *http.Request, msg string) {
+	w.Header().Set("Allow", strings.Join([]string{http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete, http.MethodOptions, methodPropfind}, ", "))
+	writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed", msg, r.URL.Path)
+}
+
+// mkcolResponseWriter turns uploadHandler's answers into MKCOL's: 201
+// Created for a stored marker and 405 for one that already existed.
+type mkcolResponseWriter struct {
+	http.ResponseWriter
+	r *http.Request
+	// Set once the upload's own response is replaced and its body dropped
+	replaced bool
+}
+
+func (m *mkcolResponseWriter) WriteHeader(status int) {
+	switch status {
+	case http.StatusNoContent:
+		m.Header().Del("ETag")
+		m.Header().Set("Content-Length", "0")
+		m.ResponseWriter.WriteHeader(http.StatusCreated)
+		debugLog(m.r, "Created WebDAV collection", "path", m.r.URL.Path)
+	case http.StatusPreconditionFailed:
+		m.replaced = true
+		m.Header().Del("Content-Type")
+		writeMkcolExists(m.ResponseWriter, m.r, "The folder already exists")
+	default:
+		m.ResponseWriter.WriteHeader(status)
+	}
+}
+
+func (m *mkcolResponseWriter) Write(p []byte) (int, error) {
+	if m.replaced {
+		return len(p), nil
+	}
+	return m.ResponseWriter.Write(p)
+}
+
+func (m *mkcolResponseWriter) Unwrap() http.ResponseWriter {
+	return m.ResponseWriter
+}